@@ -0,0 +1,527 @@
+package honuadatabase
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/JonasBordewick/honua-database/expression"
+	"github.com/JonasBordewick/honua-database/models"
+	"github.com/lib/pq"
+)
+
+// action_parameter_tables are the tables holding the parameters of exactly one
+// action and the reference to them in the table actions. Deleting a row
+// deletes its action by a constraint, but not the other way around.
+var action_parameter_tables = []struct {
+	table string
+	id    func(row *actionRow) sql.NullInt32
+}{
+	{"delays", func(row *actionRow) sql.NullInt32 { return row.delayID }},
+	{"notifications", func(row *actionRow) sql.NullInt32 { return row.notificationID }},
+	{"state_changes", func(row *actionRow) sql.NullInt32 { return row.stateChangeID }},
+	{"rule_switches", func(row *actionRow) sql.NullInt32 { return row.ruleSwitchID }},
+	{"waits", func(row *actionRow) sql.NullInt32 { return row.waitID }},
+	{"repeats", func(row *actionRow) sql.NullInt32 { return row.repeatID }},
+}
+
+// delete_action_parameters removes the parameters and the condition trees of
+// waits and repeats of the actions matching where, e.g. "rule_id=$2" with arg
+// as $2. The ids are read first, because every delete cascades to actions.
+func (hdb *HonuaDatabase) delete_action_parameters(ctx context.Context, q querier, identity string, where string, arg int) error {
+	query := "SELECT " + action_columns + " FROM actions WHERE identity=$1 AND " + where + ";"
+	rows, err := q.QueryContext(ctx, query, identity, arg)
+	if err != nil {
+		return map_error(err)
+	}
+
+	var ids map[string][]int = map[string][]int{}
+	for rows.Next() {
+		row := &actionRow{}
+		if err = rows.Scan(row.fields()...); err != nil {
+			rows.Close()
+			return map_error(err)
+		}
+		for _, t := range action_parameter_tables {
+			if id := t.id(row); id.Valid {
+				ids[t.table] = append(ids[t.table], int(id.Int32))
+			}
+		}
+	}
+	rows.Close()
+
+	conditionIDs, err := hdb.get_control_condition_ids(ctx, q, identity, ids["waits"], ids["repeats"])
+	if err != nil {
+		return err
+	}
+
+	for _, t := range action_parameter_tables {
+		if len(ids[t.table]) == 0 {
+			continue
+		}
+		_, err = q.ExecContext(ctx, "DELETE FROM "+t.table+" WHERE identity=$1 AND id = ANY($2);", identity, pq.Array(ids[t.table]))
+		if err != nil {
+			return map_error(err)
+		}
+	}
+	if len(conditionIDs) > 0 {
+		_, err = q.ExecContext(ctx, "DELETE FROM conditions WHERE identity=$1 AND id = ANY($2);", identity, pq.Array(conditionIDs))
+		if err != nil {
+			return map_error(err)
+		}
+	}
+	return nil
+}
+
+// actionParameters are the parameters of the actions of one or more rules by
+// their id, every table is read with one query
+type actionParameters struct {
+	domains       map[int]string
+	targets       map[int]*models.Entity
+	delays        map[int]*models.Delay
+	notifications map[int]*models.Notification
+	stateChanges  map[int]*models.StateChange
+	ruleSwitches  map[int]*models.RuleSwitch
+	scenes        map[int]*models.Scene
+	waits         map[int]*models.Wait
+	repeats       map[int]*models.Repeat
+}
+
+// get_action_parameters loads the parameters of the action rows
+func (hdb *HonuaDatabase) get_action_parameters(ctx context.Context, q querier, identity string, rows []*actionRow) (*actionParameters, error) {
+	var ids map[string][]int = map[string][]int{}
+	var serviceIDs, targetIDs, sceneIDs []int
+	for _, row := range rows {
+		for _, t := range action_parameter_tables {
+			if id := t.id(row); id.Valid {
+				ids[t.table] = append(ids[t.table], int(id.Int32))
+			}
+		}
+		if row.serviceID.Valid {
+			serviceIDs = append(serviceIDs, int(row.serviceID.Int32))
+		}
+		if row.targetID.Valid {
+			targetIDs = append(targetIDs, int(row.targetID.Int32))
+		}
+		if row.sceneID.Valid {
+			sceneIDs = append(sceneIDs, int(row.sceneID.Int32))
+		}
+	}
+
+	var err error
+	result := &actionParameters{scenes: map[int]*models.Scene{}}
+	if result.domains, err = hdb.get_hass_service_domains(ctx, q, identity, serviceIDs); err != nil {
+		return nil, err
+	}
+	if result.targets, err = hdb.get_entities_by_id(ctx, q, identity, targetIDs); err != nil {
+		return nil, err
+	}
+	if result.delays, err = hdb.get_delays(ctx, q, identity, ids["delays"]); err != nil {
+		return nil, err
+	}
+	if result.notifications, err = hdb.get_notifications(ctx, q, identity, ids["notifications"]); err != nil {
+		return nil, err
+	}
+	if result.stateChanges, err = hdb.get_state_changes(ctx, q, identity, ids["state_changes"]); err != nil {
+		return nil, err
+	}
+	if result.ruleSwitches, err = hdb.get_rule_switches(ctx, q, identity, ids["rule_switches"]); err != nil {
+		return nil, err
+	}
+	if result.waits, err = hdb.get_waits(ctx, q, identity, ids["waits"]); err != nil {
+		return nil, err
+	}
+	if result.repeats, err = hdb.get_repeats(ctx, q, identity, ids["repeats"]); err != nil {
+		return nil, err
+	}
+	// get_scenes reads every scene without ids
+	if len(sceneIDs) > 0 {
+		scenes, err := hdb.get_scenes(ctx, q, identity, sceneIDs)
+		if err != nil {
+			return nil, err
+		}
+		for _, scene := range scenes {
+			result.scenes[scene.Id] = scene
+		}
+	}
+	return result, nil
+}
+
+// query_by_ids runs query with the identity as $1 and the ids as $2 and
+// calls scan for every row, it does not query without ids
+func query_by_ids(ctx context.Context, q querier, query, identity string, ids []int, scan func(rows *sql.Rows) error) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	rows, err := q.QueryContext(ctx, query, identity, pq.Array(ids))
+	if err != nil {
+		return map_error(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err = scan(rows); err != nil {
+			return map_error(err)
+		}
+	}
+	return map_error(rows.Err())
+}
+
+// get_control_condition_ids returns the ids of the condition trees of the waits and repeats
+func (hdb *HonuaDatabase) get_control_condition_ids(ctx context.Context, q querier, identity string, waitIDs, repeatIDs []int) ([]int, error) {
+	const query = `SELECT condition_id FROM waits WHERE identity=$1 AND id = ANY($2)
+		UNION SELECT condition_id FROM repeats WHERE identity=$1 AND id = ANY($3) AND condition_id IS NOT NULL;`
+
+	var result []int = []int{}
+	if len(waitIDs) == 0 && len(repeatIDs) == 0 {
+		return result, nil
+	}
+
+	rows, err := q.QueryContext(ctx, query, identity, pq.Array(waitIDs), pq.Array(repeatIDs))
+	if err != nil {
+		return nil, map_error(err)
+	}
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, map_error(err)
+		}
+		result = append(result, id)
+	}
+	rows.Close()
+
+	return result, nil
+}
+
+// ---------------------------------------------------------------------------
+// notifications
+
+func (hdb *HonuaDatabase) add_notification(ctx context.Context, q querier, identity string, notification *models.Notification) (int, error) {
+	if notification == nil || notification.Message == "" {
+		return -1, fmt.Errorf("%w: a notification needs a message", ErrInvalidAction)
+	}
+	message, err := parse_message(notification.Message)
+	if err != nil {
+		return -1, err
+	}
+	known, err := hdb.known_entities(ctx, q, identity, message.Entities())
+	if err != nil {
+		return -1, err
+	}
+	if err := check_message_entities(message, known); err != nil {
+		return -1, err
+	}
+
+	const query = "INSERT INTO notifications(id, identity, title, message, recipient) VALUES ($1, $2, $3, $4, $5);"
+	id, err := hdb.next_id(ctx, q, identity, "notifications")
+	if err != nil {
+		return -1, err
+	}
+
+	_, err = q.ExecContext(ctx, query, id, identity, notification.Title, notification.Message, notification.Recipient)
+	if err != nil {
+		return -1, map_error(err)
+	}
+	return id, nil
+}
+
+// parse_message parses the expressions of the message of a notification
+func parse_message(message string) (*expression.Message, error) {
+	result, err := expression.ParseMessage(message)
+	if err != nil {
+		return nil, fmt.Errorf("%w: the message %q: %v", ErrInvalidAction, message, err)
+	}
+	return result, nil
+}
+
+func check_message_entities(message *expression.Message, known map[string]bool) error {
+	for _, name := range message.Entities() {
+		if !known[name] {
+			return fmt.Errorf("%w: the entity %s of the message %q does not exist", ErrInvalidAction, name, message)
+		}
+	}
+	return nil
+}
+
+// get_notifications returns the notifications with the ids by their id
+func (hdb *HonuaDatabase) get_notifications(ctx context.Context, q querier, identity string, ids []int) (map[int]*models.Notification, error) {
+	const query = "SELECT id, title, message, recipient FROM notifications WHERE identity=$1 AND id = ANY($2);"
+
+	var result map[int]*models.Notification = map[int]*models.Notification{}
+	err := query_by_ids(ctx, q, query, identity, ids, func(rows *sql.Rows) error {
+		n := &models.Notification{}
+		if err := rows.Scan(&n.Id, &n.Title, &n.Message, &n.Recipient); err != nil {
+			return err
+		}
+		result[n.Id] = n
+		return nil
+	})
+	return result, err
+}
+
+// ---------------------------------------------------------------------------
+// state changes
+
+func (hdb *HonuaDatabase) add_state_change(ctx context.Context, q querier, identity string, change *models.StateChange) (int, error) {
+	if change == nil || change.Entity == nil {
+		return -1, fmt.Errorf("%w: a state change needs an entity", ErrInvalidAction)
+	}
+
+	const query = "INSERT INTO state_changes(id, identity, entity_id, state) VALUES ($1, $2, $3, $4);"
+	id, err := hdb.next_id(ctx, q, identity, "state_changes")
+	if err != nil {
+		return -1, err
+	}
+
+	_, err = q.ExecContext(ctx, query, id, identity, change.Entity.Id, change.State)
+	if err != nil {
+		return -1, map_error(err)
+	}
+	return id, nil
+}
+
+// get_state_changes returns the state changes with the ids and their entities by their id
+func (hdb *HonuaDatabase) get_state_changes(ctx context.Context, q querier, identity string, ids []int) (map[int]*models.StateChange, error) {
+	const query = "SELECT id, entity_id, state FROM state_changes WHERE identity=$1 AND id = ANY($2);"
+
+	var result map[int]*models.StateChange = map[int]*models.StateChange{}
+	var entityIDs map[int]int = map[int]int{}
+	err := query_by_ids(ctx, q, query, identity, ids, func(rows *sql.Rows) error {
+		var entityID int
+		change := &models.StateChange{}
+		if err := rows.Scan(&change.Id, &entityID, &change.State); err != nil {
+			return err
+		}
+		result[change.Id] = change
+		entityIDs[change.Id] = entityID
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var all []int
+	for _, entityID := range entityIDs {
+		all = append(all, entityID)
+	}
+	entities, err := hdb.get_entities_by_id(ctx, q, identity, all)
+	if err != nil {
+		return nil, err
+	}
+	for id, change := range result {
+		change.Entity = entities[entityIDs[id]]
+	}
+	return result, nil
+}
+
+// ---------------------------------------------------------------------------
+// rule switches
+
+func (hdb *HonuaDatabase) add_rule_switch(ctx context.Context, q querier, identity string, ruleSwitch *models.RuleSwitch) (int, error) {
+	if ruleSwitch == nil {
+		return -1, fmt.Errorf("%w: a rule switch needs a rule", ErrInvalidAction)
+	}
+
+	// rule_id has no constraint, see 007-migration.sql
+	var exists bool
+	err := q.QueryRowContext(ctx, "SELECT EXISTS (SELECT * FROM rules WHERE identity=$1 AND id=$2);", identity, ruleSwitch.RuleID).Scan(&exists)
+	if err != nil {
+		return -1, map_error(err)
+	}
+	if !exists {
+		return -1, fmt.Errorf("%w: the rule %d of %s does not exist", ErrForeignKeyViolation, ruleSwitch.RuleID, identity)
+	}
+
+	const query = "INSERT INTO rule_switches(id, identity, rule_id, enabled) VALUES ($1, $2, $3, $4);"
+	id, err := hdb.next_id(ctx, q, identity, "rule_switches")
+	if err != nil {
+		return -1, err
+	}
+
+	_, err = q.ExecContext(ctx, query, id, identity, ruleSwitch.RuleID, ruleSwitch.Enabled)
+	if err != nil {
+		return -1, map_error(err)
+	}
+	return id, nil
+}
+
+// get_rule_switches returns the rule switches with the ids by their id
+func (hdb *HonuaDatabase) get_rule_switches(ctx context.Context, q querier, identity string, ids []int) (map[int]*models.RuleSwitch, error) {
+	const query = "SELECT id, rule_id, enabled FROM rule_switches WHERE identity=$1 AND id = ANY($2);"
+
+	var result map[int]*models.RuleSwitch = map[int]*models.RuleSwitch{}
+	err := query_by_ids(ctx, q, query, identity, ids, func(rows *sql.Rows) error {
+		r := &models.RuleSwitch{}
+		if err := rows.Scan(&r.Id, &r.RuleID, &r.Enabled); err != nil {
+			return err
+		}
+		result[r.Id] = r
+		return nil
+	})
+	return result, err
+}
+
+// delete_rule_switches_of_rule removes the switches of the rule and the
+// actions using them
+func (hdb *HonuaDatabase) delete_rule_switches_of_rule(ctx context.Context, q querier, identity string, ruleID int) error {
+	err := hdb.delete_actions(ctx, q, identity, "rule_switch_id IN (SELECT id FROM rule_switches WHERE identity=$1 AND rule_id=$2)", ruleID)
+	if err != nil {
+		return err
+	}
+	_, err = q.ExecContext(ctx, "DELETE FROM rule_switches WHERE identity=$1 AND rule_id=$2;", identity, ruleID)
+	return map_error(err)
+}
+
+// ---------------------------------------------------------------------------
+// waits and repeats
+
+// check_control_condition checks that condition can be the root of a condition
+// tree, like the condition of a rule
+func check_control_condition(condition *models.Condition) error {
+	if condition == nil {
+		return fmt.Errorf("%w: the condition is missing", ErrInvalidCondition)
+	}
+	if condition.Type >= models.NUMERICSTATE {
+		return fmt.Errorf("%w: the root of a condition tree must be AND, OR, NAND or NOR", ErrInvalidCondition)
+	}
+	return nil
+}
+
+// check_wait_timeout checks that the timeout of a wait can be stored in whole seconds
+func check_wait_timeout(timeout time.Duration) error {
+	if timeout < 0 || timeout%time.Second != 0 {
+		return fmt.Errorf("%w: the timeout %v of a wait is not valid", ErrInvalidAction, timeout)
+	}
+	return nil
+}
+
+func (hdb *HonuaDatabase) add_wait(ctx context.Context, q querier, identity string, wait *models.Wait) (int, error) {
+	if wait == nil {
+		return -1, fmt.Errorf("%w: a wait needs a condition", ErrInvalidAction)
+	}
+	if err := check_control_condition(wait.Condition); err != nil {
+		return -1, err
+	}
+	if err := check_wait_timeout(wait.Timeout); err != nil {
+		return -1, err
+	}
+
+	conditionID, err := hdb.add_condition(ctx, q, identity, wait.Condition)
+	if err != nil {
+		return -1, err
+	}
+
+	const query = "INSERT INTO waits(id, identity, condition_id, timeout_seconds) VALUES ($1, $2, $3, $4);"
+	id, err := hdb.next_id(ctx, q, identity, "waits")
+	if err != nil {
+		return -1, err
+	}
+
+	_, err = q.ExecContext(ctx, query, id, identity, conditionID, int(wait.Timeout/time.Second))
+	if err != nil {
+		return -1, map_error(err)
+	}
+	return id, nil
+}
+
+// get_waits returns the waits with the ids and their conditions by their id,
+// the timeout actions are added by the caller
+func (hdb *HonuaDatabase) get_waits(ctx context.Context, q querier, identity string, ids []int) (map[int]*models.Wait, error) {
+	const query = "SELECT id, condition_id, timeout_seconds FROM waits WHERE identity=$1 AND id = ANY($2);"
+
+	var result map[int]*models.Wait = map[int]*models.Wait{}
+	var conditionIDs map[int]int = map[int]int{}
+	err := query_by_ids(ctx, q, query, identity, ids, func(rows *sql.Rows) error {
+		var id, conditionID, timeout int
+		if err := rows.Scan(&id, &conditionID, &timeout); err != nil {
+			return err
+		}
+		result[id] = &models.Wait{Id: id, Timeout: time.Duration(timeout) * time.Second, TimeoutActions: []*models.Action{}}
+		conditionIDs[id] = conditionID
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var roots []int
+	for _, conditionID := range conditionIDs {
+		roots = append(roots, conditionID)
+	}
+	conditions, err := hdb.get_condition_trees(ctx, q, identity, roots)
+	if err != nil {
+		return nil, err
+	}
+	for id, wait := range result {
+		wait.Condition = conditions[conditionIDs[id]]
+	}
+	return result, nil
+}
+
+func (hdb *HonuaDatabase) add_repeat(ctx context.Context, q querier, identity string, repeat *models.Repeat) (int, error) {
+	if repeat == nil || (repeat.Count <= 0 && repeat.While == nil) {
+		return -1, fmt.Errorf("%w: a repeat needs a count or a condition", ErrInvalidAction)
+	}
+
+	var conditionID sql.NullInt32
+	if repeat.While != nil {
+		if err := check_control_condition(repeat.While); err != nil {
+			return -1, err
+		}
+		id, err := hdb.add_condition(ctx, q, identity, repeat.While)
+		if err != nil {
+			return -1, err
+		}
+		conditionID = null_int(id)
+	}
+
+	const query = "INSERT INTO repeats(id, identity, count, condition_id) VALUES ($1, $2, $3, $4);"
+	id, err := hdb.next_id(ctx, q, identity, "repeats")
+	if err != nil {
+		return -1, err
+	}
+
+	_, err = q.ExecContext(ctx, query, id, identity, repeat.Count, conditionID)
+	if err != nil {
+		return -1, map_error(err)
+	}
+	return id, nil
+}
+
+// get_repeats returns the repeats with the ids and their conditions by their
+// id, the nested actions are added by the caller
+func (hdb *HonuaDatabase) get_repeats(ctx context.Context, q querier, identity string, ids []int) (map[int]*models.Repeat, error) {
+	const query = "SELECT id, count, condition_id FROM repeats WHERE identity=$1 AND id = ANY($2);"
+
+	var result map[int]*models.Repeat = map[int]*models.Repeat{}
+	var conditionIDs map[int]int = map[int]int{}
+	err := query_by_ids(ctx, q, query, identity, ids, func(rows *sql.Rows) error {
+		var conditionID sql.NullInt32
+		repeat := &models.Repeat{Actions: []*models.Action{}}
+		if err := rows.Scan(&repeat.Id, &repeat.Count, &conditionID); err != nil {
+			return err
+		}
+		result[repeat.Id] = repeat
+		if conditionID.Valid {
+			conditionIDs[repeat.Id] = int(conditionID.Int32)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var roots []int
+	for _, conditionID := range conditionIDs {
+		roots = append(roots, conditionID)
+	}
+	conditions, err := hdb.get_condition_trees(ctx, q, identity, roots)
+	if err != nil {
+		return nil, err
+	}
+	for id, conditionID := range conditionIDs {
+		result[id].While = conditions[conditionID]
+	}
+	return result, nil
+}
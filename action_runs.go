@@ -0,0 +1,187 @@
+package honuadatabase
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/JonasBordewick/honua-database/models"
+)
+
+// The runs of a rule are deleted with the rule, when the rule is edited and
+// when it is disabled. An executor that finds its run deleted stops it.
+
+const action_run_columns = "id, rule_id, is_then_action, position, resume_at, started_at, rule_run_id"
+
+// AddActionRun stores a new run, it sets the id and the start of the run
+func (hdb *HonuaDatabase) AddActionRun(identity string, run *models.ActionRun) error {
+	return hdb.AddActionRunContext(context.Background(), identity, run)
+}
+
+func (hdb *HonuaDatabase) AddActionRunContext(ctx context.Context, identity string, run *models.ActionRun) (err error) {
+	defer hdb.observe(ctx, "add_action_run", time.Now(), &err, slog.String("identity", identity), slog.Int("rule_id", run.RuleID))
+	const query = `INSERT INTO action_runs(id, identity, rule_id, is_then_action, position, resume_at, rule_run_id) VALUES ($1, $2, $3, $4, $5, $6, $7)
+RETURNING started_at;`
+
+	position, err := json.Marshal(positions(run.Position))
+	if err != nil {
+		return err
+	}
+
+	var id int
+	var startedAt time.Time
+	err = hdb.with_tx(ctx, func(tx *sql.Tx) error {
+		var err error
+		id, err = hdb.next_id(ctx, tx, identity, "action_runs")
+		if err != nil {
+			return err
+		}
+		err = tx.QueryRowContext(ctx, query, id, identity, run.RuleID, run.IsThenAction, position, run.ResumeAt, run.RuleRunID).Scan(&startedAt)
+		return map_error(err)
+	})
+	if err != nil {
+		return err
+	}
+	run.Id = id
+	run.StartedAt = startedAt
+	return nil
+}
+
+// UpdateActionRun stores the position and the resume time of the run,
+// ErrNotFound if the run was deleted
+func (hdb *HonuaDatabase) UpdateActionRun(identity string, run *models.ActionRun) error {
+	return hdb.UpdateActionRunContext(context.Background(), identity, run)
+}
+
+func (hdb *HonuaDatabase) UpdateActionRunContext(ctx context.Context, identity string, run *models.ActionRun) (err error) {
+	defer hdb.observe(ctx, "update_action_run", time.Now(), &err, slog.String("identity", identity), slog.Int("action_run_id", run.Id))
+	const query = "UPDATE action_runs SET position = $1, resume_at = $2 WHERE identity = $3 AND id = $4;"
+
+	position, err := json.Marshal(positions(run.Position))
+	if err != nil {
+		return err
+	}
+	result, err := hdb.db.ExecContext(ctx, query, position, run.ResumeAt, identity, run.Id)
+	return affected_or_not_found(result, err, "the action run %d of %s does not exist", run.Id, identity)
+}
+
+func (hdb *HonuaDatabase) GetActionRun(identity string, id int) (*models.ActionRun, error) {
+	return hdb.GetActionRunContext(context.Background(), identity, id)
+}
+
+func (hdb *HonuaDatabase) GetActionRunContext(ctx context.Context, identity string, id int) (_ *models.ActionRun, err error) {
+	defer hdb.observe(ctx, "get_action_run", time.Now(), &err, slog.String("identity", identity), slog.Int("action_run_id", id))
+	const query = "SELECT " + action_run_columns + " FROM action_runs WHERE identity = $1 AND id = $2;"
+
+	run, err := scan_action_run(hdb.db.QueryRowContext(ctx, query, identity, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: the action run %d of %s does not exist", ErrNotFound, id, identity)
+	}
+	return run, err
+}
+
+// GetActionRuns returns the runs of the identity ordered by id, they are resumed after a restart
+func (hdb *HonuaDatabase) GetActionRuns(identity string) ([]*models.ActionRun, error) {
+	return hdb.GetActionRunsContext(context.Background(), identity)
+}
+
+func (hdb *HonuaDatabase) GetActionRunsContext(ctx context.Context, identity string) (_ []*models.ActionRun, err error) {
+	defer hdb.observe(ctx, "get_action_runs", time.Now(), &err, slog.String("identity", identity))
+	const query = "SELECT " + action_run_columns + " FROM action_runs WHERE identity = $1 ORDER BY id;"
+
+	rows, err := hdb.db.QueryContext(ctx, query, identity)
+	if err != nil {
+		return nil, map_error(err)
+	}
+	defer rows.Close()
+
+	var result []*models.ActionRun = []*models.ActionRun{}
+	for rows.Next() {
+		run, err := scan_action_run(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, run)
+	}
+	return result, map_error(rows.Err())
+}
+
+func (hdb *HonuaDatabase) DeleteActionRun(identity string, id int) error {
+	return hdb.DeleteActionRunContext(context.Background(), identity, id)
+}
+
+func (hdb *HonuaDatabase) DeleteActionRunContext(ctx context.Context, identity string, id int) (err error) {
+	defer hdb.observe(ctx, "delete_action_run", time.Now(), &err, slog.String("identity", identity), slog.Int("action_run_id", id))
+	const query = "DELETE FROM action_runs WHERE identity = $1 AND id = $2;"
+
+	result, err := hdb.db.ExecContext(ctx, query, identity, id)
+	return affected_or_not_found(result, err, "the action run %d of %s does not exist", id, identity)
+}
+
+// DeleteActionRunsOfRule cancels the runs of the rule
+func (hdb *HonuaDatabase) DeleteActionRunsOfRule(identity string, ruleID int) error {
+	return hdb.DeleteActionRunsOfRuleContext(context.Background(), identity, ruleID)
+}
+
+func (hdb *HonuaDatabase) DeleteActionRunsOfRuleContext(ctx context.Context, identity string, ruleID int) (err error) {
+	defer hdb.observe(ctx, "delete_action_runs_of_rule", time.Now(), &err, slog.String("identity", identity), slog.Int("rule_id", ruleID))
+	return hdb.delete_action_runs(ctx, hdb.db, identity, &ruleID)
+}
+
+// delete_action_runs deletes the runs of the rule, or of every rule if ruleID is nil
+func (hdb *HonuaDatabase) delete_action_runs(ctx context.Context, q querier, identity string, ruleID *int) error {
+	var err error
+	if ruleID == nil {
+		_, err = q.ExecContext(ctx, "DELETE FROM action_runs WHERE identity = $1;", identity)
+	} else {
+		_, err = q.ExecContext(ctx, "DELETE FROM action_runs WHERE identity = $1 AND rule_id = $2;", identity, *ruleID)
+	}
+	return map_error(err)
+}
+
+// delete_entity_action_runs deletes the runs of the rules targeting the entity
+func (hdb *HonuaDatabase) delete_entity_action_runs(ctx context.Context, q querier, identity string, entityID int) error {
+	const query = "DELETE FROM action_runs WHERE identity = $1 AND rule_id IN (SELECT id FROM rules WHERE identity = $1 AND entity_id = $2);"
+	_, err := q.ExecContext(ctx, query, identity, entityID)
+	return map_error(err)
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scan_action_run(row rowScanner) (*models.ActionRun, error) {
+	var run models.ActionRun
+	var position []byte
+	var resumeAt sql.NullTime
+	var ruleRunID sql.NullInt32
+	err := row.Scan(&run.Id, &run.RuleID, &run.IsThenAction, &position, &resumeAt, &run.StartedAt, &ruleRunID)
+	if err == sql.ErrNoRows {
+		return nil, err
+	}
+	if err != nil {
+		return nil, map_error(err)
+	}
+	if err := json.Unmarshal(position, &run.Position); err != nil {
+		return nil, fmt.Errorf("the position of the action run %d: %w", run.Id, err)
+	}
+	if resumeAt.Valid {
+		run.ResumeAt = &resumeAt.Time
+	}
+	if ruleRunID.Valid {
+		id := int(ruleRunID.Int32)
+		run.RuleRunID = &id
+	}
+	return &run, nil
+}
+
+// positions stores an empty position as [] instead of null
+func positions(p []models.ActionPosition) []models.ActionPosition {
+	if p == nil {
+		return []models.ActionPosition{}
+	}
+	return p
+}
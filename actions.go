@@ -1,171 +1,436 @@
 package honuadatabase
 
 import (
+	"context"
 	"database/sql"
-	"errors"
+	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
+	"time"
 
 	"github.com/JonasBordewick/honua-database/models"
+	"github.com/lib/pq"
 )
 
-
 func (hdb *HonuaDatabase) GetActionsOfRule(identifier string, ruleID int) ([]*models.Action, []*models.Action, error) {
-	const query = "SELECT * FROM actions WHERE identity=$1 AND rule_id=$2;"
-
+	return hdb.GetActionsOfRuleContext(context.Background(), identifier, ruleID)
+}
 
-	rows, err := hdb.db.Query(query, identifier, ruleID)
+func (hdb *HonuaDatabase) GetActionsOfRuleContext(ctx context.Context, identifier string, ruleID int) (_ []*models.Action, _ []*models.Action, err error) {
+	defer hdb.observe(ctx, "get_actions_of_rule", time.Now(), &err, slog.String("identity", identifier), slog.Int("rule_id", ruleID))
+	actions, err := hdb.get_actions_of_rules(ctx, hdb.db, identifier, []int{ruleID})
 	if err != nil {
-		log.Printf("An error occured during getting all actions of rule %d in %s: %s\n", ruleID, identifier, err.Error())
 		return nil, nil, err
 	}
-	
-	thenActions := []*models.Action{}
-	elseActions := []*models.Action{}
+	return actions[ruleID].then, actions[ruleID].otherwise, nil
+}
 
-	for rows.Next() {
-		var id int
-		var identity string
-		var aType models.ActionType
-		var ruleid int
-		var isThenAction bool
-		var serviceID sql.NullInt32
-		var delayID sql.NullInt32
-
-		err := rows.Scan(&id, &identity, &aType, &ruleid, &isThenAction, &serviceID, &delayID)
-		if err != nil {
-			rows.Close()
-			log.Printf("An error occured during getting all actions of rule %d in %s: %s\n", ruleID, identifier, err.Error())
-			return nil, nil, err
+// ruleActions are the then and else actions of a rule
+type ruleActions struct {
+	then      []*models.Action
+	otherwise []*models.Action
+}
+
+// get_actions_of_rules loads the actions of the rules with their parameters,
+// the number of queries does not depend on the number of rules
+func (hdb *HonuaDatabase) get_actions_of_rules(ctx context.Context, q querier, identifier string, ruleIDs []int) (map[int]*ruleActions, error) {
+	const query = "SELECT " + action_columns + " FROM actions WHERE identity=$1 AND rule_id = ANY($2) ORDER BY position, id;"
+
+	var result map[int]*ruleActions = map[int]*ruleActions{}
+	for _, id := range ruleIDs {
+		result[id] = &ruleActions{then: []*models.Action{}, otherwise: []*models.Action{}}
+	}
+
+	var actionRows []*actionRow
+	err := query_by_ids(ctx, q, query, identifier, ruleIDs, func(rows *sql.Rows) error {
+		row := &actionRow{}
+		if err := rows.Scan(row.fields()...); err != nil {
+			return err
 		}
+		actionRows = append(actionRows, row)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		if aType == models.SERVICE {
-			service, err := hdb.GetHassService(identifier, int(serviceID.Int32))
-			if err != nil {
-				rows.Close()
-				log.Printf("An error occured during getting all actions of rule %d in %s: %s\n", ruleID, identifier, err.Error())
-				return nil, nil, err
-			}
+	parameters, err := hdb.get_action_parameters(ctx, q, identifier, actionRows)
+	if err != nil {
+		return nil, err
+	}
 
-			if isThenAction {
-				thenActions = append(thenActions, &models.Action{
-					Id: id,
-					Type: aType,
-					Service: service.Domain,
-				})
-			} else {
-				elseActions = append(elseActions, &models.Action{
-					Id: id,
-					Type: aType,
-					Service: service.Domain,
-				})
-			}
-		} else if aType == models.DELAY {
-			delay, err := hdb.GetDelay(identifier, int(delayID.Int32))
-			if err != nil {
-				rows.Close()
-				log.Printf("An error occured during getting all actions of rule %d in %s: %s\n", ruleID, identifier, err.Error())
-				return nil, nil, err
-			}
+	var byID map[int]*models.Action = map[int]*models.Action{}
+	for _, row := range actionRows {
+		action, err := make_action(identifier, row, parameters)
+		if err != nil {
+			return nil, err
+		}
+		byID[row.id] = action
+	}
 
-			if isThenAction {
-				thenActions = append(thenActions, &models.Action{
-					Id: id,
-					Type: aType,
-					Delay: delay,
-				})
-			} else {
-				elseActions = append(elseActions, &models.Action{
-					Id: id,
-					Type: aType,
-					Delay: delay,
-				})
+	// the rows are ordered by position, so every list keeps its order
+	for _, row := range actionRows {
+		action := byID[row.id]
+		if row.parentID.Valid {
+			parent, ok := byID[int(row.parentID.Int32)]
+			if !ok {
+				continue
+			}
+			if parent.Wait != nil {
+				parent.Wait.TimeoutActions = append(parent.Wait.TimeoutActions, action)
+			} else if parent.Repeat != nil {
+				parent.Repeat.Actions = append(parent.Repeat.Actions, action)
 			}
+		} else if row.isThenAction {
+			result[row.ruleID].then = append(result[row.ruleID].then, action)
+		} else {
+			result[row.ruleID].otherwise = append(result[row.ruleID].otherwise, action)
 		}
 	}
 
-	rows.Close()
+	return result, nil
+}
+
+// make_action builds the action of the row with its loaded parameters, the
+// nested actions of a wait or repeat are added by the caller
+func make_action(identifier string, row *actionRow, p *actionParameters) (*models.Action, error) {
+	action := &models.Action{
+		Id:       row.id,
+		Type:     row.actionType,
+		Position: row.position,
+	}
 
-	return thenActions, elseActions, nil
+	var found bool
+	switch row.actionType {
+	case models.SERVICE:
+		action.Service, found = p.domains[int(row.serviceID.Int32)]
+		action.ServiceName = row.serviceName
+		action.ServiceData = row.serviceData
+		if row.targetID.Valid {
+			action.Target = p.targets[int(row.targetID.Int32)]
+		}
+	case models.DELAY:
+		action.Delay, found = p.delays[int(row.delayID.Int32)]
+	case models.NOTIFY:
+		action.Notification, found = p.notifications[int(row.notificationID.Int32)]
+	case models.SET_STATE:
+		action.StateChange, found = p.stateChanges[int(row.stateChangeID.Int32)]
+	case models.SWITCH_RULE:
+		action.RuleSwitch, found = p.ruleSwitches[int(row.ruleSwitchID.Int32)]
+	case models.SCENE:
+		action.Scene, found = p.scenes[int(row.sceneID.Int32)]
+	case models.WAIT_UNTIL:
+		action.Wait, found = p.waits[int(row.waitID.Int32)]
+	case models.REPEAT:
+		action.Repeat, found = p.repeats[int(row.repeatID.Int32)]
+	default:
+		return nil, fmt.Errorf("%w: actiontype %d not supported", ErrUnsupportedType, row.actionType)
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: the parameters of the action %d of %s do not exist", ErrNotFound, row.id, identifier)
+	}
+	return action, nil
 }
 
+// AddAction appends the action to the then or else actions of the rule
 func (hdb *HonuaDatabase) AddAction(identifier string, ruleID int, isThenAction bool, action *models.Action) error {
-	id, err := hdb.get_action_id(identifier)
-	if err != nil {
-		log.Printf("An error occured during adding a new action: %s\n", err.Error())
-		return err
-	}
+	return hdb.AddActionContext(context.Background(), identifier, ruleID, isThenAction, action)
+}
+
+func (hdb *HonuaDatabase) AddActionContext(ctx context.Context, identifier string, ruleID int, isThenAction bool, action *models.Action) (err error) {
+	defer hdb.observe(ctx, "add_action", time.Now(), &err, slog.String("identity", identifier), slog.Int("rule_id", ruleID))
+	return hdb.with_tx(ctx, func(tx *sql.Tx) error {
+		return hdb.add_action(ctx, tx, identifier, ruleID, isThenAction, action)
+	})
+}
+
+// InsertAction inserts the action at position into the then or else actions
+// of the rule, the following actions move one position down
+func (hdb *HonuaDatabase) InsertAction(identifier string, ruleID int, isThenAction bool, position int, action *models.Action) error {
+	return hdb.InsertActionContext(context.Background(), identifier, ruleID, isThenAction, position, action)
+}
 
-	if action.Type == models.DELAY {
-		delayID, err := hdb.AddDelay(identifier, action.Delay)
+func (hdb *HonuaDatabase) InsertActionContext(ctx context.Context, identifier string, ruleID int, isThenAction bool, position int, action *models.Action) (err error) {
+	defer hdb.observe(ctx, "insert_action", time.Now(), &err, slog.String("identity", identifier), slog.Int("rule_id", ruleID), slog.Int("position", position))
+	return hdb.with_tx(ctx, func(tx *sql.Tx) error {
+		list := actionList{ruleID: ruleID, isThenAction: isThenAction}
+		ids, err := hdb.get_action_ids(ctx, tx, identifier, list)
 		if err != nil {
-			log.Printf("An error occured during adding a new action: %s\n", err.Error())
 			return err
 		}
-		query := "INSERT INTO actions(id, identity, type, rule_id, is_then_action, delay_id) VALUES ($1, $2, $3, $4, $5, $6)"
-		_, err  = hdb.db.Exec(query, id, identifier, action.Type, ruleID, isThenAction, delayID)
+		if position < 0 || position > len(ids) {
+			position = len(ids)
+		}
+
+		const query = `UPDATE actions SET position = position + 1
+			WHERE identity=$1 AND rule_id=$2 AND is_then_action=$3 AND parent_action_id IS NULL AND position >= $4;`
+		_, err = tx.ExecContext(ctx, query, identifier, ruleID, isThenAction, position)
 		if err != nil {
-			log.Printf("An error occured during adding a new action: %s\n", err.Error())
-			return err
+			return map_error(err)
 		}
-		return nil
-	} else if action.Type == models.SERVICE {
-		serviceID, err := hdb.GetIDofHassService(identifier, action.Service)
+		return hdb.insert_action(ctx, tx, identifier, list, position, action)
+	})
+}
+
+// MoveActionUp swaps the action with the action before it
+func (hdb *HonuaDatabase) MoveActionUp(identifier string, id int) error {
+	return hdb.MoveActionUpContext(context.Background(), identifier, id)
+}
+
+func (hdb *HonuaDatabase) MoveActionUpContext(ctx context.Context, identifier string, id int) (err error) {
+	defer hdb.observe(ctx, "move_action_up", time.Now(), &err, slog.String("identity", identifier), slog.Int("action_id", id))
+	return hdb.move_action(ctx, identifier, id, -1)
+}
+
+// MoveActionDown swaps the action with the action after it
+func (hdb *HonuaDatabase) MoveActionDown(identifier string, id int) error {
+	return hdb.MoveActionDownContext(context.Background(), identifier, id)
+}
+
+func (hdb *HonuaDatabase) MoveActionDownContext(ctx context.Context, identifier string, id int) (err error) {
+	defer hdb.observe(ctx, "move_action_down", time.Now(), &err, slog.String("identity", identifier), slog.Int("action_id", id))
+	return hdb.move_action(ctx, identifier, id, 1)
+}
+
+// move_action moves the action by offset positions inside its list, which
+// may be the nested actions of a wait or repeat. Moving the first action up or
+// the last one down does nothing.
+func (hdb *HonuaDatabase) move_action(ctx context.Context, identifier string, id int, offset int) error {
+	return hdb.with_tx(ctx, func(tx *sql.Tx) error {
+		row, err := hdb.get_action_row(ctx, tx, identifier, id)
 		if err != nil {
-			log.Printf("An error occured during adding a new action: %s\n", err.Error())
 			return err
 		}
-		query := "INSERT INTO actions(id, identity, type, rule_id, is_then_action, service_id) VALUES ($1, $2, $3, $4, $5, $6)"
-		_, err  = hdb.db.Exec(query, id, identifier, action.Type, ruleID, isThenAction, serviceID)
+		ids, err := hdb.get_action_ids(ctx, tx, identifier, row.list())
 		if err != nil {
-			log.Printf("An error occured during adding a new action: %s\n", err.Error())
 			return err
 		}
-		return nil
-	}
 
-	return fmt.Errorf("actiontype %d not supported", action.Type)
+		var index int = index_of(ids, id)
+		var target int = index + offset
+		if target < 0 || target >= len(ids) {
+			return nil
+		}
+		ids[index], ids[target] = ids[target], ids[index]
+		return hdb.set_action_positions(ctx, tx, identifier, ids)
+	})
+}
+
+// ReorderActions sets the order of the then or else actions of the rule.
+// ids must contain every action of the list exactly once.
+func (hdb *HonuaDatabase) ReorderActions(identifier string, ruleID int, isThenAction bool, ids []int) error {
+	return hdb.ReorderActionsContext(context.Background(), identifier, ruleID, isThenAction, ids)
 }
 
-func (hdb *HonuaDatabase) DeleteAction(identifier string, id int) error {
+func (hdb *HonuaDatabase) ReorderActionsContext(ctx context.Context, identifier string, ruleID int, isThenAction bool, ids []int) (err error) {
+	defer hdb.observe(ctx, "reorder_actions", time.Now(), &err, slog.String("identity", identifier), slog.Int("rule_id", ruleID))
+	return hdb.with_tx(ctx, func(tx *sql.Tx) error {
+		current, err := hdb.get_action_ids(ctx, tx, identifier, actionList{ruleID: ruleID, isThenAction: isThenAction})
+		if err != nil {
+			return err
+		}
+		if err = check_action_order(current, ids); err != nil {
+			return err
+		}
+		return hdb.set_action_positions(ctx, tx, identifier, ids)
+	})
+}
 
-	aType, err := hdb.get_action_type(identifier, id)
+// add_action appends the action using q, which may be a transaction.
+// If the delay of a delay action can not be added a *RuleError is returned.
+func (hdb *HonuaDatabase) add_action(ctx context.Context, q querier, identifier string, ruleID int, isThenAction bool, action *models.Action) error {
+	list := actionList{ruleID: ruleID, isThenAction: isThenAction}
+	ids, err := hdb.get_action_ids(ctx, q, identifier, list)
 	if err != nil {
-		log.Printf("An error occured during deleting the action %d in %s: %s\n", id, identifier, err.Error())
 		return err
 	}
+	return hdb.insert_action(ctx, q, identifier, list, len(ids), action)
+}
 
-	if aType == models.DELAY {
-		dId, err := hdb.get_delay_id_of_action(identifier, id)
+// insert_action inserts the action at position into list, the nested actions
+// of a wait or repeat are inserted after it
+func (hdb *HonuaDatabase) insert_action(ctx context.Context, q querier, identifier string, list actionList, position int, action *models.Action) error {
+	id, err := hdb.next_id(ctx, q, identifier, "actions")
+	if err != nil {
+		return err
+	}
+
+	var ruleID int = list.ruleID
+	var nested []*models.Action
+	row := &actionRow{
+		id:           id,
+		actionType:   action.Type,
+		ruleID:       ruleID,
+		isThenAction: list.isThenAction,
+		position:     position,
+		parentID:     list.parentID,
+	}
+
+	switch action.Type {
+	case models.SERVICE:
+		serviceID, err := hdb.check_service_action(ctx, q, identifier, ruleID, action)
+		if err != nil {
+			return err
+		}
+		row.serviceID = null_int(serviceID)
+		row.serviceName = action.ServiceName
+		if action.Target != nil {
+			row.targetID = null_int(action.Target.Id)
+		}
+		if len(action.ServiceData) > 0 {
+			row.serviceData = action.ServiceData
+		}
+	case models.DELAY:
+		delayID, err := hdb.add_delay(ctx, q, identifier, action.Delay)
+		if err != nil {
+			return &RuleError{Part: RulePartDelay, RuleID: ruleID, Err: err}
+		}
+		row.delayID = null_int(delayID)
+	case models.NOTIFY:
+		notificationID, err := hdb.add_notification(ctx, q, identifier, action.Notification)
+		if err != nil {
+			return err
+		}
+		row.notificationID = null_int(notificationID)
+	case models.SET_STATE:
+		stateChangeID, err := hdb.add_state_change(ctx, q, identifier, action.StateChange)
+		if err != nil {
+			return err
+		}
+		row.stateChangeID = null_int(stateChangeID)
+	case models.SWITCH_RULE:
+		ruleSwitchID, err := hdb.add_rule_switch(ctx, q, identifier, action.RuleSwitch)
+		if err != nil {
+			return err
+		}
+		row.ruleSwitchID = null_int(ruleSwitchID)
+	case models.SCENE:
+		if action.Scene == nil {
+			return fmt.Errorf("%w: a scene action needs a scene", ErrInvalidAction)
+		}
+		row.sceneID = null_int(action.Scene.Id)
+	case models.WAIT_UNTIL:
+		waitID, err := hdb.add_wait(ctx, q, identifier, action.Wait)
+		if err != nil {
+			return err
+		}
+		row.waitID = null_int(waitID)
+		nested = action.Wait.TimeoutActions
+	case models.REPEAT:
+		repeatID, err := hdb.add_repeat(ctx, q, identifier, action.Repeat)
 		if err != nil {
-			log.Printf("An error occured during deleting the action %d in %s: %s\n", id, identifier, err.Error())
 			return err
 		}
+		row.repeatID = null_int(repeatID)
+		nested = action.Repeat.Actions
+	default:
+		return fmt.Errorf("%w: actiontype %d not supported", ErrUnsupportedType, action.Type)
+	}
+
+	const query = `INSERT INTO actions(identity, ` + action_columns + `)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18);`
+	_, err = q.ExecContext(ctx, query, append([]any{identifier}, row.values()...)...)
+	if err != nil {
+		return map_error(err)
+	}
 
-		err = hdb.DeleteDelay(identifier, dId)
+	for i, a := range nested {
+		err = hdb.insert_action(ctx, q, identifier, actionList{ruleID: ruleID, isThenAction: list.isThenAction, parentID: null_int(id)}, i, a)
 		if err != nil {
-			log.Printf("An error occured during deleting the action %d in %s: %s\n", id, identifier, err.Error())
 			return err
 		}
 	}
 
-	const query = "DELETE FROM actions WHERE id=$1 AND identity=$2;"
-	_, err = hdb.db.Exec(query, id, identifier)
+	action.Id = id
+	action.Position = position
+	return nil
+}
+
+func (hdb *HonuaDatabase) DeleteAction(identifier string, id int) error {
+	return hdb.DeleteActionContext(context.Background(), identifier, id)
+}
+
+// DeleteActionContext removes the action with its nested actions, closes
+// the gap in the positions and deletes the runs of the rule
+func (hdb *HonuaDatabase) DeleteActionContext(ctx context.Context, identifier string, id int) (err error) {
+	defer hdb.observe(ctx, "delete_action", time.Now(), &err, slog.String("identity", identifier), slog.Int("action_id", id))
+	defer hdb.subscribers.rules_changed(identifier, &err)
+
+	return hdb.with_tx(ctx, func(tx *sql.Tx) error {
+		if _, err := hdb.get_action_row(ctx, tx, identifier, id); err != nil {
+			return err
+		}
+		return hdb.delete_actions(ctx, tx, identifier, "id=$2", id)
+	})
+}
+
+// delete_actions removes the actions matching where, e.g. "scene_id=$2" with
+// arg as $2, with their nested actions and parameters. The gaps in the
+// positions are closed and the runs of their rules are deleted, because the
+// stored position of a run could point to another action now.
+func (hdb *HonuaDatabase) delete_actions(ctx context.Context, q querier, identifier string, where string, arg any) error {
+	query := "SELECT " + action_columns + " FROM actions WHERE identity=$1 AND (" + where + ") ORDER BY id;"
+	rows, err := q.QueryContext(ctx, query, identifier, arg)
 	if err != nil {
-		log.Printf("An error occured during deleting the action %d in %s: %s\n", id, identifier, err.Error())
-		return err
+		return map_error(err)
+	}
+	var actionRows []*actionRow
+	for rows.Next() {
+		row := &actionRow{}
+		if err = rows.Scan(row.fields()...); err != nil {
+			rows.Close()
+			return map_error(err)
+		}
+		actionRows = append(actionRows, row)
 	}
+	rows.Close()
 
+	var lists []actionList
+	var ruleIDs []int
+	var seen map[int]bool = map[int]bool{}
+	for _, row := range actionRows {
+		// the constraints delete the action too, unless it has no parameters of its own
+		if err = hdb.delete_action_parameters(ctx, q, identifier, action_subtree, row.id); err != nil {
+			return err
+		}
+		_, err = q.ExecContext(ctx, "DELETE FROM actions WHERE id=$1 AND identity=$2;", row.id, identifier)
+		if err != nil {
+			return map_error(err)
+		}
+		lists = append(lists, row.list())
+		if !seen[row.ruleID] {
+			seen[row.ruleID] = true
+			ruleIDs = append(ruleIDs, row.ruleID)
+		}
+	}
 
+	for _, list := range lists {
+		ids, err := hdb.get_action_ids(ctx, q, identifier, list)
+		if err != nil {
+			return err
+		}
+		if err = hdb.set_action_positions(ctx, q, identifier, ids); err != nil {
+			return err
+		}
+	}
+	for _, ruleID := range ruleIDs {
+		if err = hdb.delete_action_runs(ctx, q, identifier, &ruleID); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func (hdb *HonuaDatabase) ExistAction(identifier string, id int) (bool, error) {
+	return hdb.ExistActionContext(context.Background(), identifier, id)
+}
+
+func (hdb *HonuaDatabase) ExistActionContext(ctx context.Context, identifier string, id int) (_ bool, err error) {
+	defer hdb.observe(ctx, "exist_action", time.Now(), &err, slog.String("identity", identifier), slog.Int("action_id", id))
 	const query = "SELECT CASE WHEN EXISTS ( SELECT * FROM actions WHERE identity=$1 AND id = $2) THEN true ELSE false END"
-	rows, err := hdb.db.Query(query, identifier, id)
+	rows, err := hdb.db.QueryContext(ctx, query, identifier, id)
 	if err != nil {
-		log.Printf("An error occured during checking if the action with id %d exists: %s\n", id, err.Error())
-		return false, err
+		return false, map_error(err)
 	}
 
 	var state bool = false
@@ -174,8 +439,7 @@ func (hdb *HonuaDatabase) ExistAction(identifier string, id int) (bool, error) {
 		err = rows.Scan(&state)
 		if err != nil {
 			rows.Close()
-			log.Printf("An error occured during checking if the action with id %d exists: %s\n", id, err.Error())
-			return false, err
+			return false, map_error(err)
 		}
 	}
 
@@ -184,106 +448,177 @@ func (hdb *HonuaDatabase) ExistAction(identifier string, id int) (bool, error) {
 	return state, nil
 }
 
-func (hdb *HonuaDatabase) get_action_type(identifier string, id int) (models.ActionType, error) {
-	const query = "SELECT type FROM actions WHERE id=$1 AND identity=$2;"
-	rows, err := hdb.db.Query(query, id, identifier)
-	if err != nil {
-		log.Printf("An error occured during getting the action type of action %d in %s: %s\n", id, identifier, err.Error())
-		return -1, nil
+// actionRow is a row of the table actions
+type actionRow struct {
+	id             int
+	actionType     models.ActionType
+	ruleID         int
+	isThenAction   bool
+	position       int
+	serviceID      sql.NullInt32
+	serviceName    string
+	targetID       sql.NullInt32
+	serviceData    []byte
+	delayID        sql.NullInt32
+	notificationID sql.NullInt32
+	stateChangeID  sql.NullInt32
+	ruleSwitchID   sql.NullInt32
+	sceneID        sql.NullInt32
+	parentID       sql.NullInt32
+	waitID         sql.NullInt32
+	repeatID       sql.NullInt32
+}
+
+// action_columns are the columns of an actionRow, in the order of fields and values
+const action_columns = `id, type, rule_id, is_then_action, position, service_id, service_name, target_id, service_data,
+	delay_id, notification_id, state_change_id, rule_switch_id, scene_id, parent_action_id, wait_id, repeat_id`
+
+func (row *actionRow) fields() []any {
+	return []any{
+		&row.id, &row.actionType, &row.ruleID, &row.isThenAction, &row.position, &row.serviceID, &row.serviceName, &row.targetID, &row.serviceData,
+		&row.delayID, &row.notificationID, &row.stateChangeID, &row.ruleSwitchID, &row.sceneID, &row.parentID, &row.waitID, &row.repeatID,
 	}
+}
 
-	var result models.ActionType
-	for rows.Next() {
-		err = rows.Scan(&result)
-		if err != nil {
-			rows.Close()
-			log.Printf("An error occured during getting the action type of action %d in %s: %s\n", id, identifier, err.Error())
-			return -1, nil
-		}
+func (row *actionRow) values() []any {
+	return []any{
+		row.id, row.actionType, row.ruleID, row.isThenAction, row.position, row.serviceID, row.serviceName, row.targetID, row.serviceData,
+		row.delayID, row.notificationID, row.stateChangeID, row.ruleSwitchID, row.sceneID, row.parentID, row.waitID, row.repeatID,
 	}
-	rows.Close()
+}
 
-	return result, nil
+// actionList names one ordered list of actions: the then or else actions of a
+// rule, or the nested actions of the wait or repeat action parentID
+type actionList struct {
+	ruleID       int
+	isThenAction bool
+	parentID     sql.NullInt32
+}
+
+func (row *actionRow) list() actionList {
+	return actionList{ruleID: row.ruleID, isThenAction: row.isThenAction, parentID: row.parentID}
+}
+
+// action_subtree selects the action $2 and all actions nested in it
+const action_subtree = `id IN (WITH RECURSIVE subtree(id) AS (
+		SELECT id FROM actions WHERE identity=$1 AND id=$2
+		UNION ALL
+		SELECT a.id FROM actions a JOIN subtree s ON a.parent_action_id = s.id WHERE a.identity=$1
+	) SELECT id FROM subtree)`
+
+func (hdb *HonuaDatabase) get_action_row(ctx context.Context, q querier, identifier string, id int) (*actionRow, error) {
+	const query = "SELECT " + action_columns + " FROM actions WHERE id=$1 AND identity=$2;"
+
+	row := &actionRow{}
+	err := q.QueryRowContext(ctx, query, id, identifier).Scan(row.fields()...)
+	if err != nil {
+		return nil, map_error(err)
+	}
+	return row, nil
 }
 
-func (hdb *HonuaDatabase) get_delay_id_of_action(identifier string, id int) (int, error) {
-	const query = "SELECT delay_id FROM actions WHERE id=$1 AND identity=$2;"
-	rows, err := hdb.db.Query(query, id, identifier)
+// get_action_ids returns the ids of the actions in list in their order
+func (hdb *HonuaDatabase) get_action_ids(ctx context.Context, q querier, identifier string, list actionList) ([]int, error) {
+	const query = `SELECT id FROM actions
+		WHERE identity=$1 AND rule_id=$2 AND is_then_action=$3 AND parent_action_id IS NOT DISTINCT FROM $4
+		ORDER BY position, id;`
+
+	rows, err := q.QueryContext(ctx, query, identifier, list.ruleID, list.isThenAction, list.parentID)
 	if err != nil {
-		log.Printf("An error occured during getting the delay_id of action %d in %s: %s\n", id, identifier, err.Error())
-		return -1, nil
+		return nil, map_error(err)
 	}
 
-	var result sql.NullInt32
+	var result []int = []int{}
 	for rows.Next() {
-		err = rows.Scan(&result)
-		if err != nil {
+		var id int
+		if err = rows.Scan(&id); err != nil {
 			rows.Close()
-			log.Printf("An error occured during getting the delay_id of action %d in %s: %s\n", id, identifier, err.Error())
-			return -1, nil
+			return nil, map_error(err)
 		}
+		result = append(result, id)
 	}
 	rows.Close()
 
-	if !result.Valid {
-		log.Printf("An error occured during getting the delay_id of action %d in %s.\n", id, identifier)
-		return -1, fmt.Errorf("an error occured during getting the delay_id of action %d in %s", id, identifier)
-	}
+	return result, nil
+}
 
-	return int(result.Int32), nil
+// set_action_positions gives every action the position of its id in ids
+func (hdb *HonuaDatabase) set_action_positions(ctx context.Context, q querier, identifier string, ids []int) error {
+	const query = `UPDATE actions SET position = ordered.position - 1
+		FROM unnest($2::INTEGER[]) WITH ORDINALITY AS ordered(id, position)
+		WHERE actions.identity = $1 AND actions.id = ordered.id;`
+
+	_, err := q.ExecContext(ctx, query, identifier, pq.Array(ids))
+	return map_error(err)
 }
 
-func (hdb *HonuaDatabase) get_action_id(identifier string) (int, error) {
-	query := "SELECT CASE WHEN EXISTS ( SELECT * FROM actions WHERE identity = $1) THEN true ELSE false END"
+// check_service_action checks the service data of a service action and that
+// the service is allowed for its target, which defaults to the target of the
+// rule. It returns the id of the service.
+func (hdb *HonuaDatabase) check_service_action(ctx context.Context, q querier, identifier string, ruleID int, action *models.Action) (int, error) {
+	if err := check_service_data(action.ServiceData); err != nil {
+		return -1, err
+	}
 
-	rows, err := hdb.db.Query(query, identifier)
+	serviceID, err := hdb.get_id_of_hass_service(ctx, q, identifier, action.Service)
 	if err != nil {
-		log.Printf("An error occured during getting id of action in %s: %s\n", identifier, err.Error())
 		return -1, err
 	}
 
-	var exist_identity bool = false
-
-	for rows.Next() {
-		err = rows.Scan(&exist_identity)
+	var targetID int
+	if action.Target != nil {
+		targetID = action.Target.Id
+	} else {
+		err = q.QueryRowContext(ctx, "SELECT entity_id FROM rules WHERE identity=$1 AND id=$2;", identifier, ruleID).Scan(&targetID)
 		if err != nil {
-			rows.Close()
-			log.Printf("An error occured during getting id of action in %s: %s\n", identifier, err.Error())
-			return -1, err
+			return -1, map_error(err)
 		}
 	}
 
-	rows.Close()
-
-	if !exist_identity {
-		return 0, nil
-	}
-
-	query = "SELECT MAX(id) FROM actions WHERE identity = $1;"
-
-	rows, err = hdb.db.Query(query, identifier)
+	const query = "SELECT EXISTS (SELECT * FROM allowed_services WHERE identity=$1 AND entity_id=$2 AND service_id=$3);"
+	var allowed bool
+	err = q.QueryRowContext(ctx, query, identifier, targetID, serviceID).Scan(&allowed)
 	if err != nil {
-		log.Printf("An error occured during getting id of action in %s: %s\n", identifier, err.Error())
-		return -1, err
+		return -1, map_error(err)
 	}
+	if !allowed {
+		return -1, fmt.Errorf("%w: the service %s is not allowed for the entity %d in %s", ErrServiceNotAllowed, action.Service, targetID, identifier)
+	}
+	return serviceID, nil
+}
 
-	var id int = -1
+// check_service_data checks that data is empty or a JSON object
+func check_service_data(data json.RawMessage) error {
+	if len(data) == 0 {
+		return nil
+	}
+	var object map[string]any
+	if err := json.Unmarshal(data, &object); err != nil || object == nil {
+		return fmt.Errorf("%w: the service data is no JSON object", ErrInvalidAction)
+	}
+	return nil
+}
 
-	for rows.Next() {
-		err = rows.Scan(&id)
-		if err != nil {
-			rows.Close()
-			log.Printf("An error occured during getting id of action in %s: %s\n", identifier, err.Error())
-			return -1, err
+// check_action_order checks that order contains the ids of current exactly once
+func check_action_order(current, order []int) error {
+	if len(current) != len(order) {
+		return fmt.Errorf("%w: expected %d actions, got %d", ErrInvalidActionOrder, len(current), len(order))
+	}
+	var seen map[int]bool = map[int]bool{}
+	for _, id := range order {
+		if seen[id] || index_of(current, id) == -1 {
+			return fmt.Errorf("%w: action %d is unknown or appears twice", ErrInvalidActionOrder, id)
 		}
+		seen[id] = true
 	}
-	rows.Close()
+	return nil
+}
 
-	if id == -1 {
-		return -1, errors.New("something went wrong during getting id of action")
+func index_of(ids []int, id int) int {
+	for i, v := range ids {
+		if v == id {
+			return i
+		}
 	}
-
-	id = id + 1
-
-	return id, nil
+	return -1
 }
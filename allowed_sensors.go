@@ -1,78 +1,88 @@
 package honuadatabase
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
+	"time"
 )
 
 func (hdb *HonuaDatabase) AllowSensor(identity, deviceId, sensorId string) error {
-	dId, err := hdb.GetIdOfEntity(identity, deviceId)
+	return hdb.AllowSensorContext(context.Background(), identity, deviceId, sensorId)
+}
+
+func (hdb *HonuaDatabase) AllowSensorContext(ctx context.Context, identity, deviceId, sensorId string) (err error) {
+	defer hdb.observe(ctx, "allow_sensor", time.Now(), &err, slog.String("identity", identity), slog.String("entity_id", deviceId), slog.String("sensor_id", sensorId))
+	dId, err := hdb.GetIdOfEntityContext(ctx, identity, deviceId)
 	if err != nil {
 		return err
 	}
 
-	sId, err := hdb.GetIdOfEntity(identity, sensorId)
+	sId, err := hdb.GetIdOfEntityContext(ctx, identity, sensorId)
 	if err != nil {
 		return err
 	}
 
 	const query = "INSERT INTO allowed_sensors(identity, device_id, sensor_id) VALUES ($1, $2, $3);"
 
-	_, err = hdb.db.Exec(query, identity, dId, sId)
+	_, err = hdb.db.ExecContext(ctx, query, identity, dId, sId)
 
-	if err != nil {
-		log.Printf("An error occured during allowing the sensor %s for %s: %s\n", deviceId, sensorId, err.Error())
-	}
-	return err
+	return map_error(err)
 }
 
 func (hdb *HonuaDatabase) DisallowSensor(identity, deviceId, sensorId string) error {
-	allowed, err := hdb.IsSensorAllowed(identity, deviceId, sensorId)
+	return hdb.DisallowSensorContext(context.Background(), identity, deviceId, sensorId)
+}
+
+func (hdb *HonuaDatabase) DisallowSensorContext(ctx context.Context, identity, deviceId, sensorId string) (err error) {
+	defer hdb.observe(ctx, "disallow_sensor", time.Now(), &err, slog.String("identity", identity), slog.String("entity_id", deviceId), slog.String("sensor_id", sensorId))
+	allowed, err := hdb.IsSensorAllowedContext(ctx, identity, deviceId, sensorId)
 	if err != nil {
 		return err
 	}
 	
 	if !allowed {
-		return fmt.Errorf("sensor %s is not allowed for %s in %s", sensorId, deviceId, identity)
+		return fmt.Errorf("%w: sensor %s is not allowed for %s in %s", ErrNotFound, sensorId, deviceId, identity)
 	}
 
-	dId, err := hdb.GetIdOfEntity(identity, deviceId)
+	dId, err := hdb.GetIdOfEntityContext(ctx, identity, deviceId)
 	if err != nil {
 		return err
 	}
 
-	sId, err := hdb.GetIdOfEntity(identity, sensorId)
+	sId, err := hdb.GetIdOfEntityContext(ctx, identity, sensorId)
 	if err != nil {
 		return err
 	}
 	
 	const query = "DELETE FROM allowed_sensors WHERE identity=$1 AND device_id=$2 AND sensor_id=$3;"
 
-	_, err = hdb.db.Exec(query, identity, dId, sId)
+	_, err = hdb.db.ExecContext(ctx, query, identity, dId, sId)
 
-	if err != nil {
-		log.Printf("An error occured during deleting from allowed_sensors: %s\n", err.Error())
-	}
-	return err
+	return map_error(err)
 }
 
 func (hdb *HonuaDatabase) IsSensorAllowed(identity, deviceId, sensorId string) (bool, error) {
-	dId, err := hdb.GetIdOfEntity(identity, deviceId)
+	return hdb.IsSensorAllowedContext(context.Background(), identity, deviceId, sensorId)
+}
+
+func (hdb *HonuaDatabase) IsSensorAllowedContext(ctx context.Context, identity, deviceId, sensorId string) (_ bool, err error) {
+	defer hdb.observe(ctx, "is_sensor_allowed", time.Now(), &err, slog.String("identity", identity), slog.String("entity_id", deviceId), slog.String("sensor_id", sensorId))
+	dId, err := hdb.GetIdOfEntityContext(ctx, identity, deviceId)
 	if err != nil {
 		return false, err
 	}
 
-	sId, err := hdb.GetIdOfEntity(identity, sensorId)
+	sId, err := hdb.GetIdOfEntityContext(ctx, identity, sensorId)
 	if err != nil {
 		return false, err
 	}
 
 	const query = "SELECT CASE WHEN EXISTS ( SELECT * FROM allowed_sensors WHERE identity=$1 AND device_id = $2 AND sensor_id = $3) THEN true ELSE false END"
 
-	rows, err := hdb.db.Query(query, identity, dId, sId)
+	rows, err := hdb.db.QueryContext(ctx, query, identity, dId, sId)
 	if err != nil {
-		log.Printf("An error occured during checking if the sensor %s is allowed for %s in %s: %s\n", sensorId, deviceId, identity, err.Error())
-		return false, err
+		return false, map_error(err)
 	}
 
 	var state bool = false
@@ -81,8 +91,7 @@ func (hdb *HonuaDatabase) IsSensorAllowed(identity, deviceId, sensorId string) (
 		err = rows.Scan(&state)
 		if err != nil {
 			rows.Close()
-			log.Printf("An error occured during checking if the sensor %s is allowed for %s in %s: %s\n", sensorId, deviceId, identity, err.Error())
-			return false, err
+			return false, map_error(err)
 		}
 	}
 
@@ -1,94 +1,104 @@
 package honuadatabase
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
+	"time"
 )
 
 func (hdb *HonuaDatabase) AllowService(identity, domain, entityId string) error {
-	exists, err := hdb.ExistsHassService(identity, domain)
+	return hdb.AllowServiceContext(context.Background(), identity, domain, entityId)
+}
+
+func (hdb *HonuaDatabase) AllowServiceContext(ctx context.Context, identity, domain, entityId string) (err error) {
+	defer hdb.observe(ctx, "allow_service", time.Now(), &err, slog.String("identity", identity), slog.String("entity_id", entityId), slog.String("domain", domain))
+	exists, err := hdb.ExistsHassServiceContext(ctx, identity, domain)
 	if err != nil {
 		return err
 	}
 	if !exists {
-		return fmt.Errorf("the homeassistant service with identity %s and domain %s does not exist", identity, domain)
+		return fmt.Errorf("%w: the homeassistant service with identity %s and domain %s does not exist", ErrNotFound, identity, domain)
 	}
 
-	sId, err := hdb.GetIDofHassService(identity, domain)
+	sId, err := hdb.GetIDofHassServiceContext(ctx, identity, domain)
 	if err != nil {
 		return err
 	}
 
-	eId, err := hdb.GetIdOfEntity(identity, entityId)
+	eId, err := hdb.GetIdOfEntityContext(ctx, identity, entityId)
 	if err != nil {
 		return err
 	}
 
 	const query = "INSERT INTO allowed_services(identity, entity_id, service_id) VALUES ($1, $2, $3)"
 
-	_, err = hdb.db.Exec(query, identity, eId, sId)
+	_, err = hdb.db.ExecContext(ctx, query, identity, eId, sId)
 
-	if err != nil {
-		log.Printf("An error occured during adding a new Homeassistant Service to table hass_services: %s\n", err.Error())
-	}
-	return err
+	return map_error(err)
 }
 
 func (hdb *HonuaDatabase) DisallowService(identity, domain, entityId string) error {
-	allowed, err := hdb.IsServiceAllowed(identity, domain, entityId)
+	return hdb.DisallowServiceContext(context.Background(), identity, domain, entityId)
+}
+
+func (hdb *HonuaDatabase) DisallowServiceContext(ctx context.Context, identity, domain, entityId string) (err error) {
+	defer hdb.observe(ctx, "disallow_service", time.Now(), &err, slog.String("identity", identity), slog.String("entity_id", entityId), slog.String("domain", domain))
+	allowed, err := hdb.IsServiceAllowedContext(ctx, identity, domain, entityId)
 	if err != nil {
 		return err
 	}
 	
 	if !allowed {
-		return fmt.Errorf("homeassistant service %s is not allowed for %s in %s", domain, entityId, identity)
+		return fmt.Errorf("%w: homeassistant service %s is not allowed for %s in %s", ErrNotFound, domain, entityId, identity)
 	}
 
-	sId, err := hdb.GetIDofHassService(identity, domain)
+	sId, err := hdb.GetIDofHassServiceContext(ctx, identity, domain)
 	if err != nil {
 		return err
 	}
 
-	eId, err := hdb.GetIdOfEntity(identity, entityId)
+	eId, err := hdb.GetIdOfEntityContext(ctx, identity, entityId)
 	if err != nil {
 		return err
 	}
 	
 	const query = "DELETE FROM allowed_services WHERE identity=$1 AND entity_id=$2 AND service_id=$3;"
 
-	_, err = hdb.db.Exec(query, identity, eId, sId)
+	_, err = hdb.db.ExecContext(ctx, query, identity, eId, sId)
 
-	if err != nil {
-		log.Printf("An error occured during deleting a Homeassistant Service from table hass_services: %s\n", err.Error())
-	}
-	return err
+	return map_error(err)
 }
 
 func (hdb *HonuaDatabase) IsServiceAllowed(identity, domain, entityId string) (bool, error) {
-	exists, err := hdb.ExistsHassService(identity, domain)
+	return hdb.IsServiceAllowedContext(context.Background(), identity, domain, entityId)
+}
+
+func (hdb *HonuaDatabase) IsServiceAllowedContext(ctx context.Context, identity, domain, entityId string) (_ bool, err error) {
+	defer hdb.observe(ctx, "is_service_allowed", time.Now(), &err, slog.String("identity", identity), slog.String("entity_id", entityId), slog.String("domain", domain))
+	exists, err := hdb.ExistsHassServiceContext(ctx, identity, domain)
 	if err != nil {
 		return false, err
 	}
 	if !exists {
-		return false, fmt.Errorf("the homeassistant service with identity %s and domain %s does not exist", identity, domain)
+		return false, fmt.Errorf("%w: the homeassistant service with identity %s and domain %s does not exist", ErrNotFound, identity, domain)
 	}
 
-	sId, err := hdb.GetIDofHassService(identity, domain)
+	sId, err := hdb.GetIDofHassServiceContext(ctx, identity, domain)
 	if err != nil {
 		return false, err
 	}
 
-	eId, err := hdb.GetIdOfEntity(identity, entityId)
+	eId, err := hdb.GetIdOfEntityContext(ctx, identity, entityId)
 	if err != nil {
 		return false, err
 	}
 
 	const query = "SELECT CASE WHEN EXISTS ( SELECT * FROM allowed_services WHERE identity = $1 aND entity_id = $2 AND service_id = $3) THEN true ELSE false END"
 
-	rows, err := hdb.db.Query(query, identity, eId, sId)
+	rows, err := hdb.db.QueryContext(ctx, query, identity, eId, sId)
 	if err != nil {
-		log.Printf("An error occured during checking if the service %s is allowed for %s in %s: %s\n", domain, entityId, identity, err.Error())
-		return false, err
+		return false, map_error(err)
 	}
 
 	var state bool = false
@@ -97,8 +107,7 @@ func (hdb *HonuaDatabase) IsServiceAllowed(identity, domain, entityId string) (b
 		err = rows.Scan(&state)
 		if err != nil {
 			rows.Close()
-			log.Printf("An error occured during checking if the service %s is allowed for %s in %s: %s\n", domain, entityId, identity, err.Error())
-			return false, err
+			return false, map_error(err)
 		}
 	}
 
@@ -0,0 +1,155 @@
+// Package clock tells the time to the engine and the scheduler, so the time
+// can be replaced in tests and simulations.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock returns the current time and creates timers
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer sends the time on C once its duration passed, like time.Timer
+type Timer interface {
+	C() <-chan time.Time
+	// Stop prevents the timer from firing, it returns false if it already fired or was stopped
+	Stop() bool
+}
+
+type system struct{}
+
+func (system) Now() time.Time {
+	return time.Now()
+}
+
+func (system) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+type systemTimer struct {
+	t *time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time { return t.t.C }
+func (t systemTimer) Stop() bool          { return t.t.Stop() }
+
+// System is the clock of the operating system
+func System() Clock {
+	return system{}
+}
+
+// Fixed is a clock that always returns the same time, its timers never fire
+type Fixed time.Time
+
+func (f Fixed) Now() time.Time {
+	return time.Time(f)
+}
+
+func (f Fixed) NewTimer(d time.Duration) Timer {
+	return &fakeTimer{c: make(chan time.Time, 1)}
+}
+
+// Fake is a clock for tests, its time only moves with Advance and Set
+type Fake struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers []*fakeTimer
+}
+
+func NewFake(now time.Time) *Fake {
+	f := &Fake{now: now}
+	f.cond = sync.NewCond(&f.mutex)
+	return f
+}
+
+func (f *Fake) Now() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.now
+}
+
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	t := &fakeTimer{clock: f, at: f.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- f.now
+		return t
+	}
+	f.timers = append(f.timers, t)
+	f.cond.Broadcast()
+	return t
+}
+
+// Advance moves the time forward and fires the timers that are due, in the order of their time
+func (f *Fake) Advance(d time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.set(f.now.Add(d))
+}
+
+// Set moves the time to t and fires the timers that are due
+func (f *Fake) Set(t time.Time) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.set(t)
+}
+
+func (f *Fake) set(t time.Time) {
+	f.now = t
+	sort.SliceStable(f.timers, func(i, j int) bool { return f.timers[i].at.Before(f.timers[j].at) })
+
+	var pending []*fakeTimer
+	for _, timer := range f.timers {
+		if timer.at.After(t) {
+			pending = append(pending, timer)
+			continue
+		}
+		timer.c <- timer.at
+	}
+	f.timers = pending
+	f.cond.Broadcast()
+}
+
+// BlockUntil waits until n timers are waiting, so a test knows that the
+// goroutines it started are blocked on the clock
+func (f *Fake) BlockUntil(n int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for len(f.timers) < n {
+		f.cond.Wait()
+	}
+}
+
+type fakeTimer struct {
+	clock *Fake
+	at    time.Time
+	c     chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	if t.clock == nil {
+		return false
+	}
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	for i, timer := range t.clock.timers {
+		if timer == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			t.clock.cond.Broadcast()
+			return true
+		}
+	}
+	return false
+}
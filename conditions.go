@@ -1,40 +1,46 @@
 package honuadatabase
 
 import (
+	"context"
 	"database/sql"
-	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
+	"time"
 
+	"github.com/JonasBordewick/honua-database/expression"
 	"github.com/JonasBordewick/honua-database/models"
+	"github.com/lib/pq"
 )
 
-const add_condition_query = `
-INSERT INTO conditions(
-	id, identity, type, sensor_id, before,
-	after, below, above,
-	comparison_state, parent_id
-) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10);
-`
+const add_condition_query = `INSERT INTO conditions(identity, ` + condition_columns + `)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19);`
 
 func (hdb *HonuaDatabase) AddCondition(identity string, condition *models.Condition) (int, error) {
+	return hdb.AddConditionContext(context.Background(), identity, condition)
+}
+
+func (hdb *HonuaDatabase) AddConditionContext(ctx context.Context, identity string, condition *models.Condition) (_ int, err error) {
+	defer hdb.observe(ctx, "add_condition", time.Now(), &err, slog.String("identity", identity))
+	return hdb.add_condition(ctx, hdb.db, identity, condition)
+}
 
-	id, err := hdb.get_condition_id(identity)
+// add_condition adds the condition with its subconditions using q, which may be a transaction
+func (hdb *HonuaDatabase) add_condition(ctx context.Context, q querier, identity string, condition *models.Condition) (int, error) {
+	id, err := hdb.next_id(ctx, q, identity, "conditions")
 	if err != nil {
-		log.Printf("An error occured during adding a new condition: %s\n", err.Error())
 		return -1, err
 	}
 
-	_, err = hdb.db.Exec(add_condition_query, id, identity, condition.Type, sql.NullInt32{}, sql.NullString{}, sql.NullString{}, sql.NullInt32{}, sql.NullInt32{}, sql.NullString{}, sql.NullInt32{})
+	row := &conditionRow{id: id, conditionType: condition.Type}
+	_, err = q.ExecContext(ctx, add_condition_query, append([]any{identity}, row.values()...)...)
 	if err != nil {
-		log.Printf("Error during adding new condition to table: %s\n", err.Error())
-		return -1, err
+		return -1, map_error(err)
 	}
 
 	for _, sub := range condition.SubConditions {
-		err = hdb.add_subcondition(identity, sub, id)
+		err = hdb.add_subcondition(ctx, q, identity, sub, id)
 		if err != nil {
-			log.Printf("Error during adding new condition to table: %s\n", err.Error())
 			return -1, err
 		}
 	}
@@ -43,121 +49,107 @@ func (hdb *HonuaDatabase) AddCondition(identity string, condition *models.Condit
 }
 
 func (hdb *HonuaDatabase) DeleteCondition(conditionID int, identity string) error {
+	return hdb.DeleteConditionContext(context.Background(), conditionID, identity)
+}
+
+func (hdb *HonuaDatabase) DeleteConditionContext(ctx context.Context, conditionID int, identity string) (err error) {
+	defer hdb.observe(ctx, "delete_condition", time.Now(), &err, slog.String("identity", identity), slog.Int("condition_id", conditionID))
+	defer hdb.subscribers.rules_changed(identity, &err)
 	const query = "DELETE FROM conditions WHERE id=$1 AND identity=$2;"
 
-	_, err := hdb.db.Exec(query, conditionID, identity)
-	if err != nil {
-		log.Printf("An error occured during deleting the condition with id = %d of identity %s: %s\n", conditionID, identity, err.Error())
-	}
-	return err
+	return hdb.with_tx(ctx, func(tx *sql.Tx) error {
+		// the root condition of a rule deletes the rule
+		ruleIDs, err := hdb.get_rule_ids(ctx, tx, "identity=$1 AND condition_id=$2", identity, conditionID)
+		if err != nil {
+			return err
+		}
+		if len(ruleIDs) > 0 {
+			return hdb.delete_rules(ctx, tx, identity, ruleIDs)
+		}
+
+		result, err := tx.ExecContext(ctx, query, conditionID, identity)
+		return affected_or_not_found(result, err, "the condition %d of %s does not exist", conditionID, identity)
+	})
 }
 
 func (hdb *HonuaDatabase) EditCondition(identity string, condition *models.Condition) error {
-	exist, err := hdb.ExistCondition(condition.Id, identity)
+	return hdb.EditConditionContext(context.Background(), identity, condition)
+}
+
+func (hdb *HonuaDatabase) EditConditionContext(ctx context.Context, identity string, condition *models.Condition) (err error) {
+	defer hdb.observe(ctx, "edit_condition", time.Now(), &err, slog.String("identity", identity), slog.Int("condition_id", condition.Id))
+	defer hdb.subscribers.rules_changed(identity, &err)
+	exist, err := hdb.ExistConditionContext(ctx, condition.Id, identity)
 
 	if err != nil {
-		log.Printf("An error occured during editity condition: %s\n", err.Error())
 		return err
 	}
 
 	if !exist {
-		log.Println("This Condition does not exist")
-		return fmt.Errorf("the Condition with a id %d does not exist in %s", condition.Id, identity)
+		return fmt.Errorf("%w: the Condition with a id %d does not exist in %s", ErrNotFound, condition.Id, identity)
 	}
 
 	if condition.Type < models.NUMERICSTATE {
-		hasParent, err := hdb.has_no_parent(condition.Id, identity)
+		hasParent, err := hdb.has_no_parent(ctx, condition.Id, identity)
 		if err != nil {
-			log.Printf("An error occured during editity condition: %s\n", err.Error())
 			return err
 		}
 		if !hasParent {
-			log.Printf("This Condition (%d, %s) has a parent, the condition type of %d is not valid.\n", condition.Id, identity, condition.Type)
-			return fmt.Errorf("this Condition (%d, %s) has a parent, the condition type of %d is not valid", condition.Id, identity, condition.Type)
+			return fmt.Errorf("%w: this Condition (%d, %s) has a parent, the condition type of %d is not valid", ErrInvalidCondition, condition.Id, identity, condition.Type)
 		}
 		query := "UPDATE conditions SET type=$1 WHERE id=$2 AND identity=$3"
 
-		_, err = hdb.db.Exec(query, condition.Type, condition.Id, identity)
+		_, err = hdb.db.ExecContext(ctx, query, condition.Type, condition.Id, identity)
 		if err != nil {
-			log.Printf("An error occured during editity condition: %s\n", err.Error())
-			return err
+			return map_error(err)
 		}
 
 		for _, c := range condition.SubConditions {
-			err = hdb.EditCondition(identity, c)
+			err = hdb.EditConditionContext(ctx, identity, c)
 			if err != nil {
-				log.Printf("An error occured during editity condition: %s\n", err.Error())
 				return err
 			}
 		}
 
 		return nil
-		
+
 	} else {
-		hasParent, err := hdb.has_no_parent(condition.Id, identity)
+		hasParent, err := hdb.has_no_parent(ctx, condition.Id, identity)
 		if err != nil {
-			log.Printf("An error occured during editity condition: %s\n", err.Error())
 			return err
 		}
 		if hasParent {
-			log.Printf("This Condition (%d, %s) hasn't a parent, the condition type of %d is not valid.\n", condition.Id, identity, condition.Type)
-			return fmt.Errorf("this Condition (%d, %s) hasn't a parent, the condition type of %d is not valid", condition.Id, identity, condition.Type)
+			return fmt.Errorf("%w: this Condition (%d, %s) hasn't a parent, the condition type of %d is not valid", ErrInvalidCondition, condition.Id, identity, condition.Type)
 		}
 
-		if condition.Type == models.NUMERICSTATE {
-			query := "UPDATE conditions SET type=$1, sensor_id=$2, below=$3, above=$4 WHERE id=$5 AND identity=$6"
-			var below sql.NullInt32 = sql.NullInt32{}
-			var above sql.NullInt32 = sql.NullInt32{}
+		const query = `UPDATE conditions SET type=$3, sensor_id=$4, before=$5, after=$6, below=$7, above=$8, comparison_state=$9,
+	attribute=$10, template=$11, weekdays=$12, date_from=$13, date_to=$14, for_seconds=$15, from_state=$16, to_state=$17
+WHERE id=$1 AND identity=$2;`
 
-			if condition.Below != nil {
-				below = sql.NullInt32{Valid: condition.Below.Valid, Int32: int32(condition.Below.Value)}
-			}
-
-			if condition.Above != nil {
-				above = sql.NullInt32{Valid: condition.Above.Valid, Int32: int32(condition.Above.Value)}
-			}
-			_, err = hdb.db.Exec(query, condition.Type, condition.Sensor.Id, below, above, condition.Id, identity)
-			if err != nil {
-				log.Printf("An error occured during editity condition: %s\n", err.Error())
-			}
-			return err
-		} else if condition.Type == models.STATE {
-			query := "UPDATE conditions SET type=$1, sensor_id=$2, comparison_state=$3 WHERE id=$4 AND identity=$5"
-			_, err = hdb.db.Exec(query, condition.Type, condition.Sensor.Id, condition.ComparisonState, condition.Id, identity)
-			if err != nil {
-				log.Printf("An error occured during editity condition: %s\n", err.Error())
-			}
+		row, err := leaf_condition_row(condition)
+		if err != nil {
 			return err
-		} else if condition.Type == models.TIME {
-			var before sql.NullString = sql.NullString{
-				Valid:  len(condition.Before) > 0,
-				String: condition.Before,
-			}
-
-			var after sql.NullString = sql.NullString{
-				Valid:  len(condition.After) > 0,
-				String: condition.After,
-			}
-
-			query := "UPDATE conditions SET type=$1, after=$2, before=$3 WHERE id=$4 AND identity=$5"
-
-			_, err := hdb.db.Exec(query, condition.Type, after, before, condition.Id, identity)
-			if err != nil {
-				log.Printf("An error occured during editity condition: %s\n", err.Error())
-			}
+		}
+		if err := hdb.check_references(ctx, hdb.db, identity, condition); err != nil {
 			return err
 		}
-		return fmt.Errorf("the condition type %d is not supported", condition.Type)
+		_, err = hdb.db.ExecContext(ctx, query, condition.Id, identity, row.conditionType, row.sensorID, row.before, row.after, row.below, row.above, row.comparisonState,
+			row.attribute, row.template, row.weekdays, row.dateFrom, row.dateTo, row.forSeconds, row.fromState, row.toState)
+		return map_error(err)
 	}
 }
 
 func (hdb *HonuaDatabase) ExistCondition(conditionID int, identity string) (bool, error) {
+	return hdb.ExistConditionContext(context.Background(), conditionID, identity)
+}
+
+func (hdb *HonuaDatabase) ExistConditionContext(ctx context.Context, conditionID int, identity string) (_ bool, err error) {
+	defer hdb.observe(ctx, "exist_condition", time.Now(), &err, slog.String("identity", identity), slog.Int("condition_id", conditionID))
 	const query = "SELECT CASE WHEN EXISTS ( SELECT * FROM conditions WHERE identity=$1 AND id = $2) THEN true ELSE false END"
 
-	rows, err := hdb.db.Query(query, identity, conditionID)
+	rows, err := hdb.db.QueryContext(ctx, query, identity, conditionID)
 	if err != nil {
-		log.Printf("An error occured during checking if the condition with id %d exists: %s\n", conditionID, err.Error())
-		return false, err
+		return false, map_error(err)
 	}
 
 	var state bool = false
@@ -166,8 +158,7 @@ func (hdb *HonuaDatabase) ExistCondition(conditionID int, identity string) (bool
 		err = rows.Scan(&state)
 		if err != nil {
 			rows.Close()
-			log.Printf("An error occured during checking if the condition with id %d exists: %s\n", conditionID, err.Error())
-			return false, err
+			return false, map_error(err)
 		}
 	}
 
@@ -177,275 +168,472 @@ func (hdb *HonuaDatabase) ExistCondition(conditionID int, identity string) (bool
 }
 
 func (hdb *HonuaDatabase) GetCondition(conditionID int, identity string) (*models.Condition, error) {
+	return hdb.GetConditionContext(context.Background(), conditionID, identity)
+}
+
+func (hdb *HonuaDatabase) GetConditionContext(ctx context.Context, conditionID int, identity string) (_ *models.Condition, err error) {
+	defer hdb.observe(ctx, "get_condition", time.Now(), &err, slog.String("identity", identity), slog.Int("condition_id", conditionID))
 
-	exist, err := hdb.ExistCondition(conditionID, identity)
+	exist, err := hdb.ExistConditionContext(ctx, conditionID, identity)
 	if err != nil {
-		log.Printf("An error occured during getting the condition with id %d: %s\n", conditionID, err.Error())
 		return nil, err
 	}
 
 	if !exist {
-		log.Printf("the condition with id = %d does not exist!\n", conditionID)
-		return nil, fmt.Errorf("the condition with id = %d does not exist", conditionID)
+		return nil, fmt.Errorf("%w: the condition with id = %d does not exist", ErrNotFound, conditionID)
 	}
 
-	const query = "SELECT * FROM conditions WHERE identity =$1 AND id=$2;"
-
-	rows, err := hdb.db.Query(query, identity, conditionID)
+	trees, err := hdb.get_condition_trees(ctx, hdb.db, identity, []int{conditionID})
 	if err != nil {
-		log.Printf("An error occured during getting the condition with id %d: %s\n", conditionID, err.Error())
 		return nil, err
 	}
 
-	var result *models.Condition
-
-	for rows.Next() {
-		condition, err := hdb.make_condition(rows)
-		if err != nil {
-			rows.Close()
-			log.Printf("An error occured during getting the condition with id %d: %s\n", conditionID, err.Error())
-			return nil, err
-		}
+	return trees[conditionID], nil
+}
 
-		result = condition
+func (hdb *HonuaDatabase) add_subcondition(ctx context.Context, q querier, identity string, condition *models.Condition, parentID int) error {
+	id, err := hdb.next_id(ctx, q, identity, "conditions")
+	if err != nil {
+		return err
 	}
+	row, err := leaf_condition_row(condition)
+	if err != nil {
+		return err
+	}
+	if err := hdb.check_references(ctx, q, identity, condition); err != nil {
+		return err
+	}
+	row.id = id
+	row.parentID = null_int(parentID)
 
-	rows.Close()
-
-	return result, nil
+	_, err = q.ExecContext(ctx, add_condition_query, append([]any{identity}, row.values()...)...)
+	return map_error(err)
 }
 
-func (hdb *HonuaDatabase) get_condition_id(identifier string) (int, error) {
-	query := "SELECT CASE WHEN EXISTS ( SELECT * FROM conditions WHERE identity = $1) THEN true ELSE false END"
+// get_condition_trees loads the conditions rootIDs with all their subconditions
+// using one recursive query. The sensors are loaded with a second query.
+func (hdb *HonuaDatabase) get_condition_trees(ctx context.Context, q querier, identity string, rootIDs []int) (map[int]*models.Condition, error) {
+	const query = `
+WITH RECURSIVE tree AS (
+	SELECT identity, ` + condition_columns + `
+	FROM conditions WHERE identity = $1 AND id = ANY($2)
+	UNION ALL
+	SELECT c.identity, ` + prefixed_condition_columns + `
+	FROM conditions c JOIN tree t ON c.identity = t.identity AND c.parent_id = t.id
+)
+SELECT ` + condition_columns + ` FROM tree ORDER BY id;`
 
-	rows, err := hdb.db.Query(query, identifier)
-	if err != nil {
-		log.Printf("An error occured during getting id of condition in %s: %s\n", identifier, err.Error())
-		return -1, err
+	var result map[int]*models.Condition = map[int]*models.Condition{}
+	if len(rootIDs) == 0 {
+		return result, nil
 	}
 
-	var exist_identity bool = false
+	rows, err := q.QueryContext(ctx, query, identity, pq.Array(rootIDs))
+	if err != nil {
+		return nil, map_error(err)
+	}
 
+	var conditionRows []*conditionRow
+	var sensorIDs []int
 	for rows.Next() {
-		err = rows.Scan(&exist_identity)
+		row := &conditionRow{}
+		err = rows.Scan(row.fields()...)
 		if err != nil {
 			rows.Close()
-			log.Printf("An error occured during getting id of enconditiontity in %s: %s\n", identifier, err.Error())
-			return -1, err
+			return nil, map_error(err)
+		}
+		if row.sensorID.Valid {
+			sensorIDs = append(sensorIDs, int(row.sensorID.Int32))
 		}
+		conditionRows = append(conditionRows, row)
 	}
-
 	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, map_error(err)
+	}
 
-	if !exist_identity {
-		return 0, nil
+	sensors, err := hdb.get_entities_by_id(ctx, q, identity, sensorIDs)
+	if err != nil {
+		return nil, err
 	}
 
-	query = "SELECT MAX(id) FROM conditions WHERE identity = $1;"
+	for _, id := range rootIDs {
+		condition, err := make_condition_tree(conditionRows, sensors, id)
+		if err != nil {
+			return nil, err
+		}
+		result[id] = condition
+	}
+	return result, nil
+}
 
-	rows, err = hdb.db.Query(query, identifier)
+func (hdb *HonuaDatabase) has_no_parent(ctx context.Context, conditionID int, identity string) (bool, error) {
+	const query = "SELECT parent_id FROM conditions WHERE identity = $1 AND id = $2"
+	rows, err := hdb.db.QueryContext(ctx, query, identity, conditionID)
 	if err != nil {
-		log.Printf("An error occured during getting id of condition in %s: %s\n", identifier, err.Error())
-		return -1, err
+		return false, map_error(err)
 	}
 
-	var id int = -1
-
+	var state bool = false
 	for rows.Next() {
-		err = rows.Scan(&id)
+		var pid sql.NullInt32
+		err = rows.Scan(&pid)
 		if err != nil {
 			rows.Close()
-			log.Printf("An error occured during getting id of condition in %s: %s\n", identifier, err.Error())
-			return -1, err
+			return false, map_error(err)
 		}
+		state = !pid.Valid
 	}
-	rows.Close()
 
-	if id == -1 {
-		return -1, errors.New("something went wrong during getting id of condition")
-	}
+	rows.Close()
 
-	id = id + 1
+	return state, nil
+}
 
-	return id, nil
+// conditionRow is a row of the table conditions
+type conditionRow struct {
+	id              int
+	conditionType   models.ConditionType
+	sensorID        sql.NullInt32
+	before          sql.NullString
+	after           sql.NullString
+	below           sql.NullFloat64
+	above           sql.NullFloat64
+	comparisonState sql.NullString
+	parentID        sql.NullInt32
+	attribute       sql.NullString
+	template        sql.NullString
+	weekdays        sql.NullInt32
+	dateFrom        sql.NullString
+	dateTo          sql.NullString
+	forSeconds      sql.NullInt32
+	fromState       sql.NullString
+	toState         sql.NullString
 }
 
-func (hdb *HonuaDatabase) add_subcondition(identity string, condition *models.Condition, parentID int) error {
-	id, err := hdb.get_condition_id(identity)
-	if err != nil {
-		log.Printf("An error occured during adding a new condition: %s\n", err.Error())
-		return err
+// condition_columns are the columns of a conditionRow, in the order of fields and values
+const condition_columns = `id, type, sensor_id, before, after, below, above, comparison_state, parent_id,
+	attribute, template, weekdays, date_from, date_to, for_seconds, from_state, to_state`
+
+const prefixed_condition_columns = `c.id, c.type, c.sensor_id, c.before, c.after, c.below, c.above, c.comparison_state, c.parent_id,
+	c.attribute, c.template, c.weekdays, c.date_from, c.date_to, c.for_seconds, c.from_state, c.to_state`
+
+func (row *conditionRow) fields() []any {
+	return []any{
+		&row.id, &row.conditionType, &row.sensorID, &row.before, &row.after, &row.below, &row.above, &row.comparisonState, &row.parentID,
+		&row.attribute, &row.template, &row.weekdays, &row.dateFrom, &row.dateTo, &row.forSeconds, &row.fromState, &row.toState,
 	}
-	log.Printf("Parent: %d || ID: %d\n", parentID, id)
-	if condition.Type == models.NUMERICSTATE {
-		var below sql.NullInt32 = sql.NullInt32{}
-		var above sql.NullInt32 = sql.NullInt32{}
+}
 
-		if condition.Below != nil {
-			below = sql.NullInt32{Valid: condition.Below.Valid, Int32: int32(condition.Below.Value)}
-		}
+func (row *conditionRow) values() []any {
+	return []any{
+		row.id, row.conditionType, row.sensorID, row.before, row.after, row.below, row.above, row.comparisonState, row.parentID,
+		row.attribute, row.template, row.weekdays, row.dateFrom, row.dateTo, row.forSeconds, row.fromState, row.toState,
+	}
+}
 
-		if condition.Above != nil {
-			above = sql.NullInt32{Valid: condition.Above.Valid, Int32: int32(condition.Above.Value)}
-		}
+// leaf_condition_row fills the columns of a condition that is not AND, OR,
+// NAND or NOR, the entities of a template and the attribute of the sensor
+// are checked by the caller
+func leaf_condition_row(condition *models.Condition) (*conditionRow, error) {
+	row := &conditionRow{id: condition.Id, conditionType: condition.Type}
 
-		_, err = hdb.db.Exec(add_condition_query, id, identity, condition.Type, condition.Sensor.Id, sql.NullString{}, sql.NullString{}, below, above, sql.NullString{}, parentID)
-		if err != nil {
-			log.Printf("Error during adding new condition to table: %s\n", err.Error())
+	switch condition.Type {
+	case models.NUMERICSTATE:
+		if err := check_thresholds(condition); err != nil {
+			return nil, err
 		}
-		return err
-	} else if condition.Type == models.STATE {
-		_, err := hdb.db.Exec(add_condition_query, id, identity, condition.Type, condition.Sensor.Id, sql.NullString{}, sql.NullString{}, sql.NullInt32{}, sql.NullInt32{}, condition.ComparisonState, parentID)
-		if err != nil {
-			log.Printf("Error during adding new condition to table: %s\n", err.Error())
+		row.below = threshold(condition.Below)
+		row.above = threshold(condition.Above)
+	case models.STATE:
+		row.comparisonState = sql.NullString{Valid: true, String: condition.ComparisonState}
+	case models.FROM_TO:
+		if len(condition.FromState) == 0 && len(condition.ToState) == 0 {
+			return nil, fmt.Errorf("%w: a from_to condition needs a from or a to state", ErrInvalidCondition)
 		}
-		return err
-	} else if condition.Type == models.TIME {
-		var before sql.NullString = sql.NullString{
-			Valid:  len(condition.Before) > 0,
-			String: condition.Before,
+		if condition.FromState == condition.ToState {
+			return nil, fmt.Errorf("%w: the from and the to state of a from_to condition are the same", ErrInvalidCondition)
 		}
-
-		var after sql.NullString = sql.NullString{
-			Valid:  len(condition.After) > 0,
-			String: condition.After,
+		row.fromState = sql.NullString{Valid: len(condition.FromState) > 0, String: condition.FromState}
+		row.toState = sql.NullString{Valid: len(condition.ToState) > 0, String: condition.ToState}
+	case models.TIME:
+		if err := row.set_time(condition); err != nil {
+			return nil, err
 		}
-		_, err := hdb.db.Exec(add_condition_query, id, identity, condition.Type, sql.NullInt32{}, before, after, sql.NullInt32{}, sql.NullInt32{}, sql.NullString{}, parentID)
-		if err != nil {
-			log.Printf("Error during adding new condition to table: %s\n", err.Error())
+	case models.TEMPLATE:
+		if _, err := parse_template(condition.Template); err != nil {
+			return nil, err
 		}
-		return err
+		row.template = sql.NullString{Valid: true, String: condition.Template}
+	default:
+		return nil, fmt.Errorf("%w: the condition type %d is not supported", ErrUnsupportedType, condition.Type)
 	}
 
-	log.Printf("Error during adding new condition to table: ConditionType %d not supported.\n", condition.Type)
-	return fmt.Errorf("error during adding new condition to table: ConditionType %d not supported", condition.Type)
-}
-
-func (hdb *HonuaDatabase) get_subconditions(parentID int) ([]*models.Condition, error) {
-	const query = "SELECT * FROM conditions WHERE parent_id=$1;"
-
-	rows, err := hdb.db.Query(query, parentID)
-	if err != nil {
-		log.Printf("An error occured during getting all subconditions of condition with id %d: %s\n", parentID, err.Error())
-		return nil, err
-	}
-
-	var result []*models.Condition = []*models.Condition{}
-
-	for rows.Next() {
-		condition, err := hdb.make_condition(rows)
-		if err != nil {
-			rows.Close()
-			log.Printf("An error occured during getting all subconditions of condition with id %d: %s\n", parentID, err.Error())
-			return nil, err
+	if !has_sensor(condition.Type) {
+		if condition.For != 0 {
+			return nil, fmt.Errorf("%w: only sensor conditions can have a duration", ErrInvalidCondition)
 		}
-
-		result = append(result, condition)
+		return row, nil
 	}
 
-	rows.Close()
+	if condition.Sensor == nil {
+		return nil, fmt.Errorf("%w: the condition has no sensor", ErrInvalidCondition)
+	}
+	if condition.For < 0 || condition.For%time.Second != 0 {
+		return nil, fmt.Errorf("%w: the duration %v is not a positive number of seconds", ErrInvalidCondition, condition.For)
+	}
+	row.sensorID = null_int(condition.Sensor.Id)
+	row.attribute = sql.NullString{Valid: len(condition.Attribute) > 0, String: condition.Attribute}
+	if condition.For > 0 {
+		row.forSeconds = null_int(int(condition.For / time.Second))
+	}
+	return row, nil
+}
 
-	return result, nil
+// has_sensor is true for the condition types that compare the state of a sensor
+func has_sensor(conditionType models.ConditionType) bool {
+	return conditionType == models.NUMERICSTATE || conditionType == models.STATE || conditionType == models.FROM_TO
 }
 
-func (hdb HonuaDatabase) has_no_parent(conditionID int, identity string) (bool, error) {
-	const query = "SELECT parent_id FROM conditions WHERE identity = $1 AND id = $2"
-	rows, err := hdb.db.Query(query, identity, conditionID)
-	if err != nil {
-		log.Printf("An error occured during checking if the codntion %d has a parent in %s: %s\n", conditionID, identity, err.Error())
-		return false, err
-	}
+// make_condition_tree builds the condition rootID out of the rows of its tree,
+// sensors contains the entities the rows refer to
+func make_condition_tree(rows []*conditionRow, sensors map[int]*models.Entity, rootID int) (*models.Condition, error) {
+	var root *conditionRow
+	var children map[int][]*conditionRow = map[int][]*conditionRow{}
 
-	var state bool = false
-	for rows.Next() {
-		var pid sql.NullInt32
-		err = rows.Scan(&pid)
-		if err != nil {
-			rows.Close()
-			log.Printf("An error occured during checking if the codntion %d has a parent in %s: %s\n", conditionID, identity, err.Error())
-			return false, err
+	for _, row := range rows {
+		if row.id == rootID {
+			root = row
+		}
+		if row.parentID.Valid {
+			children[int(row.parentID.Int32)] = append(children[int(row.parentID.Int32)], row)
 		}
-		state = !pid.Valid
 	}
-
-	return state, nil
-}
-
-func (hdb *HonuaDatabase) make_condition(rows *sql.Rows) (*models.Condition, error) {
-	var identity string
-	var id int
-	var conditionType models.ConditionType
-	var sensorID sql.NullInt32
-	var before sql.NullString
-	var after sql.NullString
-	var below sql.NullInt32
-	var above sql.NullInt32
-	var comparisonState sql.NullString
-	var parentID sql.NullInt32
-
-	err := rows.Scan(&id, &identity, &conditionType, &sensorID, &before, &after, &below, &above, &comparisonState, &parentID)
-	if err != nil {
-		return nil, err
+	if root == nil {
+		return nil, fmt.Errorf("%w: the condition with id = %d does not exist", ErrNotFound, rootID)
 	}
+	return make_condition(root, children, sensors)
+}
 
-	if conditionType < models.NUMERICSTATE {
-		sub, err := hdb.get_subconditions(id)
-		if err != nil {
-			return nil, err
+func make_condition(row *conditionRow, children map[int][]*conditionRow, sensors map[int]*models.Entity) (*models.Condition, error) {
+	if row.conditionType < models.NUMERICSTATE {
+		var sub []*models.Condition = []*models.Condition{}
+		for _, child := range children[row.id] {
+			condition, err := make_condition(child, children, sensors)
+			if err != nil {
+				return nil, err
+			}
+			sub = append(sub, condition)
 		}
 		return &models.Condition{
-			Id:            id,
-			Type:          conditionType,
+			Id:            row.id,
+			Type:          row.conditionType,
 			SubConditions: sub,
 		}, nil
 	}
 
-	if conditionType == models.NUMERICSTATE {
-		if !sensorID.Valid || !(above.Valid || below.Valid) {
-			return nil, errors.New("numeric_state condition is not valid")
+	if row.conditionType == models.NUMERICSTATE {
+		if !row.sensorID.Valid || !(row.above.Valid || row.below.Valid) {
+			return nil, fmt.Errorf("%w: numeric_state condition %d is not valid", ErrInvalidCondition, row.id)
 		}
 
-		sensor, err := hdb.GetEntity(identity, int(sensorID.Int32))
+		sensor, err := get_sensor(sensors, row)
 		if err != nil {
 			return nil, err
 		}
 
 		// Assertion: Numeric State is Valid
 		return &models.Condition{
-			Id:     id,
-			Type:   conditionType,
-			Sensor: sensor,
-			Above:  &models.ConditionValue{Valid: above.Valid, Value: int(above.Int32)},
-			Below:  &models.ConditionValue{Valid: below.Valid, Value: int(below.Int32)},
+			Id:        row.id,
+			Type:      row.conditionType,
+			Sensor:    sensor,
+			Above:     &models.ConditionValue{Valid: row.above.Valid, Value: row.above.Float64},
+			Below:     &models.ConditionValue{Valid: row.below.Valid, Value: row.below.Float64},
+			Attribute: row.attribute.String,
+			For:       time.Duration(row.forSeconds.Int32) * time.Second,
 		}, nil
-	} else if conditionType == models.STATE {
-		if !sensorID.Valid || !comparisonState.Valid {
-			return nil, errors.New("state condition is not valid")
+	} else if row.conditionType == models.STATE {
+		if !row.sensorID.Valid || !row.comparisonState.Valid {
+			return nil, fmt.Errorf("%w: state condition %d is not valid", ErrInvalidCondition, row.id)
 		}
 
-		sensor, err := hdb.GetEntity(identity, int(sensorID.Int32))
+		sensor, err := get_sensor(sensors, row)
 		if err != nil {
 			return nil, err
 		}
 
 		return &models.Condition{
-			Id:              id,
-			Type:            conditionType,
+			Id:              row.id,
+			Type:            row.conditionType,
 			Sensor:          sensor,
-			ComparisonState: comparisonState.String,
+			ComparisonState: row.comparisonState.String,
+			Attribute:       row.attribute.String,
+			For:             time.Duration(row.forSeconds.Int32) * time.Second,
 		}, nil
-	} else if conditionType == models.TIME {
-		if !(after.Valid || before.Valid) {
-			return nil, errors.New("time condition is not valid")
+	} else if row.conditionType == models.FROM_TO {
+		if !row.sensorID.Valid || !(row.fromState.Valid || row.toState.Valid) {
+			return nil, fmt.Errorf("%w: from_to condition %d is not valid", ErrInvalidCondition, row.id)
+		}
+
+		sensor, err := get_sensor(sensors, row)
+		if err != nil {
+			return nil, err
+		}
+
+		return &models.Condition{
+			Id:        row.id,
+			Type:      row.conditionType,
+			Sensor:    sensor,
+			FromState: row.fromState.String,
+			ToState:   row.toState.String,
+			Attribute: row.attribute.String,
+			For:       time.Duration(row.forSeconds.Int32) * time.Second,
+		}, nil
+	} else if row.conditionType == models.TIME {
+		if !(row.after.Valid || row.before.Valid || row.weekdays.Valid || row.dateFrom.Valid) {
+			return nil, fmt.Errorf("%w: time condition %d is not valid", ErrInvalidCondition, row.id)
+		}
+		tc, err := make_time_condition(row)
+		if err != nil {
+			return nil, err
 		}
 		// Assertion: time condition is valid
 		return &models.Condition{
-			Id:     id,
-			Type:   conditionType,
-			After:  after.String,
-			Before: before.String,
+			Id:     row.id,
+			Type:   row.conditionType,
+			After:  row.after.String,
+			Before: row.before.String,
+			Time:   tc,
+		}, nil
+	} else if row.conditionType == models.TEMPLATE {
+		if !row.template.Valid {
+			return nil, fmt.Errorf("%w: template condition %d is not valid", ErrInvalidCondition, row.id)
+		}
+		return &models.Condition{
+			Id:       row.id,
+			Type:     row.conditionType,
+			Template: row.template.String,
 		}, nil
 	}
 
-	return nil, fmt.Errorf("condition type %d not supported", conditionType)
+	return nil, fmt.Errorf("%w: condition type %d not supported", ErrUnsupportedType, row.conditionType)
+}
+
+// get_sensor returns a copy of the sensor of the condition row
+func get_sensor(sensors map[int]*models.Entity, row *conditionRow) (*models.Entity, error) {
+	sensor, ok := sensors[int(row.sensorID.Int32)]
+	if !ok {
+		return nil, fmt.Errorf("%w: the sensor %d of condition %d does not exist", ErrNotFound, row.sensorID.Int32, row.id)
+	}
+	result := *sensor
+	return &result, nil
+}
+
+// threshold converts the above or below value of a numeric state condition into its column value
+func threshold(v *models.ConditionValue) sql.NullFloat64 {
+	if v == nil {
+		return sql.NullFloat64{}
+	}
+	return sql.NullFloat64{Valid: v.Valid, Float64: v.Value}
+}
+
+// check_thresholds checks that a numeric state condition has a finite above or
+// below value and that above is less than below if both are set
+func check_thresholds(condition *models.Condition) error {
+	above := threshold(condition.Above)
+	below := threshold(condition.Below)
+	if !above.Valid && !below.Valid {
+		return fmt.Errorf("%w: a numeric_state condition needs an above or a below value", ErrInvalidCondition)
+	}
+	for _, v := range []sql.NullFloat64{above, below} {
+		if v.Valid && (math.IsNaN(v.Float64) || math.IsInf(v.Float64, 0)) {
+			return fmt.Errorf("%w: the threshold %v of a numeric_state condition is not a finite number", ErrInvalidCondition, v.Float64)
+		}
+	}
+	if above.Valid && below.Valid && above.Float64 >= below.Float64 {
+		return fmt.Errorf("%w: above (%v) must be less than below (%v)", ErrInvalidCondition, above.Float64, below.Float64)
+	}
+	return nil
+}
+
+// parse_template parses the expression of a template condition
+func parse_template(template string) (*expression.Expression, error) {
+	expr, err := expression.Parse(template)
+	if err != nil {
+		return nil, fmt.Errorf("%w: the template %q: %v", ErrInvalidCondition, template, err)
+	}
+	return expr, nil
+}
+
+// check_references checks the entities of a template condition and that the
+// sensor of a condition records its attribute
+func (hdb *HonuaDatabase) check_references(ctx context.Context, q querier, identity string, condition *models.Condition) error {
+	if condition.Type == models.TEMPLATE {
+		return hdb.check_template(ctx, q, identity, condition.Template)
+	}
+	if condition.Attribute == "" || condition.Sensor == nil {
+		return nil
+	}
+	sensors, err := hdb.get_entities_by_id(ctx, q, identity, []int{condition.Sensor.Id})
+	if err != nil {
+		return err
+	}
+	sensor, ok := sensors[condition.Sensor.Id]
+	if !ok {
+		// the foreign key of the sensor fails
+		return nil
+	}
+	return check_attribute(condition, sensor)
+}
+
+// check_attribute checks that the sensor records the attribute of the
+// condition, the states table holds only one value per entity
+func check_attribute(condition *models.Condition, sensor *models.Entity) error {
+	if condition.Attribute == "" || (sensor.HasAttribute && sensor.Attribute == condition.Attribute) {
+		return nil
+	}
+	return fmt.Errorf("%w: the sensor %s does not record the attribute %s", ErrInvalidCondition, sensor.EntityId, condition.Attribute)
+}
+
+// check_template parses the template and checks that the entities it uses exist
+func (hdb *HonuaDatabase) check_template(ctx context.Context, q querier, identity string, template string) error {
+	expr, err := parse_template(template)
+	if err != nil {
+		return err
+	}
+	known, err := hdb.known_entities(ctx, q, identity, expr.Entities())
+	if err != nil {
+		return err
+	}
+	return check_template_entities(expr, known)
+}
+
+// known_entities returns which of the Home Assistant entity ids are entities of the identity
+func (hdb *HonuaDatabase) known_entities(ctx context.Context, q querier, identity string, entityIDs []string) (map[string]bool, error) {
+	const query = "SELECT entity_id FROM entities WHERE identity=$1 AND entity_id = ANY($2);"
+
+	rows, err := q.QueryContext(ctx, query, identity, pq.Array(entityIDs))
+	if err != nil {
+		return nil, map_error(err)
+	}
+	var known map[string]bool = map[string]bool{}
+	for rows.Next() {
+		var entityID string
+		if err = rows.Scan(&entityID); err != nil {
+			rows.Close()
+			return nil, map_error(err)
+		}
+		known[entityID] = true
+	}
+	rows.Close()
+	return known, nil
+}
+
+func check_template_entities(expr *expression.Expression, known map[string]bool) error {
+	for _, name := range expr.Entities() {
+		if !known[name] {
+			return fmt.Errorf("%w: the entity %s of the template %q does not exist", ErrInvalidCondition, name, expr)
+		}
+	}
+	return nil
 }
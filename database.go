@@ -1,81 +1,213 @@
 package honuadatabase
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"log"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"os"
+	"time"
 
 	_ "github.com/lib/pq"
 )
 
 type HonuaDatabase struct {
-	db *sql.DB
-	//mutex       sync.Mutex
-	pathToFiles string
+	db     *sql.DB
+	files  fs.FS
+	logger *slog.Logger
+	// subscribers are notified about new states and changed rules
+	subscribers subscribers
+}
+
+// Config contains everything that is needed to open a HonuaDatabase with New.
+type Config struct {
+	// DSN is a complete connection string. If it is empty, the connection string
+	// is built from User, Password, Host, Port, DBName and SSLMode.
+	DSN      string
+	User     string
+	Password string
+	Host     string
+	Port     string
+	DBName   string
+	// SSLMode is the sslmode of the connection, default is disable
+	SSLMode string
+
+	// Pool settings, zero values keep the defaults of database/sql
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+
+	// FS contains create.sql and the migrations. If it is nil, PathToFiles
+	// is used, and if that is empty too, the files embedded in the package.
+	FS fs.FS
+	// PathToFiles is a folder containing create.sql and the migrations
+	PathToFiles string
+
+	// Logger used by the database, default is a logger that discards everything.
+	// Failed queries are logged at error level, all other queries at debug level.
+	Logger *slog.Logger
+}
+
+func (c *Config) dsn() string {
+	if c.DSN != "" {
+		return c.DSN
+	}
+
+	var sslmode string = c.SSLMode
+	if sslmode == "" {
+		sslmode = "disable"
+	}
+
+	u := url.URL{
+		Scheme:   "postgresql",
+		User:     url.UserPassword(c.User, c.Password),
+		Host:     fmt.Sprintf("%s:%s", c.Host, c.Port),
+		Path:     "/" + c.DBName,
+		RawQuery: url.Values{"sslmode": []string{sslmode}}.Encode(),
+	}
+	return u.String()
+}
+
+func (c *Config) files() fs.FS {
+	if c.FS != nil {
+		return c.FS
+	}
+	if c.PathToFiles != "" {
+		return os.DirFS(c.PathToFiles)
+	}
+	return EmbeddedFiles()
+}
+
+// New opens a new connection to the database described by config, creates the
+// tables and runs the migrations. Every call returns an independent handle.
+func New(ctx context.Context, config Config) (*HonuaDatabase, error) {
+	var logger *slog.Logger = config.Logger
+	if logger == nil {
+		logger = DiscardLogger()
+	}
+
+	db, err := sql.Open("postgres", config.dsn())
+	if err != nil {
+		return nil, fmt.Errorf("opening the database connection: %w", err)
+	}
+
+	if config.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(config.MaxOpenConns)
+	}
+	if config.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(config.MaxIdleConns)
+	}
+	if config.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(config.ConnMaxLifetime)
+	}
+	if config.ConnMaxIdleTime > 0 {
+		db.SetConnMaxIdleTime(config.ConnMaxIdleTime)
+	}
+
+	if err = db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("connecting to the database: %w", err)
+	}
+	logger.InfoContext(ctx, "The Database connection is established", slog.String("host", config.Host), slog.String("database", config.DBName))
+
+	hdb := &HonuaDatabase{
+		db:     db,
+		files:  config.files(),
+		logger: logger,
+	}
+
+	if err = hdb.CreateTablesContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating the tables: %w", err)
+	}
+	if err = hdb.MigrateContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating the database: %w", err)
+	}
+
+	return hdb, nil
+}
+
+// querier is implemented by *sql.DB and *sql.Tx, so the private methods
+// can be used inside and outside of a transaction
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// with_tx runs fn in a transaction. The transaction is committed if fn
+// returns nil, otherwise it is rolled back.
+func (hdb *HonuaDatabase) with_tx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := hdb.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("beginning the transaction: %w", err)
+	}
+
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("committing the transaction: %w", err)
+	}
+	return nil
 }
 
 var instance *HonuaDatabase
 
 // Gibt die aktuelle Datenbank Instanz zurück
 // Falls noch keine existiert, dann wird eine neue erstellt, dafür muss man die Parameter übergeben
+//
+// Deprecated: use New, which returns errors instead of panicking and allows multiple handles.
 func GetHonuaDatabaseInstance(user, password, host, port, dbname, pathToFiles string) *HonuaDatabase {
 	if instance == nil {
-		var connStr = fmt.Sprintf("postgresql://%s:%s@%s:%s/%s?sslmode=disable", user, password, host, port, dbname)
-		db, err := sql.Open("postgres", connStr)
+		hdb, err := New(context.Background(), Config{
+			User:        user,
+			Password:    password,
+			Host:        host,
+			Port:        port,
+			DBName:      dbname,
+			PathToFiles: pathToFiles,
+		})
 		if err != nil {
 			panic(err) // If any error occure Panic
 		}
-		if err = db.Ping(); err != nil {
-			panic(err) // If any error occure Panic
-		}
-		log.Println("The Database connection is established")
-		instance = &HonuaDatabase{
-			db: db,
-			//mutex:       sync.Mutex{},
-			pathToFiles: pathToFiles,
-		}
-		err = instance.CreateTables()
-		if err != nil {
-			panic(err) // If any error occure Panic
-		}
-		instance.Migrate()
+		instance = hdb
 	}
 	return instance
 }
 
 // Führt im Ordner der Instanz die create.sql file aus
-// Dazu wird die File eingelesen und in Statements unterteilt.
-// Jedes Statement wird dann ausgeführt. Dadurch, dass die Create Table Statements
+// Die File wird als Ganzes ausgeführt. Dadurch, dass die Create Table Statements
 // mit einem IF NOT EXIST verbunden sind sollte es keine Fehler geben, wenn diese
 // Methode öfter ausgeführt wird.
 func (hdb *HonuaDatabase) CreateTables() error {
-	stmts, err := read_and_parse_sql_file(fmt.Sprintf("%s/create.sql", hdb.pathToFiles))
+	return hdb.CreateTablesContext(context.Background())
+}
+
+func (hdb *HonuaDatabase) CreateTablesContext(ctx context.Context) error {
+	content, err := fs.ReadFile(hdb.files, "create.sql")
 	if err != nil {
-		log.Printf("Error while reading file %s/create.sql: %s\n", hdb.pathToFiles, err.Error())
+		hdb.logger.ErrorContext(ctx, "Error while reading file create.sql", slog.Any("error", err))
 		return err
 	}
-	for _, stmt := range stmts {
-		_, err := hdb.db.Exec(stmt)
-		if err != nil {
-			log.Printf("Error while executing statement %s: %s\n", stmt, err.Error())
-			return err
-		}
-	}
-
-	exists, err := hdb.exists_metadata(fmt.Sprintf("%s/create.sql", hdb.pathToFiles))
+	_, err = hdb.db.ExecContext(ctx, string(content))
 	if err != nil {
+		hdb.logger.ErrorContext(ctx, "Error while executing create.sql", slog.Any("error", err))
 		return err
 	}
-
-	if !exists {
-		hdb.write_metadata(fmt.Sprintf("%s/create.sql", hdb.pathToFiles))
-	}
-
 	return nil
 }
 
 func (hd *HonuaDatabase) CloseDatabase() {
 	hd.db.Close()
-	instance = nil
-	log.Println("The Database Connection is closed")
+	if instance == hd {
+		instance = nil
+	}
+	hd.logger.Info("The Database Connection is closed")
 }
@@ -1,32 +1,36 @@
 package honuadatabase
 
 import (
-	"errors"
+	"context"
+	"database/sql"
 	"fmt"
-	"log"
+	"log/slog"
+	"time"
 
 	"github.com/JonasBordewick/honua-database/models"
 )
 
 func (hdb *HonuaDatabase) GetDelay(identifier string, delayID int) (*models.Delay, error) {
-	exist, err := hdb.ExistDelay(identifier, delayID)
+	return hdb.GetDelayContext(context.Background(), identifier, delayID)
+}
+
+func (hdb *HonuaDatabase) GetDelayContext(ctx context.Context, identifier string, delayID int) (_ *models.Delay, err error) {
+	defer hdb.observe(ctx, "get_delay", time.Now(), &err, slog.String("identity", identifier), slog.Int("delay_id", delayID))
+	exist, err := hdb.ExistDelayContext(ctx, identifier, delayID)
 
 	if err != nil {
-		log.Printf("An error occured during getting delay %d of %s: %s\n", delayID, identifier, err.Error())
 		return nil, err
 	}
 
 	if !exist {
-		log.Printf("The delay %d of %s does not exist.\n", delayID, identifier)
-		return nil, fmt.Errorf("the delay %d of %s does not exist", delayID, identifier)
+		return nil, fmt.Errorf("%w: the delay %d of %s does not exist", ErrNotFound, delayID, identifier)
 	}
 
 	const query = "SELECT * from delays WHERE id=$1 AND identity=$2;"
 
-	rows, err := hdb.db.Query(query, delayID, identifier)
+	rows, err := hdb.db.QueryContext(ctx, query, delayID, identifier)
 	if err != nil {
-		log.Printf("An error occured during getting delay %d of %s: %s\n", delayID, identifier, err.Error())
-		return nil, err
+		return nil, map_error(err)
 	}
 
 	var result *models.Delay
@@ -40,8 +44,7 @@ func (hdb *HonuaDatabase) GetDelay(identifier string, delayID int) (*models.Dela
 		err := rows.Scan(&id, &identity, &hours, &minutes, &seconds)
 		if err != nil {
 			rows.Close()
-			log.Printf("An error occured during getting delay %d of %s: %s\n", delayID, identifier, err.Error())
-			return nil, err
+			return nil, map_error(err)
 		}
 
 		result = &models.Delay{
@@ -55,63 +58,76 @@ func (hdb *HonuaDatabase) GetDelay(identifier string, delayID int) (*models.Dela
 	rows.Close()
 
 	if result == nil {
-		log.Printf("An error occured during getting delay %d of %s: %s\n", delayID, identifier, err.Error())
-		return nil, fmt.Errorf("an error occured during getting delay %d of %s: %s", delayID, identifier, err.Error())
+		return nil, fmt.Errorf("%w: the delay %d of %s does not exist", ErrNotFound, delayID, identifier)
 	}
 
 	return result, nil
 }
 
 func (hdb *HonuaDatabase) AddDelay(identity string, delay *models.Delay) (int, error) {
+	return hdb.AddDelayContext(context.Background(), identity, delay)
+}
+
+func (hdb *HonuaDatabase) AddDelayContext(ctx context.Context, identity string, delay *models.Delay) (_ int, err error) {
+	defer hdb.observe(ctx, "add_delay", time.Now(), &err, slog.String("identity", identity))
+	return hdb.add_delay(ctx, hdb.db, identity, delay)
+}
+
+func (hdb *HonuaDatabase) add_delay(ctx context.Context, q querier, identity string, delay *models.Delay) (int, error) {
 	const query = "INSERT INTO delays(id, identity, hours, minutes, seconds) VALUES ($1, $2, $3, $4, $5);"
-	id, err := hdb.get_delay_id(identity)
+	id, err := hdb.next_id(ctx, q, identity, "delays")
 	if err != nil {
-		log.Printf("An error occured during adding a new delay: %s\n", err.Error())
 		return -1, err
 	}
 
-	_, err = hdb.db.Exec(query, id, identity, delay.Hours, delay.Minutes, delay.Seconds)
+	_, err = q.ExecContext(ctx, query, id, identity, delay.Hours, delay.Minutes, delay.Seconds)
 	if err != nil {
-		log.Printf("An error occured during adding a new delay: %s\n", err.Error())
-		return -1, err
+		return -1, map_error(err)
 	}
 	return id, nil
 }
 
 func (hdb *HonuaDatabase) EditDelay(identity string, delay *models.Delay) error {
-	exist, err := hdb.ExistDelay(identity, delay.Id)
+	return hdb.EditDelayContext(context.Background(), identity, delay)
+}
+
+func (hdb *HonuaDatabase) EditDelayContext(ctx context.Context, identity string, delay *models.Delay) (err error) {
+	defer hdb.observe(ctx, "edit_delay", time.Now(), &err, slog.String("identity", identity), slog.Int("delay_id", delay.Id))
+	exist, err := hdb.ExistDelayContext(ctx, identity, delay.Id)
 	if err != nil {
-		log.Printf("Error during editing delay %d of %s: %s\n", delay.Id, identity, err.Error())
 		return err
 	}
 	if !exist {
-		log.Printf("The delay %d of %s does not exist\n", delay.Id, identity)
-		return fmt.Errorf("the delay %d of %s does not exist", delay.Id, identity)
+		return fmt.Errorf("%w: the delay %d of %s does not exist", ErrNotFound, delay.Id, identity)
 	}
 	const query = "UPDATE delays SET hours=$1, minutes=$2, seconds=$3 WHERE id=$4 AND identity=$5;"
-	_, err = hdb.db.Exec(query, delay.Hours, delay.Minutes, delay.Seconds, delay.Id, identity)
-	if err != nil {
-		log.Printf("Error during editing delay %d of %s: %s\n", delay.Id, identity, err.Error())
-	}
-	return err
+	_, err = hdb.db.ExecContext(ctx, query, delay.Hours, delay.Minutes, delay.Seconds, delay.Id, identity)
+	return map_error(err)
 }
 
 func (hdb *HonuaDatabase) DeleteDelay(identity string, delayID int) error {
+	return hdb.DeleteDelayContext(context.Background(), identity, delayID)
+}
+
+func (hdb *HonuaDatabase) DeleteDelayContext(ctx context.Context, identity string, delayID int) (err error) {
+	defer hdb.observe(ctx, "delete_delay", time.Now(), &err, slog.String("identity", identity), slog.Int("delay_id", delayID))
 	const query = "DELETE FROM delays WHERE id=$1 AND identity=$2;"
 
-	_, err := hdb.db.Exec(query, delayID, identity)
-	if err != nil {
-		log.Printf("An error occured during deleting the delay with id = %d of identity %s: %s\n", delayID, identity, err.Error())
-	}
+	result, err := hdb.db.ExecContext(ctx, query, delayID, identity)
+	err = affected_or_not_found(result, err, "the delay %d of %s does not exist", delayID, identity)
 	return err
 }
 
 func (hdb *HonuaDatabase) ExistDelay(identifier string, delayID int) (bool, error) {
+	return hdb.ExistDelayContext(context.Background(), identifier, delayID)
+}
+
+func (hdb *HonuaDatabase) ExistDelayContext(ctx context.Context, identifier string, delayID int) (_ bool, err error) {
+	defer hdb.observe(ctx, "exist_delay", time.Now(), &err, slog.String("identity", identifier), slog.Int("delay_id", delayID))
 	const query = "SELECT CASE WHEN EXISTS ( SELECT * FROM delays WHERE identity = $1 AND id = $2) THEN true ELSE false END;"
-	rows, err := hdb.db.Query(query, identifier, delayID)
+	rows, err := hdb.db.QueryContext(ctx, query, identifier, delayID)
 	if err != nil {
-		log.Printf("An error occured during checking if the delay %d exists in %s: %s\n", delayID, identifier, err.Error())
-		return false, err
+		return false, map_error(err)
 	}
 
 	var state bool = false
@@ -120,8 +136,7 @@ func (hdb *HonuaDatabase) ExistDelay(identifier string, delayID int) (bool, erro
 		err = rows.Scan(&state)
 		if err != nil {
 			rows.Close()
-			log.Printf("An error occured during checking if the delay %d exists in %s: %s\n", delayID, identifier, err.Error())
-			return false, err
+			return false, map_error(err)
 		}
 	}
 
@@ -130,57 +145,18 @@ func (hdb *HonuaDatabase) ExistDelay(identifier string, delayID int) (bool, erro
 	return state, nil
 }
 
-func (hdb *HonuaDatabase) get_delay_id(identifier string) (int, error) {
-	query := "SELECT CASE WHEN EXISTS ( SELECT * FROM delays WHERE identity = $1) THEN true ELSE false END"
-
-	rows, err := hdb.db.Query(query, identifier)
-	if err != nil {
-		log.Printf("An error occured during getting id of delay in %s: %s\n", identifier, err.Error())
-		return -1, err
-	}
-
-	var exist_delay bool = false
-
-	for rows.Next() {
-		err = rows.Scan(&exist_delay)
-		if err != nil {
-			rows.Close()
-			log.Printf("An error occured during getting id of delay in %s: %s\n", identifier, err.Error())
-			return -1, err
-		}
-	}
-
-	rows.Close()
+// get_delays returns the delays with the ids by their id
+func (hdb *HonuaDatabase) get_delays(ctx context.Context, q querier, identity string, ids []int) (map[int]*models.Delay, error) {
+	const query = "SELECT id, hours, minutes, seconds FROM delays WHERE identity=$1 AND id = ANY($2);"
 
-	if !exist_delay {
-		return 0, nil
-	}
-
-	query = "SELECT MAX(id) FROM delays WHERE identity = $1;"
-
-	rows, err = hdb.db.Query(query, identifier)
-	if err != nil {
-		log.Printf("An error occured during getting id of delay in %s: %s\n", identifier, err.Error())
-		return -1, err
-	}
-
-	var id int = -1
-
-	for rows.Next() {
-		err = rows.Scan(&id)
-		if err != nil {
-			rows.Close()
-			log.Printf("An error occured during getting id of delay in %s: %s\n", identifier, err.Error())
-			return -1, err
+	var result map[int]*models.Delay = map[int]*models.Delay{}
+	err := query_by_ids(ctx, q, query, identity, ids, func(rows *sql.Rows) error {
+		d := &models.Delay{}
+		if err := rows.Scan(&d.Id, &d.Hours, &d.Minutes, &d.Seconds); err != nil {
+			return err
 		}
-	}
-	rows.Close()
-
-	if id == -1 {
-		return -1, errors.New("something went wrong during getting id of delay")
-	}
-
-	id = id + 1
-
-	return id, nil
+		result[d.Id] = d
+		return nil
+	})
+	return result, err
 }
@@ -0,0 +1,274 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	honuadatabase "github.com/JonasBordewick/honua-database"
+	"github.com/JonasBordewick/honua-database/expression"
+	"github.com/JonasBordewick/honua-database/models"
+	"github.com/JonasBordewick/honua-database/sun"
+)
+
+func (ev *evaluation) numeric_state(c *models.Condition, trace *Trace) error {
+	return ev.sensor(c, trace, func(state string) (bool, string) {
+		v, err := strconv.ParseFloat(strings.TrimSpace(state), 64)
+		if err != nil {
+			return false, fmt.Sprintf("%q is not a number", state)
+		}
+		if c.Above != nil && c.Above.Valid && !(v > c.Above.Value) {
+			return false, fmt.Sprintf("%v is not above %v", v, c.Above.Value)
+		}
+		if c.Below != nil && c.Below.Valid && !(v < c.Below.Value) {
+			return false, fmt.Sprintf("%v is not below %v", v, c.Below.Value)
+		}
+		return true, fmt.Sprintf("%v is in range", v)
+	})
+}
+
+func (ev *evaluation) state(c *models.Condition, trace *Trace) error {
+	return ev.sensor(c, trace, func(state string) (bool, string) {
+		if state != c.ComparisonState {
+			return false, fmt.Sprintf("%q is not %q", state, c.ComparisonState)
+		}
+		return true, fmt.Sprintf("%q is %q", state, c.ComparisonState)
+	})
+}
+
+// sensor checks the latest state of the sensor with match, with a duration
+// every state since now - For has to match too
+func (ev *evaluation) sensor(c *models.Condition, trace *Trace, match func(state string) (bool, string)) error {
+	if c.Sensor == nil {
+		return fmt.Errorf("condition %d has no sensor", c.Id)
+	}
+
+	state, err := ev.provider.State(ev.ctx, c.Sensor, c.Attribute)
+	if errors.Is(err, ErrNoState) {
+		trace.Reason = err.Error()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	trace.Result, trace.Reason = match(state.State)
+	if !trace.Result || c.For <= 0 {
+		return nil
+	}
+
+	from := ev.now.Add(-c.For)
+	states, err := ev.provider.States(ev.ctx, c.Sensor, c.Attribute, from, ev.now)
+	if err != nil {
+		return err
+	}
+	if len(states) == 0 || states[0].RecordTime == nil || states[0].RecordTime.After(from) {
+		trace.Result = false
+		trace.Reason = fmt.Sprintf("there is no state of %s since %v", c.Sensor.EntityId, c.For)
+		return nil
+	}
+	for _, s := range states {
+		if ok, reason := match(s.State); !ok {
+			trace.Result = false
+			trace.Reason = fmt.Sprintf("not met for %v: %s", c.For, reason)
+			return nil
+		}
+	}
+	trace.Reason = fmt.Sprintf("%s for %v", trace.Reason, c.For)
+	return nil
+}
+
+func (ev *evaluation) from_to(c *models.Condition, trace *Trace) error {
+	if c.Sensor == nil {
+		return fmt.Errorf("condition %d has no sensor", c.Id)
+	}
+
+	transition, err := ev.provider.LastChange(ev.ctx, c.Sensor, c.Attribute)
+	if errors.Is(err, ErrNoState) {
+		trace.Reason = err.Error()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case transition.From == "":
+		trace.Reason = fmt.Sprintf("the state of %s never changed", c.Sensor.EntityId)
+	case c.FromState != "" && transition.From != c.FromState:
+		trace.Reason = fmt.Sprintf("the state changed from %q, not from %q", transition.From, c.FromState)
+	case c.ToState != "" && transition.To != c.ToState:
+		trace.Reason = fmt.Sprintf("the state changed to %q, not to %q", transition.To, c.ToState)
+	case c.For > 0 && ev.now.Sub(transition.Since) < c.For:
+		trace.Reason = fmt.Sprintf("the state changed %v ago, not %v", ev.now.Sub(transition.Since), c.For)
+	default:
+		trace.Result = true
+		trace.Reason = fmt.Sprintf("the state changed from %q to %q at %s", transition.From, transition.To, transition.Since.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (ev *evaluation) time(c *models.Condition, trace *Trace) error {
+	tc, err := honuadatabase.TimeConditionOf(c)
+	if err != nil {
+		return fmt.Errorf("time condition %d: %w", c.Id, err)
+	}
+
+	needsSun := (tc.After != nil && tc.After.Type != models.CLOCK) || (tc.Before != nil && tc.Before.Type != models.CLOCK)
+	loc, err := ev.get_location(needsSun)
+	if err != nil {
+		return err
+	}
+	now := ev.now.In(loc.zone)
+
+	if len(tc.Weekdays) > 0 && !contains(tc.Weekdays, now.Weekday()) {
+		trace.Reason = fmt.Sprintf("%v is not one of %v", now.Weekday(), tc.Weekdays)
+		return nil
+	}
+
+	if tc.DateFrom != nil && tc.DateTo != nil && !in_date_range(now, tc.DateFrom, tc.DateTo) {
+		trace.Reason = fmt.Sprintf("%s is not between %d-%d and %d-%d", now.Format("01-02"), tc.DateFrom.Month, tc.DateFrom.Day, tc.DateTo.Month, tc.DateTo.Day)
+		return nil
+	}
+
+	var after, before time.Time
+	if tc.After != nil {
+		if after, err = loc.resolve(tc.After, now); err != nil {
+			trace.Reason = err.Error()
+			return nil
+		}
+	}
+	if tc.Before != nil {
+		if before, err = loc.resolve(tc.Before, now); err != nil {
+			trace.Reason = err.Error()
+			return nil
+		}
+	}
+
+	switch {
+	case tc.After != nil && tc.Before != nil && !after.Before(before):
+		// the range wraps around midnight, like 22:00 to 06:00
+		trace.Result = !now.Before(after) || now.Before(before)
+	case tc.After != nil && tc.Before != nil:
+		trace.Result = !now.Before(after) && now.Before(before)
+	case tc.After != nil:
+		trace.Result = !now.Before(after)
+	case tc.Before != nil:
+		trace.Result = now.Before(before)
+	default:
+		trace.Result = true
+	}
+	trace.Reason = fmt.Sprintf("the time is %s", now.Format("2006-01-02 15:04:05 Mon"))
+	if !after.IsZero() {
+		trace.Reason += fmt.Sprintf(", after %s", after.Format("15:04:05"))
+	}
+	if !before.IsZero() {
+		trace.Reason += fmt.Sprintf(", before %s", before.Format("15:04:05"))
+	}
+	return nil
+}
+
+func (ev *evaluation) template(c *models.Condition, trace *Trace) error {
+	expr, err := expression.Parse(c.Template)
+	if err != nil {
+		return fmt.Errorf("template condition %d: %w", c.Id, err)
+	}
+
+	var states map[string]string = map[string]string{}
+	for _, name := range expr.Entities() {
+		entity, err := ev.provider.Entity(ev.ctx, name)
+		if err == nil {
+			var state *models.State
+			state, err = ev.provider.State(ev.ctx, entity, "")
+			if err == nil {
+				states[name] = state.State
+				continue
+			}
+		}
+		if errors.Is(err, ErrNoState) {
+			trace.Reason = err.Error()
+			return nil
+		}
+		return err
+	}
+
+	result, err := expr.Evaluate(func(name string) (string, bool) {
+		state, ok := states[name]
+		return state, ok
+	})
+	if err != nil {
+		// the states do not fit the template, like a text where a number is needed
+		trace.Reason = err.Error()
+		return nil
+	}
+	trace.Result = result
+	trace.Reason = fmt.Sprintf("%s is %v", c.Template, result)
+	return nil
+}
+
+// timeLocation is the location of the identity with its loaded time zone
+type timeLocation struct {
+	*models.Location
+	zone *time.Location
+}
+
+// get_location loads the location once per evaluation. Without a location
+// the clock times are in UTC, bounds relative to the sun need a location.
+func (ev *evaluation) get_location(needed bool) (*timeLocation, error) {
+	if ev.location == nil {
+		location, err := ev.provider.Location(ev.ctx)
+		if errors.Is(err, ErrNoLocation) && !needed {
+			return &timeLocation{zone: time.UTC}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		ev.location = location
+	}
+
+	zone, err := time.LoadLocation(ev.location.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+	return &timeLocation{Location: ev.location, zone: zone}, nil
+}
+
+// resolve returns the time of the bound on the day of now
+func (l *timeLocation) resolve(b *models.TimeBound, now time.Time) (time.Time, error) {
+	year, month, day := now.Date()
+	if b.Type == models.CLOCK {
+		secs := int(b.Clock / time.Second)
+		return time.Date(year, month, day, secs/3600, secs/60%60, secs%60, 0, l.zone), nil
+	}
+
+	sunrise, sunset, err := sun.Times(time.Date(year, month, day, 12, 0, 0, 0, l.zone), l.Latitude, l.Longitude)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if b.Type == models.SUNRISE {
+		return sunrise.Add(b.Offset), nil
+	}
+	return sunset.Add(b.Offset), nil
+}
+
+func contains(days []time.Weekday, day time.Weekday) bool {
+	for _, d := range days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// in_date_range checks the day of t, the range wraps around the new year if from is after to
+func in_date_range(t time.Time, from, to *models.MonthDay) bool {
+	day := int(t.Month())*100 + t.Day()
+	first := int(from.Month)*100 + from.Day
+	last := int(to.Month)*100 + to.Day
+	if first <= last {
+		return day >= first && day <= last
+	}
+	return day >= first || day <= last
+}
@@ -0,0 +1,162 @@
+// Package engine evaluates the condition tree of a rule with the states of a
+// StateProvider and decides if the then or the else actions run.
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/JonasBordewick/honua-database/clock"
+	"github.com/JonasBordewick/honua-database/models"
+)
+
+// ErrNoCondition is returned for a rule without a condition tree
+var ErrNoCondition = errors.New("the rule has no condition")
+
+type Branch int
+
+const (
+	Then Branch = iota
+	Else
+)
+
+func (b Branch) String() string {
+	if b == Then {
+		return "then"
+	}
+	return "else"
+}
+
+// Result is the outcome of the evaluation of a rule
+type Result struct {
+	RuleID int
+	// Time is the time of the clock the rule was evaluated at
+	Time    time.Time
+	Matched bool
+	// Branch names the action list that runs, Then if the condition matched
+	Branch  Branch
+	Actions []*models.Action
+	Trace   *Trace
+}
+
+// Trace is the result of one condition of the tree, it is recorded with the RuleRun
+type Trace = models.ConditionTrace
+
+type Engine struct {
+	clock clock.Clock
+}
+
+type Option func(*Engine)
+
+// WithClock replaces the system clock
+func WithClock(c clock.Clock) Option {
+	return func(e *Engine) {
+		e.clock = c
+	}
+}
+
+func New(options ...Option) *Engine {
+	e := &Engine{clock: clock.System()}
+	for _, option := range options {
+		option(e)
+	}
+	return e
+}
+
+// Evaluate evaluates the condition tree of the rule at the current time of
+// the clock. A condition is false if a state it needs is missing, errors of
+// the provider are returned.
+func (e *Engine) Evaluate(ctx context.Context, rule *models.Rule, provider StateProvider) (*Result, error) {
+	if rule.Condition == nil {
+		return nil, fmt.Errorf("%w: rule %d", ErrNoCondition, rule.Id)
+	}
+
+	ev := &evaluation{ctx: ctx, provider: provider, now: e.clock.Now()}
+	trace, err := ev.evaluate(rule.Condition)
+	if err != nil {
+		return nil, fmt.Errorf("rule %d: %w", rule.Id, err)
+	}
+
+	result := &Result{
+		RuleID:  rule.Id,
+		Time:    ev.now,
+		Matched: trace.Result,
+		Branch:  Then,
+		Actions: rule.ThenActions,
+		Trace:   trace,
+	}
+	if !trace.Result {
+		result.Branch = Else
+		result.Actions = rule.ElseActions
+	}
+	return result, nil
+}
+
+// evaluation holds what one call of Evaluate needs, now is the same for every condition
+type evaluation struct {
+	ctx      context.Context
+	provider StateProvider
+	now      time.Time
+	location *models.Location
+}
+
+func (ev *evaluation) evaluate(c *models.Condition) (*Trace, error) {
+	if err := ev.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	trace := &Trace{ConditionID: c.Id, Type: c.Type}
+	var err error
+	switch c.Type {
+	case models.AND, models.OR, models.NAND, models.NOR:
+		err = ev.logical(c, trace)
+	case models.NUMERICSTATE:
+		err = ev.numeric_state(c, trace)
+	case models.STATE:
+		err = ev.state(c, trace)
+	case models.FROM_TO:
+		err = ev.from_to(c, trace)
+	case models.TIME:
+		err = ev.time(c, trace)
+	case models.TEMPLATE:
+		err = ev.template(c, trace)
+	default:
+		err = fmt.Errorf("condition %d: the condition type %d is not supported", c.Id, c.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return trace, nil
+}
+
+// logical evaluates every subcondition, so the trace is complete
+func (ev *evaluation) logical(c *models.Condition, trace *Trace) error {
+	trueCount := 0
+	for _, sub := range c.SubConditions {
+		child, err := ev.evaluate(sub)
+		if err != nil {
+			return err
+		}
+		trace.Children = append(trace.Children, child)
+		if child.Result {
+			trueCount++
+		}
+	}
+
+	all := trueCount == len(c.SubConditions)
+	any := trueCount > 0
+	switch c.Type {
+	case models.AND:
+		trace.Result = all
+	case models.OR:
+		trace.Result = any
+	case models.NAND:
+		trace.Result = !all
+	case models.NOR:
+		trace.Result = !any
+	}
+	trace.Reason = fmt.Sprintf("%d of %d subconditions are true", trueCount, len(c.SubConditions))
+	return nil
+}
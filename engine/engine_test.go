@@ -0,0 +1,322 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/JonasBordewick/honua-database/clock"
+	"github.com/JonasBordewick/honua-database/models"
+)
+
+// recorded is a state recorded ago before the time of the evaluation
+type recorded struct {
+	ago   time.Duration
+	state string
+}
+
+// fakeProvider holds the states of the entities ordered by their record time
+type fakeProvider struct {
+	now      time.Time
+	entities map[string]*models.Entity
+	states   map[int][]*models.State
+	location *models.Location
+}
+
+func new_fake_provider(now time.Time, location *models.Location, history map[*models.Entity][]recorded) *fakeProvider {
+	p := &fakeProvider{now: now, entities: map[string]*models.Entity{}, states: map[int][]*models.State{}, location: location}
+	for entity, states := range history {
+		p.entities[entity.EntityId] = entity
+		for _, r := range states {
+			at := now.Add(-r.ago)
+			p.states[entity.Id] = append(p.states[entity.Id], &models.State{EntityId: entity.Id, State: r.state, RecordTime: &at})
+		}
+	}
+	return p
+}
+
+func (p *fakeProvider) history(entity *models.Entity, attribute string) ([]*models.State, error) {
+	if attribute != "" && !(entity.HasAttribute && entity.Attribute == attribute) {
+		return nil, fmt.Errorf("%w: the attribute %s of %s is not recorded", ErrNoState, attribute, entity.EntityId)
+	}
+	states := p.states[entity.Id]
+	if len(states) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNoState, entity.EntityId)
+	}
+	return states, nil
+}
+
+func (p *fakeProvider) State(ctx context.Context, entity *models.Entity, attribute string) (*models.State, error) {
+	states, err := p.history(entity, attribute)
+	if err != nil {
+		return nil, err
+	}
+	return states[len(states)-1], nil
+}
+
+func (p *fakeProvider) States(ctx context.Context, entity *models.Entity, attribute string, from, to time.Time) ([]*models.State, error) {
+	states, err := p.history(entity, attribute)
+	if err != nil {
+		return []*models.State{}, nil
+	}
+	var result []*models.State = []*models.State{}
+	for i, s := range states {
+		if s.RecordTime.After(to) {
+			break
+		}
+		if s.RecordTime.After(from) {
+			result = append(result, s)
+		} else if i+1 == len(states) || states[i+1].RecordTime.After(from) {
+			// the state the entity had at from
+			result = append(result, s)
+		}
+	}
+	return result, nil
+}
+
+func (p *fakeProvider) LastChange(ctx context.Context, entity *models.Entity, attribute string) (*models.StateTransition, error) {
+	states, err := p.history(entity, attribute)
+	if err != nil {
+		return nil, err
+	}
+	last := states[len(states)-1]
+	result := &models.StateTransition{EntityId: entity.Id, To: last.State, Since: *last.RecordTime}
+	for i := len(states) - 2; i >= 0; i-- {
+		if states[i].State != result.To {
+			result.From = states[i].State
+			break
+		}
+		result.Since = *states[i].RecordTime
+	}
+	return result, nil
+}
+
+func (p *fakeProvider) Entity(ctx context.Context, entityID string) (*models.Entity, error) {
+	entity, ok := p.entities[entityID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNoState, entityID)
+	}
+	return entity, nil
+}
+
+func (p *fakeProvider) Location(ctx context.Context) (*models.Location, error) {
+	if p.location == nil {
+		return nil, ErrNoLocation
+	}
+	return p.location, nil
+}
+
+func clock_bound(hours, minutes int) *models.TimeBound {
+	return &models.TimeBound{Type: models.CLOCK, Clock: time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute}
+}
+
+func TestEvaluate(t *testing.T) {
+	pv := &models.Entity{Id: 1, EntityId: "sensor.pv", HasNumericState: true}
+	loads := &models.Entity{Id: 2, EntityId: "sensor.acloads", HasNumericState: true}
+	door := &models.Entity{Id: 3, EntityId: "binary_sensor.door"}
+	light := &models.Entity{Id: 4, EntityId: "light.kitchen", HasAttribute: true, Attribute: "brightness"}
+	missing := &models.Entity{Id: 5, EntityId: "sensor.missing"}
+
+	on := &models.Condition{Id: 10, Type: models.STATE, Sensor: door, ComparisonState: "on"}
+	off := &models.Condition{Id: 11, Type: models.STATE, Sensor: door, ComparisonState: "off"}
+
+	// Monday, the 15th of January 2024
+	monday := time.Date(2024, time.January, 15, 12, 0, 0, 0, time.UTC)
+	berlin := &models.Location{Latitude: 52.52, Longitude: 13.405, TimeZone: "Europe/Berlin"}
+	zone, err := time.LoadLocation(berlin.TimeZone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sunrise is about 04:43 and sunset about 21:33 in Berlin
+	midsummer := func(hours, minutes int) time.Time {
+		return time.Date(2024, time.June, 21, hours, minutes, 0, 0, zone)
+	}
+	history := map[*models.Entity][]recorded{
+		pv:    {{ago: time.Hour, state: "800"}},
+		loads: {{ago: time.Hour, state: "200"}},
+		door:  {{ago: time.Hour, state: "off"}, {ago: 5 * time.Minute, state: "on"}},
+		light: {{ago: time.Hour, state: "120"}},
+	}
+
+	tests := []struct {
+		name      string
+		now       time.Time
+		location  *models.Location
+		history   map[*models.Entity][]recorded
+		condition *models.Condition
+		want      bool
+		wantErr   bool
+	}{
+		// AND, OR, NAND and NOR
+		{name: "and all true", condition: &models.Condition{Type: models.AND, SubConditions: []*models.Condition{on, on}}, want: true},
+		{name: "and one false", condition: &models.Condition{Type: models.AND, SubConditions: []*models.Condition{on, off}}, want: false},
+		{name: "and without subconditions", condition: &models.Condition{Type: models.AND}, want: true},
+		{name: "or one true", condition: &models.Condition{Type: models.OR, SubConditions: []*models.Condition{off, on}}, want: true},
+		{name: "or all false", condition: &models.Condition{Type: models.OR, SubConditions: []*models.Condition{off, off}}, want: false},
+		{name: "nand all true", condition: &models.Condition{Type: models.NAND, SubConditions: []*models.Condition{on, on}}, want: false},
+		{name: "nand one false", condition: &models.Condition{Type: models.NAND, SubConditions: []*models.Condition{on, off}}, want: true},
+		{name: "nor all false", condition: &models.Condition{Type: models.NOR, SubConditions: []*models.Condition{off, off}}, want: true},
+		{name: "nor one true", condition: &models.Condition{Type: models.NOR, SubConditions: []*models.Condition{off, on}}, want: false},
+		{name: "nested", condition: &models.Condition{Type: models.AND, SubConditions: []*models.Condition{
+			on, {Type: models.NOR, SubConditions: []*models.Condition{off}},
+		}}, want: true},
+
+		// NUMERICSTATE
+		{name: "numeric in range", condition: &models.Condition{Type: models.NUMERICSTATE, Sensor: pv,
+			Above: &models.ConditionValue{Valid: true, Value: 500}, Below: &models.ConditionValue{Valid: true, Value: 1000}}, want: true},
+		{name: "numeric above the range", condition: &models.Condition{Type: models.NUMERICSTATE, Sensor: pv,
+			Below: &models.ConditionValue{Valid: true, Value: 800}}, want: false},
+		{name: "numeric below the range", condition: &models.Condition{Type: models.NUMERICSTATE, Sensor: pv,
+			Above: &models.ConditionValue{Valid: true, Value: 800}}, want: false},
+		{name: "numeric not a number", condition: &models.Condition{Type: models.NUMERICSTATE, Sensor: door,
+			Above: &models.ConditionValue{Valid: true, Value: 0}}, want: false},
+		{name: "numeric attribute", condition: &models.Condition{Type: models.NUMERICSTATE, Sensor: light, Attribute: "brightness",
+			Above: &models.ConditionValue{Valid: true, Value: 100}}, want: true},
+		{name: "numeric attribute not recorded", condition: &models.Condition{Type: models.NUMERICSTATE, Sensor: pv, Attribute: "voltage",
+			Above: &models.ConditionValue{Valid: true, Value: 0}}, want: false},
+
+		// STATE
+		{name: "state matches", condition: on, want: true},
+		{name: "state does not match", condition: off, want: false},
+		{name: "state without a state is false", condition: &models.Condition{Type: models.STATE, Sensor: missing, ComparisonState: "on"}, want: false},
+		{name: "state without a sensor", condition: &models.Condition{Type: models.STATE, ComparisonState: "on"}, wantErr: true},
+		{name: "state for long enough", condition: &models.Condition{Type: models.STATE, Sensor: door, ComparisonState: "on", For: 5 * time.Minute}, want: true},
+		{name: "state not for long enough", condition: &models.Condition{Type: models.STATE, Sensor: door, ComparisonState: "on", For: 10 * time.Minute}, want: false},
+		{name: "state for longer than the history", history: map[*models.Entity][]recorded{door: {{ago: 5 * time.Minute, state: "on"}}},
+			condition: &models.Condition{Type: models.STATE, Sensor: door, ComparisonState: "on", For: 10 * time.Minute}, want: false},
+		{name: "state for with repeated states", history: map[*models.Entity][]recorded{door: {{ago: time.Hour, state: "on"}, {ago: time.Minute, state: "on"}}},
+			condition: &models.Condition{Type: models.STATE, Sensor: door, ComparisonState: "on", For: 30 * time.Minute}, want: true},
+
+		// FROM_TO
+		{name: "from_to matches", condition: &models.Condition{Type: models.FROM_TO, Sensor: door, FromState: "off", ToState: "on"}, want: true},
+		{name: "from_to any from", condition: &models.Condition{Type: models.FROM_TO, Sensor: door, ToState: "on"}, want: true},
+		{name: "from_to other from", condition: &models.Condition{Type: models.FROM_TO, Sensor: door, FromState: "open", ToState: "on"}, want: false},
+		{name: "from_to other to", condition: &models.Condition{Type: models.FROM_TO, Sensor: door, FromState: "on", ToState: "off"}, want: false},
+		{name: "from_to never changed", history: map[*models.Entity][]recorded{door: {{ago: time.Hour, state: "on"}, {ago: time.Minute, state: "on"}}},
+			condition: &models.Condition{Type: models.FROM_TO, Sensor: door, ToState: "on"}, want: false},
+		{name: "from_to for long enough", condition: &models.Condition{Type: models.FROM_TO, Sensor: door, FromState: "off", ToState: "on", For: 5 * time.Minute}, want: true},
+		{name: "from_to not for long enough", condition: &models.Condition{Type: models.FROM_TO, Sensor: door, FromState: "off", ToState: "on", For: 6 * time.Minute}, want: false},
+		{name: "from_to without a state is false", condition: &models.Condition{Type: models.FROM_TO, Sensor: missing, ToState: "on"}, want: false},
+
+		// TIME
+		{name: "time in range", condition: &models.Condition{Type: models.TIME, Time: &models.TimeCondition{After: clock_bound(8, 0), Before: clock_bound(18, 0)}}, want: true},
+		{name: "time after the range", condition: &models.Condition{Type: models.TIME, Time: &models.TimeCondition{After: clock_bound(8, 0), Before: clock_bound(11, 0)}}, want: false},
+		{name: "time at the start of the range", condition: &models.Condition{Type: models.TIME, Time: &models.TimeCondition{After: clock_bound(12, 0)}}, want: true},
+		{name: "time at the end of the range", condition: &models.Condition{Type: models.TIME, Time: &models.TimeCondition{Before: clock_bound(12, 0)}}, want: false},
+		{name: "time over midnight, late", now: time.Date(2024, time.January, 15, 23, 0, 0, 0, time.UTC),
+			condition: &models.Condition{Type: models.TIME, Time: &models.TimeCondition{After: clock_bound(22, 0), Before: clock_bound(6, 0)}}, want: true},
+		{name: "time over midnight, early", now: time.Date(2024, time.January, 15, 5, 0, 0, 0, time.UTC),
+			condition: &models.Condition{Type: models.TIME, Time: &models.TimeCondition{After: clock_bound(22, 0), Before: clock_bound(6, 0)}}, want: true},
+		{name: "time over midnight, day", condition: &models.Condition{Type: models.TIME, Time: &models.TimeCondition{After: clock_bound(22, 0), Before: clock_bound(6, 0)}}, want: false},
+		{name: "time as text", condition: &models.Condition{Type: models.TIME, After: "11:30", Before: "12:30"}, want: true},
+		{name: "time with invalid text", condition: &models.Condition{Type: models.TIME, After: "morning"}, wantErr: true},
+		{name: "weekday matches", condition: &models.Condition{Type: models.TIME, Time: &models.TimeCondition{Weekdays: []time.Weekday{time.Monday, time.Tuesday}}}, want: true},
+		{name: "weekday does not match", condition: &models.Condition{Type: models.TIME, Time: &models.TimeCondition{Weekdays: []time.Weekday{time.Saturday, time.Sunday}}}, want: false},
+		{name: "date in range", condition: &models.Condition{Type: models.TIME, Time: &models.TimeCondition{
+			DateFrom: &models.MonthDay{Month: time.January, Day: 1}, DateTo: &models.MonthDay{Month: time.March, Day: 31}}}, want: true},
+		{name: "date over the new year, january", condition: &models.Condition{Type: models.TIME, Time: &models.TimeCondition{
+			DateFrom: &models.MonthDay{Month: time.December, Day: 1}, DateTo: &models.MonthDay{Month: time.February, Day: 28}}}, want: true},
+		{name: "date over the new year, december", now: time.Date(2023, time.December, 24, 12, 0, 0, 0, time.UTC),
+			condition: &models.Condition{Type: models.TIME, Time: &models.TimeCondition{
+				DateFrom: &models.MonthDay{Month: time.December, Day: 1}, DateTo: &models.MonthDay{Month: time.February, Day: 28}}}, want: true},
+		{name: "date over the new year, summer", now: time.Date(2024, time.July, 1, 12, 0, 0, 0, time.UTC),
+			condition: &models.Condition{Type: models.TIME, Time: &models.TimeCondition{
+				DateFrom: &models.MonthDay{Month: time.December, Day: 1}, DateTo: &models.MonthDay{Month: time.February, Day: 28}}}, want: false},
+		{name: "time in the zone of the location", now: midsummer(7, 0), location: berlin,
+			condition: &models.Condition{Type: models.TIME, Time: &models.TimeCondition{After: clock_bound(6, 30), Before: clock_bound(7, 30)}}, want: true},
+		{name: "after sunrise with offset", now: midsummer(5, 30), location: berlin,
+			condition: &models.Condition{Type: models.TIME, Time: &models.TimeCondition{After: &models.TimeBound{Type: models.SUNRISE, Offset: 30 * time.Minute}}}, want: true},
+		{name: "before sunrise with offset", now: midsummer(5, 0), location: berlin,
+			condition: &models.Condition{Type: models.TIME, Time: &models.TimeCondition{After: &models.TimeBound{Type: models.SUNRISE, Offset: 30 * time.Minute}}}, want: false},
+		{name: "before sunset with offset", now: midsummer(20, 0), location: berlin,
+			condition: &models.Condition{Type: models.TIME, Time: &models.TimeCondition{Before: &models.TimeBound{Type: models.SUNSET, Offset: -time.Hour}}}, want: true},
+		{name: "after sunset with offset", now: midsummer(21, 0), location: berlin,
+			condition: &models.Condition{Type: models.TIME, Time: &models.TimeCondition{Before: &models.TimeBound{Type: models.SUNSET, Offset: -time.Hour}}}, want: false},
+		{name: "sun without a location", condition: &models.Condition{Type: models.TIME, Time: &models.TimeCondition{After: &models.TimeBound{Type: models.SUNRISE}}}, wantErr: true},
+
+		// TEMPLATE
+		{name: "template true", condition: &models.Condition{Type: models.TEMPLATE, Template: "sensor.pv - sensor.acloads > 500"}, want: true},
+		{name: "template false", condition: &models.Condition{Type: models.TEMPLATE, Template: "sensor.pv - sensor.acloads > 600"}, want: false},
+		{name: "template strings", condition: &models.Condition{Type: models.TEMPLATE, Template: "binary_sensor.door == 'on' && sensor.pv > 0"}, want: true},
+		{name: "template type mismatch", condition: &models.Condition{Type: models.TEMPLATE, Template: "binary_sensor.door > 5"}, want: false},
+		{name: "template without a state", condition: &models.Condition{Type: models.TEMPLATE, Template: "sensor.missing > 5"}, want: false},
+		{name: "template with a syntax error", condition: &models.Condition{Type: models.TEMPLATE, Template: "sensor.pv >"}, wantErr: true},
+
+		{name: "unknown condition type", condition: &models.Condition{Type: models.ConditionType(99)}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			now := test.now
+			if now.IsZero() {
+				now = monday
+			}
+			h := test.history
+			if h == nil {
+				h = history
+			}
+			p := new_fake_provider(now, test.location, h)
+			e := New(WithClock(clock.NewFake(now)))
+
+			result, err := e.Evaluate(context.Background(), &models.Rule{Id: 1, Condition: test.condition}, p)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("got %v (%s), want an error", result.Matched, result.Trace.Reason)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Matched != test.want {
+				t.Errorf("got %v (%s), want %v", result.Matched, result.Trace.Reason, test.want)
+			}
+			if result.Trace.Result != result.Matched || result.Trace.Reason == "" {
+				t.Errorf("the trace %+v does not explain the result", result.Trace)
+			}
+		})
+	}
+}
+
+func TestEvaluateResult(t *testing.T) {
+	door := &models.Entity{Id: 1, EntityId: "binary_sensor.door"}
+	now := time.Date(2024, time.January, 15, 12, 0, 0, 0, time.UTC)
+	p := new_fake_provider(now, nil, map[*models.Entity][]recorded{door: {{ago: time.Minute, state: "on"}}})
+	e := New(WithClock(clock.NewFake(now)))
+
+	then := []*models.Action{{Id: 1}}
+	otherwise := []*models.Action{{Id: 2}}
+	rule := &models.Rule{Id: 7, ThenActions: then, ElseActions: otherwise, Condition: &models.Condition{Id: 1, Type: models.OR, SubConditions: []*models.Condition{
+		{Id: 2, Type: models.STATE, Sensor: door, ComparisonState: "on"},
+		{Id: 3, Type: models.STATE, Sensor: door, ComparisonState: "off"},
+	}}}
+
+	result, err := e.Evaluate(context.Background(), rule, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RuleID != 7 || !result.Time.Equal(now) || result.Branch != Then || len(result.Actions) != 1 || result.Actions[0] != then[0] {
+		t.Errorf("got %+v, want the then actions of rule 7 at %v", result, now)
+	}
+	if len(result.Trace.Children) != 2 || !result.Trace.Children[0].Result || result.Trace.Children[1].Result {
+		t.Errorf("got the trace %+v, want the subconditions true and false", result.Trace)
+	}
+	if result.Trace.Children[1].ConditionID != 3 {
+		t.Errorf("got the condition %d in the trace, want 3", result.Trace.Children[1].ConditionID)
+	}
+
+	rule.Condition.Type = models.NOR
+	result, err = e.Evaluate(context.Background(), rule, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Branch != Else || len(result.Actions) != 1 || result.Actions[0] != otherwise[0] {
+		t.Errorf("got %+v, want the else actions", result)
+	}
+
+	if _, err := e.Evaluate(context.Background(), &models.Rule{Id: 8}, p); !errors.Is(err, ErrNoCondition) {
+		t.Errorf("got %v, want ErrNoCondition", err)
+	}
+}
@@ -0,0 +1,103 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	honuadatabase "github.com/JonasBordewick/honua-database"
+	"github.com/JonasBordewick/honua-database/models"
+)
+
+// Errors returned by a StateProvider
+var (
+	// ErrNoState is returned if there is no state of an entity, a condition
+	// over this entity is false
+	ErrNoState = errors.New("no state")
+	// ErrNoLocation is returned if there is no location for sun based bounds
+	ErrNoLocation = errors.New("no location")
+)
+
+// StateProvider returns the states the conditions of a rule are evaluated with.
+// An attribute that is not empty selects an attribute of the entity instead of its state.
+type StateProvider interface {
+	// State returns the latest state of the entity
+	State(ctx context.Context, entity *models.Entity, attribute string) (*models.State, error)
+	// States returns the states recorded after from until to, the first
+	// state is the one the entity had at from, like Store.GetStatesBetween
+	States(ctx context.Context, entity *models.Entity, attribute string, from, to time.Time) ([]*models.State, error)
+	// LastChange returns the last change of the state of the entity
+	LastChange(ctx context.Context, entity *models.Entity, attribute string) (*models.StateTransition, error)
+	// Entity returns the entity with the Home Assistant entity id, it is used by templates
+	Entity(ctx context.Context, entityID string) (*models.Entity, error)
+	// Location returns where the identity is, ErrNoLocation if it is unknown
+	Location(ctx context.Context) (*models.Location, error)
+}
+
+// StoreProvider reads the states of one identity from a Store. The states
+// table holds one value per entity, so an attribute is only known if the
+// entity tracks exactly this attribute.
+type StoreProvider struct {
+	store    honuadatabase.Store
+	identity string
+}
+
+func NewStoreProvider(store honuadatabase.Store, identity string) *StoreProvider {
+	return &StoreProvider{store: store, identity: identity}
+}
+
+func (p *StoreProvider) State(ctx context.Context, entity *models.Entity, attribute string) (*models.State, error) {
+	if err := p.check_attribute(entity, attribute); err != nil {
+		return nil, err
+	}
+	state, err := p.store.GetStateContext(ctx, p.identity, entity.Id)
+	return state, no_state(err)
+}
+
+func (p *StoreProvider) States(ctx context.Context, entity *models.Entity, attribute string, from, to time.Time) ([]*models.State, error) {
+	if err := p.check_attribute(entity, attribute); err != nil {
+		return nil, err
+	}
+	return p.store.GetStatesBetweenContext(ctx, p.identity, entity.Id, from, to)
+}
+
+func (p *StoreProvider) LastChange(ctx context.Context, entity *models.Entity, attribute string) (*models.StateTransition, error) {
+	if err := p.check_attribute(entity, attribute); err != nil {
+		return nil, err
+	}
+	transition, err := p.store.GetLastStateChangeContext(ctx, p.identity, entity.Id)
+	return transition, no_state(err)
+}
+
+func (p *StoreProvider) Entity(ctx context.Context, entityID string) (*models.Entity, error) {
+	id, err := p.store.GetIdOfEntityContext(ctx, p.identity, entityID)
+	if err != nil {
+		return nil, no_state(err)
+	}
+	entity, err := p.store.GetEntityContext(ctx, p.identity, id)
+	return entity, no_state(err)
+}
+
+func (p *StoreProvider) Location(ctx context.Context) (*models.Location, error) {
+	location, err := p.store.GetLocationContext(ctx, p.identity)
+	if errors.Is(err, honuadatabase.ErrNotFound) {
+		return nil, fmt.Errorf("%w: %s has no location", ErrNoLocation, p.identity)
+	}
+	return location, err
+}
+
+func (p *StoreProvider) check_attribute(entity *models.Entity, attribute string) error {
+	if attribute == "" || (entity.HasAttribute && entity.Attribute == attribute) {
+		return nil
+	}
+	return fmt.Errorf("%w: the attribute %s of %s is not recorded", ErrNoState, attribute, entity.EntityId)
+}
+
+// no_state translates ErrNotFound of the store into ErrNoState
+func no_state(err error) error {
+	if errors.Is(err, honuadatabase.ErrNotFound) {
+		return fmt.Errorf("%w: %v", ErrNoState, err)
+	}
+	return err
+}
@@ -1,76 +1,28 @@
 package honuadatabase
 
 import (
+	"context"
 	"database/sql"
-	"errors"
-	"log"
+	"fmt"
+	"log/slog"
+	"time"
 
 	"github.com/JonasBordewick/honua-database/models"
+	"github.com/lib/pq"
 )
 
-// Make sure that before calling this method, you have already been locked. This method does not lock
-func (hdb *HonuaDatabase) get_entity_id(identifier string) (int, error) {
-	query := "SELECT CASE WHEN EXISTS ( SELECT * FROM entities WHERE identity = $1) THEN true ELSE false END"
 
-	rows, err := hdb.db.Query(query, identifier)
-	if err != nil {
-		log.Printf("An error occured during getting id of entity in %s: %s\n", identifier, err.Error())
-		return -1, err
-	}
-
-	var exist_identity bool = false
-
-	for rows.Next() {
-		err = rows.Scan(&exist_identity)
-		if err != nil {
-			rows.Close()
-			log.Printf("An error occured during getting id of entity in %s: %s\n", identifier, err.Error())
-			return -1, err
-		}
-	}
-
-	rows.Close()
-
-	if !exist_identity {
-		return 0, nil
-	}
-
-	query = "SELECT MAX(id) FROM entities WHERE identity = $1;"
-
-	rows, err = hdb.db.Query(query, identifier)
-	if err != nil {
-		log.Printf("An error occured during getting id of entity in %s: %s\n", identifier, err.Error())
-		return -1, err
-	}
-
-	var id int = -1
-
-	for rows.Next() {
-		err = rows.Scan(&id)
-		if err != nil {
-			rows.Close()
-			log.Printf("An error occured during getting id of entity in %s: %s\n", identifier, err.Error())
-			return -1, err
-		}
-	}
-	rows.Close()
-
-	if id == -1 {
-		return -1, errors.New("something went wrong during getting id of entity")
-	}
-
-	id = id + 1
-
-	return id, nil
+func (hdb *HonuaDatabase) GetEntity(identity string, id int) (*models.Entity, error) {
+	return hdb.GetEntityContext(context.Background(), identity, id)
 }
 
-func (hdb *HonuaDatabase) GetEntity(identity string, id int) (*models.Entity, error) {
+func (hdb *HonuaDatabase) GetEntityContext(ctx context.Context, identity string, id int) (_ *models.Entity, err error) {
+	defer hdb.observe(ctx, "get_entity", time.Now(), &err, slog.String("identity", identity), slog.Int("entity_id", id))
 	const query = "SELECT * FROM entities WHERE id=$1 AND identity=$2;"
 
-	rows, err := hdb.db.Query(query, id, identity)
+	rows, err := hdb.db.QueryContext(ctx, query, id, identity)
 	if err != nil {
-		log.Printf("An error occured during getting entity: %s\n", err.Error())
-		return nil, err
+		return nil, map_error(err)
 	}
 
 	var result *models.Entity
@@ -79,7 +31,6 @@ func (hdb *HonuaDatabase) GetEntity(identity string, id int) (*models.Entity, er
 		entity, err := hdb.make_entity(rows)
 		if err != nil {
 			rows.Close()
-			log.Printf("An error occured during getting entity: %s\n", err.Error())
 			return nil, err
 		}
 		result = entity
@@ -87,55 +38,87 @@ func (hdb *HonuaDatabase) GetEntity(identity string, id int) (*models.Entity, er
 
 	rows.Close()
 
+	if result == nil {
+		return nil, fmt.Errorf("%w: the entity %d of %s does not exist", ErrNotFound, id, identity)
+	}
+
 	return result, nil
 }
 
 // Fügt eine neue Entität zur Datenbank hinzu
 func (hdb *HonuaDatabase) AddEntity(entity *models.Entity) error {
+	return hdb.AddEntityContext(context.Background(), entity)
+}
+
+func (hdb *HonuaDatabase) AddEntityContext(ctx context.Context, entity *models.Entity) (err error) {
+	defer hdb.observe(ctx, "add_entity", time.Now(), &err, slog.String("identity", entity.IdentityId), slog.String("entity_id", entity.EntityId))
 	const query = `
 INSERT INTO entities(
 	id, identity, entity_id, name,
 	is_device, allow_rules, has_attribute,
-	attribute, is_victron_sensor, sensor_type, has_numeric_state
-) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11);
+	attribute, is_victron_sensor, sensor_type, has_numeric_state, rules_enabled
+) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12);
 `
 	var attributeString sql.NullString = sql.NullString{
 		Valid:  entity.Attribute != "",
 		String: entity.Attribute,
 	}
 
-	id, err := hdb.get_entity_id(entity.IdentityId)
+	id, err := hdb.next_id(ctx, hdb.db, entity.IdentityId, "entities")
 	if err != nil {
-		log.Printf("An error occured during adding a new entitiy to table entities: %s\n", err.Error())
 		return err
 	}
 
-	log.Printf("ID %d\n", id)
-
-	_, err = hdb.db.Exec(query, id, entity.IdentityId, entity.EntityId, entity.Name, entity.IsDevice, entity.AllowRules, entity.HasAttribute, attributeString, entity.IsVictronSensor, entity.SensorType, entity.HasNumericState)
+	_, err = hdb.db.ExecContext(ctx, query, id, entity.IdentityId, entity.EntityId, entity.Name, entity.IsDevice, entity.AllowRules, entity.HasAttribute, attributeString, entity.IsVictronSensor, entity.SensorType, entity.HasNumericState, entity.RulesEnabled)
 
 	if err != nil {
-		log.Printf("An error occured during adding a new entitiy to table entities: %s\n", err.Error())
+		return map_error(err)
 	}
-	return err
+	entity.Id = id
+	return nil
 }
 
 // Löscht eine Enität mit der ID im Parameter
 func (hdb *HonuaDatabase) DeleteEntity(id int, identity string) error {
+	return hdb.DeleteEntityContext(context.Background(), id, identity)
+}
+
+func (hdb *HonuaDatabase) DeleteEntityContext(ctx context.Context, id int, identity string) (err error) {
+	defer hdb.observe(ctx, "delete_entity", time.Now(), &err, slog.String("identity", identity), slog.Int("entity_id", id))
+	defer hdb.subscribers.rules_changed(identity, &err)
 	const query = "DELETE FROM entities WHERE identity=$1 AND id = $2;"
 
-	_, err := hdb.db.Exec(query, identity, id)
-	if err != nil {
-		log.Printf("An error occured during deleting the entity with id = %d: %s\n", id, err.Error())
-	}
-	return err
+	return hdb.with_tx(ctx, func(tx *sql.Tx) error {
+		ruleIDs, err := hdb.get_rule_ids(ctx, tx, "identity=$1 AND entity_id=$2", identity, id)
+		if err != nil {
+			return err
+		}
+		if err = hdb.delete_rules(ctx, tx, identity, ruleIDs); err != nil {
+			return err
+		}
+		// the service and set state actions of other rules for the entity
+		err = hdb.delete_actions(ctx, tx, identity, "target_id=$2 OR state_change_id IN (SELECT id FROM state_changes WHERE identity=$1 AND entity_id=$2)", id)
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.ExecContext(ctx, query, identity, id)
+		return affected_or_not_found(result, err, "the entity %d of %s does not exist", id, identity)
+	})
 }
 
 func (hdb *HonuaDatabase) EditEntity(identifier string, entity *models.Entity) error {
+	return hdb.EditEntityContext(context.Background(), identifier, entity)
+}
+
+func (hdb *HonuaDatabase) EditEntityContext(ctx context.Context, identifier string, entity *models.Entity) (err error) {
+	defer hdb.observe(ctx, "edit_entity", time.Now(), &err, slog.String("identity", entity.IdentityId), slog.String("entity_id", entity.EntityId))
+	defer hdb.subscribers.rules_changed(entity.IdentityId, &err)
 	const query = `
 UPDATE entities
-SET name = $1, is_device = $2, allow_rules = $3, has_attribute = $4, attribute = $5, is_victron_sensor = $6, sensor_type = $7, has_numeric_state = $8
-WHERE identity = $9 AND entity_id = $10;
+SET name = $1, is_device = $2, allow_rules = $3, has_attribute = $4, attribute = $5, is_victron_sensor = $6, sensor_type = $7, has_numeric_state = $8, rules_enabled = $9
+WHERE identity = $10 AND entity_id = $11
+RETURNING id;
 	`
 
 	var attributeString sql.NullString = sql.NullString{
@@ -145,24 +128,61 @@ WHERE identity = $9 AND entity_id = $10;
 
 	entity.HasAttribute = attributeString.Valid
 
-	_, err := hdb.db.Exec(query, entity.Name, entity.IsDevice, entity.AllowRules, entity.HasAttribute, attributeString, entity.IsVictronSensor, entity.SensorType, entity.HasNumericState, entity.IdentityId, entity.EntityId)
+	return hdb.with_tx(ctx, func(tx *sql.Tx) error {
+		var id int
+		err := tx.QueryRowContext(ctx, query, entity.Name, entity.IsDevice, entity.AllowRules, entity.HasAttribute, attributeString, entity.IsVictronSensor, entity.SensorType, entity.HasNumericState, entity.RulesEnabled, entity.IdentityId, entity.EntityId).Scan(&id)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("%w: the entity %s of %s does not exist", ErrNotFound, entity.EntityId, entity.IdentityId)
+		}
+		if err != nil {
+			return map_error(err)
+		}
+		// disabled rules do not finish their running actions
+		if !entity.RulesEnabled {
+			return hdb.delete_entity_action_runs(ctx, tx, entity.IdentityId, id)
+		}
+		return nil
+	})
+}
 
-	if err != nil {
-		log.Printf("An error occured during editity entitiy: %s\n", err.Error())
-	}
-	return err
+// SetEntityRulesEnabled switches all rules targeting the entity on or off,
+// switching them off cancels their running actions
+func (hdb *HonuaDatabase) SetEntityRulesEnabled(identity string, id int, enabled bool) error {
+	return hdb.SetEntityRulesEnabledContext(context.Background(), identity, id, enabled)
+}
+
+func (hdb *HonuaDatabase) SetEntityRulesEnabledContext(ctx context.Context, identity string, id int, enabled bool) (err error) {
+	defer hdb.observe(ctx, "set_entity_rules_enabled", time.Now(), &err, slog.String("identity", identity), slog.Int("entity_id", id), slog.Bool("enabled", enabled))
+	defer hdb.subscribers.rules_changed(identity, &err)
+	const query = "UPDATE entities SET rules_enabled = $1 WHERE identity = $2 AND id = $3;"
+
+	return hdb.with_tx(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, query, enabled, identity, id)
+		if err := affected_or_not_found(result, err, "the entity %d of %s does not exist", id, identity); err != nil {
+			return err
+		}
+		// disabled rules do not finish their running actions
+		if !enabled {
+			return hdb.delete_entity_action_runs(ctx, tx, identity, id)
+		}
+		return nil
+	})
 }
 
 // Checkt, ob eine Entität existiert die einen bestimmten Identifier und eine EntityID hat
 func (hdb *HonuaDatabase) ExistEntity(identifier string, id int, hasAttribute bool, attribute string) (bool, error) {
+	return hdb.ExistEntityContext(context.Background(), identifier, id, hasAttribute, attribute)
+}
+
+func (hdb *HonuaDatabase) ExistEntityContext(ctx context.Context, identifier string, id int, hasAttribute bool, attribute string) (_ bool, err error) {
+	defer hdb.observe(ctx, "exist_entity", time.Now(), &err, slog.String("identity", identifier), slog.Int("entity_id", id))
 
 	if hasAttribute {
 		const query = "SELECT CASE WHEN EXISTS ( SELECT * FROM entities WHERE identity = $1 AND id = $2 AND has_attribute AND attribute = $3) THEN true ELSE false END"
 
-		rows, err := hdb.db.Query(query, identifier, id, attribute)
+		rows, err := hdb.db.QueryContext(ctx, query, identifier, id, attribute)
 		if err != nil {
-			log.Printf("An error occured during checking if the entity %d exists in %s: %s\n", id, identifier, err.Error())
-			return false, err
+			return false, map_error(err)
 		}
 
 		var state bool = false
@@ -171,8 +191,7 @@ func (hdb *HonuaDatabase) ExistEntity(identifier string, id int, hasAttribute bo
 			err = rows.Scan(&state)
 			if err != nil {
 				rows.Close()
-				log.Printf("An error occured during checking if the entity %d exists in %s: %s\n", id, identifier, err.Error())
-				return false, err
+				return false, map_error(err)
 			}
 		}
 
@@ -183,10 +202,9 @@ func (hdb *HonuaDatabase) ExistEntity(identifier string, id int, hasAttribute bo
 
 	const query = "SELECT CASE WHEN EXISTS ( SELECT * FROM entities WHERE identity = $1 AND id = $2 AND NOT has_attribute) THEN true ELSE false END"
 
-	rows, err := hdb.db.Query(query, identifier, id)
+	rows, err := hdb.db.QueryContext(ctx, query, identifier, id)
 	if err != nil {
-		log.Printf("An error occured during checking if the entity %d exists in %s: %s\n", id, identifier, err.Error())
-		return false, err
+		return false, map_error(err)
 	}
 
 	var state bool = false
@@ -195,8 +213,7 @@ func (hdb *HonuaDatabase) ExistEntity(identifier string, id int, hasAttribute bo
 		err = rows.Scan(&state)
 		if err != nil {
 			rows.Close()
-			log.Printf("An error occured during checking if the entity %d exists in %s: %s\n", id, identifier, err.Error())
-			return false, err
+			return false, map_error(err)
 		}
 	}
 
@@ -206,12 +223,16 @@ func (hdb *HonuaDatabase) ExistEntity(identifier string, id int, hasAttribute bo
 }
 
 func (hdb *HonuaDatabase) GetIdOfEntity(identifier, entityId string) (int, error) {
+	return hdb.GetIdOfEntityContext(context.Background(), identifier, entityId)
+}
+
+func (hdb *HonuaDatabase) GetIdOfEntityContext(ctx context.Context, identifier, entityId string) (_ int, err error) {
+	defer hdb.observe(ctx, "get_id_of_entity", time.Now(), &err, slog.String("identity", identifier), slog.String("entity_id", entityId))
 	const query = "SELECT id FROM entities WHERE identity = $1 AND entity_id = $2"
 
-	rows, err := hdb.db.Query(query, identifier, entityId)
+	rows, err := hdb.db.QueryContext(ctx, query, identifier, entityId)
 	if err != nil {
-		log.Printf("An error occured during checking the id of entity (%s, %s): %s\n", identifier, entityId, err.Error())
-		return -1, err
+		return -1, map_error(err)
 	}
 
 	var id int = -1
@@ -220,23 +241,30 @@ func (hdb *HonuaDatabase) GetIdOfEntity(identifier, entityId string) (int, error
 		err = rows.Scan(&id)
 		if err != nil {
 			rows.Close()
-			log.Printf("An error occured during checking the id of entity (%s, %s): %s\n", identifier, entityId, err.Error())
-			return -1, err
+			return -1, map_error(err)
 		}
 	}
 
 	rows.Close()
 
+	if id == -1 {
+		return -1, fmt.Errorf("%w: the entity %s of %s does not exist", ErrNotFound, entityId, identifier)
+	}
+
 	return id, nil
 }
 
 func (hdb *HonuaDatabase) GetEntities(identifier string) ([]*models.Entity, error) {
+	return hdb.GetEntitiesContext(context.Background(), identifier)
+}
+
+func (hdb *HonuaDatabase) GetEntitiesContext(ctx context.Context, identifier string) (_ []*models.Entity, err error) {
+	defer hdb.observe(ctx, "get_entities", time.Now(), &err, slog.String("identity", identifier))
 	const query = "SELECT * FROM entities WHERE identity = $1;"
 
-	rows, err := hdb.db.Query(query, identifier)
+	rows, err := hdb.db.QueryContext(ctx, query, identifier)
 	if err != nil {
-		log.Printf("An error occured during getting all entities of identity = %s: %s\n", identifier, err.Error())
-		return nil, err
+		return nil, map_error(err)
 	}
 
 	var result []*models.Entity = []*models.Entity{}
@@ -245,7 +273,6 @@ func (hdb *HonuaDatabase) GetEntities(identifier string) ([]*models.Entity, erro
 		entity, err := hdb.make_entity(rows)
 		if err != nil {
 			rows.Close()
-			log.Printf("An error occured during getting all entities of identity = %s: %s\n", identifier, err.Error())
 			return nil, err
 		}
 		result = append(result, entity)
@@ -257,12 +284,16 @@ func (hdb *HonuaDatabase) GetEntities(identifier string) ([]*models.Entity, erro
 }
 
 func (hdb *HonuaDatabase) GetEntitiesWhereRulesAreAllowed(identifier string) ([]*models.Entity, error) {
+	return hdb.GetEntitiesWhereRulesAreAllowedContext(context.Background(), identifier)
+}
+
+func (hdb *HonuaDatabase) GetEntitiesWhereRulesAreAllowedContext(ctx context.Context, identifier string) (_ []*models.Entity, err error) {
+	defer hdb.observe(ctx, "get_entities_where_rules_are_allowed", time.Now(), &err, slog.String("identity", identifier))
 	const query = "SELECT * FROM entities WHERE identity = $1 AND allow_rules;"
 
-	rows, err := hdb.db.Query(query, identifier)
+	rows, err := hdb.db.QueryContext(ctx, query, identifier)
 	if err != nil {
-		log.Printf("An error occured during getting all entities of identity = %s: %s\n", identifier, err.Error())
-		return nil, err
+		return nil, map_error(err)
 	}
 
 	var result []*models.Entity = []*models.Entity{}
@@ -271,7 +302,6 @@ func (hdb *HonuaDatabase) GetEntitiesWhereRulesAreAllowed(identifier string) ([]
 		entity, err := hdb.make_entity(rows)
 		if err != nil {
 			rows.Close()
-			log.Printf("An error occured during getting all entities of identity = %s: %s\n", identifier, err.Error())
 			return nil, err
 		}
 		result = append(result, entity)
@@ -283,25 +313,27 @@ func (hdb *HonuaDatabase) GetEntitiesWhereRulesAreAllowed(identifier string) ([]
 }
 
 func (hdb *HonuaDatabase) GetEntitiesWithoutRule(identifier string) ([]*models.Entity, error) {
+	return hdb.GetEntitiesWithoutRuleContext(context.Background(), identifier)
+}
+
+func (hdb *HonuaDatabase) GetEntitiesWithoutRuleContext(ctx context.Context, identifier string) (_ []*models.Entity, err error) {
+	defer hdb.observe(ctx, "get_entities_without_rule", time.Now(), &err, slog.String("identity", identifier))
 
-	existRules, err := hdb.ExistRules(identifier)
+	existRules, err := hdb.ExistRulesContext(ctx, identifier)
 	if err != nil {
-		log.Printf("An error occured during getting all entities without rule of identity = %s: %s\n", identifier, err.Error())
 		return nil, err
 	}
 	if !existRules {
-		entities, err := hdb.GetEntities(identifier)
+		entities, err := hdb.GetEntitiesContext(ctx, identifier)
 		if err != nil {
-			log.Printf("An error occured during getting all entities without rule of identity = %s: %s\n", identifier, err.Error())
 			return nil, err
 		}
 		return entities, nil
 	}
 	const query = "SELECT * FROM entities WHERE identity=$1 AND id NOT IN (SELECT entity_id FROM rules WHERE identity=$1);"
-	rows, err := hdb.db.Query(query, identifier)
+	rows, err := hdb.db.QueryContext(ctx, query, identifier)
 	if err != nil {
-		log.Printf("An error occured during getting all entities without rule of identity = %s: %s\n", identifier, err.Error())
-		return nil, err
+		return nil, map_error(err)
 	}
 	var result []*models.Entity = []*models.Entity{}
 
@@ -309,7 +341,6 @@ func (hdb *HonuaDatabase) GetEntitiesWithoutRule(identifier string) ([]*models.E
 		entity, err := hdb.make_entity(rows)
 		if err != nil {
 			rows.Close()
-			log.Printf("An error occured during getting all entities of identity = %s: %s\n", identifier, err.Error())
 			return nil, err
 		}
 		result = append(result, entity)
@@ -321,12 +352,16 @@ func (hdb *HonuaDatabase) GetEntitiesWithoutRule(identifier string) ([]*models.E
 }
 
 func (hdb *HonuaDatabase) GetVictronEntities(identifier string) ([]*models.Entity, error) {
+	return hdb.GetVictronEntitiesContext(context.Background(), identifier)
+}
+
+func (hdb *HonuaDatabase) GetVictronEntitiesContext(ctx context.Context, identifier string) (_ []*models.Entity, err error) {
+	defer hdb.observe(ctx, "get_victron_entities", time.Now(), &err, slog.String("identity", identifier))
 	const query = "SELECT * FROM entities WHERE identity = $1 AND is_victron_sensor;"
 
-	rows, err := hdb.db.Query(query, identifier)
+	rows, err := hdb.db.QueryContext(ctx, query, identifier)
 	if err != nil {
-		log.Printf("An error occured during getting all entities of identity = %s: %s\n", identifier, err.Error())
-		return nil, err
+		return nil, map_error(err)
 	}
 
 	var result []*models.Entity = []*models.Entity{}
@@ -335,7 +370,6 @@ func (hdb *HonuaDatabase) GetVictronEntities(identifier string) ([]*models.Entit
 		entity, err := hdb.make_entity(rows)
 		if err != nil {
 			rows.Close()
-			log.Printf("An error occured during getting all entities of identity = %s: %s\n", identifier, err.Error())
 			return nil, err
 		}
 		result = append(result, entity)
@@ -346,6 +380,34 @@ func (hdb *HonuaDatabase) GetVictronEntities(identifier string) ([]*models.Entit
 	return result, nil
 }
 
+// get_entities_by_id loads the entities with the given ids in one query
+func (hdb *HonuaDatabase) get_entities_by_id(ctx context.Context, q querier, identity string, ids []int) (map[int]*models.Entity, error) {
+	const query = "SELECT * FROM entities WHERE identity=$1 AND id = ANY($2);"
+
+	var result map[int]*models.Entity = map[int]*models.Entity{}
+	if len(ids) == 0 {
+		return result, nil
+	}
+
+	rows, err := q.QueryContext(ctx, query, identity, pq.Array(ids))
+	if err != nil {
+		return nil, map_error(err)
+	}
+
+	for rows.Next() {
+		entity, err := hdb.make_entity(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		result[entity.Id] = entity
+	}
+
+	rows.Close()
+
+	return result, nil
+}
+
 func (hdb *HonuaDatabase) make_entity(rows *sql.Rows) (*models.Entity, error) {
 	var id int
 	var identity string
@@ -362,7 +424,7 @@ func (hdb *HonuaDatabase) make_entity(rows *sql.Rows) (*models.Entity, error) {
 
 	err := rows.Scan(&id, &identity, &entityID, &name, &isDevice, &allowRules, &hasAttribute, &attribute, &isVictronSensor, &hasNumericState, &rulesEnabled, &sensorType)
 	if err != nil {
-		return nil, err
+		return nil, map_error(err)
 	}
 
 	var result *models.Entity = &models.Entity{
@@ -0,0 +1,82 @@
+package honuadatabase
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// Errors returned by the Store implementations. They can be checked with
+// errors.Is, the returned errors wrap the error of the database driver.
+var (
+	ErrNotFound            = errors.New("not found")
+	ErrAlreadyExists       = errors.New("already exists")
+	ErrForeignKeyViolation = errors.New("foreign key violation")
+	ErrInvalidCondition    = errors.New("invalid condition")
+	ErrUnsupportedType     = errors.New("unsupported type")
+	ErrInvalidActionOrder  = errors.New("invalid action order")
+	ErrInvalidAction       = errors.New("invalid action")
+	ErrServiceNotAllowed   = errors.New("service not allowed")
+	ErrInvalidLocation     = errors.New("invalid location")
+)
+
+var sentinel_errors = []error{
+	ErrNotFound,
+	ErrAlreadyExists,
+	ErrForeignKeyViolation,
+	ErrInvalidCondition,
+	ErrUnsupportedType,
+	ErrInvalidActionOrder,
+	ErrInvalidAction,
+	ErrServiceNotAllowed,
+	ErrInvalidLocation,
+}
+
+// map_error translates an error of the database driver to one of the errors
+// above. Errors that are already mapped and unknown errors are returned as they are.
+func map_error(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	for _, sentinel := range sentinel_errors {
+		if errors.Is(err, sentinel) {
+			return err
+		}
+	}
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Name() {
+		case "unique_violation":
+			return fmt.Errorf("%w: %w", ErrAlreadyExists, err)
+		case "foreign_key_violation":
+			return fmt.Errorf("%w: %w", ErrForeignKeyViolation, err)
+		}
+	}
+
+	return err
+}
+
+// affected_or_not_found maps the error of an UPDATE or DELETE statement and
+// returns ErrNotFound if the statement did not change any row.
+func affected_or_not_found(result sql.Result, err error, format string, args ...any) error {
+	if err != nil {
+		return map_error(err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: %s", ErrNotFound, fmt.Sprintf(format, args...))
+	}
+	return nil
+}
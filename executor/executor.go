@@ -0,0 +1,749 @@
+// Package executor runs the then or else actions of evaluated rules. Every
+// run is stored with its position and the end of its running delay, so the
+// runs continue after a restart.
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	honuadatabase "github.com/JonasBordewick/honua-database"
+	"github.com/JonasBordewick/honua-database/clock"
+	"github.com/JonasBordewick/honua-database/engine"
+	"github.com/JonasBordewick/honua-database/expression"
+	"github.com/JonasBordewick/honua-database/models"
+	"github.com/JonasBordewick/honua-database/scheduler"
+)
+
+var (
+	ErrRunning    = errors.New("the executor is already running")
+	ErrNotRunning = errors.New("the executor is not running")
+	// ErrUnsupportedAction is returned for an action that can not be executed,
+	// like a NOTIFY action without a Notifier
+	ErrUnsupportedAction = errors.New("the action is not supported")
+)
+
+var (
+	// errDeleted stops a run whose stored run was deleted, because its rule
+	// was edited, disabled or deleted
+	errDeleted = errors.New("the action run was deleted")
+	// errCancelled stops a run that was cancelled with Cancel
+	errCancelled = errors.New("the action run was cancelled")
+)
+
+// ServiceCall is a call of a Home Assistant service
+type ServiceCall struct {
+	Domain  string
+	Service string
+	// EntityID is the Home Assistant entity id of the target, it is empty for scenes
+	EntityID string
+	Data     json.RawMessage
+}
+
+// ServiceCaller calls the services of SERVICE and SCENE actions. A scene is
+// applied with the service scene.apply.
+type ServiceCaller interface {
+	CallService(ctx context.Context, identity string, call *ServiceCall) error
+}
+
+// Notifier sends the notifications of NOTIFY actions, the message of the
+// notification is already rendered
+type Notifier interface {
+	Notify(ctx context.Context, identity string, notification *models.Notification) error
+}
+
+// Executor runs the actions of rules, it implements scheduler.Executor. A
+// rule has at most one run, while it runs new results of the rule are ignored.
+// A run is stopped as soon as the store reports that its rule was edited,
+// disabled or deleted.
+type Executor struct {
+	store    honuadatabase.Store
+	caller   ServiceCaller
+	notifier Notifier
+	engine   *engine.Engine
+	clock    clock.Clock
+	poll     time.Duration
+	logger   *slog.Logger
+
+	mutex   sync.Mutex
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running map[runKey]*running
+	wg      sync.WaitGroup
+
+	unsubscribe func()
+	// changed are the identities whose rules were changed, their running
+	// runs are checked by handle_changes
+	changedMutex sync.Mutex
+	changed      map[string]bool
+}
+
+type runKey struct {
+	identity string
+	ruleID   int
+}
+
+type running struct {
+	id     int
+	cancel context.CancelCauseFunc
+}
+
+type Option func(*Executor)
+
+// WithClock replaces the system clock, for the delays and the waits
+func WithClock(c clock.Clock) Option {
+	return func(e *Executor) {
+		e.clock = c
+	}
+}
+
+// WithNotifier sets the Notifier of NOTIFY actions, without one they fail
+func WithNotifier(n Notifier) Option {
+	return func(e *Executor) {
+		e.notifier = n
+	}
+}
+
+// WithPollInterval sets how often the condition of a WAIT_UNTIL action is
+// evaluated and the shortest iteration of a REPEAT without a count, default
+// is 10 seconds. A d <= 0 keeps the default.
+func WithPollInterval(d time.Duration) Option {
+	return func(e *Executor) {
+		if d > 0 {
+			e.poll = d
+		}
+	}
+}
+
+// WithLogger sets the logger, default is a logger that discards everything
+func WithLogger(logger *slog.Logger) Option {
+	return func(e *Executor) {
+		e.logger = logger
+	}
+}
+
+func New(store honuadatabase.Store, caller ServiceCaller, options ...Option) *Executor {
+	e := &Executor{
+		store:  store,
+		caller: caller,
+		clock:  clock.System(),
+		poll:   10 * time.Second,
+		logger: honuadatabase.DiscardLogger(),
+	}
+	for _, option := range options {
+		option(e)
+	}
+	e.engine = engine.New(engine.WithClock(e.clock))
+	return e
+}
+
+// Start resumes the stored runs of every identity. The runs are executed
+// until ctx is done or Stop is called.
+func (e *Executor) Start(ctx context.Context) error {
+	e.mutex.Lock()
+	if e.cancel != nil {
+		e.mutex.Unlock()
+		return ErrRunning
+	}
+	e.ctx, e.cancel = context.WithCancel(ctx)
+	e.running = map[runKey]*running{}
+	signal := make(chan struct{}, 1)
+	e.unsubscribe = e.store.SubscribeRules(func(identity string) {
+		e.on_rules(signal, identity)
+	})
+	e.wg.Add(1)
+	go e.handle_changes(e.ctx, signal)
+	e.mutex.Unlock()
+
+	if err := e.resume(ctx); err != nil {
+		e.Stop()
+		return err
+	}
+	return nil
+}
+
+// Stop stops the runs and waits for them. The stored runs are kept, so they
+// are resumed by the next Start.
+func (e *Executor) Stop() {
+	e.mutex.Lock()
+	if e.cancel == nil {
+		e.mutex.Unlock()
+		return
+	}
+	e.cancel()
+	e.unsubscribe()
+	e.cancel = nil
+	e.running = nil
+	e.mutex.Unlock()
+
+	e.wg.Wait()
+}
+
+// Execute starts the actions of the result of the run, it does not wait for them
+func (e *Executor) Execute(ctx context.Context, run *scheduler.Run) error {
+	if len(run.Result.Actions) == 0 {
+		return nil
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.cancel == nil {
+		return ErrNotRunning
+	}
+
+	key := runKey{identity: run.Identity, ruleID: run.Rule.Id}
+	if r, ok := e.running[key]; ok {
+		// the running run is only replaced if its stored run was deleted
+		_, err := e.store.GetActionRunContext(ctx, run.Identity, r.id)
+		if err == nil {
+			e.logger.DebugContext(ctx, "The rule is still running", slog.String("identity", run.Identity), slog.Int("rule_id", run.Rule.Id))
+			if run.RuleRun != nil {
+				e.finish_rule_run(ctx, run.Identity, run.RuleRun.Id, "the actions were skipped, the rule is still running")
+			}
+			return nil
+		}
+		if !errors.Is(err, honuadatabase.ErrNotFound) {
+			return err
+		}
+		r.cancel(errDeleted)
+		delete(e.running, key)
+	}
+
+	actionRun := &models.ActionRun{
+		RuleID:       run.Rule.Id,
+		IsThenAction: run.Result.Branch == engine.Then,
+		Position:     []models.ActionPosition{{Index: 0}},
+	}
+	if run.RuleRun != nil {
+		id := run.RuleRun.Id
+		actionRun.RuleRunID = &id
+	}
+	if err := e.store.AddActionRunContext(ctx, run.Identity, actionRun); err != nil {
+		return err
+	}
+	e.launch(run.Identity, run.Rule, actionRun)
+	return nil
+}
+
+// Cancel stops the run of the rule and deletes it
+func (e *Executor) Cancel(ctx context.Context, identity string, ruleID int) error {
+	e.mutex.Lock()
+	key := runKey{identity: identity, ruleID: ruleID}
+	if r, ok := e.running[key]; ok {
+		r.cancel(errCancelled)
+		delete(e.running, key)
+	}
+	e.mutex.Unlock()
+
+	return e.store.DeleteActionRunsOfRuleContext(ctx, identity, ruleID)
+}
+
+// on_rules is called when the rules of the identity were changed, it must not block
+func (e *Executor) on_rules(signal chan<- struct{}, identity string) {
+	e.changedMutex.Lock()
+	if e.changed == nil {
+		e.changed = map[string]bool{}
+	}
+	e.changed[identity] = true
+	e.changedMutex.Unlock()
+
+	select {
+	case signal <- struct{}{}:
+	default:
+		// a signal is waiting already, it checks this identity too
+	}
+}
+
+// handle_changes stops the running runs of the changed identities whose
+// stored run was deleted, because their rule was edited, disabled or deleted
+func (e *Executor) handle_changes(ctx context.Context, signal <-chan struct{}) {
+	defer e.wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signal:
+		}
+
+		e.changedMutex.Lock()
+		changed := e.changed
+		e.changed = nil
+		e.changedMutex.Unlock()
+
+		for identity := range changed {
+			if err := e.stop_deleted(ctx, identity); err != nil && ctx.Err() == nil {
+				e.logger.ErrorContext(ctx, "Error while checking the runs of the changed rules", slog.String("identity", identity), slog.Any("error", err))
+			}
+		}
+	}
+}
+
+// stop_deleted cancels the running runs of the identity whose stored run is gone
+func (e *Executor) stop_deleted(ctx context.Context, identity string) error {
+	e.mutex.Lock()
+	ids := map[runKey]int{}
+	for key, r := range e.running {
+		if key.identity == identity {
+			ids[key] = r.id
+		}
+	}
+	e.mutex.Unlock()
+
+	for key, id := range ids {
+		_, err := e.store.GetActionRunContext(ctx, identity, id)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, honuadatabase.ErrNotFound) {
+			return err
+		}
+		e.mutex.Lock()
+		// the run may have finished or been replaced meanwhile
+		if r, ok := e.running[key]; ok && r.id == id {
+			r.cancel(errDeleted)
+			delete(e.running, key)
+		}
+		e.mutex.Unlock()
+	}
+	return nil
+}
+
+// resume starts the stored runs, runs of rules that do not exist anymore are deleted
+func (e *Executor) resume(ctx context.Context) error {
+	identities, err := e.store.GetIdentitiesContext(ctx)
+	if err != nil {
+		return err
+	}
+	for _, identity := range identities {
+		runs, err := e.store.GetActionRunsContext(ctx, identity.Id)
+		if err != nil {
+			return err
+		}
+		for _, run := range runs {
+			rule, err := e.store.GetRuleContext(ctx, identity.Id, run.RuleID)
+			if errors.Is(err, honuadatabase.ErrNotFound) {
+				err = e.delete(ctx, identity.Id, run.Id)
+			}
+			if err != nil {
+				return err
+			}
+			if rule == nil {
+				continue
+			}
+
+			e.mutex.Lock()
+			if e.cancel == nil {
+				e.mutex.Unlock()
+				return ErrNotRunning
+			}
+			_, duplicate := e.running[runKey{identity: identity.Id, ruleID: rule.Id}]
+			if !duplicate {
+				e.launch(identity.Id, rule, run)
+			}
+			e.mutex.Unlock()
+
+			if duplicate {
+				if err := e.delete(ctx, identity.Id, run.Id); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// launch starts the run in a goroutine, the mutex must be held
+func (e *Executor) launch(identity string, rule *models.Rule, run *models.ActionRun) {
+	ctx, cancel := context.WithCancelCause(e.ctx)
+	e.running[runKey{identity: identity, ruleID: rule.Id}] = &running{id: run.Id, cancel: cancel}
+	e.wg.Add(1)
+	go e.execute(ctx, identity, rule, run)
+}
+
+func (e *Executor) execute(ctx context.Context, identity string, rule *models.Rule, actionRun *models.ActionRun) {
+	defer e.wg.Done()
+
+	r := &run{ActionRun: actionRun, identity: identity, rule: rule, resume: actionRun.Position, resumeAt: actionRun.ResumeAt}
+	actions := rule.ThenActions
+	if !actionRun.IsThenAction {
+		actions = rule.ElseActions
+	}
+	defer e.finish(identity, rule.Id, actionRun.Id)
+	_, err := e.list(ctx, r, actions, nil)
+
+	if cause := context.Cause(ctx); errors.Is(cause, errCancelled) || errors.Is(cause, errDeleted) {
+		err = cause
+	} else if ctx.Err() != nil {
+		// a stopped run is resumed after the restart
+		return
+	}
+
+	var failure string
+	switch {
+	case errors.Is(err, errCancelled) || errors.Is(err, errDeleted):
+		e.logger.InfoContext(ctx, "The action run was cancelled", slog.String("identity", identity), slog.Int("rule_id", rule.Id))
+		failure = err.Error()
+		ctx = context.WithoutCancel(ctx)
+	case err != nil:
+		e.logger.ErrorContext(ctx, "Error while executing the actions", slog.String("identity", identity), slog.Int("rule_id", rule.Id), slog.Any("position", r.Position), slog.Any("error", err))
+		failure = err.Error()
+		fallthrough
+	default:
+		if err := e.delete(ctx, identity, actionRun.Id); err != nil {
+			e.logger.ErrorContext(ctx, "Error while deleting the action run", slog.String("identity", identity), slog.Int("rule_id", rule.Id), slog.Any("error", err))
+		}
+	}
+	if actionRun.RuleRunID != nil {
+		e.finish_rule_run(ctx, identity, *actionRun.RuleRunID, failure)
+	}
+}
+
+// finish removes the run from the running runs, unless it was replaced
+func (e *Executor) finish(identity string, ruleID, id int) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	key := runKey{identity: identity, ruleID: ruleID}
+	if r, ok := e.running[key]; ok && r.id == id {
+		r.cancel(nil)
+		delete(e.running, key)
+	}
+}
+
+// finish_rule_run records the end of the actions, a pruned rule run is not an error
+func (e *Executor) finish_rule_run(ctx context.Context, identity string, id int, failure string) {
+	err := e.store.FinishRuleRunContext(ctx, identity, id, e.clock.Now(), failure)
+	if err != nil && !errors.Is(err, honuadatabase.ErrNotFound) {
+		e.logger.ErrorContext(ctx, "Error while recording the rule run", slog.String("identity", identity), slog.Int("rule_run_id", id), slog.Any("error", err))
+	}
+}
+
+// record adds the outcome of the action to the recorded rule run
+func (e *Executor) record(ctx context.Context, r *run, a *models.Action, here []models.ActionPosition, started time.Time, timedOut bool, err error) {
+	if r.RuleRunID == nil || ctx.Err() != nil {
+		return
+	}
+	outcome := &models.ActionOutcome{
+		ActionID:  a.Id,
+		Type:      a.Type,
+		Position:  append([]models.ActionPosition{}, here...),
+		StartedAt: started,
+		Duration:  e.clock.Now().Sub(started),
+		TimedOut:  timedOut,
+	}
+	if err != nil {
+		outcome.Error = err.Error()
+	}
+	err = e.store.AddRuleRunActionContext(ctx, r.identity, *r.RuleRunID, outcome)
+	if err != nil && !errors.Is(err, honuadatabase.ErrNotFound) {
+		e.logger.ErrorContext(ctx, "Error while recording the action", slog.String("identity", r.identity), slog.Int("rule_run_id", *r.RuleRunID), slog.Any("error", err))
+	}
+}
+
+func (e *Executor) delete(ctx context.Context, identity string, id int) error {
+	err := e.store.DeleteActionRunContext(ctx, identity, id)
+	if errors.Is(err, honuadatabase.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// run is a run that is being executed
+type run struct {
+	*models.ActionRun
+	identity string
+	rule     *models.Rule
+	// resume is the rest of the stored position, it is used up while the
+	// run descends to the action it continues with
+	resume []models.ActionPosition
+	// resumeAt is the stored end of the delay or timeout of the wait the run continues with
+	resumeAt *time.Time
+}
+
+// take_resume_at returns the stored resume time once
+func (r *run) take_resume_at() *time.Time {
+	t := r.resumeAt
+	r.resumeAt = nil
+	return t
+}
+
+// save stores the position of the running action, errDeleted if the stored run is gone
+func (e *Executor) save(ctx context.Context, r *run, here []models.ActionPosition, resumeAt *time.Time) error {
+	r.Position = append([]models.ActionPosition{}, here...)
+	r.ResumeAt = resumeAt
+	err := e.store.UpdateActionRunContext(ctx, r.identity, r.ActionRun)
+	if errors.Is(err, honuadatabase.ErrNotFound) {
+		return errDeleted
+	}
+	return err
+}
+
+// list runs the actions in their order, path is the position of the list.
+// ended is true if the run must not continue with the following actions.
+func (e *Executor) list(ctx context.Context, r *run, actions []*models.Action, path []models.ActionPosition) (ended bool, err error) {
+	start := 0
+	var resumed *models.ActionPosition
+	if len(r.resume) > 0 {
+		p := r.resume[0]
+		r.resume = r.resume[1:]
+		resumed = &p
+		start = p.Index
+	}
+
+	for i := start; i < len(actions); i++ {
+		here := append(append([]models.ActionPosition{}, path...), models.ActionPosition{Index: i})
+		if resumed != nil && i == start {
+			here[len(here)-1] = *resumed
+		}
+		if ended, err = e.action(ctx, r, actions[i], here); ended || err != nil {
+			return ended, err
+		}
+	}
+	return false, nil
+}
+
+func (e *Executor) action(ctx context.Context, r *run, a *models.Action, here []models.ActionPosition) (bool, error) {
+	switch a.Type {
+	case models.WAIT_UNTIL:
+		return e.wait(ctx, r, a, here)
+	case models.REPEAT:
+		return e.repeat(ctx, r, a, here)
+	case models.DELAY:
+		return false, e.delay(ctx, r, a, here)
+	}
+
+	if err := e.save(ctx, r, here, nil); err != nil {
+		return false, err
+	}
+
+	started := e.clock.Now()
+	var err error
+	switch a.Type {
+	case models.SERVICE:
+		err = e.service(ctx, r, a)
+	case models.NOTIFY:
+		err = e.notify(ctx, r, a)
+	case models.SET_STATE:
+		if a.StateChange == nil || a.StateChange.Entity == nil {
+			err = fmt.Errorf("%w: action %d has no state change", ErrUnsupportedAction, a.Id)
+			break
+		}
+		err = e.store.AddStateContext(ctx, r.identity, &models.State{EntityId: a.StateChange.Entity.Id, State: a.StateChange.State})
+	case models.SWITCH_RULE:
+		if a.RuleSwitch == nil {
+			err = fmt.Errorf("%w: action %d has no rule switch", ErrUnsupportedAction, a.Id)
+			break
+		}
+		err = e.store.SetRuleEnabledContext(ctx, r.identity, a.RuleSwitch.RuleID, a.RuleSwitch.Enabled)
+	case models.SCENE:
+		err = e.scene(ctx, r, a)
+	default:
+		err = fmt.Errorf("%w: the action type %d of action %d", ErrUnsupportedAction, a.Type, a.Id)
+	}
+	e.record(ctx, r, a, here, started, false, err)
+	if err != nil {
+		return false, fmt.Errorf("action %d: %w", a.Id, err)
+	}
+	return false, nil
+}
+
+func (e *Executor) service(ctx context.Context, r *run, a *models.Action) error {
+	target := a.Target
+	if target == nil {
+		target = r.rule.Target
+	}
+	if target == nil {
+		return fmt.Errorf("%w: the service %s.%s has no target", ErrUnsupportedAction, a.Service, a.ServiceName)
+	}
+	return e.caller.CallService(ctx, r.identity, &ServiceCall{Domain: a.Service, Service: a.ServiceName, EntityID: target.EntityId, Data: a.ServiceData})
+}
+
+// notify sends the notification with its message rendered with the latest
+// states, it fails if an entity of the message has no state
+func (e *Executor) notify(ctx context.Context, r *run, a *models.Action) error {
+	if e.notifier == nil || a.Notification == nil {
+		return fmt.Errorf("%w: action %d has no notifier", ErrUnsupportedAction, a.Id)
+	}
+	message, err := expression.ParseMessage(a.Notification.Message)
+	if err != nil {
+		return err
+	}
+
+	var states map[string]string = map[string]string{}
+	for _, name := range message.Entities() {
+		id, err := e.store.GetIdOfEntityContext(ctx, r.identity, name)
+		if err == nil {
+			var state *models.State
+			state, err = e.store.GetStateContext(ctx, r.identity, id)
+			if err == nil {
+				states[name] = state.State
+				continue
+			}
+		}
+		if !errors.Is(err, honuadatabase.ErrNotFound) {
+			return err
+		}
+	}
+
+	text, err := message.Render(func(name string) (string, bool) {
+		state, ok := states[name]
+		return state, ok
+	})
+	if err != nil {
+		return err
+	}
+	notification := *a.Notification
+	notification.Message = text
+	return e.notifier.Notify(ctx, r.identity, &notification)
+}
+
+func (e *Executor) scene(ctx context.Context, r *run, a *models.Action) error {
+	if a.Scene == nil {
+		return fmt.Errorf("%w: action %d has no scene", ErrUnsupportedAction, a.Id)
+	}
+	var entities map[string]string = map[string]string{}
+	for _, state := range a.Scene.States {
+		entities[state.Entity.EntityId] = state.State
+	}
+	data, err := json.Marshal(map[string]any{"entities": entities})
+	if err != nil {
+		return err
+	}
+	return e.caller.CallService(ctx, r.identity, &ServiceCall{Domain: "scene", Service: "apply", Data: data})
+}
+
+// delay stores the end of the delay before it waits, a resumed delay only waits the rest
+func (e *Executor) delay(ctx context.Context, r *run, a *models.Action, here []models.ActionPosition) error {
+	if a.Delay == nil {
+		return fmt.Errorf("%w: action %d has no delay", ErrUnsupportedAction, a.Id)
+	}
+	until := r.take_resume_at()
+	if until == nil {
+		d := time.Duration(a.Delay.Hours)*time.Hour + time.Duration(a.Delay.Minutes)*time.Minute + time.Duration(a.Delay.Seconds)*time.Second
+		t := e.clock.Now().Add(d)
+		until = &t
+	}
+	if err := e.save(ctx, r, here, until); err != nil {
+		return err
+	}
+	started := e.clock.Now()
+	if err := e.sleep(ctx, until.Sub(started)); err != nil {
+		return err
+	}
+	e.record(ctx, r, a, here, started, false, nil)
+	return nil
+}
+
+// wait evaluates the condition until it holds. If the timeout passes first,
+// the timeout actions run and the run ends.
+func (e *Executor) wait(ctx context.Context, r *run, a *models.Action, here []models.ActionPosition) (bool, error) {
+	w := a.Wait
+	if w == nil || w.Condition == nil {
+		return false, fmt.Errorf("%w: action %d has no wait condition", ErrUnsupportedAction, a.Id)
+	}
+
+	last := &here[len(here)-1]
+	if !last.Timeout {
+		deadline := r.take_resume_at()
+		if deadline == nil && w.Timeout > 0 {
+			t := e.clock.Now().Add(w.Timeout)
+			deadline = &t
+		}
+		if err := e.save(ctx, r, here, deadline); err != nil {
+			return false, err
+		}
+
+		started := e.clock.Now()
+		for {
+			ok, err := e.holds(ctx, r, w.Condition)
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				e.record(ctx, r, a, here, started, false, nil)
+				return false, nil
+			}
+			d := e.poll
+			if deadline != nil {
+				left := deadline.Sub(e.clock.Now())
+				if left <= 0 {
+					break
+				}
+				if left < d {
+					d = left
+				}
+			}
+			if err := e.sleep(ctx, d); err != nil {
+				return false, err
+			}
+		}
+		last.Timeout = true
+		e.record(ctx, r, a, here, started, true, nil)
+	}
+
+	_, err := e.list(ctx, r, w.TimeoutActions, here)
+	return true, err
+}
+
+// repeat runs the actions Count times or while its condition holds. A
+// resumed repeat continues the stored iteration without checking the condition.
+// Without a count an iteration takes at least the poll interval, so a
+// condition that keeps holding does not run the actions in a busy loop.
+func (e *Executor) repeat(ctx context.Context, r *run, a *models.Action, here []models.ActionPosition) (bool, error) {
+	rp := a.Repeat
+	if rp == nil || (rp.Count <= 0 && rp.While == nil) {
+		return false, fmt.Errorf("%w: action %d has no repeat", ErrUnsupportedAction, a.Id)
+	}
+	if len(rp.Actions) == 0 {
+		return false, nil
+	}
+
+	last := &here[len(here)-1]
+	inside := len(r.resume) > 0
+	for ; rp.Count <= 0 || last.Iteration < rp.Count; last.Iteration++ {
+		if !inside && rp.While != nil {
+			ok, err := e.holds(ctx, r, rp.While)
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+		inside = false
+		started := e.clock.Now()
+		if ended, err := e.list(ctx, r, rp.Actions, here); ended || err != nil {
+			return ended, err
+		}
+		if rp.Count <= 0 {
+			if left := e.poll - e.clock.Now().Sub(started); left > 0 {
+				if err := e.sleep(ctx, left); err != nil {
+					return false, err
+				}
+			}
+		}
+	}
+	return false, nil
+}
+
+// holds evaluates a condition of a wait or repeat action
+func (e *Executor) holds(ctx context.Context, r *run, condition *models.Condition) (bool, error) {
+	result, err := e.engine.Evaluate(ctx, &models.Rule{Id: r.rule.Id, Condition: condition}, engine.NewStoreProvider(e.store, r.identity))
+	if err != nil {
+		return false, err
+	}
+	return result.Matched, nil
+}
+
+func (e *Executor) sleep(ctx context.Context, d time.Duration) error {
+	timer := e.clock.NewTimer(d)
+	select {
+	case <-ctx.Done():
+		timer.Stop()
+		return ctx.Err()
+	case <-timer.C():
+		return nil
+	}
+}
@@ -0,0 +1,374 @@
+package executor
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	honuadatabase "github.com/JonasBordewick/honua-database"
+	"github.com/JonasBordewick/honua-database/clock"
+	"github.com/JonasBordewick/honua-database/engine"
+	"github.com/JonasBordewick/honua-database/models"
+	"github.com/JonasBordewick/honua-database/scheduler"
+)
+
+const identity = "home"
+
+var start = time.Date(2024, 6, 21, 12, 0, 0, 0, time.UTC)
+
+// recorder is a Notifier that sends the message of every notification to its channel
+type recorder chan string
+
+func (r recorder) Notify(ctx context.Context, identity string, notification *models.Notification) error {
+	r <- notification.Message
+	return nil
+}
+
+// next checks that the next notification is message
+func (r recorder) next(t *testing.T, message string) {
+	t.Helper()
+	select {
+	case got := <-r:
+		if got != message {
+			t.Fatalf("got the notification %q, want %q", got, message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the notification %q was not sent", message)
+	}
+}
+
+// none checks that no notification is waiting
+func (r recorder) none(t *testing.T) {
+	t.Helper()
+	select {
+	case got := <-r:
+		t.Fatalf("the notification %q was sent", got)
+	default:
+	}
+}
+
+// test_store returns a store with the identity, the target switch.pump and
+// sensor.pv with the state "on"
+func test_store(t *testing.T) (*honuadatabase.MemoryStore, *models.Entity, *models.Entity) {
+	t.Helper()
+	store := honuadatabase.NewMemoryStore()
+	if err := store.AddIdentity(&models.Identity{Id: identity, Name: identity}); err != nil {
+		t.Fatalf("AddIdentity: %v", err)
+	}
+	var entities []*models.Entity
+	for _, entityID := range []string{"switch.pump", "sensor.pv"} {
+		entity := &models.Entity{IdentityId: identity, EntityId: entityID, Name: entityID, AllowRules: true, RulesEnabled: true}
+		if err := store.AddEntity(entity); err != nil {
+			t.Fatalf("AddEntity: %v", err)
+		}
+		entities = append(entities, entity)
+	}
+	set_state(t, store, entities[1], "on")
+	return store, entities[0], entities[1]
+}
+
+func set_state(t *testing.T, store *honuadatabase.MemoryStore, entity *models.Entity, state string) {
+	t.Helper()
+	if err := store.AddState(identity, &models.State{EntityId: entity.Id, State: state}); err != nil {
+		t.Fatalf("AddState: %v", err)
+	}
+}
+
+// is_on returns a condition that holds while the sensor has the state
+func is_on(sensor *models.Entity, state string) *models.Condition {
+	return &models.Condition{Type: models.AND, SubConditions: []*models.Condition{
+		{Type: models.STATE, Sensor: sensor, ComparisonState: state},
+	}}
+}
+
+func notify(message string) *models.Action {
+	return &models.Action{Type: models.NOTIFY, Notification: &models.Notification{Title: "test", Message: message}}
+}
+
+func delay(d time.Duration) *models.Action {
+	return &models.Action{Type: models.DELAY, Delay: &models.Delay{Seconds: int32(d / time.Second)}}
+}
+
+// add_rule adds a rule on target with the then actions and returns it as it is stored
+func add_rule(t *testing.T, store *honuadatabase.MemoryStore, target, sensor *models.Entity, actions ...*models.Action) *models.Rule {
+	t.Helper()
+	rule := &models.Rule{
+		Enabled:              true,
+		EventBasedEvaluation: true,
+		Name:                 "test",
+		Target:               target,
+		Condition:            is_on(sensor, "on"),
+		ThenActions:          actions,
+	}
+	if err := store.AddRule(identity, rule); err != nil {
+		t.Fatalf("AddRule: %v", err)
+	}
+	stored, err := store.GetRule(identity, rule.Id)
+	if err != nil {
+		t.Fatalf("GetRule: %v", err)
+	}
+	return stored
+}
+
+func start_executor(t *testing.T, store honuadatabase.Store, fake *clock.Fake, notifier Notifier) *Executor {
+	t.Helper()
+	e := New(store, nil, WithClock(fake), WithNotifier(notifier), WithPollInterval(10*time.Second))
+	if err := e.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(e.Stop)
+	return e
+}
+
+// execute starts the then actions of the rule, ruleRun may be nil
+func execute(t *testing.T, e *Executor, rule *models.Rule, ruleRun *models.RuleRun) {
+	t.Helper()
+	run := &scheduler.Run{
+		Identity: identity,
+		Rule:     rule,
+		Trigger:  scheduler.Event,
+		Result:   &engine.Result{RuleID: rule.Id, Matched: true, Branch: engine.Then, Actions: rule.ThenActions},
+		RuleRun:  ruleRun,
+	}
+	if err := e.Execute(context.Background(), run); err != nil {
+		t.Fatalf("Execute: %v", err)
+	}
+}
+
+// stored returns the stored run of the rule, nil if there is none
+func stored(t *testing.T, store honuadatabase.Store, ruleID int) *models.ActionRun {
+	t.Helper()
+	runs, err := store.GetActionRuns(identity)
+	if err != nil {
+		t.Fatalf("GetActionRuns: %v", err)
+	}
+	for _, run := range runs {
+		if run.RuleID == ruleID {
+			return run
+		}
+	}
+	return nil
+}
+
+// wait_for waits until check is true, for the work of the executor that
+// does not wait on the clock
+func wait_for(t *testing.T, what string, check func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !check() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func check_position(t *testing.T, run *models.ActionRun, position []models.ActionPosition, resumeAt *time.Time) {
+	t.Helper()
+	if run == nil {
+		t.Fatal("the run is not stored")
+	}
+	if !reflect.DeepEqual(run.Position, position) {
+		t.Errorf("got the position %+v, want %+v", run.Position, position)
+	}
+	switch {
+	case resumeAt == nil && run.ResumeAt != nil:
+		t.Errorf("got the resume time %s, want none", run.ResumeAt)
+	case resumeAt != nil && (run.ResumeAt == nil || !run.ResumeAt.Equal(*resumeAt)):
+		t.Errorf("got the resume time %v, want %s", run.ResumeAt, resumeAt)
+	}
+}
+
+func TestDurablePosition(t *testing.T) {
+	store, target, sensor := test_store(t)
+	rule := add_rule(t, store, target, sensor, notify("a"), delay(time.Minute), notify("b"))
+
+	fake := clock.NewFake(start)
+	notifications := make(recorder, 16)
+	e := start_executor(t, store, fake, notifications)
+	execute(t, e, rule, nil)
+
+	notifications.next(t, "a")
+	fake.BlockUntil(1)
+	until := start.Add(time.Minute)
+	check_position(t, stored(t, store, rule.Id), []models.ActionPosition{{Index: 1}}, &until)
+
+	fake.Advance(time.Minute)
+	notifications.next(t, "b")
+	wait_for(t, "the deleted run", func() bool { return stored(t, store, rule.Id) == nil })
+}
+
+func TestResume(t *testing.T) {
+	store, target, sensor := test_store(t)
+	rule := add_rule(t, store, target, sensor, notify("a"), delay(time.Minute), notify("b"))
+
+	fake := clock.NewFake(start)
+	notifications := make(recorder, 16)
+	e := New(store, nil, WithClock(fake), WithNotifier(notifications))
+	if err := e.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	execute(t, e, rule, nil)
+	notifications.next(t, "a")
+	fake.BlockUntil(1)
+	fake.Advance(20 * time.Second)
+	e.Stop()
+
+	// the stopped run is kept with the end of its delay
+	until := start.Add(time.Minute)
+	check_position(t, stored(t, store, rule.Id), []models.ActionPosition{{Index: 1}}, &until)
+
+	start_executor(t, store, fake, notifications)
+	fake.BlockUntil(1)
+	fake.Advance(39 * time.Second)
+	notifications.none(t)
+	fake.Advance(time.Second)
+	// the run continues after the delay, the first action is not run again
+	notifications.next(t, "b")
+	wait_for(t, "the deleted run", func() bool { return stored(t, store, rule.Id) == nil })
+	notifications.none(t)
+}
+
+func TestWait(t *testing.T) {
+	wait := func(sensor *models.Entity) *models.Action {
+		return &models.Action{Type: models.WAIT_UNTIL, Wait: &models.Wait{
+			Condition:      is_on(sensor, "off"),
+			Timeout:        30 * time.Second,
+			TimeoutActions: []*models.Action{notify("timeout")},
+		}}
+	}
+
+	t.Run("timeout", func(t *testing.T) {
+		store, target, sensor := test_store(t)
+		rule := add_rule(t, store, target, sensor, wait(sensor), notify("after"))
+
+		fake := clock.NewFake(start)
+		notifications := make(recorder, 16)
+		e := start_executor(t, store, fake, notifications)
+		execute(t, e, rule, nil)
+
+		fake.BlockUntil(1)
+		until := start.Add(30 * time.Second)
+		check_position(t, stored(t, store, rule.Id), []models.ActionPosition{{Index: 0}}, &until)
+		for i := 0; i < 2; i++ {
+			fake.Advance(10 * time.Second)
+			fake.BlockUntil(1)
+		}
+		notifications.none(t)
+
+		// the timeout actions run and the run ends
+		fake.Advance(10 * time.Second)
+		notifications.next(t, "timeout")
+		wait_for(t, "the deleted run", func() bool { return stored(t, store, rule.Id) == nil })
+		notifications.none(t)
+	})
+
+	t.Run("holds", func(t *testing.T) {
+		store, target, sensor := test_store(t)
+		rule := add_rule(t, store, target, sensor, wait(sensor), notify("after"))
+
+		fake := clock.NewFake(start)
+		notifications := make(recorder, 16)
+		e := start_executor(t, store, fake, notifications)
+		execute(t, e, rule, nil)
+
+		fake.BlockUntil(1)
+		set_state(t, store, sensor, "off")
+		fake.Advance(10 * time.Second)
+		notifications.next(t, "after")
+		wait_for(t, "the deleted run", func() bool { return stored(t, store, rule.Id) == nil })
+		notifications.none(t)
+	})
+}
+
+func TestRepeat(t *testing.T) {
+	t.Run("count", func(t *testing.T) {
+		store, target, sensor := test_store(t)
+		repeat := &models.Action{Type: models.REPEAT, Repeat: &models.Repeat{Count: 3, Actions: []*models.Action{notify("x")}}}
+		rule := add_rule(t, store, target, sensor, repeat, notify("done"))
+
+		notifications := make(recorder, 16)
+		e := start_executor(t, store, clock.NewFake(start), notifications)
+		execute(t, e, rule, nil)
+
+		for i := 0; i < 3; i++ {
+			notifications.next(t, "x")
+		}
+		notifications.next(t, "done")
+	})
+
+	t.Run("while", func(t *testing.T) {
+		store, target, sensor := test_store(t)
+		repeat := &models.Action{Type: models.REPEAT, Repeat: &models.Repeat{While: is_on(sensor, "on"), Actions: []*models.Action{notify("x")}}}
+		rule := add_rule(t, store, target, sensor, repeat, notify("done"))
+
+		fake := clock.NewFake(start)
+		notifications := make(recorder, 16)
+		e := start_executor(t, store, fake, notifications)
+		execute(t, e, rule, nil)
+
+		// an iteration takes at least the poll interval
+		notifications.next(t, "x")
+		fake.BlockUntil(1)
+		notifications.none(t)
+		fake.Advance(10 * time.Second)
+		notifications.next(t, "x")
+		fake.BlockUntil(1)
+		check_position(t, stored(t, store, rule.Id), []models.ActionPosition{{Index: 0, Iteration: 1}, {Index: 0}}, nil)
+
+		set_state(t, store, sensor, "off")
+		fake.Advance(10 * time.Second)
+		notifications.next(t, "done")
+	})
+}
+
+// TestCancelOnRuleChange checks that a changed rule stops its running delay
+// at once, without waiting for the delay to end
+func TestCancelOnRuleChange(t *testing.T) {
+	for name, change := range map[string]func(store *honuadatabase.MemoryStore, rule *models.Rule) error{
+		"disable": func(store *honuadatabase.MemoryStore, rule *models.Rule) error {
+			return store.SetRuleEnabled(identity, rule.Id, false)
+		},
+		"edit": func(store *honuadatabase.MemoryStore, rule *models.Rule) error {
+			return store.EditRule(identity, rule)
+		},
+		"delete": func(store *honuadatabase.MemoryStore, rule *models.Rule) error {
+			return store.DeleteRule(identity, rule.Id)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			store, target, sensor := test_store(t)
+			rule := add_rule(t, store, target, sensor, delay(time.Hour), notify("after"))
+			ruleRun := &models.RuleRun{RuleID: rule.Id, EntityID: target.Id, Trigger: models.EVENT, Matched: true, EvaluatedAt: start}
+			if err := store.AddRuleRun(identity, ruleRun); err != nil {
+				t.Fatalf("AddRuleRun: %v", err)
+			}
+
+			fake := clock.NewFake(start)
+			notifications := make(recorder, 16)
+			e := start_executor(t, store, fake, notifications)
+			execute(t, e, rule, ruleRun)
+			fake.BlockUntil(1)
+
+			if err := change(store, rule); err != nil {
+				t.Fatalf("change: %v", err)
+			}
+			var finished *models.RuleRun
+			wait_for(t, "the cancelled run", func() bool {
+				run, err := store.GetRuleRun(identity, ruleRun.Id)
+				if err != nil {
+					t.Fatalf("GetRuleRun: %v", err)
+				}
+				finished = run
+				return run.FinishedAt != nil
+			})
+			if finished.Error != errDeleted.Error() {
+				t.Errorf("got the error %q, want %q", finished.Error, errDeleted)
+			}
+
+			fake.Advance(time.Hour)
+			notifications.none(t)
+		})
+	}
+}
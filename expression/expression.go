@@ -0,0 +1,335 @@
+// Package expression parses and evaluates the expressions of template
+// conditions, like "sensor.pv - sensor.acloads > 500".
+//
+// An expression combines numbers, strings in quotes, true, false and entity
+// ids with the operators + - * / == != > >= < <= && || ! and parentheses.
+// An entity id stands for the latest state of the entity, which is a number
+// if it can be parsed as one and a string otherwise.
+//
+// A Message embeds expressions in a text, like the messages of notifications.
+package expression
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Errors returned by Evaluate
+var (
+	ErrUnknownEntity  = errors.New("no state for entity")
+	ErrType           = errors.New("type mismatch")
+	ErrDivisionByZero = errors.New("division by zero")
+)
+
+// Error is a syntax or type error found by Parse, Pos is the index of the
+// character in the expression
+type Error struct {
+	Pos int
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("position %d: %s", e.Pos, e.Msg)
+}
+
+type Kind int
+
+const (
+	// KindAny is the kind of an entity before its state is known
+	KindAny Kind = iota
+	KindNumber
+	KindString
+	KindBool
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindNumber:
+		return "number"
+	case KindString:
+		return "string"
+	case KindBool:
+		return "bool"
+	}
+	return "any"
+}
+
+// Value is the result of a part of an expression
+type Value struct {
+	Kind   Kind
+	Number float64
+	Str    string
+	Bool   bool
+}
+
+func Number(v float64) Value { return Value{Kind: KindNumber, Number: v} }
+func String(v string) Value  { return Value{Kind: KindString, Str: v} }
+func Bool(v bool) Value      { return Value{Kind: KindBool, Bool: v} }
+
+// FromState converts the state of an entity into a value
+func FromState(state string) Value {
+	if v, err := strconv.ParseFloat(strings.TrimSpace(state), 64); err == nil {
+		return Number(v)
+	}
+	return String(state)
+}
+
+func (v Value) String() string {
+	switch v.Kind {
+	case KindNumber:
+		return strconv.FormatFloat(v.Number, 'f', -1, 64)
+	case KindBool:
+		return strconv.FormatBool(v.Bool)
+	}
+	return v.Str
+}
+
+// Lookup returns the latest state of the entity with the entity id name
+type Lookup func(name string) (string, bool)
+
+// Expression is a parsed expression
+type Expression struct {
+	src      string
+	root     node
+	entities []string
+}
+
+// Parse parses src and checks that it results in a bool
+func Parse(src string) (*Expression, error) {
+	root, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+	if root.kind() != KindBool {
+		return nil, &Error{Pos: 0, Msg: fmt.Sprintf("the expression results in %s, not in bool", root.kind())}
+	}
+	return &Expression{src: src, root: root, entities: entities_of(root)}, nil
+}
+
+// parse parses src into a node of any kind
+func parse(src string) (node, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.parse_or()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, &Error{Pos: t.pos, Msg: fmt.Sprintf("unexpected %q", t.text)}
+	}
+	return root, nil
+}
+
+// entities_of returns the sorted entity ids used in the nodes
+func entities_of(nodes ...node) []string {
+	var names map[string]bool = map[string]bool{}
+	for _, n := range nodes {
+		collect_entities(n, names)
+	}
+	var entities []string = []string{}
+	for name := range names {
+		entities = append(entities, name)
+	}
+	sort.Strings(entities)
+	return entities
+}
+
+// Entities returns the sorted entity ids used in the expression
+func (e *Expression) Entities() []string {
+	return append([]string{}, e.entities...)
+}
+
+func (e *Expression) String() string {
+	return e.src
+}
+
+// Evaluate evaluates the expression with the states returned by lookup
+func (e *Expression) Evaluate(lookup Lookup) (bool, error) {
+	v, err := e.root.eval(lookup)
+	if err != nil {
+		return false, err
+	}
+	if v.Kind != KindBool {
+		return false, fmt.Errorf("%w: the expression results in %s", ErrType, v.Kind)
+	}
+	return v.Bool, nil
+}
+
+type node interface {
+	kind() Kind
+	eval(lookup Lookup) (Value, error)
+}
+
+type literal struct {
+	value Value
+}
+
+func (l *literal) kind() Kind                 { return l.value.Kind }
+func (l *literal) eval(Lookup) (Value, error) { return l.value, nil }
+
+type entity struct {
+	name string
+}
+
+func (e *entity) kind() Kind { return KindAny }
+
+func (e *entity) eval(lookup Lookup) (Value, error) {
+	state, ok := lookup(e.name)
+	if !ok {
+		return Value{}, fmt.Errorf("%w %s", ErrUnknownEntity, e.name)
+	}
+	return FromState(state), nil
+}
+
+type unary struct {
+	op      string
+	operand node
+}
+
+func new_unary(t token, operand node) (node, error) {
+	want := KindNumber
+	if t.text == "!" {
+		want = KindBool
+	}
+	if k := operand.kind(); k != KindAny && k != want {
+		return nil, &Error{Pos: t.pos, Msg: fmt.Sprintf("%s needs a %s, not a %s", t.text, want, k)}
+	}
+	return &unary{op: t.text, operand: operand}, nil
+}
+
+func (u *unary) kind() Kind {
+	if u.op == "!" {
+		return KindBool
+	}
+	return KindNumber
+}
+
+func (u *unary) eval(lookup Lookup) (Value, error) {
+	v, err := u.operand.eval(lookup)
+	if err != nil {
+		return Value{}, err
+	}
+	if u.op == "!" {
+		if v.Kind != KindBool {
+			return Value{}, fmt.Errorf("%w: ! needs a bool, not %q", ErrType, v)
+		}
+		return Bool(!v.Bool), nil
+	}
+	if v.Kind != KindNumber {
+		return Value{}, fmt.Errorf("%w: - needs a number, not %q", ErrType, v)
+	}
+	return Number(-v.Number), nil
+}
+
+type binary struct {
+	op          string
+	left, right node
+}
+
+// new_binary checks the kinds of the operands as far as they are known
+func new_binary(t token, left, right node) (node, error) {
+	l, r := left.kind(), right.kind()
+	switch t.text {
+	case "&&", "||":
+		if (l != KindAny && l != KindBool) || (r != KindAny && r != KindBool) {
+			return nil, &Error{Pos: t.pos, Msg: fmt.Sprintf("%s needs two bools, not %s and %s", t.text, l, r)}
+		}
+	case "==", "!=":
+		if l != KindAny && r != KindAny && l != r {
+			return nil, &Error{Pos: t.pos, Msg: fmt.Sprintf("can not compare %s with %s", l, r)}
+		}
+	default:
+		if (l != KindAny && l != KindNumber) || (r != KindAny && r != KindNumber) {
+			return nil, &Error{Pos: t.pos, Msg: fmt.Sprintf("%s needs two numbers, not %s and %s", t.text, l, r)}
+		}
+	}
+	return &binary{op: t.text, left: left, right: right}, nil
+}
+
+func (b *binary) kind() Kind {
+	switch b.op {
+	case "+", "-", "*", "/":
+		return KindNumber
+	}
+	return KindBool
+}
+
+func (b *binary) eval(lookup Lookup) (Value, error) {
+	l, err := b.left.eval(lookup)
+	if err != nil {
+		return Value{}, err
+	}
+
+	// && and || do not evaluate the right side if the left side decides
+	if b.op == "&&" || b.op == "||" {
+		if l.Kind != KindBool {
+			return Value{}, fmt.Errorf("%w: %s needs a bool, not %q", ErrType, b.op, l)
+		}
+		if l.Bool == (b.op == "||") {
+			return l, nil
+		}
+		r, err := b.right.eval(lookup)
+		if err != nil {
+			return Value{}, err
+		}
+		if r.Kind != KindBool {
+			return Value{}, fmt.Errorf("%w: %s needs a bool, not %q", ErrType, b.op, r)
+		}
+		return r, nil
+	}
+
+	r, err := b.right.eval(lookup)
+	if err != nil {
+		return Value{}, err
+	}
+
+	if b.op == "==" || b.op == "!=" {
+		if l.Kind != r.Kind {
+			// a number state compared with a string is never equal
+			return Bool(b.op == "!="), nil
+		}
+		return Bool((l == r) == (b.op == "==")), nil
+	}
+
+	if l.Kind != KindNumber || r.Kind != KindNumber {
+		return Value{}, fmt.Errorf("%w: %s needs two numbers, not %q and %q", ErrType, b.op, l, r)
+	}
+	switch b.op {
+	case "+":
+		return Number(l.Number + r.Number), nil
+	case "-":
+		return Number(l.Number - r.Number), nil
+	case "*":
+		return Number(l.Number * r.Number), nil
+	case "/":
+		if r.Number == 0 {
+			return Value{}, ErrDivisionByZero
+		}
+		return Number(l.Number / r.Number), nil
+	case ">":
+		return Bool(l.Number > r.Number), nil
+	case ">=":
+		return Bool(l.Number >= r.Number), nil
+	case "<":
+		return Bool(l.Number < r.Number), nil
+	}
+	return Bool(l.Number <= r.Number), nil
+}
+
+func collect_entities(n node, names map[string]bool) {
+	switch n := n.(type) {
+	case *entity:
+		names[n.name] = true
+	case *unary:
+		collect_entities(n.operand, names)
+	case *binary:
+		collect_entities(n.left, names)
+		collect_entities(n.right, names)
+	}
+}
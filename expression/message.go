@@ -0,0 +1,80 @@
+package expression
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Message is a text with expressions in double braces, like
+// "the battery is at {{ sensor.soc }} %". The expressions may result in any
+// kind, they are replaced by their values when the message is rendered.
+type Message struct {
+	src      string
+	parts    []messagePart
+	entities []string
+}
+
+// messagePart is a text or an expression of a message
+type messagePart struct {
+	text string
+	expr node
+}
+
+// ParseMessage parses the expressions of the message src
+func ParseMessage(src string) (*Message, error) {
+	var parts []messagePart
+	var exprs []node
+	rest := src
+	for {
+		start := strings.Index(rest, "{{")
+		if start < 0 {
+			parts = append(parts, messagePart{text: rest})
+			break
+		}
+		offset := len(src) - len(rest)
+		end := strings.Index(rest[start+2:], "}}")
+		if end < 0 {
+			return nil, &Error{Pos: utf8.RuneCountInString(src[:offset+start]), Msg: "unterminated {{"}
+		}
+		inner := rest[start+2 : start+2+end]
+		expr, err := parse(inner)
+		if err != nil {
+			if e, ok := err.(*Error); ok {
+				// the position in the message instead of the one in the expression
+				e.Pos += utf8.RuneCountInString(src[:offset+start+2])
+			}
+			return nil, err
+		}
+		parts = append(parts, messagePart{text: rest[:start]}, messagePart{expr: expr})
+		exprs = append(exprs, expr)
+		rest = rest[start+2+end+2:]
+	}
+	return &Message{src: src, parts: parts, entities: entities_of(exprs...)}, nil
+}
+
+// Entities returns the sorted entity ids used in the expressions of the message
+func (m *Message) Entities() []string {
+	return append([]string{}, m.entities...)
+}
+
+func (m *Message) String() string {
+	return m.src
+}
+
+// Render replaces the expressions with their values, evaluated with the
+// states returned by lookup
+func (m *Message) Render(lookup Lookup) (string, error) {
+	var b strings.Builder
+	for _, part := range m.parts {
+		if part.expr == nil {
+			b.WriteString(part.text)
+			continue
+		}
+		v, err := part.expr.eval(lookup)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(v.String())
+	}
+	return b.String(), nil
+}
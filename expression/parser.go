@@ -0,0 +1,262 @@
+package expression
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenNumber
+	tokenString
+	tokenIdent
+	tokenOperator
+	tokenLParen
+	tokenRParen
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+var operators = []string{"&&", "||", "==", "!=", ">=", "<=", ">", "<", "+", "-", "*", "/", "!"}
+
+// lex splits src into tokens, identifiers may contain dots like sensor.pv
+func lex(src string) ([]token, error) {
+	var result []token
+	runes := []rune(src)
+	i := 0
+	for i < len(runes) {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			result = append(result, token{kind: tokenLParen, text: "(", pos: i})
+			i++
+		case r == ')':
+			result = append(result, token{kind: tokenRParen, text: ")", pos: i})
+			i++
+		case unicode.IsDigit(r) || (r == '.' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			result = append(result, token{kind: tokenNumber, text: string(runes[start:i]), pos: start})
+		case r == '"' || r == '\'':
+			start := i
+			i++
+			for i < len(runes) && runes[i] != r {
+				i++
+			}
+			if i == len(runes) {
+				return nil, &Error{Pos: start, Msg: "unterminated string"}
+			}
+			result = append(result, token{kind: tokenString, text: string(runes[start+1 : i]), pos: start})
+			i++
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_' || runes[i] == '.') {
+				i++
+			}
+			result = append(result, token{kind: tokenIdent, text: string(runes[start:i]), pos: start})
+		default:
+			rest := string(runes[i:])
+			found := false
+			for _, op := range operators {
+				if strings.HasPrefix(rest, op) {
+					result = append(result, token{kind: tokenOperator, text: op, pos: i})
+					i += len([]rune(op))
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, &Error{Pos: i, Msg: fmt.Sprintf("unexpected character %q", r)}
+			}
+		}
+	}
+	return append(result, token{kind: tokenEOF, pos: len(runes)}), nil
+}
+
+// parser is a recursive descent parser, one method per precedence level
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) accept(ops ...string) (token, bool) {
+	t := p.peek()
+	if t.kind != tokenOperator {
+		return t, false
+	}
+	for _, op := range ops {
+		if t.text == op {
+			return p.next(), true
+		}
+	}
+	return t, false
+}
+
+func (p *parser) parse_or() (node, error) {
+	left, err := p.parse_and()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t, ok := p.accept("||")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parse_and()
+		if err != nil {
+			return nil, err
+		}
+		left, err = new_binary(t, left, right)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) parse_and() (node, error) {
+	left, err := p.parse_comparison()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t, ok := p.accept("&&")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parse_comparison()
+		if err != nil {
+			return nil, err
+		}
+		left, err = new_binary(t, left, right)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) parse_comparison() (node, error) {
+	left, err := p.parse_sum()
+	if err != nil {
+		return nil, err
+	}
+	t, ok := p.accept("==", "!=", ">=", "<=", ">", "<")
+	if !ok {
+		return left, nil
+	}
+	right, err := p.parse_sum()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := p.accept("==", "!=", ">=", "<=", ">", "<"); ok {
+		return nil, &Error{Pos: p.tokens[p.pos-1].pos, Msg: "comparisons can not be chained"}
+	}
+	return new_binary(t, left, right)
+}
+
+func (p *parser) parse_sum() (node, error) {
+	left, err := p.parse_product()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t, ok := p.accept("+", "-")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parse_product()
+		if err != nil {
+			return nil, err
+		}
+		left, err = new_binary(t, left, right)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) parse_product() (node, error) {
+	left, err := p.parse_unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t, ok := p.accept("*", "/")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parse_unary()
+		if err != nil {
+			return nil, err
+		}
+		left, err = new_binary(t, left, right)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) parse_unary() (node, error) {
+	if t, ok := p.accept("-", "!"); ok {
+		operand, err := p.parse_unary()
+		if err != nil {
+			return nil, err
+		}
+		return new_unary(t, operand)
+	}
+	return p.parse_primary()
+}
+
+func (p *parser) parse_primary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenNumber:
+		v, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, &Error{Pos: t.pos, Msg: fmt.Sprintf("invalid number %q", t.text)}
+		}
+		return &literal{value: Number(v)}, nil
+	case tokenString:
+		return &literal{value: String(t.text)}, nil
+	case tokenIdent:
+		if t.text == "true" || t.text == "false" {
+			return &literal{value: Bool(t.text == "true")}, nil
+		}
+		return &entity{name: t.text}, nil
+	case tokenLParen:
+		inner, err := p.parse_or()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokenRParen {
+			return nil, &Error{Pos: closing.pos, Msg: "missing )"}
+		}
+		return inner, nil
+	case tokenEOF:
+		return nil, &Error{Pos: t.pos, Msg: "unexpected end of expression"}
+	}
+	return nil, &Error{Pos: t.pos, Msg: fmt.Sprintf("unexpected %q", t.text)}
+}
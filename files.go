@@ -0,0 +1,23 @@
+package honuadatabase
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// create.sql and the migrations are part of the binary, so the files folder
+// does not have to be shipped with the services using this package
+//
+//go:embed files/*.sql
+var embedded_files embed.FS
+
+// EmbeddedFiles returns the embedded create.sql and migrations. It can be
+// used as a base for an own Config.FS.
+func EmbeddedFiles() fs.FS {
+	files, err := fs.Sub(embedded_files, "files")
+	if err != nil {
+		// the directory is embedded, so this can not happen
+		panic(err)
+	}
+	return files
+}
@@ -0,0 +1 @@
+ALTER TABLE entities DROP COLUMN IF EXISTS rules_enabled;
@@ -0,0 +1,31 @@
+CREATE TABLE IF NOT EXISTS id_counters (
+    identity TEXT NOT NULL,
+    CONSTRAINT fk_identity FOREIGN KEY(identity) REFERENCES identities(identifier) ON DELETE CASCADE,
+    kind TEXT NOT NULL,
+    last_id INTEGER NOT NULL,
+    PRIMARY KEY(identity, kind)
+);
+
+INSERT INTO id_counters(identity, kind, last_id)
+    SELECT identity, 'entities', MAX(id) FROM entities GROUP BY identity
+    ON CONFLICT DO NOTHING;
+
+INSERT INTO id_counters(identity, kind, last_id)
+    SELECT identity, 'hass_services', MAX(id) FROM hass_services GROUP BY identity
+    ON CONFLICT DO NOTHING;
+
+INSERT INTO id_counters(identity, kind, last_id)
+    SELECT identity, 'conditions', MAX(id) FROM conditions GROUP BY identity
+    ON CONFLICT DO NOTHING;
+
+INSERT INTO id_counters(identity, kind, last_id)
+    SELECT identity, 'rules', MAX(id) FROM rules GROUP BY identity
+    ON CONFLICT DO NOTHING;
+
+INSERT INTO id_counters(identity, kind, last_id)
+    SELECT identity, 'delays', MAX(id) FROM delays GROUP BY identity
+    ON CONFLICT DO NOTHING;
+
+INSERT INTO id_counters(identity, kind, last_id)
+    SELECT identity, 'actions', MAX(id) FROM actions GROUP BY identity
+    ON CONFLICT DO NOTHING;
@@ -0,0 +1,5 @@
+ALTER TABLE rules ADD COLUMN IF NOT EXISTS name TEXT NOT NULL DEFAULT '';
+
+UPDATE rules SET name = entities.name || ' -- Regel'
+    FROM entities
+    WHERE rules.name = '' AND entities.identity = rules.identity AND entities.id = rules.entity_id;
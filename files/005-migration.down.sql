@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS actions_rule_position;
+ALTER TABLE actions DROP COLUMN IF EXISTS position;
@@ -0,0 +1,10 @@
+ALTER TABLE actions ADD COLUMN IF NOT EXISTS position INTEGER NOT NULL DEFAULT 0;
+
+UPDATE actions SET position = ordered.position
+    FROM (
+        SELECT id, identity, ROW_NUMBER() OVER (PARTITION BY identity, rule_id, is_then_action ORDER BY id) - 1 AS position
+        FROM actions
+    ) AS ordered
+    WHERE actions.identity = ordered.identity AND actions.id = ordered.id;
+
+CREATE INDEX IF NOT EXISTS actions_rule_position ON actions(identity, rule_id, is_then_action, position);
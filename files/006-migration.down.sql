@@ -0,0 +1,4 @@
+ALTER TABLE actions DROP CONSTRAINT IF EXISTS fk_target_id;
+ALTER TABLE actions DROP COLUMN IF EXISTS service_data;
+ALTER TABLE actions DROP COLUMN IF EXISTS target_id;
+ALTER TABLE actions DROP COLUMN IF EXISTS service_name;
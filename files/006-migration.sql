@@ -0,0 +1,6 @@
+ALTER TABLE actions ADD COLUMN IF NOT EXISTS service_name TEXT NOT NULL DEFAULT '';
+ALTER TABLE actions ADD COLUMN IF NOT EXISTS target_id INTEGER;
+ALTER TABLE actions ADD COLUMN IF NOT EXISTS service_data JSONB;
+
+ALTER TABLE actions DROP CONSTRAINT IF EXISTS fk_target_id;
+ALTER TABLE actions ADD CONSTRAINT fk_target_id FOREIGN KEY(identity, target_id) REFERENCES entities(identity, id) ON DELETE CASCADE;
@@ -0,0 +1,17 @@
+ALTER TABLE actions DROP CONSTRAINT IF EXISTS fk_scene_id;
+ALTER TABLE actions DROP CONSTRAINT IF EXISTS fk_rule_switch_id;
+ALTER TABLE actions DROP CONSTRAINT IF EXISTS fk_state_change_id;
+ALTER TABLE actions DROP CONSTRAINT IF EXISTS fk_notification_id;
+
+DELETE FROM actions WHERE notification_id IS NOT NULL OR state_change_id IS NOT NULL OR rule_switch_id IS NOT NULL OR scene_id IS NOT NULL;
+
+ALTER TABLE actions DROP COLUMN IF EXISTS scene_id;
+ALTER TABLE actions DROP COLUMN IF EXISTS rule_switch_id;
+ALTER TABLE actions DROP COLUMN IF EXISTS state_change_id;
+ALTER TABLE actions DROP COLUMN IF EXISTS notification_id;
+
+DROP TABLE IF EXISTS scene_states;
+DROP TABLE IF EXISTS scenes;
+DROP TABLE IF EXISTS rule_switches;
+DROP TABLE IF EXISTS state_changes;
+DROP TABLE IF EXISTS notifications;
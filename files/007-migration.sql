@@ -0,0 +1,63 @@
+CREATE TABLE IF NOT EXISTS notifications (
+    id INTEGER NOT NULL,
+    identity TEXT NOT NULL,
+    CONSTRAINT fk_identity FOREIGN KEY(identity) REFERENCES identities(identifier) ON DELETE CASCADE,
+    PRIMARY KEY(id, identity),
+    title TEXT NOT NULL DEFAULT '',
+    message TEXT NOT NULL,
+    recipient TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS state_changes (
+    id INTEGER NOT NULL,
+    identity TEXT NOT NULL,
+    CONSTRAINT fk_identity FOREIGN KEY(identity) REFERENCES identities(identifier) ON DELETE CASCADE,
+    PRIMARY KEY(id, identity),
+    entity_id INTEGER NOT NULL,
+    CONSTRAINT fk_entity_id FOREIGN KEY(identity, entity_id) REFERENCES entities(identity, id) ON DELETE CASCADE,
+    state TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS rule_switches (
+    id INTEGER NOT NULL,
+    identity TEXT NOT NULL,
+    CONSTRAINT fk_identity FOREIGN KEY(identity) REFERENCES identities(identifier) ON DELETE CASCADE,
+    PRIMARY KEY(id, identity),
+    -- no foreign key, EditRule deletes and inserts the rule again which would remove the switch
+    rule_id INTEGER NOT NULL,
+    enabled BOOLEAN NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS scenes (
+    id INTEGER NOT NULL,
+    identity TEXT NOT NULL,
+    CONSTRAINT fk_identity FOREIGN KEY(identity) REFERENCES identities(identifier) ON DELETE CASCADE,
+    PRIMARY KEY(id, identity),
+    name TEXT NOT NULL,
+    CONSTRAINT uc_scene_name UNIQUE (identity, name)
+);
+
+CREATE TABLE IF NOT EXISTS scene_states (
+    identity TEXT NOT NULL,
+    CONSTRAINT fk_identity FOREIGN KEY(identity) REFERENCES identities(identifier) ON DELETE CASCADE,
+    scene_id INTEGER NOT NULL,
+    CONSTRAINT fk_scene_id FOREIGN KEY(identity, scene_id) REFERENCES scenes(identity, id) ON DELETE CASCADE,
+    entity_id INTEGER NOT NULL,
+    CONSTRAINT fk_entity_id FOREIGN KEY(identity, entity_id) REFERENCES entities(identity, id) ON DELETE CASCADE,
+    state TEXT NOT NULL,
+    PRIMARY KEY(identity, scene_id, entity_id)
+);
+
+ALTER TABLE actions ADD COLUMN IF NOT EXISTS notification_id INTEGER;
+ALTER TABLE actions ADD COLUMN IF NOT EXISTS state_change_id INTEGER;
+ALTER TABLE actions ADD COLUMN IF NOT EXISTS rule_switch_id INTEGER;
+ALTER TABLE actions ADD COLUMN IF NOT EXISTS scene_id INTEGER;
+
+ALTER TABLE actions DROP CONSTRAINT IF EXISTS fk_notification_id;
+ALTER TABLE actions ADD CONSTRAINT fk_notification_id FOREIGN KEY(identity, notification_id) REFERENCES notifications(identity, id) ON DELETE CASCADE;
+ALTER TABLE actions DROP CONSTRAINT IF EXISTS fk_state_change_id;
+ALTER TABLE actions ADD CONSTRAINT fk_state_change_id FOREIGN KEY(identity, state_change_id) REFERENCES state_changes(identity, id) ON DELETE CASCADE;
+ALTER TABLE actions DROP CONSTRAINT IF EXISTS fk_rule_switch_id;
+ALTER TABLE actions ADD CONSTRAINT fk_rule_switch_id FOREIGN KEY(identity, rule_switch_id) REFERENCES rule_switches(identity, id) ON DELETE CASCADE;
+ALTER TABLE actions DROP CONSTRAINT IF EXISTS fk_scene_id;
+ALTER TABLE actions ADD CONSTRAINT fk_scene_id FOREIGN KEY(identity, scene_id) REFERENCES scenes(identity, id) ON DELETE CASCADE;
@@ -0,0 +1,14 @@
+ALTER TABLE actions DROP CONSTRAINT IF EXISTS fk_repeat_id;
+ALTER TABLE actions DROP CONSTRAINT IF EXISTS fk_wait_id;
+ALTER TABLE actions DROP CONSTRAINT IF EXISTS fk_parent_action_id;
+
+DELETE FROM conditions WHERE id IN (SELECT condition_id FROM waits WHERE waits.identity = conditions.identity);
+DELETE FROM conditions WHERE id IN (SELECT condition_id FROM repeats WHERE repeats.identity = conditions.identity);
+DELETE FROM actions WHERE parent_action_id IS NOT NULL OR wait_id IS NOT NULL OR repeat_id IS NOT NULL;
+
+ALTER TABLE actions DROP COLUMN IF EXISTS repeat_id;
+ALTER TABLE actions DROP COLUMN IF EXISTS wait_id;
+ALTER TABLE actions DROP COLUMN IF EXISTS parent_action_id;
+
+DROP TABLE IF EXISTS repeats;
+DROP TABLE IF EXISTS waits;
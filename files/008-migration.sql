@@ -0,0 +1,30 @@
+CREATE TABLE IF NOT EXISTS waits (
+    id INTEGER NOT NULL,
+    identity TEXT NOT NULL,
+    CONSTRAINT fk_identity FOREIGN KEY(identity) REFERENCES identities(identifier) ON DELETE CASCADE,
+    PRIMARY KEY(id, identity),
+    condition_id INTEGER NOT NULL,
+    CONSTRAINT fk_condition_id FOREIGN KEY(identity, condition_id) REFERENCES conditions(identity, id) ON DELETE CASCADE,
+    timeout_seconds INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS repeats (
+    id INTEGER NOT NULL,
+    identity TEXT NOT NULL,
+    CONSTRAINT fk_identity FOREIGN KEY(identity) REFERENCES identities(identifier) ON DELETE CASCADE,
+    PRIMARY KEY(id, identity),
+    count INTEGER NOT NULL DEFAULT 0,
+    condition_id INTEGER,
+    CONSTRAINT fk_condition_id FOREIGN KEY(identity, condition_id) REFERENCES conditions(identity, id) ON DELETE CASCADE
+);
+
+ALTER TABLE actions ADD COLUMN IF NOT EXISTS parent_action_id INTEGER;
+ALTER TABLE actions ADD COLUMN IF NOT EXISTS wait_id INTEGER;
+ALTER TABLE actions ADD COLUMN IF NOT EXISTS repeat_id INTEGER;
+
+ALTER TABLE actions DROP CONSTRAINT IF EXISTS fk_parent_action_id;
+ALTER TABLE actions ADD CONSTRAINT fk_parent_action_id FOREIGN KEY(identity, parent_action_id) REFERENCES actions(identity, id) ON DELETE CASCADE;
+ALTER TABLE actions DROP CONSTRAINT IF EXISTS fk_wait_id;
+ALTER TABLE actions ADD CONSTRAINT fk_wait_id FOREIGN KEY(identity, wait_id) REFERENCES waits(identity, id) ON DELETE CASCADE;
+ALTER TABLE actions DROP CONSTRAINT IF EXISTS fk_repeat_id;
+ALTER TABLE actions ADD CONSTRAINT fk_repeat_id FOREIGN KEY(identity, repeat_id) REFERENCES repeats(identity, id) ON DELETE CASCADE;
@@ -0,0 +1,2 @@
+ALTER TABLE conditions ALTER COLUMN below TYPE INTEGER USING ROUND(below)::INTEGER;
+ALTER TABLE conditions ALTER COLUMN above TYPE INTEGER USING ROUND(above)::INTEGER;
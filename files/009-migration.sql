@@ -0,0 +1,4 @@
+-- thresholds of numeric state conditions can be decimal and negative numbers,
+-- the existing integer values are kept as they are
+ALTER TABLE conditions ALTER COLUMN below TYPE NUMERIC USING below::NUMERIC;
+ALTER TABLE conditions ALTER COLUMN above TYPE NUMERIC USING above::NUMERIC;
@@ -0,0 +1,5 @@
+-- template conditions (type 7) can not exist without the column template
+DELETE FROM conditions WHERE type = 7;
+
+ALTER TABLE conditions DROP COLUMN IF EXISTS template;
+ALTER TABLE conditions DROP COLUMN IF EXISTS attribute;
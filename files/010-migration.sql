@@ -0,0 +1,4 @@
+-- the attribute a state or numeric state condition compares instead of the
+-- state, and the expression of a template condition
+ALTER TABLE conditions ADD COLUMN IF NOT EXISTS attribute TEXT;
+ALTER TABLE conditions ADD COLUMN IF NOT EXISTS template TEXT;
@@ -0,0 +1,8 @@
+-- time conditions (type 6) without after and before are not valid anymore
+DELETE FROM conditions WHERE type = 6 AND after IS NULL AND before IS NULL;
+
+ALTER TABLE conditions DROP COLUMN IF EXISTS date_to;
+ALTER TABLE conditions DROP COLUMN IF EXISTS date_from;
+ALTER TABLE conditions DROP COLUMN IF EXISTS weekdays;
+
+DROP TABLE IF EXISTS locations;
@@ -0,0 +1,14 @@
+-- where an identity is, for time conditions relative to sunrise and sunset
+CREATE TABLE IF NOT EXISTS locations (
+    identity TEXT NOT NULL,
+    CONSTRAINT fk_identity FOREIGN KEY(identity) REFERENCES identities(identifier) ON DELETE CASCADE,
+    PRIMARY KEY(identity),
+    latitude DOUBLE PRECISION NOT NULL,
+    longitude DOUBLE PRECISION NOT NULL,
+    time_zone TEXT NOT NULL DEFAULT 'UTC'
+);
+
+-- weekdays is a bit mask with Sunday as bit 0, the dates are MM-DD
+ALTER TABLE conditions ADD COLUMN IF NOT EXISTS weekdays INTEGER;
+ALTER TABLE conditions ADD COLUMN IF NOT EXISTS date_from TEXT;
+ALTER TABLE conditions ADD COLUMN IF NOT EXISTS date_to TEXT;
@@ -0,0 +1,8 @@
+-- from_to conditions (type 8) can not exist without their states
+DELETE FROM conditions WHERE type = 8;
+
+DROP INDEX IF EXISTS states_entity_history;
+
+ALTER TABLE conditions DROP COLUMN IF EXISTS to_state;
+ALTER TABLE conditions DROP COLUMN IF EXISTS from_state;
+ALTER TABLE conditions DROP COLUMN IF EXISTS for_seconds;
@@ -0,0 +1,7 @@
+-- how long a sensor condition has to be met and the states of a from_to condition
+ALTER TABLE conditions ADD COLUMN IF NOT EXISTS for_seconds INTEGER;
+ALTER TABLE conditions ADD COLUMN IF NOT EXISTS from_state TEXT;
+ALTER TABLE conditions ADD COLUMN IF NOT EXISTS to_state TEXT;
+
+-- the history of one entity is read for the durations and the transitions
+CREATE INDEX IF NOT EXISTS states_entity_history ON states(identity, entity_id, id);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS action_runs_rule;
+
+DROP TABLE IF EXISTS action_runs;
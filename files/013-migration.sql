@@ -0,0 +1,17 @@
+-- the action lists that are being executed, so a run can continue after a restart
+CREATE TABLE IF NOT EXISTS action_runs (
+    id INTEGER NOT NULL,
+    identity TEXT NOT NULL,
+    CONSTRAINT fk_identity FOREIGN KEY(identity) REFERENCES identities(identifier) ON DELETE CASCADE,
+    PRIMARY KEY(id, identity),
+    rule_id INTEGER NOT NULL,
+    CONSTRAINT fk_rule_id FOREIGN KEY(identity, rule_id) REFERENCES rules(identity, id) ON DELETE CASCADE,
+    is_then_action BOOLEAN NOT NULL DEFAULT true,
+    -- the JSON list of the positions from the then or else actions to the running action
+    position JSONB NOT NULL,
+    -- the end of the running delay or the timeout of the running wait
+    resume_at TIMESTAMPTZ,
+    started_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS action_runs_rule ON action_runs(identity, rule_id);
@@ -0,0 +1,8 @@
+ALTER TABLE action_runs DROP COLUMN IF EXISTS rule_run_id;
+
+DROP INDEX IF EXISTS rule_runs_time;
+DROP INDEX IF EXISTS rule_runs_trigger_entity;
+DROP INDEX IF EXISTS rule_runs_entity;
+DROP INDEX IF EXISTS rule_runs_rule;
+
+DROP TABLE IF EXISTS rule_runs;
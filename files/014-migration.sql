@@ -0,0 +1,27 @@
+-- every evaluation of a rule with its trace and the outcomes of its actions.
+-- The runs are kept when the rule is deleted, so there is no foreign key to rules.
+CREATE TABLE IF NOT EXISTS rule_runs (
+    id INTEGER NOT NULL,
+    identity TEXT NOT NULL,
+    CONSTRAINT fk_identity FOREIGN KEY(identity) REFERENCES identities(identifier) ON DELETE CASCADE,
+    PRIMARY KEY(id, identity),
+    rule_id INTEGER NOT NULL,
+    entity_id INTEGER NOT NULL,
+    trigger INTEGER NOT NULL,
+    trigger_entity_id INTEGER,
+    matched BOOLEAN NOT NULL,
+    trace JSONB,
+    error TEXT NOT NULL DEFAULT '',
+    actions JSONB NOT NULL DEFAULT '[]',
+    evaluated_at TIMESTAMPTZ NOT NULL,
+    duration_ns BIGINT NOT NULL,
+    finished_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS rule_runs_rule ON rule_runs(identity, rule_id, evaluated_at);
+CREATE INDEX IF NOT EXISTS rule_runs_entity ON rule_runs(identity, entity_id, evaluated_at);
+CREATE INDEX IF NOT EXISTS rule_runs_trigger_entity ON rule_runs(identity, trigger_entity_id, evaluated_at);
+CREATE INDEX IF NOT EXISTS rule_runs_time ON rule_runs(identity, evaluated_at);
+
+-- the recorded rule run of an action run, it is not a foreign key because runs are pruned
+ALTER TABLE action_runs ADD COLUMN IF NOT EXISTS rule_run_id INTEGER;
@@ -0,0 +1,5 @@
+UPDATE metadata SET executed_at = executed_at AT TIME ZONE 'Europe/Berlin' AT TIME ZONE 'UTC';
+ALTER TABLE metadata ALTER COLUMN executed_at SET DEFAULT timezone('Europe/Berlin', now());
+
+UPDATE states SET record_time = record_time AT TIME ZONE 'Europe/Berlin' AT TIME ZONE 'UTC';
+ALTER TABLE states ALTER COLUMN record_time SET DEFAULT timezone('Europe/Berlin', now());
@@ -0,0 +1,9 @@
+-- record_time and executed_at defaulted to timezone('Europe/Berlin', now()),
+-- the wall clock of Berlin read as a time in the time zone of the session,
+-- so on a UTC server every row was 1 or 2 hours in the future. The rows
+-- are shifted to the real time, assuming they were written in UTC.
+ALTER TABLE states ALTER COLUMN record_time SET DEFAULT now();
+UPDATE states SET record_time = record_time AT TIME ZONE 'UTC' AT TIME ZONE 'Europe/Berlin';
+
+ALTER TABLE metadata ALTER COLUMN executed_at SET DEFAULT now();
+UPDATE metadata SET executed_at = executed_at AT TIME ZONE 'UTC' AT TIME ZONE 'Europe/Berlin';
@@ -1,5 +1,5 @@
 module github.com/JonasBordewick/honua-database
 
-go 1.20
+go 1.21
 
 require github.com/lib/pq v1.10.9
@@ -1,43 +1,52 @@
 package honuadatabase
 
 import (
+	"context"
 	"database/sql"
-	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"time"
 
 	"github.com/JonasBordewick/honua-database/models"
 )
 
 func (hdb *HonuaDatabase) AddHassService(service *models.HassService, identity string) error {
+	return hdb.AddHassServiceContext(context.Background(), service, identity)
+}
+
+func (hdb *HonuaDatabase) AddHassServiceContext(ctx context.Context, service *models.HassService, identity string) (err error) {
+	defer hdb.observe(ctx, "add_hass_service", time.Now(), &err, slog.String("identity", identity), slog.String("domain", service.Domain))
 	const query = `
 INSERT INTO hass_services(
 	id, identity, domain, name
 ) VALUES ($1, $2, $3, $4);
 `
 
-
-	id, err := hdb.get_hass_service_id(identity)
+	id, err := hdb.next_id(ctx, hdb.db, identity, "hass_services")
 	if err != nil {
-		log.Printf("An error occured during adding a new service to table hass_services: %s\n", err.Error())
 		return err
 	}
 
-	_, err = hdb.db.Exec(query, id, identity, service.Domain, service.Name)
+	_, err = hdb.db.ExecContext(ctx, query, id, identity, service.Domain, service.Name)
 
-	if err != nil {
-		log.Printf("An error occured during adding a new Homeassistant Service to table hass_services: %s\n", err.Error())
-	}
-	return err
+	return map_error(err)
 }
 
 func (hdb *HonuaDatabase) GetIDofHassService(identity, domain string) (int, error) {
+	return hdb.GetIDofHassServiceContext(context.Background(), identity, domain)
+}
+
+func (hdb *HonuaDatabase) GetIDofHassServiceContext(ctx context.Context, identity, domain string) (_ int, err error) {
+	defer hdb.observe(ctx, "get_id_of_hass_service", time.Now(), &err, slog.String("identity", identity), slog.String("domain", domain))
+	return hdb.get_id_of_hass_service(ctx, hdb.db, identity, domain)
+}
+
+func (hdb *HonuaDatabase) get_id_of_hass_service(ctx context.Context, q querier, identity, domain string) (int, error) {
 	const query = "SELECT id FROM hass_services WHERE identity=$1 AND domain=$2;"
 
-	rows, err := hdb.db.Query(query, identity, domain)
+	rows, err := q.QueryContext(ctx, query, identity, domain)
 	if err != nil {
-		log.Printf("An error occured during getting the id of homeassistant service with identity = %s and domain = %s: %s\n", identity, domain, err.Error())
-		return -1, err
+		return -1, map_error(err)
 	}
 
 	var id int = -1
@@ -46,26 +55,29 @@ func (hdb *HonuaDatabase) GetIDofHassService(identity, domain string) (int, erro
 		err = rows.Scan(&id)
 		if err != nil {
 			rows.Close()
-			log.Printf("An error occured during getting the id of homeassistant service with identity = %s and domain = %s: %s\n", identity, domain, err.Error())
-			return -1, err
+			return -1, map_error(err)
 		}
 	}
 
 	rows.Close()
 
 	if id == -1 {
-		return -1, fmt.Errorf("no element in database found where identity = %s and domain = %s", identity, domain)
+		return -1, fmt.Errorf("%w: no element in database found where identity = %s and domain = %s", ErrNotFound, identity, domain)
 	}
 
 	return id, nil
 }
 
 func (hdb *HonuaDatabase) GetHassService(identity string, id int) (*models.HassService, error) {
+	return hdb.GetHassServiceContext(context.Background(), identity, id)
+}
+
+func (hdb *HonuaDatabase) GetHassServiceContext(ctx context.Context, identity string, id int) (_ *models.HassService, err error) {
+	defer hdb.observe(ctx, "get_hass_service", time.Now(), &err, slog.String("identity", identity), slog.Int("service_id", id))
 	const query = "SELECT domain, name, enabled FROM hass_services WHERE identity=$1 AND id=$2;"
-	rows, err := hdb.db.Query(query, identity, id)
+	rows, err := hdb.db.QueryContext(ctx, query, identity, id)
 	if err != nil {
-		log.Printf("An error occured during getting service %d of %s: %s\n", id, identity, err.Error())
-		return nil, err
+		return nil, map_error(err)
 	}
 	var result *models.HassService
 
@@ -73,42 +85,62 @@ func (hdb *HonuaDatabase) GetHassService(identity string, id int) (*models.HassS
 		result, err = hdb.make_hass_service(rows)
 		if err != nil {
 			rows.Close()
-			log.Printf("An error occured during getting service %d of %s: %s\n", id, identity, err.Error())
 			return nil, err
 		}
 	}
 
 	rows.Close()
 
+	if result == nil {
+		return nil, fmt.Errorf("%w: the homeassistant service %d of %s does not exist", ErrNotFound, id, identity)
+	}
+
 	return result, nil
 }
 
 func (hdb *HonuaDatabase) ToggleHassService(identity, domain string) error {
+	return hdb.ToggleHassServiceContext(context.Background(), identity, domain)
+}
+
+func (hdb *HonuaDatabase) ToggleHassServiceContext(ctx context.Context, identity, domain string) (err error) {
+	defer hdb.observe(ctx, "toggle_hass_service", time.Now(), &err, slog.String("identity", identity), slog.String("domain", domain))
 	const query = "UPDATE hass_services SET enabled = NOT enabled WHERE identity=$1 AND domain=$2;"
 
-	_, err := hdb.db.Exec(query, identity, domain)
-	if err != nil {
-		log.Printf("An error occured during changing the enabled state to the opposite from homeassistant service of identity %s with domain = %s: %s\n", identity, domain, err.Error())
-	}
+	result, err := hdb.db.ExecContext(ctx, query, identity, domain)
+	err = affected_or_not_found(result, err, "the homeassistant service with identity %s and domain %s does not exist", identity, domain)
 	return err
 }
 
 func (hdb *HonuaDatabase) DeleteHassService(identity, domain string) error {
+	return hdb.DeleteHassServiceContext(context.Background(), identity, domain)
+}
+
+func (hdb *HonuaDatabase) DeleteHassServiceContext(ctx context.Context, identity, domain string) (err error) {
+	defer hdb.observe(ctx, "delete_hass_service", time.Now(), &err, slog.String("identity", identity), slog.String("domain", domain))
+	defer hdb.subscribers.rules_changed(identity, &err)
 	const query = "DELETE FROM hass_services WHERE identity=$1 AND domain=$2;"
-	_, err := hdb.db.Exec(query, identity, domain)
-	if err != nil {
-		log.Printf("An error occured during deleting the homeassistant service of identity %s with domain = %s: %s\n", identity, domain, err.Error())
-	}
-	return err
+	return hdb.with_tx(ctx, func(tx *sql.Tx) error {
+		// the constraint would delete the service actions too, but leave gaps in the positions
+		err := hdb.delete_actions(ctx, tx, identity, "service_id IN (SELECT id FROM hass_services WHERE identity=$1 AND domain=$2)", domain)
+		if err != nil {
+			return err
+		}
+		result, err := tx.ExecContext(ctx, query, identity, domain)
+		return affected_or_not_found(result, err, "the homeassistant service with identity %s and domain %s does not exist", identity, domain)
+	})
 }
 
 func (hdb *HonuaDatabase) ExistsHassService(identity, domain string) (bool, error) {
+	return hdb.ExistsHassServiceContext(context.Background(), identity, domain)
+}
+
+func (hdb *HonuaDatabase) ExistsHassServiceContext(ctx context.Context, identity, domain string) (_ bool, err error) {
+	defer hdb.observe(ctx, "exists_hass_service", time.Now(), &err, slog.String("identity", identity), slog.String("domain", domain))
 	const query = "SELECT CASE WHEN EXISTS ( SELECT * FROM hass_services WHERE identity = $1 AND domain = $2) THEN true ELSE false END"
 
-	rows, err := hdb.db.Query(query, identity, domain)
+	rows, err := hdb.db.QueryContext(ctx, query, identity, domain)
 	if err != nil {
-		log.Printf("An error occured during checking if the entity %s exists in %s: %s\n", identity, domain, err.Error())
-		return false, err
+		return false, map_error(err)
 	}
 
 	var state bool = false
@@ -117,8 +149,7 @@ func (hdb *HonuaDatabase) ExistsHassService(identity, domain string) (bool, erro
 		err = rows.Scan(&state)
 		if err != nil {
 			rows.Close()
-			log.Printf("An error occured during checking if the entity %s exists in %s: %s\n", identity, domain, err.Error())
-			return false, err
+			return false, map_error(err)
 		}
 	}
 
@@ -128,16 +159,20 @@ func (hdb *HonuaDatabase) ExistsHassService(identity, domain string) (bool, erro
 }
 
 func (hdb *HonuaDatabase) GetAllowedHassServicesOfEntity(identity, entityId string) ([]*models.HassService, error) {
+	return hdb.GetAllowedHassServicesOfEntityContext(context.Background(), identity, entityId)
+}
+
+func (hdb *HonuaDatabase) GetAllowedHassServicesOfEntityContext(ctx context.Context, identity, entityId string) (_ []*models.HassService, err error) {
+	defer hdb.observe(ctx, "get_allowed_hass_services_of_entity", time.Now(), &err, slog.String("identity", identity), slog.String("entity_id", entityId))
 	const query = `
 	SELECT services.domain, services.name, services.enabled 
 	FROM hass_services as services, allowed_services as a 
 	WHERE services.id = a.service_id AND a.entity_id = (SELECT id FROM entities WHERE identity=$1 AND entity_id=$2);
 	`
 
-	rows, err := hdb.db.Query(query, identity, entityId)
+	rows, err := hdb.db.QueryContext(ctx, query, identity, entityId)
 	if err != nil {
-		log.Printf("An error occured during getting all allowed homeassistant services of entity %s in %s: %s\n", entityId, identity, err.Error())
-		return nil, err
+		return nil, map_error(err)
 	}
 
 	var result []*models.HassService = []*models.HassService{}
@@ -146,7 +181,6 @@ func (hdb *HonuaDatabase) GetAllowedHassServicesOfEntity(identity, entityId stri
 		service, err := hdb.make_hass_service(rows)
 		if err != nil {
 			rows.Close()
-			log.Printf("An error occured during getting all allowed homeassistant services of entity %s in %s: %s\n", entityId, identity, err.Error())
 			return nil, err
 		}
 		result = append(result, service)
@@ -156,61 +190,6 @@ func (hdb *HonuaDatabase) GetAllowedHassServicesOfEntity(identity, entityId stri
 	return result, err
 }
 
-// Make sure that before calling this method, you have already been locked. This method does not lock
-func (hdb *HonuaDatabase) get_hass_service_id(identifier string) (int, error) {
-	query := "SELECT CASE WHEN EXISTS ( SELECT * FROM hass_services WHERE identity = $1) THEN true ELSE false END"
-
-	rows, err := hdb.db.Query(query, identifier)
-	if err != nil {
-		log.Printf("An error occured during getting id of serivce in %s: %s\n", identifier, err.Error())
-		return -1, err
-	}
-
-	var exist_identity bool = false
-
-	for rows.Next() {
-		err = rows.Scan(&exist_identity)
-		if err != nil {
-			rows.Close()
-			log.Printf("An error occured during getting id of service in %s: %s\n", identifier, err.Error())
-			return -1, err
-		}
-	}
-
-	rows.Close()
-
-	if !exist_identity {
-		return 0, nil
-	}
-
-	query = "SELECT MAX(id) FROM hass_services WHERE identity = $1;"
-
-	rows, err = hdb.db.Query(query, identifier)
-	if err != nil {
-		log.Printf("An error occured during getting id of service in %s: %s\n", identifier, err.Error())
-		return -1, err
-	}
-
-	var id int = -1
-
-	for rows.Next() {
-		err = rows.Scan(&id)
-		if err != nil {
-			rows.Close()
-			log.Printf("An error occured during getting id of serivce in %s: %s\n", identifier, err.Error())
-			return -1, err
-		}
-	}
-	rows.Close()
-
-	if id == -1 {
-		return -1, errors.New("something went wrong during getting id of service")
-	}
-
-	id = id + 1
-
-	return id, nil
-}
 
 func (hdb *HonuaDatabase) make_hass_service(rows *sql.Rows) (*models.HassService, error) {
 	var domain string
@@ -219,7 +198,7 @@ func (hdb *HonuaDatabase) make_hass_service(rows *sql.Rows) (*models.HassService
 
 	err := rows.Scan(&domain, &name, &enabled)
 	if err != nil {
-		return nil, err
+		return nil, map_error(err)
 	}
 
 	var result *models.HassService = &models.HassService{
@@ -230,3 +209,20 @@ func (hdb *HonuaDatabase) make_hass_service(rows *sql.Rows) (*models.HassService
 
 	return result, nil
 }
+
+// get_hass_service_domains returns the domains of the services with the ids by their id
+func (hdb *HonuaDatabase) get_hass_service_domains(ctx context.Context, q querier, identity string, ids []int) (map[int]string, error) {
+	const query = "SELECT id, domain FROM hass_services WHERE identity=$1 AND id = ANY($2);"
+
+	var result map[int]string = map[int]string{}
+	err := query_by_ids(ctx, q, query, identity, ids, func(rows *sql.Rows) error {
+		var id int
+		var domain string
+		if err := rows.Scan(&id, &domain); err != nil {
+			return err
+		}
+		result[id] = domain
+		return nil
+	})
+	return result, err
+}
@@ -1,36 +1,49 @@
 package honuadatabase
 
 import (
+	"context"
 	"database/sql"
-	"log"
+	"fmt"
+	"log/slog"
+	"time"
 
 	"github.com/JonasBordewick/honua-database/models"
 )
 
 func (hdb *HonuaDatabase) AddIdentity(identity *models.Identity) error {
+	return hdb.AddIdentityContext(context.Background(), identity)
+}
+
+func (hdb *HonuaDatabase) AddIdentityContext(ctx context.Context, identity *models.Identity) (err error) {
+	defer hdb.observe(ctx, "add_identity", time.Now(), &err, slog.String("identity", identity.Id))
 	const query = "INSERT INTO identities(identifier, name) VALUES($1, $2);"
-	_, err := hdb.db.Exec(query, identity.Id, identity.Name)
-	if err != nil {
-		log.Printf("An error occured during adding a new identity(identifier=%s, name=%s) to identities: %s\n", identity.Id, identity.Name, err.Error())
-	}
-	return err
+	_, err = hdb.db.ExecContext(ctx, query, identity.Id, identity.Name)
+	return map_error(err)
 }
 
 func (hdb *HonuaDatabase) DeleteIdentity(identifier string) error {
+	return hdb.DeleteIdentityContext(context.Background(), identifier)
+}
+
+func (hdb *HonuaDatabase) DeleteIdentityContext(ctx context.Context, identifier string) (err error) {
+	defer hdb.observe(ctx, "delete_identity", time.Now(), &err, slog.String("identity", identifier))
+	defer hdb.subscribers.rules_changed(identifier, &err)
 	const query = "DELETE FROM identities WHERE identifier = $1"
-	_, err := hdb.db.Exec(query, identifier)
-	if err != nil {
-		log.Printf("An error occured during deleting the identity %s: %s\n", identifier, err.Error())
-	}
+	result, err := hdb.db.ExecContext(ctx, query, identifier)
+	err = affected_or_not_found(result, err, "the identity %s does not exist", identifier)
 	return err
 }
 
 func (hdb *HonuaDatabase) ExistIdentity(identifier string) (bool, error) {
+	return hdb.ExistIdentityContext(context.Background(), identifier)
+}
+
+func (hdb *HonuaDatabase) ExistIdentityContext(ctx context.Context, identifier string) (_ bool, err error) {
+	defer hdb.observe(ctx, "exist_identity", time.Now(), &err, slog.String("identity", identifier))
 	const query = "SELECT CASE WHEN EXISTS ( SELECT * FROM identities WHERE identifier = $1) THEN true ELSE false END;"
-	rows, err := hdb.db.Query(query, identifier)
+	rows, err := hdb.db.QueryContext(ctx, query, identifier)
 	if err != nil {
-		log.Printf("An error occured during checking if the identity with id %s exists: %s\n", identifier, err.Error())
-		return false, err
+		return false, map_error(err)
 	}
 
 	var state bool = false
@@ -39,8 +52,7 @@ func (hdb *HonuaDatabase) ExistIdentity(identifier string) (bool, error) {
 		err = rows.Scan(&state)
 		if err != nil {
 			rows.Close()
-			log.Printf("An error occured during checking if the identity with id %s exists: %s\n", identifier, err.Error())
-			return false, err
+			return false, map_error(err)
 		}
 	}
 
@@ -50,12 +62,16 @@ func (hdb *HonuaDatabase) ExistIdentity(identifier string) (bool, error) {
 }
 
 func (hdb *HonuaDatabase) GetIdentity(identifier string) (*models.Identity, error) {
+	return hdb.GetIdentityContext(context.Background(), identifier)
+}
+
+func (hdb *HonuaDatabase) GetIdentityContext(ctx context.Context, identifier string) (_ *models.Identity, err error) {
+	defer hdb.observe(ctx, "get_identity", time.Now(), &err, slog.String("identity", identifier))
 	const query = "SELECT * FROM identities WHERE identifier = $1;"
 
-	rows, err := hdb.db.Query(query, identifier)
+	rows, err := hdb.db.QueryContext(ctx, query, identifier)
 	if err != nil {
-		log.Printf("An error occured during getting identity = %s: %s\n", identifier, err.Error())
-		return nil, err
+		return nil, map_error(err)
 	}
 
 	var result *models.Identity
@@ -64,22 +80,29 @@ func (hdb *HonuaDatabase) GetIdentity(identifier string) (*models.Identity, erro
 		result, err = hdb.make_identity(rows)
 		if err != nil {
 			rows.Close()
-			log.Printf("An error occured during getting identity = %s: %s\n", identifier, err.Error())
 			return nil, err
 		}
 	}
 	rows.Close()
 
-	return result, err
+	if result == nil {
+		return nil, fmt.Errorf("%w: the identity %s does not exist", ErrNotFound, identifier)
+	}
+
+	return result, nil
 }
 
 func (hdb *HonuaDatabase) GetIdentities() ([]*models.Identity, error) {
+	return hdb.GetIdentitiesContext(context.Background())
+}
+
+func (hdb *HonuaDatabase) GetIdentitiesContext(ctx context.Context) (_ []*models.Identity, err error) {
+	defer hdb.observe(ctx, "get_identities", time.Now(), &err)
 	const query = "SELECT * FROM identities"
 
-	rows, err := hdb.db.Query(query)
+	rows, err := hdb.db.QueryContext(ctx, query)
 	if err != nil {
-		log.Printf("An error occured during getting all identities: %s\n", err.Error())
-		return nil, err
+		return nil, map_error(err)
 	}
 
 	var result []*models.Identity = []*models.Identity{}
@@ -88,7 +111,6 @@ func (hdb *HonuaDatabase) GetIdentities() ([]*models.Identity, error) {
 		identity, err := hdb.make_identity(rows)
 		if err != nil {
 			rows.Close()
-			log.Printf("An error occured during getting all identities: %s\n", err.Error())
 			return nil, err
 		}
 		result = append(result, identity)
@@ -104,7 +126,7 @@ func (hdb *HonuaDatabase) make_identity(rows *sql.Rows) (*models.Identity, error
 
 	err := rows.Scan(&id, &name)
 	if err != nil {
-		return nil, err
+		return nil, map_error(err)
 	}
 
 	var result *models.Identity = &models.Identity{
@@ -114,3 +136,60 @@ func (hdb *HonuaDatabase) make_identity(rows *sql.Rows) (*models.Identity, error
 
 	return result, nil
 }
+
+// SetLocation stores where the identity is, it replaces a location stored before
+func (hdb *HonuaDatabase) SetLocation(identifier string, location *models.Location) error {
+	return hdb.SetLocationContext(context.Background(), identifier, location)
+}
+
+func (hdb *HonuaDatabase) SetLocationContext(ctx context.Context, identifier string, location *models.Location) (err error) {
+	defer hdb.observe(ctx, "set_location", time.Now(), &err, slog.String("identity", identifier))
+	const query = `INSERT INTO locations(identity, latitude, longitude, time_zone) VALUES ($1, $2, $3, $4)
+ON CONFLICT (identity) DO UPDATE SET latitude = EXCLUDED.latitude, longitude = EXCLUDED.longitude, time_zone = EXCLUDED.time_zone;`
+
+	if err = check_location(location); err != nil {
+		return err
+	}
+	_, err = hdb.db.ExecContext(ctx, query, identifier, location.Latitude, location.Longitude, location.TimeZone)
+	return map_error(err)
+}
+
+// GetLocation returns where the identity is, ErrNotFound if no location is stored
+func (hdb *HonuaDatabase) GetLocation(identifier string) (*models.Location, error) {
+	return hdb.GetLocationContext(context.Background(), identifier)
+}
+
+func (hdb *HonuaDatabase) GetLocationContext(ctx context.Context, identifier string) (_ *models.Location, err error) {
+	defer hdb.observe(ctx, "get_location", time.Now(), &err, slog.String("identity", identifier))
+	const query = "SELECT latitude, longitude, time_zone FROM locations WHERE identity = $1;"
+
+	location := &models.Location{}
+	err = hdb.db.QueryRowContext(ctx, query, identifier).Scan(&location.Latitude, &location.Longitude, &location.TimeZone)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: there is no location of %s", ErrNotFound, identifier)
+	}
+	if err != nil {
+		return nil, map_error(err)
+	}
+	return location, nil
+}
+
+// check_location checks the coordinates and the time zone, an empty time zone becomes UTC
+func check_location(location *models.Location) error {
+	if location == nil {
+		return fmt.Errorf("%w: the location is missing", ErrInvalidLocation)
+	}
+	if !(location.Latitude >= -90 && location.Latitude <= 90) {
+		return fmt.Errorf("%w: the latitude %v is not between -90 and 90", ErrInvalidLocation, location.Latitude)
+	}
+	if !(location.Longitude >= -180 && location.Longitude <= 180) {
+		return fmt.Errorf("%w: the longitude %v is not between -180 and 180", ErrInvalidLocation, location.Longitude)
+	}
+	if location.TimeZone == "" {
+		location.TimeZone = "UTC"
+	}
+	if _, err := time.LoadLocation(location.TimeZone); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidLocation, err)
+	}
+	return nil
+}
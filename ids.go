@@ -0,0 +1,23 @@
+package honuadatabase
+
+import "context"
+
+// next_id allocates the next id of a table for the identity. The ids are
+// counted per identity and table in id_counters. The upsert locks the row of
+// the counter, so concurrent calls never get the same id. Inside a
+// transaction the row stays locked until the transaction ends.
+func (hdb *HonuaDatabase) next_id(ctx context.Context, q querier, identity, table string) (int, error) {
+	const query = `
+INSERT INTO id_counters(identity, kind, last_id) VALUES ($1, $2, 0)
+ON CONFLICT (identity, kind) DO UPDATE SET last_id = id_counters.last_id + 1
+RETURNING last_id;
+`
+	var id int = -1
+
+	err := q.QueryRowContext(ctx, query, identity, table).Scan(&id)
+	if err != nil {
+		return -1, map_error(err)
+	}
+
+	return id, nil
+}
@@ -0,0 +1,189 @@
+package honuadatabase
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JonasBordewick/honua-database/models"
+)
+
+// test_database opens the database of HONUA_TEST_DSN and adds a new
+// identity, which is deleted at the end of the test
+func test_database(t *testing.T) (*HonuaDatabase, string) {
+	t.Helper()
+	dsn := os.Getenv("HONUA_TEST_DSN")
+	if dsn == "" {
+		t.Skip("HONUA_TEST_DSN is not set")
+	}
+
+	ctx := context.Background()
+	hdb, err := New(ctx, Config{DSN: dsn, MaxOpenConns: 20})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	identity := fmt.Sprintf("test-%d", time.Now().UnixNano())
+	if err := hdb.AddIdentityContext(ctx, &models.Identity{Id: identity, Name: identity}); err != nil {
+		hdb.CloseDatabase()
+		t.Fatalf("AddIdentity: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := hdb.DeleteIdentityContext(ctx, identity); err != nil {
+			t.Errorf("DeleteIdentity: %v", err)
+		}
+		hdb.CloseDatabase()
+	})
+	return hdb, identity
+}
+
+func test_entity(identity string, n int) *models.Entity {
+	return &models.Entity{
+		IdentityId:   identity,
+		EntityId:     fmt.Sprintf("sensor.test_%d", n),
+		Name:         fmt.Sprintf("Test %d", n),
+		AllowRules:   true,
+		RulesEnabled: true,
+	}
+}
+
+// check_contiguous checks that the ids are unique and follow each other
+func check_contiguous(t *testing.T, kind string, ids []int) {
+	t.Helper()
+	sorted := append([]int{}, ids...)
+	sort.Ints(sorted)
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i] == sorted[i-1] {
+			t.Errorf("the %s id %d was allocated twice", kind, sorted[i])
+		} else if sorted[i] != sorted[i-1]+1 {
+			t.Errorf("the %s ids skip from %d to %d", kind, sorted[i-1], sorted[i])
+		}
+	}
+}
+
+func TestNextIdConcurrent(t *testing.T) {
+	hdb, identity := test_database(t)
+	ctx := context.Background()
+
+	const workers = 16
+	const perWorker = 10
+
+	target := test_entity(identity, -1)
+	if err := hdb.AddEntityContext(ctx, target); err != nil {
+		t.Fatalf("AddEntity: %v", err)
+	}
+
+	var mutex sync.Mutex
+	var entityIDs, ruleIDs, conditionIDs []int
+	entityIDs = append(entityIDs, target.Id)
+	errs := make(chan error, workers*perWorker*3)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				entity := test_entity(identity, w*perWorker+i)
+				if err := hdb.AddEntityContext(ctx, entity); err != nil {
+					errs <- fmt.Errorf("AddEntity: %w", err)
+					continue
+				}
+
+				rule := &models.Rule{
+					Enabled: true,
+					Target:  target,
+					Condition: &models.Condition{Type: models.AND, SubConditions: []*models.Condition{
+						{Type: models.STATE, Sensor: entity, ComparisonState: "on"},
+					}},
+				}
+				if err := hdb.AddRuleContext(ctx, identity, rule); err != nil {
+					errs <- fmt.Errorf("AddRule: %w", err)
+					continue
+				}
+
+				conditionID, err := hdb.AddConditionContext(ctx, identity, &models.Condition{Type: models.OR})
+				if err != nil {
+					errs <- fmt.Errorf("AddCondition: %w", err)
+					continue
+				}
+
+				mutex.Lock()
+				entityIDs = append(entityIDs, entity.Id)
+				ruleIDs = append(ruleIDs, rule.Id)
+				conditionIDs = append(conditionIDs, conditionID)
+				mutex.Unlock()
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	check_contiguous(t, "entity", entityIDs)
+	check_contiguous(t, "rule", ruleIDs)
+
+	// every rule added its root and one subcondition besides the conditions added alone
+	rules, err := hdb.GetAllRulesOfIdentityContext(ctx, identity)
+	if err != nil {
+		t.Fatalf("GetAllRulesOfIdentity: %v", err)
+	}
+	if len(rules) != workers*perWorker {
+		t.Errorf("got %d rules, want %d", len(rules), workers*perWorker)
+	}
+	for _, rule := range rules {
+		conditionIDs = append(conditionIDs, rule.Condition.Id)
+		for _, sub := range rule.Condition.SubConditions {
+			conditionIDs = append(conditionIDs, sub.Id)
+		}
+	}
+	if len(conditionIDs) != 3*workers*perWorker {
+		t.Errorf("got %d conditions, want %d", len(conditionIDs), 3*workers*perWorker)
+	}
+	check_contiguous(t, "condition", conditionIDs)
+}
+
+// TestIdCountersBackfill runs the backfill of migration 003 on an identity
+// without counters, the next id has to follow the largest existing one
+func TestIdCountersBackfill(t *testing.T) {
+	hdb, identity := test_database(t)
+	ctx := context.Background()
+
+	var last int
+	for i := 0; i < 3; i++ {
+		entity := test_entity(identity, i)
+		if err := hdb.AddEntityContext(ctx, entity); err != nil {
+			t.Fatalf("AddEntity: %v", err)
+		}
+		last = entity.Id
+	}
+	// a gap, like the ids of deleted entities
+	if _, err := hdb.db.ExecContext(ctx, "UPDATE entities SET id = $1 WHERE identity = $2 AND id = $3;", last+10, identity, last); err != nil {
+		t.Fatalf("moving the entity: %v", err)
+	}
+	if _, err := hdb.db.ExecContext(ctx, "DELETE FROM id_counters WHERE identity = $1;", identity); err != nil {
+		t.Fatalf("deleting the counters: %v", err)
+	}
+
+	backfill, err := fs.ReadFile(EmbeddedFiles(), "003-migration.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hdb.db.ExecContext(ctx, string(backfill)); err != nil {
+		t.Fatalf("running the backfill: %v", err)
+	}
+
+	entity := test_entity(identity, 3)
+	if err := hdb.AddEntityContext(ctx, entity); err != nil {
+		t.Fatalf("AddEntity: %v", err)
+	}
+	if entity.Id != last+11 {
+		t.Errorf("got the id %d after the backfill, want %d", entity.Id, last+11)
+	}
+}
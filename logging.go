@@ -0,0 +1,33 @@
+package honuadatabase
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// discardHandler drops every record, it is used if no logger is configured
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+// DiscardLogger returns a logger that drops every record, it is the default
+// of the database, the scheduler and the executor
+func DiscardLogger() *slog.Logger {
+	return slog.New(discardHandler{})
+}
+
+// observe is deferred by the public methods. It logs the query name, the
+// duration and the given fields, failed queries are logged with their error.
+func (hdb *HonuaDatabase) observe(ctx context.Context, query string, start time.Time, err *error, attrs ...slog.Attr) {
+	attrs = append(attrs, slog.String("query", query), slog.Duration("duration", time.Since(start)))
+	if *err != nil {
+		attrs = append(attrs, slog.Any("error", *err))
+		hdb.logger.LogAttrs(ctx, slog.LevelError, "An error occured during "+query, attrs...)
+		return
+	}
+	hdb.logger.LogAttrs(ctx, slog.LevelDebug, query, attrs...)
+}
@@ -0,0 +1,929 @@
+package honuadatabase
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/JonasBordewick/honua-database/models"
+)
+
+// MemoryStore is an in-memory implementation of Store. It keeps the same
+// per identity ids and the same cascading deletes as the tables in
+// files/create.sql, so it can be used in place of a HonuaDatabase in tests.
+type MemoryStore struct {
+	mutex       sync.Mutex
+	identities  map[string]*memoryIdentity
+	lastStateID int
+	subscribers subscribers
+}
+
+type memoryIdentity struct {
+	identity        models.Identity
+	location        *models.Location
+	entities        map[int]*models.Entity
+	states          []*memoryState
+	hassServices    map[int]*models.HassService
+	allowedServices map[[2]int]bool // entity_id, service_id
+	allowedSensors  map[[2]int]bool // device_id, sensor_id
+	conditions      map[int]*conditionRow
+	rules           map[int]*memoryRule
+	delays          map[int]*models.Delay
+	notifications   map[int]*models.Notification
+	stateChanges    map[int]*stateChangeRow
+	ruleSwitches    map[int]*models.RuleSwitch
+	scenes          map[int]*sceneRow
+	waits           map[int]*waitRow
+	repeats         map[int]*repeatRow
+	sceneStates     map[[2]int]string // scene_id, entity_id
+	actions         map[int]*actionRow
+	actionRuns      map[int]*models.ActionRun
+	ruleRuns        map[int]*models.RuleRun
+	counters        map[string]int
+}
+
+type memoryState struct {
+	id         int
+	entityID   int
+	state      string
+	recordTime time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		identities: map[string]*memoryIdentity{},
+	}
+}
+
+// ---------------------------------------------------------------------------
+// identities
+
+func (ms *MemoryStore) AddIdentity(identity *models.Identity) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if _, ok := ms.identities[identity.Id]; ok {
+		return fmt.Errorf("%w: the identity %s already exists", ErrAlreadyExists, identity.Id)
+	}
+
+	ms.identities[identity.Id] = &memoryIdentity{
+		identity:        *identity,
+		entities:        map[int]*models.Entity{},
+		hassServices:    map[int]*models.HassService{},
+		allowedServices: map[[2]int]bool{},
+		allowedSensors:  map[[2]int]bool{},
+		conditions:      map[int]*conditionRow{},
+		rules:           map[int]*memoryRule{},
+		delays:          map[int]*models.Delay{},
+		notifications:   map[int]*models.Notification{},
+		stateChanges:    map[int]*stateChangeRow{},
+		ruleSwitches:    map[int]*models.RuleSwitch{},
+		scenes:          map[int]*sceneRow{},
+		waits:           map[int]*waitRow{},
+		repeats:         map[int]*repeatRow{},
+		sceneStates:     map[[2]int]string{},
+		actions:         map[int]*actionRow{},
+		actionRuns:      map[int]*models.ActionRun{},
+		ruleRuns:        map[int]*models.RuleRun{},
+		counters:        map[string]int{},
+	}
+	return nil
+}
+
+func (ms *MemoryStore) DeleteIdentity(identifier string) (err error) {
+	defer ms.subscribers.rules_changed(identifier, &err)
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if _, ok := ms.identities[identifier]; !ok {
+		return fmt.Errorf("%w: the identity %s does not exist", ErrNotFound, identifier)
+	}
+	delete(ms.identities, identifier)
+	return nil
+}
+
+func (ms *MemoryStore) ExistIdentity(identifier string) (bool, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	_, ok := ms.identities[identifier]
+	return ok, nil
+}
+
+func (ms *MemoryStore) GetIdentity(identifier string) (*models.Identity, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identifier]
+	if !ok {
+		return nil, fmt.Errorf("%w: the identity %s does not exist", ErrNotFound, identifier)
+	}
+	result := mi.identity
+	return &result, nil
+}
+
+func (ms *MemoryStore) GetIdentities() ([]*models.Identity, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	var result []*models.Identity = []*models.Identity{}
+	for _, mi := range ms.identities {
+		identity := mi.identity
+		result = append(result, &identity)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Id < result[j].Id })
+	return result, nil
+}
+
+func (ms *MemoryStore) SetLocation(identifier string, location *models.Location) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, err := ms.get_identity(identifier)
+	if err != nil {
+		return err
+	}
+	if err = check_location(location); err != nil {
+		return err
+	}
+	l := *location
+	mi.location = &l
+	return nil
+}
+
+func (ms *MemoryStore) GetLocation(identifier string) (*models.Location, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identifier]
+	if !ok || mi.location == nil {
+		return nil, fmt.Errorf("%w: there is no location of %s", ErrNotFound, identifier)
+	}
+	l := *mi.location
+	return &l, nil
+}
+
+// get_identity returns the data of an identity that is referenced by a new
+// row, the caller must hold the mutex.
+func (ms *MemoryStore) get_identity(identifier string) (*memoryIdentity, error) {
+	mi, ok := ms.identities[identifier]
+	if !ok {
+		return nil, fmt.Errorf("%w: the identity %s does not exist", ErrForeignKeyViolation, identifier)
+	}
+	return mi, nil
+}
+
+// ---------------------------------------------------------------------------
+// entities
+
+func (ms *MemoryStore) GetEntity(identity string, id int) (*models.Entity, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identity]
+	if !ok {
+		return nil, fmt.Errorf("%w: the entity %d of %s does not exist", ErrNotFound, id, identity)
+	}
+	entity, ok := mi.entities[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: the entity %d of %s does not exist", ErrNotFound, id, identity)
+	}
+	result := *entity
+	return &result, nil
+}
+
+func (ms *MemoryStore) AddEntity(entity *models.Entity) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, err := ms.get_identity(entity.IdentityId)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range mi.entities {
+		if e.EntityId == entity.EntityId {
+			return fmt.Errorf("%w: the entity %s already exists in %s", ErrAlreadyExists, entity.EntityId, entity.IdentityId)
+		}
+	}
+
+	stored := *entity
+	stored.Id = mi.next_id("entities")
+	stored.HasAttribute = entity.HasAttribute && entity.Attribute != ""
+	if !stored.HasAttribute {
+		stored.Attribute = ""
+	}
+	mi.entities[stored.Id] = &stored
+	entity.Id = stored.Id
+	return nil
+}
+
+func (ms *MemoryStore) DeleteEntity(id int, identity string) (err error) {
+	defer ms.subscribers.rules_changed(identity, &err)
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identity]
+	if !ok {
+		return fmt.Errorf("%w: the entity %d of %s does not exist", ErrNotFound, id, identity)
+	}
+	if _, ok := mi.entities[id]; !ok {
+		return fmt.Errorf("%w: the entity %d of %s does not exist", ErrNotFound, id, identity)
+	}
+	mi.delete_entity(id)
+	return nil
+}
+
+func (ms *MemoryStore) EditEntity(identifier string, entity *models.Entity) (err error) {
+	defer ms.subscribers.rules_changed(entity.IdentityId, &err)
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	entity.HasAttribute = entity.Attribute != ""
+
+	mi, ok := ms.identities[entity.IdentityId]
+	if !ok {
+		return fmt.Errorf("%w: the entity %s of %s does not exist", ErrNotFound, entity.EntityId, entity.IdentityId)
+	}
+	id := mi.get_id_of_entity(entity.EntityId)
+	if id == -1 {
+		return fmt.Errorf("%w: the entity %s of %s does not exist", ErrNotFound, entity.EntityId, entity.IdentityId)
+	}
+	e := mi.entities[id]
+	e.Name = entity.Name
+	e.IsDevice = entity.IsDevice
+	e.AllowRules = entity.AllowRules
+	e.HasAttribute = entity.HasAttribute
+	e.Attribute = entity.Attribute
+	e.IsVictronSensor = entity.IsVictronSensor
+	e.SensorType = entity.SensorType
+	e.HasNumericState = entity.HasNumericState
+	e.RulesEnabled = entity.RulesEnabled
+	if !e.RulesEnabled {
+		mi.delete_entity_action_runs(id)
+	}
+	return nil
+}
+
+func (ms *MemoryStore) SetEntityRulesEnabled(identity string, id int, enabled bool) (err error) {
+	defer ms.subscribers.rules_changed(identity, &err)
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identity]
+	if !ok || mi.entities[id] == nil {
+		return fmt.Errorf("%w: the entity %d of %s does not exist", ErrNotFound, id, identity)
+	}
+	mi.entities[id].RulesEnabled = enabled
+	if !enabled {
+		mi.delete_entity_action_runs(id)
+	}
+	return nil
+}
+
+func (ms *MemoryStore) ExistEntity(identifier string, id int, hasAttribute bool, attribute string) (bool, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identifier]
+	if !ok {
+		return false, nil
+	}
+	entity, ok := mi.entities[id]
+	if !ok {
+		return false, nil
+	}
+	if hasAttribute {
+		return entity.HasAttribute && entity.Attribute == attribute, nil
+	}
+	return !entity.HasAttribute, nil
+}
+
+func (ms *MemoryStore) GetIdOfEntity(identifier, entityId string) (int, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	var id int = -1
+	if mi, ok := ms.identities[identifier]; ok {
+		id = mi.get_id_of_entity(entityId)
+	}
+	if id == -1 {
+		return -1, fmt.Errorf("%w: the entity %s of %s does not exist", ErrNotFound, entityId, identifier)
+	}
+	return id, nil
+}
+
+func (ms *MemoryStore) GetEntities(identifier string) ([]*models.Entity, error) {
+	return ms.filter_entities(identifier, func(mi *memoryIdentity, e *models.Entity) bool { return true })
+}
+
+func (ms *MemoryStore) GetEntitiesWhereRulesAreAllowed(identifier string) ([]*models.Entity, error) {
+	return ms.filter_entities(identifier, func(mi *memoryIdentity, e *models.Entity) bool { return e.AllowRules })
+}
+
+func (ms *MemoryStore) GetEntitiesWithoutRule(identifier string) ([]*models.Entity, error) {
+	return ms.filter_entities(identifier, func(mi *memoryIdentity, e *models.Entity) bool {
+		for _, r := range mi.rules {
+			if r.entityID == e.Id {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func (ms *MemoryStore) GetVictronEntities(identifier string) ([]*models.Entity, error) {
+	return ms.filter_entities(identifier, func(mi *memoryIdentity, e *models.Entity) bool { return e.IsVictronSensor })
+}
+
+func (ms *MemoryStore) filter_entities(identifier string, keep func(mi *memoryIdentity, e *models.Entity) bool) ([]*models.Entity, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	var result []*models.Entity = []*models.Entity{}
+
+	mi, ok := ms.identities[identifier]
+	if !ok {
+		return result, nil
+	}
+	for _, id := range sorted_memory_ids(mi.entities) {
+		if keep(mi, mi.entities[id]) {
+			entity := *mi.entities[id]
+			result = append(result, &entity)
+		}
+	}
+	return result, nil
+}
+
+func (mi *memoryIdentity) get_id_of_entity(entityId string) int {
+	for id, e := range mi.entities {
+		if e.EntityId == entityId {
+			return id
+		}
+	}
+	return -1
+}
+
+// delete_entity removes the entity and everything that references it
+func (mi *memoryIdentity) delete_entity(id int) {
+	if _, ok := mi.entities[id]; !ok {
+		return
+	}
+	delete(mi.entities, id)
+
+	var states []*memoryState
+	for _, s := range mi.states {
+		if s.entityID != id {
+			states = append(states, s)
+		}
+	}
+	mi.states = states
+
+	for key := range mi.allowedServices {
+		if key[0] == id {
+			delete(mi.allowedServices, key)
+		}
+	}
+	for key := range mi.allowedSensors {
+		if key[0] == id || key[1] == id {
+			delete(mi.allowedSensors, key)
+		}
+	}
+	for cID, c := range mi.conditions {
+		if c.sensorID.Valid && int(c.sensorID.Int32) == id {
+			mi.delete_condition(cID)
+		}
+	}
+	for rID, r := range mi.rules {
+		if r.entityID == id {
+			mi.delete_rule(rID)
+		}
+	}
+	// the service and set state actions of other rules for the entity
+	mi.delete_actions(func(a *actionRow) bool {
+		if a.targetID.Valid && int(a.targetID.Int32) == id {
+			return true
+		}
+		if !a.stateChangeID.Valid {
+			return false
+		}
+		change, ok := mi.stateChanges[int(a.stateChangeID.Int32)]
+		return ok && change.entityID == id
+	})
+	for sID, s := range mi.stateChanges {
+		if s.entityID == id {
+			delete(mi.stateChanges, sID)
+		}
+	}
+	for key := range mi.sceneStates {
+		if key[1] == id {
+			delete(mi.sceneStates, key)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// states
+
+func (ms *MemoryStore) AddState(identity string, state *models.State) error {
+	if err := ms.add_state(identity, state); err != nil {
+		return err
+	}
+	// the handlers are called without the lock, so they can use the store
+	ms.subscribers.notify(identity, state)
+	return nil
+}
+
+func (ms *MemoryStore) add_state(identity string, state *models.State) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, err := ms.get_identity(identity)
+	if err != nil {
+		return err
+	}
+	if _, ok := mi.entities[state.EntityId]; !ok {
+		return fmt.Errorf("%w: the entity %d does not exist in %s", ErrForeignKeyViolation, state.EntityId, identity)
+	}
+
+	ms.lastStateID++
+	recordTime := time.Now()
+	mi.states = append(mi.states, &memoryState{
+		id:         ms.lastStateID,
+		entityID:   state.EntityId,
+		state:      state.State,
+		recordTime: recordTime,
+	})
+	state.Id = ms.lastStateID
+	state.RecordTime = &recordTime
+	return nil
+}
+
+// SubscribeStates calls handler for every state added with AddState until cancel is called
+func (ms *MemoryStore) SubscribeStates(handler StateHandler) (cancel func()) {
+	return ms.subscribers.states.subscribe(handler)
+}
+
+func (ms *MemoryStore) GetState(identity string, entityID int) (*models.State, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if mi, ok := ms.identities[identity]; ok {
+		for i := len(mi.states) - 1; i >= 0; i-- {
+			if mi.states[i].entityID == entityID {
+				return mi.states[i].to_model(), nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w: there is no state of entity %d in %s", ErrNotFound, entityID, identity)
+}
+
+func (ms *MemoryStore) DeleteOldestState(identity string, entityID int) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identity]
+	if !ok {
+		return nil
+	}
+	for i, s := range mi.states {
+		if s.entityID == entityID {
+			mi.states = append(mi.states[:i], mi.states[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (ms *MemoryStore) GetNumberOfStatesOfEntity(identity string, entityID int) (int, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identity]
+	if !ok {
+		return 0, nil
+	}
+	var counter int = 0
+	for _, s := range mi.states {
+		if s.entityID == entityID {
+			counter++
+		}
+	}
+	return counter, nil
+}
+
+func (ms *MemoryStore) GetStatesBetween(identity string, entityID int, from, to time.Time) ([]*models.State, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	var result []*models.State = []*models.State{}
+	mi, ok := ms.identities[identity]
+	if !ok {
+		return result, nil
+	}
+	var initial *memoryState
+	for _, s := range mi.states {
+		if s.entityID != entityID {
+			continue
+		}
+		if !s.recordTime.After(from) {
+			initial = s
+		} else if !s.recordTime.After(to) {
+			result = append(result, s.to_model())
+		}
+	}
+	if initial != nil {
+		result = append([]*models.State{initial.to_model()}, result...)
+	}
+	return result, nil
+}
+
+func (ms *MemoryStore) GetLastStateChange(identity string, entityID int) (*models.StateTransition, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	var result *models.StateTransition
+	if mi, ok := ms.identities[identity]; ok {
+		for i := len(mi.states) - 1; i >= 0; i-- {
+			s := mi.states[i]
+			if s.entityID != entityID {
+				continue
+			}
+			if result == nil {
+				result = &models.StateTransition{EntityId: entityID, To: s.state, Since: s.recordTime}
+			} else if s.state != result.To {
+				result.From = s.state
+				break
+			} else {
+				result.Since = s.recordTime
+			}
+		}
+	}
+	if result == nil {
+		return nil, fmt.Errorf("%w: there is no state of entity %d in %s", ErrNotFound, entityID, identity)
+	}
+	return result, nil
+}
+
+func (s *memoryState) to_model() *models.State {
+	recordTime := s.recordTime
+	return &models.State{
+		Id:         s.id,
+		EntityId:   s.entityID,
+		State:      s.state,
+		RecordTime: &recordTime,
+	}
+}
+
+// ---------------------------------------------------------------------------
+// homeassistant services
+
+func (ms *MemoryStore) AddHassService(service *models.HassService, identity string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, err := ms.get_identity(identity)
+	if err != nil {
+		return err
+	}
+	if mi.get_id_of_hass_service(service.Domain) != -1 {
+		return fmt.Errorf("%w: the homeassistant service %s already exists in %s", ErrAlreadyExists, service.Domain, identity)
+	}
+
+	mi.hassServices[mi.next_id("hass_services")] = &models.HassService{
+		Domain:  service.Domain,
+		Name:    service.Name,
+		Enabled: true,
+	}
+	return nil
+}
+
+func (ms *MemoryStore) GetIDofHassService(identity, domain string) (int, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	var id int = -1
+	if mi, ok := ms.identities[identity]; ok {
+		id = mi.get_id_of_hass_service(domain)
+	}
+	if id == -1 {
+		return -1, fmt.Errorf("%w: no element in database found where identity = %s and domain = %s", ErrNotFound, identity, domain)
+	}
+	return id, nil
+}
+
+func (ms *MemoryStore) GetHassService(identity string, id int) (*models.HassService, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identity]
+	if !ok {
+		return nil, fmt.Errorf("%w: the homeassistant service %d of %s does not exist", ErrNotFound, id, identity)
+	}
+	service, ok := mi.hassServices[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: the homeassistant service %d of %s does not exist", ErrNotFound, id, identity)
+	}
+	result := *service
+	return &result, nil
+}
+
+func (ms *MemoryStore) ToggleHassService(identity, domain string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	var id int = -1
+	mi, ok := ms.identities[identity]
+	if ok {
+		id = mi.get_id_of_hass_service(domain)
+	}
+	if id == -1 {
+		return fmt.Errorf("%w: the homeassistant service with identity %s and domain %s does not exist", ErrNotFound, identity, domain)
+	}
+	mi.hassServices[id].Enabled = !mi.hassServices[id].Enabled
+	return nil
+}
+
+func (ms *MemoryStore) DeleteHassService(identity, domain string) (err error) {
+	defer ms.subscribers.rules_changed(identity, &err)
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	var id int = -1
+	mi, ok := ms.identities[identity]
+	if ok {
+		id = mi.get_id_of_hass_service(domain)
+	}
+	if id == -1 {
+		return fmt.Errorf("%w: the homeassistant service with identity %s and domain %s does not exist", ErrNotFound, identity, domain)
+	}
+	delete(mi.hassServices, id)
+	for key := range mi.allowedServices {
+		if key[1] == id {
+			delete(mi.allowedServices, key)
+		}
+	}
+	mi.delete_actions(func(a *actionRow) bool { return a.serviceID.Valid && int(a.serviceID.Int32) == id })
+	return nil
+}
+
+func (ms *MemoryStore) ExistsHassService(identity, domain string) (bool, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identity]
+	if !ok {
+		return false, nil
+	}
+	return mi.get_id_of_hass_service(domain) != -1, nil
+}
+
+func (ms *MemoryStore) GetAllowedHassServicesOfEntity(identity, entityId string) ([]*models.HassService, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	var result []*models.HassService = []*models.HassService{}
+
+	mi, ok := ms.identities[identity]
+	if !ok {
+		return result, nil
+	}
+	eID := mi.get_id_of_entity(entityId)
+	for _, sID := range sorted_memory_ids(mi.hassServices) {
+		if mi.allowedServices[[2]int{eID, sID}] {
+			service := *mi.hassServices[sID]
+			result = append(result, &service)
+		}
+	}
+	return result, nil
+}
+
+func (mi *memoryIdentity) get_id_of_hass_service(domain string) int {
+	for id, s := range mi.hassServices {
+		if s.Domain == domain {
+			return id
+		}
+	}
+	return -1
+}
+
+// ---------------------------------------------------------------------------
+// allowed services
+
+func (ms *MemoryStore) AllowService(identity, domain, entityId string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identity]
+	if !ok || mi.get_id_of_hass_service(domain) == -1 {
+		return fmt.Errorf("%w: the homeassistant service with identity %s and domain %s does not exist", ErrNotFound, identity, domain)
+	}
+	eID := mi.get_id_of_entity(entityId)
+	if eID == -1 {
+		return fmt.Errorf("%w: the entity %s does not exist in %s", ErrNotFound, entityId, identity)
+	}
+	key := [2]int{eID, mi.get_id_of_hass_service(domain)}
+	if mi.allowedServices[key] {
+		return fmt.Errorf("%w: homeassistant service %s is already allowed for %s in %s", ErrAlreadyExists, domain, entityId, identity)
+	}
+	mi.allowedServices[key] = true
+	return nil
+}
+
+func (ms *MemoryStore) DisallowService(identity, domain, entityId string) error {
+	allowed, err := ms.IsServiceAllowed(identity, domain, entityId)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return fmt.Errorf("%w: homeassistant service %s is not allowed for %s in %s", ErrNotFound, domain, entityId, identity)
+	}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if mi, ok := ms.identities[identity]; ok {
+		delete(mi.allowedServices, [2]int{mi.get_id_of_entity(entityId), mi.get_id_of_hass_service(domain)})
+	}
+	return nil
+}
+
+func (ms *MemoryStore) IsServiceAllowed(identity, domain, entityId string) (bool, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identity]
+	if !ok || mi.get_id_of_hass_service(domain) == -1 {
+		return false, fmt.Errorf("%w: the homeassistant service with identity %s and domain %s does not exist", ErrNotFound, identity, domain)
+	}
+	eID := mi.get_id_of_entity(entityId)
+	if eID == -1 {
+		return false, fmt.Errorf("%w: the entity %s does not exist in %s", ErrNotFound, entityId, identity)
+	}
+	return mi.allowedServices[[2]int{eID, mi.get_id_of_hass_service(domain)}], nil
+}
+
+// ---------------------------------------------------------------------------
+// allowed sensors
+
+func (ms *MemoryStore) AllowSensor(identity, deviceId, sensorId string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, err := ms.get_identity(identity)
+	if err != nil {
+		return err
+	}
+	dID := mi.get_id_of_entity(deviceId)
+	if dID == -1 {
+		return fmt.Errorf("%w: the entity %s does not exist in %s", ErrNotFound, deviceId, identity)
+	}
+	sID := mi.get_id_of_entity(sensorId)
+	if sID == -1 {
+		return fmt.Errorf("%w: the entity %s does not exist in %s", ErrNotFound, sensorId, identity)
+	}
+	key := [2]int{dID, sID}
+	if mi.allowedSensors[key] {
+		return fmt.Errorf("%w: sensor %s is already allowed for %s in %s", ErrAlreadyExists, sensorId, deviceId, identity)
+	}
+	mi.allowedSensors[key] = true
+	return nil
+}
+
+func (ms *MemoryStore) DisallowSensor(identity, deviceId, sensorId string) error {
+	allowed, err := ms.IsSensorAllowed(identity, deviceId, sensorId)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return fmt.Errorf("%w: sensor %s is not allowed for %s in %s", ErrNotFound, sensorId, deviceId, identity)
+	}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if mi, ok := ms.identities[identity]; ok {
+		delete(mi.allowedSensors, [2]int{mi.get_id_of_entity(deviceId), mi.get_id_of_entity(sensorId)})
+	}
+	return nil
+}
+
+func (ms *MemoryStore) IsSensorAllowed(identity, deviceId, sensorId string) (bool, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	var dID, sID int = -1, -1
+	mi, ok := ms.identities[identity]
+	if ok {
+		dID = mi.get_id_of_entity(deviceId)
+		sID = mi.get_id_of_entity(sensorId)
+	}
+	if dID == -1 {
+		return false, fmt.Errorf("%w: the entity %s does not exist in %s", ErrNotFound, deviceId, identity)
+	}
+	if sID == -1 {
+		return false, fmt.Errorf("%w: the entity %s does not exist in %s", ErrNotFound, sensorId, identity)
+	}
+	return mi.allowedSensors[[2]int{dID, sID}], nil
+}
+
+// ---------------------------------------------------------------------------
+// helpers
+
+// with_rollback runs fn on the data of the identity and restores the previous
+// data if fn fails, like a transaction does. The caller must hold the mutex.
+func (ms *MemoryStore) with_rollback(identifier string, fn func(mi *memoryIdentity) error) error {
+	mi, err := ms.get_identity(identifier)
+	if err != nil {
+		return err
+	}
+	snapshot := mi.clone()
+	if err = fn(mi); err != nil {
+		ms.identities[identifier] = snapshot
+		return err
+	}
+	return nil
+}
+
+func (mi *memoryIdentity) clone() *memoryIdentity {
+	c := &memoryIdentity{
+		identity:        mi.identity,
+		location:        mi.location,
+		entities:        clone_memory_table(mi.entities),
+		hassServices:    clone_memory_table(mi.hassServices),
+		allowedServices: map[[2]int]bool{},
+		allowedSensors:  map[[2]int]bool{},
+		conditions:      clone_memory_table(mi.conditions),
+		rules:           clone_memory_table(mi.rules),
+		delays:          clone_memory_table(mi.delays),
+		notifications:   clone_memory_table(mi.notifications),
+		stateChanges:    clone_memory_table(mi.stateChanges),
+		ruleSwitches:    clone_memory_table(mi.ruleSwitches),
+		scenes:          clone_memory_table(mi.scenes),
+		waits:           clone_memory_table(mi.waits),
+		repeats:         clone_memory_table(mi.repeats),
+		sceneStates:     map[[2]int]string{},
+		actions:         clone_memory_table(mi.actions),
+		actionRuns:      map[int]*models.ActionRun{},
+		ruleRuns:        map[int]*models.RuleRun{},
+		counters:        map[string]int{},
+	}
+	for _, s := range mi.states {
+		state := *s
+		c.states = append(c.states, &state)
+	}
+	for k, v := range mi.allowedServices {
+		c.allowedServices[k] = v
+	}
+	for k, v := range mi.allowedSensors {
+		c.allowedSensors[k] = v
+	}
+	for k, v := range mi.sceneStates {
+		c.sceneStates[k] = v
+	}
+	for k, v := range mi.counters {
+		c.counters[k] = v
+	}
+	for k, v := range mi.actionRuns {
+		c.actionRuns[k] = copy_action_run(v)
+	}
+	for k, v := range mi.ruleRuns {
+		c.ruleRuns[k] = copy_rule_run(v)
+	}
+	return c
+}
+
+func clone_memory_table[T any](table map[int]*T) map[int]*T {
+	c := make(map[int]*T, len(table))
+	for k, v := range table {
+		row := *v
+		c[k] = &row
+	}
+	return c
+}
+
+// next_id allocates the next id of a table, like the id_counters table does.
+// The caller must hold the mutex.
+func (mi *memoryIdentity) next_id(table string) int {
+	id, ok := mi.counters[table]
+	if ok {
+		id++
+	}
+	mi.counters[table] = id
+	return id
+}
+
+func sorted_memory_ids[T any](table map[int]T) []int {
+	ids := make([]int, 0, len(table))
+	for k := range table {
+		ids = append(ids, k)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func null_int(v int) sql.NullInt32 {
+	return sql.NullInt32{Valid: true, Int32: int32(v)}
+}
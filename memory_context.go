@@ -0,0 +1,606 @@
+package honuadatabase
+
+import (
+	"context"
+	"time"
+
+	"github.com/JonasBordewick/honua-database/models"
+)
+
+// The context variants of the MemoryStore only check if the context is done,
+// all operations of the MemoryStore are synchronous.
+
+func (ms *MemoryStore) AddIdentityContext(ctx context.Context, identity *models.Identity) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.AddIdentity(identity)
+}
+
+func (ms *MemoryStore) DeleteIdentityContext(ctx context.Context, identifier string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.DeleteIdentity(identifier)
+}
+
+func (ms *MemoryStore) ExistIdentityContext(ctx context.Context, identifier string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return ms.ExistIdentity(identifier)
+}
+
+func (ms *MemoryStore) GetIdentityContext(ctx context.Context, identifier string) (*models.Identity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ms.GetIdentity(identifier)
+}
+
+func (ms *MemoryStore) GetIdentitiesContext(ctx context.Context) ([]*models.Identity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ms.GetIdentities()
+}
+
+func (ms *MemoryStore) SetLocationContext(ctx context.Context, identifier string, location *models.Location) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.SetLocation(identifier, location)
+}
+
+func (ms *MemoryStore) GetLocationContext(ctx context.Context, identifier string) (*models.Location, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ms.GetLocation(identifier)
+}
+
+func (ms *MemoryStore) GetEntityContext(ctx context.Context, identity string, id int) (*models.Entity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ms.GetEntity(identity, id)
+}
+
+func (ms *MemoryStore) AddEntityContext(ctx context.Context, entity *models.Entity) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.AddEntity(entity)
+}
+
+func (ms *MemoryStore) DeleteEntityContext(ctx context.Context, id int, identity string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.DeleteEntity(id, identity)
+}
+
+func (ms *MemoryStore) EditEntityContext(ctx context.Context, identifier string, entity *models.Entity) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.EditEntity(identifier, entity)
+}
+
+func (ms *MemoryStore) ExistEntityContext(ctx context.Context, identifier string, id int, hasAttribute bool, attribute string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return ms.ExistEntity(identifier, id, hasAttribute, attribute)
+}
+
+func (ms *MemoryStore) GetIdOfEntityContext(ctx context.Context, identifier, entityId string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+	return ms.GetIdOfEntity(identifier, entityId)
+}
+
+func (ms *MemoryStore) GetEntitiesContext(ctx context.Context, identifier string) ([]*models.Entity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ms.GetEntities(identifier)
+}
+
+func (ms *MemoryStore) GetEntitiesWhereRulesAreAllowedContext(ctx context.Context, identifier string) ([]*models.Entity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ms.GetEntitiesWhereRulesAreAllowed(identifier)
+}
+
+func (ms *MemoryStore) GetEntitiesWithoutRuleContext(ctx context.Context, identifier string) ([]*models.Entity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ms.GetEntitiesWithoutRule(identifier)
+}
+
+func (ms *MemoryStore) GetVictronEntitiesContext(ctx context.Context, identifier string) ([]*models.Entity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ms.GetVictronEntities(identifier)
+}
+
+func (ms *MemoryStore) AddStateContext(ctx context.Context, identity string, state *models.State) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.AddState(identity, state)
+}
+
+func (ms *MemoryStore) GetStateContext(ctx context.Context, identity string, entityID int) (*models.State, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ms.GetState(identity, entityID)
+}
+
+func (ms *MemoryStore) DeleteOldestStateContext(ctx context.Context, identity string, entityID int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.DeleteOldestState(identity, entityID)
+}
+
+func (ms *MemoryStore) GetNumberOfStatesOfEntityContext(ctx context.Context, identity string, entityID int) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+	return ms.GetNumberOfStatesOfEntity(identity, entityID)
+}
+
+func (ms *MemoryStore) GetStatesBetweenContext(ctx context.Context, identity string, entityID int, from, to time.Time) ([]*models.State, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ms.GetStatesBetween(identity, entityID, from, to)
+}
+
+func (ms *MemoryStore) GetLastStateChangeContext(ctx context.Context, identity string, entityID int) (*models.StateTransition, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ms.GetLastStateChange(identity, entityID)
+}
+
+func (ms *MemoryStore) GetAllRulesOfIdentityContext(ctx context.Context, identity string) ([]*models.Rule, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ms.GetAllRulesOfIdentity(identity)
+}
+
+func (ms *MemoryStore) GetRuleContext(ctx context.Context, identity string, id int) (*models.Rule, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ms.GetRule(identity, id)
+}
+
+func (ms *MemoryStore) GetActiveRulesContext(ctx context.Context, identity string) ([]*models.Rule, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ms.GetActiveRules(identity)
+}
+
+func (ms *MemoryStore) SetRuleEnabledContext(ctx context.Context, identity string, id int, enabled bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.SetRuleEnabled(identity, id, enabled)
+}
+
+func (ms *MemoryStore) SetAllRulesEnabledContext(ctx context.Context, identity string, enabled bool) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return ms.SetAllRulesEnabled(identity, enabled)
+}
+
+func (ms *MemoryStore) SetEntityRulesEnabledContext(ctx context.Context, identity string, id int, enabled bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.SetEntityRulesEnabled(identity, id, enabled)
+}
+
+func (ms *MemoryStore) SearchRulesContext(ctx context.Context, identity, text string) ([]*models.Rule, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ms.SearchRules(identity, text)
+}
+
+func (ms *MemoryStore) AddRuleContext(ctx context.Context, identity string, rule *models.Rule) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.AddRule(identity, rule)
+}
+
+func (ms *MemoryStore) EditRuleContext(ctx context.Context, identity string, rule *models.Rule) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.EditRule(identity, rule)
+}
+
+func (ms *MemoryStore) DeleteRuleContext(ctx context.Context, identity string, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.DeleteRule(identity, id)
+}
+
+func (ms *MemoryStore) ExistRuleContext(ctx context.Context, identity string, id int) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return ms.ExistRule(identity, id)
+}
+
+func (ms *MemoryStore) ExistRulesContext(ctx context.Context, identity string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return ms.ExistRules(identity)
+}
+
+func (ms *MemoryStore) AddConditionContext(ctx context.Context, identity string, condition *models.Condition) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+	return ms.AddCondition(identity, condition)
+}
+
+func (ms *MemoryStore) DeleteConditionContext(ctx context.Context, conditionID int, identity string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.DeleteCondition(conditionID, identity)
+}
+
+func (ms *MemoryStore) EditConditionContext(ctx context.Context, identity string, condition *models.Condition) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.EditCondition(identity, condition)
+}
+
+func (ms *MemoryStore) ExistConditionContext(ctx context.Context, conditionID int, identity string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return ms.ExistCondition(conditionID, identity)
+}
+
+func (ms *MemoryStore) GetConditionContext(ctx context.Context, conditionID int, identity string) (*models.Condition, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ms.GetCondition(conditionID, identity)
+}
+
+func (ms *MemoryStore) GetActionsOfRuleContext(ctx context.Context, identifier string, ruleID int) ([]*models.Action, []*models.Action, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	return ms.GetActionsOfRule(identifier, ruleID)
+}
+
+func (ms *MemoryStore) AddActionContext(ctx context.Context, identifier string, ruleID int, isThenAction bool, action *models.Action) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.AddAction(identifier, ruleID, isThenAction, action)
+}
+
+func (ms *MemoryStore) InsertActionContext(ctx context.Context, identifier string, ruleID int, isThenAction bool, position int, action *models.Action) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.InsertAction(identifier, ruleID, isThenAction, position, action)
+}
+
+func (ms *MemoryStore) MoveActionUpContext(ctx context.Context, identifier string, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.MoveActionUp(identifier, id)
+}
+
+func (ms *MemoryStore) MoveActionDownContext(ctx context.Context, identifier string, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.MoveActionDown(identifier, id)
+}
+
+func (ms *MemoryStore) ReorderActionsContext(ctx context.Context, identifier string, ruleID int, isThenAction bool, ids []int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.ReorderActions(identifier, ruleID, isThenAction, ids)
+}
+
+func (ms *MemoryStore) DeleteActionContext(ctx context.Context, identifier string, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.DeleteAction(identifier, id)
+}
+
+func (ms *MemoryStore) ExistActionContext(ctx context.Context, identifier string, id int) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return ms.ExistAction(identifier, id)
+}
+
+func (ms *MemoryStore) GetDelayContext(ctx context.Context, identifier string, delayID int) (*models.Delay, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ms.GetDelay(identifier, delayID)
+}
+
+func (ms *MemoryStore) AddDelayContext(ctx context.Context, identity string, delay *models.Delay) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+	return ms.AddDelay(identity, delay)
+}
+
+func (ms *MemoryStore) EditDelayContext(ctx context.Context, identity string, delay *models.Delay) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.EditDelay(identity, delay)
+}
+
+func (ms *MemoryStore) DeleteDelayContext(ctx context.Context, identity string, delayID int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.DeleteDelay(identity, delayID)
+}
+
+func (ms *MemoryStore) ExistDelayContext(ctx context.Context, identifier string, delayID int) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return ms.ExistDelay(identifier, delayID)
+}
+
+func (ms *MemoryStore) GetScenesOfIdentityContext(ctx context.Context, identity string) ([]*models.Scene, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ms.GetScenesOfIdentity(identity)
+}
+
+func (ms *MemoryStore) GetSceneContext(ctx context.Context, identity string, id int) (*models.Scene, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ms.GetScene(identity, id)
+}
+
+func (ms *MemoryStore) AddSceneContext(ctx context.Context, identity string, scene *models.Scene) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.AddScene(identity, scene)
+}
+
+func (ms *MemoryStore) EditSceneContext(ctx context.Context, identity string, scene *models.Scene) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.EditScene(identity, scene)
+}
+
+func (ms *MemoryStore) DeleteSceneContext(ctx context.Context, identity string, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.DeleteScene(identity, id)
+}
+
+func (ms *MemoryStore) ExistSceneContext(ctx context.Context, identity string, id int) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return ms.ExistScene(identity, id)
+}
+
+func (ms *MemoryStore) AddHassServiceContext(ctx context.Context, service *models.HassService, identity string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.AddHassService(service, identity)
+}
+
+func (ms *MemoryStore) GetIDofHassServiceContext(ctx context.Context, identity, domain string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+	return ms.GetIDofHassService(identity, domain)
+}
+
+func (ms *MemoryStore) GetHassServiceContext(ctx context.Context, identity string, id int) (*models.HassService, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ms.GetHassService(identity, id)
+}
+
+func (ms *MemoryStore) ToggleHassServiceContext(ctx context.Context, identity, domain string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.ToggleHassService(identity, domain)
+}
+
+func (ms *MemoryStore) DeleteHassServiceContext(ctx context.Context, identity, domain string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.DeleteHassService(identity, domain)
+}
+
+func (ms *MemoryStore) ExistsHassServiceContext(ctx context.Context, identity, domain string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return ms.ExistsHassService(identity, domain)
+}
+
+func (ms *MemoryStore) GetAllowedHassServicesOfEntityContext(ctx context.Context, identity, entityId string) ([]*models.HassService, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ms.GetAllowedHassServicesOfEntity(identity, entityId)
+}
+
+func (ms *MemoryStore) AllowServiceContext(ctx context.Context, identity, domain, entityId string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.AllowService(identity, domain, entityId)
+}
+
+func (ms *MemoryStore) DisallowServiceContext(ctx context.Context, identity, domain, entityId string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.DisallowService(identity, domain, entityId)
+}
+
+func (ms *MemoryStore) IsServiceAllowedContext(ctx context.Context, identity, domain, entityId string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return ms.IsServiceAllowed(identity, domain, entityId)
+}
+
+func (ms *MemoryStore) AllowSensorContext(ctx context.Context, identity, deviceId, sensorId string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.AllowSensor(identity, deviceId, sensorId)
+}
+
+func (ms *MemoryStore) DisallowSensorContext(ctx context.Context, identity, deviceId, sensorId string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.DisallowSensor(identity, deviceId, sensorId)
+}
+
+func (ms *MemoryStore) IsSensorAllowedContext(ctx context.Context, identity, deviceId, sensorId string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return ms.IsSensorAllowed(identity, deviceId, sensorId)
+}
+
+func (ms *MemoryStore) AddActionRunContext(ctx context.Context, identity string, run *models.ActionRun) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.AddActionRun(identity, run)
+}
+
+func (ms *MemoryStore) UpdateActionRunContext(ctx context.Context, identity string, run *models.ActionRun) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.UpdateActionRun(identity, run)
+}
+
+func (ms *MemoryStore) GetActionRunContext(ctx context.Context, identity string, id int) (*models.ActionRun, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ms.GetActionRun(identity, id)
+}
+
+func (ms *MemoryStore) GetActionRunsContext(ctx context.Context, identity string) ([]*models.ActionRun, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ms.GetActionRuns(identity)
+}
+
+func (ms *MemoryStore) DeleteActionRunContext(ctx context.Context, identity string, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.DeleteActionRun(identity, id)
+}
+
+func (ms *MemoryStore) DeleteActionRunsOfRuleContext(ctx context.Context, identity string, ruleID int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.DeleteActionRunsOfRule(identity, ruleID)
+}
+
+func (ms *MemoryStore) AddRuleRunContext(ctx context.Context, identity string, run *models.RuleRun) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.AddRuleRun(identity, run)
+}
+
+func (ms *MemoryStore) AddRuleRunActionContext(ctx context.Context, identity string, id int, outcome *models.ActionOutcome) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.AddRuleRunAction(identity, id, outcome)
+}
+
+func (ms *MemoryStore) FinishRuleRunContext(ctx context.Context, identity string, id int, finishedAt time.Time, failure string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.FinishRuleRun(identity, id, finishedAt, failure)
+}
+
+func (ms *MemoryStore) GetRuleRunContext(ctx context.Context, identity string, id int) (*models.RuleRun, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ms.GetRuleRun(identity, id)
+}
+
+func (ms *MemoryStore) GetRuleRunsOfRuleContext(ctx context.Context, identity string, ruleID int, page models.Page) ([]*models.RuleRun, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ms.GetRuleRunsOfRule(identity, ruleID, page)
+}
+
+func (ms *MemoryStore) GetRuleRunsOfEntityContext(ctx context.Context, identity string, entityID int, page models.Page) ([]*models.RuleRun, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ms.GetRuleRunsOfEntity(identity, entityID, page)
+}
+
+func (ms *MemoryStore) PruneRuleRunsContext(ctx context.Context, identity string, policy models.RetentionPolicy) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return ms.PruneRuleRuns(identity, policy)
+}
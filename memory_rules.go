@@ -0,0 +1,1490 @@
+package honuadatabase
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/JonasBordewick/honua-database/models"
+)
+
+type memoryRule struct {
+	id                   int
+	entityID             int
+	eventBasedEvaluation bool
+	periodicTrigger      sql.NullInt32
+	name                 string
+	description          string
+	conditionID          int
+	enabled              bool
+}
+
+// ---------------------------------------------------------------------------
+// rules
+
+func (ms *MemoryStore) GetAllRulesOfIdentity(identity string) ([]*models.Rule, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identity]
+	if !ok {
+		return []*models.Rule{}, nil
+	}
+	return mi.get_rules(identity, func(r *memoryRule) bool { return true })
+}
+
+func (ms *MemoryStore) GetRule(identity string, id int) (*models.Rule, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identity]
+	if !ok || mi.rules[id] == nil {
+		return nil, fmt.Errorf("%w: the rule %d of %s does not exist", ErrNotFound, id, identity)
+	}
+	rules, err := mi.get_rules(identity, func(r *memoryRule) bool { return r.id == id })
+	if err != nil {
+		return nil, err
+	}
+	return rules[0], nil
+}
+
+func (ms *MemoryStore) GetActiveRules(identity string) ([]*models.Rule, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identity]
+	if !ok {
+		return []*models.Rule{}, nil
+	}
+	return mi.get_rules(identity, func(r *memoryRule) bool {
+		return r.enabled && mi.entities[r.entityID].RulesEnabled
+	})
+}
+
+func (ms *MemoryStore) SearchRules(identity, text string) ([]*models.Rule, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identity]
+	if !ok {
+		return []*models.Rule{}, nil
+	}
+	text = strings.ToLower(text)
+	return mi.get_rules(identity, func(r *memoryRule) bool {
+		return strings.Contains(strings.ToLower(r.name), text) || strings.Contains(strings.ToLower(r.description), text)
+	})
+}
+
+func (mi *memoryIdentity) get_rules(identity string, keep func(r *memoryRule) bool) ([]*models.Rule, error) {
+	var result []*models.Rule = []*models.Rule{}
+
+	for _, id := range sorted_memory_ids(mi.rules) {
+		r := mi.rules[id]
+		if !keep(r) {
+			continue
+		}
+		rule := &models.Rule{
+			Id:                   r.id,
+			Enabled:              r.enabled,
+			EventBasedEvaluation: r.eventBasedEvaluation,
+			Name:                 r.name,
+			Description:          r.description,
+		}
+		if !r.eventBasedEvaluation {
+			rule.PeriodicTrigger = models.PeriodicTriggerType(r.periodicTrigger.Int32)
+		}
+
+		entity := *mi.entities[r.entityID]
+		rule.Target = &entity
+
+		condition, err := mi.get_condition(r.conditionID)
+		if err != nil {
+			return nil, err
+		}
+		rule.Condition = condition
+
+		tActions, eActions, err := mi.get_actions_of_rule(identity, id)
+		if err != nil {
+			return nil, err
+		}
+		rule.ThenActions = tActions
+		rule.ElseActions = eActions
+
+		result = append(result, rule)
+	}
+
+	return result, nil
+}
+
+func (ms *MemoryStore) AddRule(identity string, rule *models.Rule) (err error) {
+	defer ms.subscribers.rules_changed(identity, &err)
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if _, err := ms.get_identity(identity); err != nil {
+		return &RuleError{Part: RulePartRule, RuleID: -1, Err: err}
+	}
+
+	var id int
+	err = ms.with_rollback(identity, func(mi *memoryIdentity) error {
+		id = mi.next_id("rules")
+		return mi.add_rule(identity, id, rule)
+	})
+	if err != nil {
+		return err
+	}
+	rule.Id = id
+	return nil
+}
+
+func (ms *MemoryStore) EditRule(identity string, rule *models.Rule) (err error) {
+	defer ms.subscribers.rules_changed(identity, &err)
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if _, ok := ms.identities[identity]; !ok {
+		return &RuleError{Part: RulePartRule, RuleID: rule.Id, Err: fmt.Errorf("%w: the rule %d of %s does not exist", ErrNotFound, rule.Id, identity)}
+	}
+	return ms.with_rollback(identity, func(mi *memoryIdentity) error {
+		if err := mi.delete_rule_graph(identity, rule.Id); err != nil {
+			return err
+		}
+		return mi.add_rule(identity, rule.Id, rule)
+	})
+}
+
+func (ms *MemoryStore) DeleteRule(identity string, id int) (err error) {
+	defer ms.subscribers.rules_changed(identity, &err)
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if _, ok := ms.identities[identity]; !ok {
+		return &RuleError{Part: RulePartRule, RuleID: id, Err: fmt.Errorf("%w: the rule %d of %s does not exist", ErrNotFound, id, identity)}
+	}
+	return ms.with_rollback(identity, func(mi *memoryIdentity) error {
+		if err := mi.delete_rule_graph(identity, id); err != nil {
+			return err
+		}
+		mi.delete_rule_switches_of_rule(id)
+		return nil
+	})
+}
+
+func (ms *MemoryStore) SetRuleEnabled(identity string, id int, enabled bool) (err error) {
+	defer ms.subscribers.rules_changed(identity, &err)
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identity]
+	if !ok || mi.rules[id] == nil {
+		return fmt.Errorf("%w: the rule %d of %s does not exist", ErrNotFound, id, identity)
+	}
+	mi.rules[id].enabled = enabled
+	if !enabled {
+		mi.delete_action_runs(func(run *models.ActionRun) bool { return run.RuleID == id })
+	}
+	return nil
+}
+
+func (ms *MemoryStore) SetAllRulesEnabled(identity string, enabled bool) (_ int, err error) {
+	defer ms.subscribers.rules_changed(identity, &err)
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	var counter int = 0
+	if mi, ok := ms.identities[identity]; ok {
+		for _, r := range mi.rules {
+			if r.enabled != enabled {
+				r.enabled = enabled
+				counter++
+			}
+		}
+		if !enabled {
+			mi.delete_action_runs(func(run *models.ActionRun) bool { return true })
+		}
+	}
+	return counter, nil
+}
+
+// SubscribeRules calls handler after every change of the rules of an identity until cancel is called
+func (ms *MemoryStore) SubscribeRules(handler RuleHandler) (cancel func()) {
+	return ms.subscribers.rules.subscribe(handler)
+}
+
+func (ms *MemoryStore) ExistRule(identity string, id int) (bool, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identity]
+	return ok && mi.rules[id] != nil, nil
+}
+
+func (ms *MemoryStore) ExistRules(identity string) (bool, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identity]
+	return ok && len(mi.rules) > 0, nil
+}
+
+func (mi *memoryIdentity) add_rule(identity string, id int, rule *models.Rule) error {
+	cID, err := mi.add_condition(rule.Condition)
+	if err != nil {
+		return &RuleError{Part: RulePartCondition, RuleID: id, Err: err}
+	}
+
+	if rule.Target == nil || mi.entities[rule.Target.Id] == nil {
+		return &RuleError{Part: RulePartRule, RuleID: id, Err: fmt.Errorf("%w: the target of the rule does not exist", ErrForeignKeyViolation)}
+	}
+
+	mi.rules[id] = &memoryRule{
+		id:                   id,
+		entityID:             rule.Target.Id,
+		eventBasedEvaluation: rule.EventBasedEvaluation,
+		periodicTrigger:      sql.NullInt32{Valid: !rule.EventBasedEvaluation, Int32: int32(rule.PeriodicTrigger)},
+		name:                 rule_name(rule),
+		enabled:              rule.Enabled,
+		description:          rule.Description,
+		conditionID:          cID,
+	}
+
+	for _, a := range rule.ThenActions {
+		if err = mi.add_action(identity, id, true, a); err != nil {
+			return as_rule_error(RulePartThenActions, id, err)
+		}
+	}
+	for _, a := range rule.ElseActions {
+		if err = mi.add_action(identity, id, false, a); err != nil {
+			return as_rule_error(RulePartElseActions, id, err)
+		}
+	}
+	return nil
+}
+
+// delete_rule_graph removes the rule with its condition tree, actions and
+// their parameters. The switches of other rules are kept, so EditRule can add
+// the rule again with the same id.
+func (mi *memoryIdentity) delete_rule_graph(identity string, id int) error {
+	r, ok := mi.rules[id]
+	if !ok {
+		return &RuleError{Part: RulePartRule, RuleID: id, Err: fmt.Errorf("%w: the rule %d of %s does not exist", ErrNotFound, id, identity)}
+	}
+	mi.remove_rule(id)
+	mi.delete_condition(r.conditionID)
+	return nil
+}
+
+// delete_rule removes the rule whose target or condition is deleted, like
+// DeleteRule with its condition tree and the switches of other rules
+func (mi *memoryIdentity) delete_rule(id int) {
+	r, ok := mi.rules[id]
+	if !ok {
+		return
+	}
+	mi.remove_rule(id)
+	mi.delete_condition(r.conditionID)
+	mi.delete_rule_switches_of_rule(id)
+}
+
+// remove_rule removes the rule with its runs, actions and their parameters
+func (mi *memoryIdentity) remove_rule(id int) {
+	delete(mi.rules, id)
+	mi.delete_action_runs(func(run *models.ActionRun) bool { return run.RuleID == id })
+	for aID, a := range mi.actions {
+		if a.ruleID == id {
+			mi.delete_action(aID)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// conditions
+
+func (ms *MemoryStore) AddCondition(identity string, condition *models.Condition) (int, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, err := ms.get_identity(identity)
+	if err != nil {
+		return -1, err
+	}
+	return mi.add_condition(condition)
+}
+
+func (ms *MemoryStore) DeleteCondition(conditionID int, identity string) (err error) {
+	defer ms.subscribers.rules_changed(identity, &err)
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identity]
+	if !ok || mi.conditions[conditionID] == nil {
+		return fmt.Errorf("%w: the condition %d of %s does not exist", ErrNotFound, conditionID, identity)
+	}
+	mi.delete_condition(conditionID)
+	return nil
+}
+
+func (ms *MemoryStore) EditCondition(identity string, condition *models.Condition) (err error) {
+	defer ms.subscribers.rules_changed(identity, &err)
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identity]
+	if !ok {
+		return fmt.Errorf("%w: the Condition with a id %d does not exist in %s", ErrNotFound, condition.Id, identity)
+	}
+	return mi.edit_condition(identity, condition)
+}
+
+func (ms *MemoryStore) ExistCondition(conditionID int, identity string) (bool, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identity]
+	return ok && mi.conditions[conditionID] != nil, nil
+}
+
+func (ms *MemoryStore) GetCondition(conditionID int, identity string) (*models.Condition, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identity]
+	if !ok || mi.conditions[conditionID] == nil {
+		return nil, fmt.Errorf("%w: the condition with id = %d does not exist", ErrNotFound, conditionID)
+	}
+	return mi.get_condition(conditionID)
+}
+
+func (mi *memoryIdentity) add_condition(condition *models.Condition) (int, error) {
+	id := mi.next_id("conditions")
+	mi.conditions[id] = &conditionRow{id: id, conditionType: condition.Type}
+
+	for _, sub := range condition.SubConditions {
+		if err := mi.add_subcondition(sub, id); err != nil {
+			return -1, err
+		}
+	}
+	return id, nil
+}
+
+func (mi *memoryIdentity) add_subcondition(condition *models.Condition, parentID int) error {
+	row, err := mi.leaf_condition_row(condition)
+	if err != nil {
+		return err
+	}
+	row.id = mi.next_id("conditions")
+	row.parentID = null_int(parentID)
+
+	mi.conditions[row.id] = row
+	return nil
+}
+
+// leaf_condition_row builds the row of the condition like the database with
+// its foreign keys and the checks of the template and the attribute
+func (mi *memoryIdentity) leaf_condition_row(condition *models.Condition) (*conditionRow, error) {
+	row, err := leaf_condition_row(condition)
+	if err != nil {
+		return nil, err
+	}
+	if row.sensorID.Valid {
+		sensor := mi.entities[int(row.sensorID.Int32)]
+		if sensor == nil {
+			return nil, fmt.Errorf("%w: the sensor of the condition does not exist", ErrForeignKeyViolation)
+		}
+		if err := check_attribute(condition, sensor); err != nil {
+			return nil, err
+		}
+	}
+	if condition.Type == models.TEMPLATE {
+		if err := mi.check_template(condition.Template); err != nil {
+			return nil, err
+		}
+	}
+	return row, nil
+}
+
+func (mi *memoryIdentity) edit_condition(identity string, condition *models.Condition) error {
+	row, ok := mi.conditions[condition.Id]
+	if !ok {
+		return fmt.Errorf("%w: the Condition with a id %d does not exist in %s", ErrNotFound, condition.Id, identity)
+	}
+
+	hasNoParent := !row.parentID.Valid
+
+	if condition.Type < models.NUMERICSTATE {
+		if !hasNoParent {
+			return fmt.Errorf("%w: this Condition (%d, %s) has a parent, the condition type of %d is not valid", ErrInvalidCondition, condition.Id, identity, condition.Type)
+		}
+		row.conditionType = condition.Type
+		for _, c := range condition.SubConditions {
+			if err := mi.edit_condition(identity, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if hasNoParent {
+		return fmt.Errorf("%w: this Condition (%d, %s) hasn't a parent, the condition type of %d is not valid", ErrInvalidCondition, condition.Id, identity, condition.Type)
+	}
+
+	edited, err := mi.leaf_condition_row(condition)
+	if err != nil {
+		return err
+	}
+	edited.parentID = row.parentID
+	mi.conditions[row.id] = edited
+	return nil
+}
+
+// delete_condition removes the condition with its subconditions and the rules using it
+func (mi *memoryIdentity) delete_condition(id int) {
+	if _, ok := mi.conditions[id]; !ok {
+		return
+	}
+	delete(mi.conditions, id)
+
+	for cID, c := range mi.conditions {
+		if c.parentID.Valid && int(c.parentID.Int32) == id {
+			mi.delete_condition(cID)
+		}
+	}
+	for rID, r := range mi.rules {
+		if r.conditionID == id {
+			mi.delete_rule(rID)
+		}
+	}
+	for _, w := range mi.waits {
+		if w.conditionID == id {
+			mi.delete_control(func(a *actionRow) bool { return a.waitID.Valid && int(a.waitID.Int32) == w.id })
+		}
+	}
+	for _, r := range mi.repeats {
+		if r.conditionID.Valid && int(r.conditionID.Int32) == id {
+			mi.delete_control(func(a *actionRow) bool { return a.repeatID.Valid && int(a.repeatID.Int32) == r.id })
+		}
+	}
+}
+
+// delete_control removes the wait or repeat actions matching, like the
+// constraints do when the condition of a wait or repeat is deleted
+func (mi *memoryIdentity) delete_control(match func(a *actionRow) bool) {
+	for aID, a := range mi.actions {
+		if match(a) {
+			mi.delete_action(aID)
+		}
+	}
+}
+
+// check_template parses the template and checks that the entities it uses exist
+func (mi *memoryIdentity) check_template(template string) error {
+	expr, err := parse_template(template)
+	if err != nil {
+		return err
+	}
+	var known map[string]bool = map[string]bool{}
+	for _, e := range mi.entities {
+		known[e.EntityId] = true
+	}
+	return check_template_entities(expr, known)
+}
+
+// check_message parses the message of a notification and checks that the entities it uses exist
+func (mi *memoryIdentity) check_message(message string) error {
+	parsed, err := parse_message(message)
+	if err != nil {
+		return err
+	}
+	var known map[string]bool = map[string]bool{}
+	for _, e := range mi.entities {
+		known[e.EntityId] = true
+	}
+	return check_message_entities(parsed, known)
+}
+
+// get_condition builds the condition with its subconditions
+func (mi *memoryIdentity) get_condition(id int) (*models.Condition, error) {
+	var rows []*conditionRow
+	for _, cID := range sorted_memory_ids(mi.conditions) {
+		rows = append(rows, mi.conditions[cID])
+	}
+	return make_condition_tree(rows, mi.entities, id)
+}
+
+// ---------------------------------------------------------------------------
+// actions
+
+func (ms *MemoryStore) GetActionsOfRule(identifier string, ruleID int) ([]*models.Action, []*models.Action, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identifier]
+	if !ok {
+		return []*models.Action{}, []*models.Action{}, nil
+	}
+	return mi.get_actions_of_rule(identifier, ruleID)
+}
+
+func (ms *MemoryStore) AddAction(identifier string, ruleID int, isThenAction bool, action *models.Action) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	return ms.with_rollback(identifier, func(mi *memoryIdentity) error {
+		return mi.add_action(identifier, ruleID, isThenAction, action)
+	})
+}
+
+func (ms *MemoryStore) InsertAction(identifier string, ruleID int, isThenAction bool, position int, action *models.Action) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	return ms.with_rollback(identifier, func(mi *memoryIdentity) error {
+		list := actionList{ruleID: ruleID, isThenAction: isThenAction}
+		ids := mi.get_action_ids(list)
+		if position < 0 || position > len(ids) {
+			position = len(ids)
+		}
+		for _, id := range ids[position:] {
+			mi.actions[id].position++
+		}
+		return mi.insert_action(identifier, list, position, action)
+	})
+}
+
+func (ms *MemoryStore) MoveActionUp(identifier string, id int) error {
+	return ms.move_action(identifier, id, -1)
+}
+
+func (ms *MemoryStore) MoveActionDown(identifier string, id int) error {
+	return ms.move_action(identifier, id, 1)
+}
+
+func (ms *MemoryStore) move_action(identifier string, id int, offset int) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identifier]
+	if !ok || mi.actions[id] == nil {
+		return fmt.Errorf("%w: the action %d of %s does not exist", ErrNotFound, id, identifier)
+	}
+	ids := mi.get_action_ids(mi.actions[id].list())
+
+	var index int = index_of(ids, id)
+	var target int = index + offset
+	if target < 0 || target >= len(ids) {
+		return nil
+	}
+	ids[index], ids[target] = ids[target], ids[index]
+	mi.set_action_positions(ids)
+	return nil
+}
+
+func (ms *MemoryStore) ReorderActions(identifier string, ruleID int, isThenAction bool, ids []int) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	current := []int{}
+	if mi, ok := ms.identities[identifier]; ok {
+		current = mi.get_action_ids(actionList{ruleID: ruleID, isThenAction: isThenAction})
+	}
+	if err := check_action_order(current, ids); err != nil {
+		return err
+	}
+	if len(ids) > 0 {
+		ms.identities[identifier].set_action_positions(ids)
+	}
+	return nil
+}
+
+func (ms *MemoryStore) DeleteAction(identifier string, id int) (err error) {
+	defer ms.subscribers.rules_changed(identifier, &err)
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identifier]
+	if !ok || mi.actions[id] == nil {
+		return fmt.Errorf("%w: the action %d of %s does not exist", ErrNotFound, id, identifier)
+	}
+	mi.delete_actions(func(a *actionRow) bool { return a.id == id })
+	return nil
+}
+
+func (ms *MemoryStore) ExistAction(identifier string, id int) (bool, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identifier]
+	return ok && mi.actions[id] != nil, nil
+}
+
+func (mi *memoryIdentity) get_actions_of_rule(identifier string, ruleID int) ([]*models.Action, []*models.Action, error) {
+	thenActions := []*models.Action{}
+	elseActions := []*models.Action{}
+
+	var ids []int
+	for _, id := range sorted_memory_ids(mi.actions) {
+		if mi.actions[id].ruleID == ruleID {
+			ids = append(ids, id)
+		}
+	}
+	sort.SliceStable(ids, func(i, j int) bool {
+		return mi.actions[ids[i]].position < mi.actions[ids[j]].position
+	})
+
+	var byID map[int]*models.Action = map[int]*models.Action{}
+	for _, id := range ids {
+		action, err := mi.make_action(identifier, mi.actions[id])
+		if err != nil {
+			return nil, nil, err
+		}
+		byID[id] = action
+	}
+
+	for _, id := range ids {
+		a := mi.actions[id]
+		action := byID[id]
+		if a.parentID.Valid {
+			parent, ok := byID[int(a.parentID.Int32)]
+			if !ok {
+				continue
+			}
+			if parent.Wait != nil {
+				parent.Wait.TimeoutActions = append(parent.Wait.TimeoutActions, action)
+			} else if parent.Repeat != nil {
+				parent.Repeat.Actions = append(parent.Repeat.Actions, action)
+			}
+		} else if a.isThenAction {
+			thenActions = append(thenActions, action)
+		} else {
+			elseActions = append(elseActions, action)
+		}
+	}
+
+	return thenActions, elseActions, nil
+}
+
+func (mi *memoryIdentity) make_action(identifier string, a *actionRow) (*models.Action, error) {
+	action := &models.Action{Id: a.id, Type: a.actionType, Position: a.position}
+	if a.actionType == models.SERVICE {
+		action.Service = mi.hassServices[int(a.serviceID.Int32)].Domain
+		action.ServiceName = a.serviceName
+		if a.serviceData != nil {
+			action.ServiceData = append(json.RawMessage{}, a.serviceData...)
+		}
+		if a.targetID.Valid {
+			target := *mi.entities[int(a.targetID.Int32)]
+			action.Target = &target
+		}
+	} else if a.actionType == models.DELAY {
+		delay, ok := mi.delays[int(a.delayID.Int32)]
+		if !ok {
+			return nil, fmt.Errorf("%w: the delay %d of %s does not exist", ErrNotFound, a.delayID.Int32, identifier)
+		}
+		d := *delay
+		action.Delay = &d
+	} else if a.actionType == models.NOTIFY {
+		n := *mi.notifications[int(a.notificationID.Int32)]
+		action.Notification = &n
+	} else if a.actionType == models.SET_STATE {
+		change := mi.stateChanges[int(a.stateChangeID.Int32)]
+		entity := *mi.entities[change.entityID]
+		action.StateChange = &models.StateChange{Id: change.id, Entity: &entity, State: change.state}
+	} else if a.actionType == models.SWITCH_RULE {
+		r := *mi.ruleSwitches[int(a.ruleSwitchID.Int32)]
+		action.RuleSwitch = &r
+	} else if a.actionType == models.SCENE {
+		action.Scene = mi.get_scene(int(a.sceneID.Int32))
+	} else if a.actionType == models.WAIT_UNTIL {
+		wait := mi.waits[int(a.waitID.Int32)]
+		condition, err := mi.get_condition(wait.conditionID)
+		if err != nil {
+			return nil, err
+		}
+		action.Wait = &models.Wait{Id: wait.id, Condition: condition, Timeout: wait.timeout, TimeoutActions: []*models.Action{}}
+	} else if a.actionType == models.REPEAT {
+		repeat := mi.repeats[int(a.repeatID.Int32)]
+		action.Repeat = &models.Repeat{Id: repeat.id, Count: repeat.count, Actions: []*models.Action{}}
+		if repeat.conditionID.Valid {
+			condition, err := mi.get_condition(int(repeat.conditionID.Int32))
+			if err != nil {
+				return nil, err
+			}
+			action.Repeat.While = condition
+		}
+	} else {
+		return nil, fmt.Errorf("%w: actiontype %d not supported", ErrUnsupportedType, a.actionType)
+	}
+	return action, nil
+}
+
+func (mi *memoryIdentity) add_action(identifier string, ruleID int, isThenAction bool, action *models.Action) error {
+	list := actionList{ruleID: ruleID, isThenAction: isThenAction}
+	return mi.insert_action(identifier, list, len(mi.get_action_ids(list)), action)
+}
+
+func (mi *memoryIdentity) insert_action(identifier string, list actionList, position int, action *models.Action) error {
+	var ruleID int = list.ruleID
+	if mi.rules[ruleID] == nil {
+		return fmt.Errorf("%w: the rule %d does not exist in %s", ErrForeignKeyViolation, ruleID, identifier)
+	}
+
+	var nested []*models.Action
+	row := &actionRow{
+		id:           mi.next_id("actions"),
+		actionType:   action.Type,
+		ruleID:       ruleID,
+		isThenAction: list.isThenAction,
+		position:     position,
+		parentID:     list.parentID,
+	}
+
+	if action.Type == models.DELAY {
+		row.delayID = null_int(mi.add_delay(action.Delay))
+	} else if action.Type == models.NOTIFY {
+		if action.Notification == nil || action.Notification.Message == "" {
+			return fmt.Errorf("%w: a notification needs a message", ErrInvalidAction)
+		}
+		if err := mi.check_message(action.Notification.Message); err != nil {
+			return err
+		}
+		n := *action.Notification
+		n.Id = mi.next_id("notifications")
+		mi.notifications[n.Id] = &n
+		row.notificationID = null_int(n.Id)
+	} else if action.Type == models.SET_STATE {
+		if action.StateChange == nil || action.StateChange.Entity == nil {
+			return fmt.Errorf("%w: a state change needs an entity", ErrInvalidAction)
+		}
+		if mi.entities[action.StateChange.Entity.Id] == nil {
+			return fmt.Errorf("%w: the entity %d does not exist in %s", ErrForeignKeyViolation, action.StateChange.Entity.Id, identifier)
+		}
+		change := &stateChangeRow{id: mi.next_id("state_changes"), entityID: action.StateChange.Entity.Id, state: action.StateChange.State}
+		mi.stateChanges[change.id] = change
+		row.stateChangeID = null_int(change.id)
+	} else if action.Type == models.SWITCH_RULE {
+		if action.RuleSwitch == nil {
+			return fmt.Errorf("%w: a rule switch needs a rule", ErrInvalidAction)
+		}
+		if mi.rules[action.RuleSwitch.RuleID] == nil {
+			return fmt.Errorf("%w: the rule %d of %s does not exist", ErrForeignKeyViolation, action.RuleSwitch.RuleID, identifier)
+		}
+		r := *action.RuleSwitch
+		r.Id = mi.next_id("rule_switches")
+		mi.ruleSwitches[r.Id] = &r
+		row.ruleSwitchID = null_int(r.Id)
+	} else if action.Type == models.SCENE {
+		if action.Scene == nil {
+			return fmt.Errorf("%w: a scene action needs a scene", ErrInvalidAction)
+		}
+		if mi.scenes[action.Scene.Id] == nil {
+			return fmt.Errorf("%w: the scene %d does not exist in %s", ErrForeignKeyViolation, action.Scene.Id, identifier)
+		}
+		row.sceneID = null_int(action.Scene.Id)
+	} else if action.Type == models.WAIT_UNTIL {
+		if action.Wait == nil {
+			return fmt.Errorf("%w: a wait needs a condition", ErrInvalidAction)
+		}
+		if err := check_control_condition(action.Wait.Condition); err != nil {
+			return err
+		}
+		if err := check_wait_timeout(action.Wait.Timeout); err != nil {
+			return err
+		}
+		conditionID, err := mi.add_condition(action.Wait.Condition)
+		if err != nil {
+			return err
+		}
+		wait := &waitRow{id: mi.next_id("waits"), conditionID: conditionID, timeout: action.Wait.Timeout}
+		mi.waits[wait.id] = wait
+		row.waitID = null_int(wait.id)
+		nested = action.Wait.TimeoutActions
+	} else if action.Type == models.REPEAT {
+		if action.Repeat == nil || (action.Repeat.Count <= 0 && action.Repeat.While == nil) {
+			return fmt.Errorf("%w: a repeat needs a count or a condition", ErrInvalidAction)
+		}
+		repeat := &repeatRow{count: action.Repeat.Count}
+		if action.Repeat.While != nil {
+			if err := check_control_condition(action.Repeat.While); err != nil {
+				return err
+			}
+			conditionID, err := mi.add_condition(action.Repeat.While)
+			if err != nil {
+				return err
+			}
+			repeat.conditionID = null_int(conditionID)
+		}
+		repeat.id = mi.next_id("repeats")
+		mi.repeats[repeat.id] = repeat
+		row.repeatID = null_int(repeat.id)
+		nested = action.Repeat.Actions
+	} else if action.Type == models.SERVICE {
+		if err := check_service_data(action.ServiceData); err != nil {
+			return err
+		}
+		serviceID := mi.get_id_of_hass_service(action.Service)
+		if serviceID == -1 {
+			return fmt.Errorf("%w: no element in database found where identity = %s and domain = %s", ErrNotFound, identifier, action.Service)
+		}
+		var targetID int = mi.rules[ruleID].entityID
+		if action.Target != nil {
+			targetID = action.Target.Id
+			row.targetID = null_int(targetID)
+		}
+		if !mi.allowedServices[[2]int{targetID, serviceID}] {
+			return fmt.Errorf("%w: the service %s is not allowed for the entity %d in %s", ErrServiceNotAllowed, action.Service, targetID, identifier)
+		}
+		row.serviceID = null_int(serviceID)
+		row.serviceName = action.ServiceName
+		if len(action.ServiceData) > 0 {
+			row.serviceData = append([]byte{}, action.ServiceData...)
+		}
+	} else {
+		return fmt.Errorf("%w: actiontype %d not supported", ErrUnsupportedType, action.Type)
+	}
+
+	mi.actions[row.id] = row
+	action.Id = row.id
+	action.Position = position
+
+	for i, a := range nested {
+		err := mi.insert_action(identifier, actionList{ruleID: ruleID, isThenAction: list.isThenAction, parentID: null_int(row.id)}, i, a)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// delete_actions removes the matching actions like delete_actions of the
+// database, with their nested actions and parameters. The gaps in the
+// positions are closed and the runs of their rules are deleted.
+func (mi *memoryIdentity) delete_actions(match func(a *actionRow) bool) {
+	var lists []actionList
+	var ruleIDs map[int]bool = map[int]bool{}
+	for _, id := range sorted_memory_ids(mi.actions) {
+		a, ok := mi.actions[id]
+		if !ok || !match(a) {
+			continue
+		}
+		mi.delete_action(id)
+		lists = append(lists, a.list())
+		ruleIDs[a.ruleID] = true
+	}
+	for _, list := range lists {
+		mi.set_action_positions(mi.get_action_ids(list))
+	}
+	mi.delete_action_runs(func(run *models.ActionRun) bool { return ruleIDs[run.RuleID] })
+}
+
+// delete_action removes the action with its parameters and nested actions
+func (mi *memoryIdentity) delete_action(id int) {
+	a, ok := mi.actions[id]
+	if !ok {
+		return
+	}
+	delete(mi.actions, id)
+	mi.delete_action_parameters(a)
+	for cID, c := range mi.actions {
+		if c.parentID.Valid && int(c.parentID.Int32) == id {
+			mi.delete_action(cID)
+		}
+	}
+}
+
+// get_action_ids returns the ids of the actions in list in their order
+func (mi *memoryIdentity) get_action_ids(list actionList) []int {
+	var result []int = []int{}
+	for _, id := range sorted_memory_ids(mi.actions) {
+		a := mi.actions[id]
+		if a.list() == list {
+			result = append(result, id)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return mi.actions[result[i]].position < mi.actions[result[j]].position
+	})
+	return result
+}
+
+func (mi *memoryIdentity) set_action_positions(ids []int) {
+	for position, id := range ids {
+		mi.actions[id].position = position
+	}
+}
+
+// ---------------------------------------------------------------------------
+// delays
+
+func (ms *MemoryStore) GetDelay(identifier string, delayID int) (*models.Delay, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identifier]
+	if !ok || mi.delays[delayID] == nil {
+		return nil, fmt.Errorf("%w: the delay %d of %s does not exist", ErrNotFound, delayID, identifier)
+	}
+	result := *mi.delays[delayID]
+	return &result, nil
+}
+
+func (ms *MemoryStore) AddDelay(identity string, delay *models.Delay) (int, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, err := ms.get_identity(identity)
+	if err != nil {
+		return -1, err
+	}
+	return mi.add_delay(delay), nil
+}
+
+func (ms *MemoryStore) EditDelay(identity string, delay *models.Delay) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identity]
+	if !ok || mi.delays[delay.Id] == nil {
+		return fmt.Errorf("%w: the delay %d of %s does not exist", ErrNotFound, delay.Id, identity)
+	}
+	stored := mi.delays[delay.Id]
+	stored.Hours = delay.Hours
+	stored.Minutes = delay.Minutes
+	stored.Seconds = delay.Seconds
+	return nil
+}
+
+func (ms *MemoryStore) DeleteDelay(identity string, delayID int) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identity]
+	if !ok || mi.delays[delayID] == nil {
+		return fmt.Errorf("%w: the delay %d of %s does not exist", ErrNotFound, delayID, identity)
+	}
+	mi.delete_delay(delayID)
+	return nil
+}
+
+func (ms *MemoryStore) ExistDelay(identifier string, delayID int) (bool, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identifier]
+	return ok && mi.delays[delayID] != nil, nil
+}
+
+func (mi *memoryIdentity) add_delay(delay *models.Delay) int {
+	id := mi.next_id("delays")
+	mi.delays[id] = &models.Delay{
+		Id:      id,
+		Hours:   delay.Hours,
+		Minutes: delay.Minutes,
+		Seconds: delay.Seconds,
+	}
+	return id
+}
+
+// delete_delay removes the delay and the actions using it
+func (mi *memoryIdentity) delete_delay(id int) {
+	delete(mi.delays, id)
+	for aID, a := range mi.actions {
+		if a.delayID.Valid && int(a.delayID.Int32) == id {
+			delete(mi.actions, aID)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// action parameters
+
+// waitRow is a row of the table waits
+type waitRow struct {
+	id          int
+	conditionID int
+	timeout     time.Duration
+}
+
+// repeatRow is a row of the table repeats
+type repeatRow struct {
+	id          int
+	count       int
+	conditionID sql.NullInt32
+}
+
+// stateChangeRow is a row of the table state_changes
+type stateChangeRow struct {
+	id       int
+	entityID int
+	state    string
+}
+
+// delete_action_parameters removes the parameters of the action that belong
+// to it alone, like delete_action_parameters of the database does
+func (mi *memoryIdentity) delete_action_parameters(a *actionRow) {
+	if a.delayID.Valid {
+		delete(mi.delays, int(a.delayID.Int32))
+	}
+	if a.notificationID.Valid {
+		delete(mi.notifications, int(a.notificationID.Int32))
+	}
+	if a.stateChangeID.Valid {
+		delete(mi.stateChanges, int(a.stateChangeID.Int32))
+	}
+	if a.ruleSwitchID.Valid {
+		delete(mi.ruleSwitches, int(a.ruleSwitchID.Int32))
+	}
+	if a.waitID.Valid {
+		if wait, ok := mi.waits[int(a.waitID.Int32)]; ok {
+			delete(mi.waits, wait.id)
+			mi.delete_condition(wait.conditionID)
+		}
+	}
+	if a.repeatID.Valid {
+		if repeat, ok := mi.repeats[int(a.repeatID.Int32)]; ok {
+			delete(mi.repeats, repeat.id)
+			if repeat.conditionID.Valid {
+				mi.delete_condition(int(repeat.conditionID.Int32))
+			}
+		}
+	}
+}
+
+// delete_rule_switches_of_rule removes the switches of the rule and the
+// actions using them
+func (mi *memoryIdentity) delete_rule_switches_of_rule(ruleID int) {
+	mi.delete_actions(func(a *actionRow) bool {
+		if !a.ruleSwitchID.Valid {
+			return false
+		}
+		ruleSwitch, ok := mi.ruleSwitches[int(a.ruleSwitchID.Int32)]
+		return ok && ruleSwitch.RuleID == ruleID
+	})
+	for sID, r := range mi.ruleSwitches {
+		if r.RuleID == ruleID {
+			delete(mi.ruleSwitches, sID)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// scenes
+
+// sceneRow is a row of the table scenes, the states are in sceneStates
+type sceneRow struct {
+	id   int
+	name string
+}
+
+func (ms *MemoryStore) GetScenesOfIdentity(identity string) ([]*models.Scene, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	var result []*models.Scene = []*models.Scene{}
+	mi, ok := ms.identities[identity]
+	if !ok {
+		return result, nil
+	}
+	for _, id := range sorted_memory_ids(mi.scenes) {
+		result = append(result, mi.get_scene(id))
+	}
+	return result, nil
+}
+
+func (ms *MemoryStore) GetScene(identity string, id int) (*models.Scene, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identity]
+	if !ok || mi.scenes[id] == nil {
+		return nil, fmt.Errorf("%w: the scene %d of %s does not exist", ErrNotFound, id, identity)
+	}
+	return mi.get_scene(id), nil
+}
+
+func (ms *MemoryStore) AddScene(identity string, scene *models.Scene) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	var id int
+	err := ms.with_rollback(identity, func(mi *memoryIdentity) error {
+		for _, s := range mi.scenes {
+			if s.name == scene.Name {
+				return fmt.Errorf("%w: the scene %s already exists in %s", ErrAlreadyExists, scene.Name, identity)
+			}
+		}
+		id = mi.next_id("scenes")
+		mi.scenes[id] = &sceneRow{id: id, name: scene.Name}
+		return mi.add_scene_states(identity, id, scene.States)
+	})
+	if err != nil {
+		return err
+	}
+	scene.Id = id
+	return nil
+}
+
+func (ms *MemoryStore) EditScene(identity string, scene *models.Scene) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identity]
+	if !ok || mi.scenes[scene.Id] == nil {
+		return fmt.Errorf("%w: the scene %d of %s does not exist", ErrNotFound, scene.Id, identity)
+	}
+	return ms.with_rollback(identity, func(mi *memoryIdentity) error {
+		for _, s := range mi.scenes {
+			if s.id != scene.Id && s.name == scene.Name {
+				return fmt.Errorf("%w: the scene %s already exists in %s", ErrAlreadyExists, scene.Name, identity)
+			}
+		}
+		mi.scenes[scene.Id].name = scene.Name
+		for key := range mi.sceneStates {
+			if key[0] == scene.Id {
+				delete(mi.sceneStates, key)
+			}
+		}
+		return mi.add_scene_states(identity, scene.Id, scene.States)
+	})
+}
+
+func (ms *MemoryStore) DeleteScene(identity string, id int) (err error) {
+	defer ms.subscribers.rules_changed(identity, &err)
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identity]
+	if !ok || mi.scenes[id] == nil {
+		return fmt.Errorf("%w: the scene %d of %s does not exist", ErrNotFound, id, identity)
+	}
+	delete(mi.scenes, id)
+	for key := range mi.sceneStates {
+		if key[0] == id {
+			delete(mi.sceneStates, key)
+		}
+	}
+	mi.delete_actions(func(a *actionRow) bool { return a.sceneID.Valid && int(a.sceneID.Int32) == id })
+	return nil
+}
+
+func (ms *MemoryStore) ExistScene(identity string, id int) (bool, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identity]
+	return ok && mi.scenes[id] != nil, nil
+}
+
+func (mi *memoryIdentity) add_scene_states(identity string, sceneID int, states []*models.SceneState) error {
+	for _, s := range states {
+		if s.Entity == nil {
+			return fmt.Errorf("%w: a state of the scene %d has no entity", ErrInvalidAction, sceneID)
+		}
+		if mi.entities[s.Entity.Id] == nil {
+			return fmt.Errorf("%w: the entity %d does not exist in %s", ErrForeignKeyViolation, s.Entity.Id, identity)
+		}
+		key := [2]int{sceneID, s.Entity.Id}
+		if _, ok := mi.sceneStates[key]; ok {
+			return fmt.Errorf("%w: the scene %d has more than one state for the entity %d", ErrAlreadyExists, sceneID, s.Entity.Id)
+		}
+		mi.sceneStates[key] = s.State
+	}
+	return nil
+}
+
+func (mi *memoryIdentity) get_scene(id int) *models.Scene {
+	scene := &models.Scene{Id: id, Name: mi.scenes[id].name, States: []*models.SceneState{}}
+	for _, eID := range sorted_memory_ids(mi.entities) {
+		state, ok := mi.sceneStates[[2]int{id, eID}]
+		if !ok {
+			continue
+		}
+		entity := *mi.entities[eID]
+		scene.States = append(scene.States, &models.SceneState{Entity: &entity, State: state})
+	}
+	return scene
+}
+
+// ---------------------------------------------------------------------------
+// action runs
+
+func (ms *MemoryStore) AddActionRun(identity string, run *models.ActionRun) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, err := ms.get_identity(identity)
+	if err != nil {
+		return err
+	}
+	if _, ok := mi.rules[run.RuleID]; !ok {
+		return fmt.Errorf("%w: the rule %d does not exist in %s", ErrForeignKeyViolation, run.RuleID, identity)
+	}
+
+	run.Id = mi.next_id("action_runs")
+	run.StartedAt = time.Now()
+	mi.actionRuns[run.Id] = copy_action_run(run)
+	return nil
+}
+
+func (ms *MemoryStore) UpdateActionRun(identity string, run *models.ActionRun) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identity]
+	if !ok || mi.actionRuns[run.Id] == nil {
+		return fmt.Errorf("%w: the action run %d of %s does not exist", ErrNotFound, run.Id, identity)
+	}
+	stored := mi.actionRuns[run.Id]
+	updated := copy_action_run(run)
+	stored.Position, stored.ResumeAt = updated.Position, updated.ResumeAt
+	return nil
+}
+
+func (ms *MemoryStore) GetActionRun(identity string, id int) (*models.ActionRun, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identity]
+	if !ok || mi.actionRuns[id] == nil {
+		return nil, fmt.Errorf("%w: the action run %d of %s does not exist", ErrNotFound, id, identity)
+	}
+	return copy_action_run(mi.actionRuns[id]), nil
+}
+
+func (ms *MemoryStore) GetActionRuns(identity string) ([]*models.ActionRun, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	var result []*models.ActionRun = []*models.ActionRun{}
+	if mi, ok := ms.identities[identity]; ok {
+		for _, id := range sorted_memory_ids(mi.actionRuns) {
+			result = append(result, copy_action_run(mi.actionRuns[id]))
+		}
+	}
+	return result, nil
+}
+
+func (ms *MemoryStore) DeleteActionRun(identity string, id int) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identity]
+	if !ok || mi.actionRuns[id] == nil {
+		return fmt.Errorf("%w: the action run %d of %s does not exist", ErrNotFound, id, identity)
+	}
+	delete(mi.actionRuns, id)
+	return nil
+}
+
+func (ms *MemoryStore) DeleteActionRunsOfRule(identity string, ruleID int) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if mi, ok := ms.identities[identity]; ok {
+		mi.delete_action_runs(func(run *models.ActionRun) bool { return run.RuleID == ruleID })
+	}
+	return nil
+}
+
+func (mi *memoryIdentity) delete_action_runs(match func(run *models.ActionRun) bool) {
+	for id, run := range mi.actionRuns {
+		if match(run) {
+			delete(mi.actionRuns, id)
+		}
+	}
+}
+
+// delete_entity_action_runs deletes the runs of the rules targeting the entity
+func (mi *memoryIdentity) delete_entity_action_runs(entityID int) {
+	mi.delete_action_runs(func(run *models.ActionRun) bool {
+		rule, ok := mi.rules[run.RuleID]
+		return ok && rule.entityID == entityID
+	})
+}
+
+func copy_action_run(run *models.ActionRun) *models.ActionRun {
+	c := *run
+	c.Position = append([]models.ActionPosition{}, run.Position...)
+	if run.ResumeAt != nil {
+		resumeAt := *run.ResumeAt
+		c.ResumeAt = &resumeAt
+	}
+	if run.RuleRunID != nil {
+		id := *run.RuleRunID
+		c.RuleRunID = &id
+	}
+	return &c
+}
+
+// ---------------------------------------------------------------------------
+// rule runs
+
+func (ms *MemoryStore) AddRuleRun(identity string, run *models.RuleRun) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, err := ms.get_identity(identity)
+	if err != nil {
+		return err
+	}
+	run.Id = mi.next_id("rule_runs")
+	mi.ruleRuns[run.Id] = copy_rule_run(run)
+	return nil
+}
+
+func (ms *MemoryStore) AddRuleRunAction(identity string, id int, outcome *models.ActionOutcome) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identity]
+	if !ok || mi.ruleRuns[id] == nil {
+		return fmt.Errorf("%w: the rule run %d of %s does not exist", ErrNotFound, id, identity)
+	}
+	o := *outcome
+	o.Position = append([]models.ActionPosition{}, outcome.Position...)
+	mi.ruleRuns[id].Actions = append(mi.ruleRuns[id].Actions, &o)
+	return nil
+}
+
+func (ms *MemoryStore) FinishRuleRun(identity string, id int, finishedAt time.Time, failure string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identity]
+	if !ok || mi.ruleRuns[id] == nil {
+		return fmt.Errorf("%w: the rule run %d of %s does not exist", ErrNotFound, id, identity)
+	}
+	run := mi.ruleRuns[id]
+	run.FinishedAt = &finishedAt
+	if failure != "" {
+		run.Error = failure
+	}
+	return nil
+}
+
+func (ms *MemoryStore) GetRuleRun(identity string, id int) (*models.RuleRun, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identity]
+	if !ok || mi.ruleRuns[id] == nil {
+		return nil, fmt.Errorf("%w: the rule run %d of %s does not exist", ErrNotFound, id, identity)
+	}
+	return copy_rule_run(mi.ruleRuns[id]), nil
+}
+
+func (ms *MemoryStore) GetRuleRunsOfRule(identity string, ruleID int, page models.Page) ([]*models.RuleRun, error) {
+	return ms.get_rule_runs(identity, page, func(run *models.RuleRun) bool {
+		return run.RuleID == ruleID
+	})
+}
+
+func (ms *MemoryStore) GetRuleRunsOfEntity(identity string, entityID int, page models.Page) ([]*models.RuleRun, error) {
+	return ms.get_rule_runs(identity, page, func(run *models.RuleRun) bool {
+		return run.EntityID == entityID || (run.TriggerEntityID != nil && *run.TriggerEntityID == entityID)
+	})
+}
+
+func (ms *MemoryStore) get_rule_runs(identity string, page models.Page, match func(run *models.RuleRun) bool) ([]*models.RuleRun, error) {
+	limit, offset, err := check_page(page)
+	if err != nil {
+		return nil, err
+	}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	var result []*models.RuleRun = []*models.RuleRun{}
+	mi, ok := ms.identities[identity]
+	if !ok {
+		return result, nil
+	}
+	for _, run := range mi.newest_rule_runs() {
+		if !match(run) {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		if len(result) == limit {
+			break
+		}
+		result = append(result, copy_rule_run(run))
+	}
+	return result, nil
+}
+
+func (ms *MemoryStore) PruneRuleRuns(identity string, policy models.RetentionPolicy) (int, error) {
+	if err := check_retention(policy); err != nil {
+		return 0, err
+	}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mi, ok := ms.identities[identity]
+	if !ok {
+		return 0, nil
+	}
+	oldest := time.Now().Add(-policy.MaxAge)
+	var perRule map[int]int = map[int]int{}
+	var deleted int
+	for _, run := range mi.newest_rule_runs() {
+		perRule[run.RuleID]++
+		if (policy.MaxAge > 0 && run.EvaluatedAt.Before(oldest)) || (policy.MaxRunsPerRule > 0 && perRule[run.RuleID] > policy.MaxRunsPerRule) {
+			delete(mi.ruleRuns, run.Id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// newest_rule_runs returns the runs ordered like the database, the newest run first
+func (mi *memoryIdentity) newest_rule_runs() []*models.RuleRun {
+	var runs []*models.RuleRun
+	for _, id := range sorted_memory_ids(mi.ruleRuns) {
+		runs = append(runs, mi.ruleRuns[id])
+	}
+	sort.SliceStable(runs, func(i, j int) bool {
+		if runs[i].EvaluatedAt.Equal(runs[j].EvaluatedAt) {
+			return runs[i].Id > runs[j].Id
+		}
+		return runs[i].EvaluatedAt.After(runs[j].EvaluatedAt)
+	})
+	return runs
+}
+
+func copy_rule_run(run *models.RuleRun) *models.RuleRun {
+	c := *run
+	if run.TriggerEntityID != nil {
+		id := *run.TriggerEntityID
+		c.TriggerEntityID = &id
+	}
+	if run.FinishedAt != nil {
+		finishedAt := *run.FinishedAt
+		c.FinishedAt = &finishedAt
+	}
+	c.Trace = copy_trace(run.Trace)
+	c.Actions = nil
+	for _, a := range run.Actions {
+		o := *a
+		o.Position = append([]models.ActionPosition{}, a.Position...)
+		c.Actions = append(c.Actions, &o)
+	}
+	return &c
+}
+
+func copy_trace(trace *models.ConditionTrace) *models.ConditionTrace {
+	if trace == nil {
+		return nil
+	}
+	c := *trace
+	c.Children = nil
+	for _, child := range trace.Children {
+		c.Children = append(c.Children, copy_trace(child))
+	}
+	return &c
+}
@@ -1,188 +1,374 @@
 package honuadatabase
 
 import (
-	"bufio"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
-	"os"
-	"path/filepath"
-	"strings"
+	"io/fs"
+	"log/slog"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Errors returned by the migration methods
+var (
+	ErrChecksumMismatch     = errors.New("checksum of an applied migration has changed")
+	ErrMissingDownMigration = errors.New("down migration is missing")
+	ErrUnknownMigration     = errors.New("unknown migration version")
 )
 
 const (
-	get_metadata    = "SELECT filepath FROM metadata ORDER BY id ASC;"
-	add_metadata    = "INSERT INTO metadata(filepath) VALUES ($1);"
-	exists_metadata = "SELECT CASE WHEN EXISTS ( SELECT * FROM metadata WHERE filepath = $1) THEN true ELSE false END"
+	create_schema_migrations = `CREATE TABLE IF NOT EXISTS schema_migrations (
+    version INTEGER PRIMARY KEY,
+    name TEXT NOT NULL,
+    checksum TEXT NOT NULL,
+    applied_at TIMESTAMPTZ DEFAULT now() NOT NULL
+);`
+	get_schema_migrations   = "SELECT version, checksum, applied_at FROM schema_migrations ORDER BY version ASC;"
+	add_schema_migration    = "INSERT INTO schema_migrations(version, name, checksum) VALUES ($1, $2, $3) ON CONFLICT (version) DO NOTHING;"
+	delete_schema_migration = "DELETE FROM schema_migrations WHERE version = $1;"
+	exists_schema_migration = "SELECT CASE WHEN EXISTS ( SELECT * FROM schema_migrations WHERE version = $1) THEN true ELSE false END"
+	get_metadata            = "SELECT filepath FROM metadata ORDER BY id ASC;"
+	lock_migrations         = "SELECT pg_advisory_xact_lock($1);"
+	migration_lock_id       = 7368221
 )
 
-func (hdb *HonuaDatabase) exists_metadata(filepath string) (bool, error) {
-	rows, err := hdb.db.Query(exists_metadata, filepath)
+// NNN-name.sql or NNN-name.down.sql
+var migration_file_pattern = regexp.MustCompile(`^(\d+)-(.+?)(\.down)?\.sql$`)
+
+// migration is a version read from the files, down is empty if there is no down file
+type migration struct {
+	version  int
+	name     string
+	up       string
+	down     string
+	checksum string
+}
+
+// MigrationStatus describes one migration version
+type MigrationStatus struct {
+	Version int
+	Name    string
+	// Applied is true if the version is recorded in the database
+	Applied   bool
+	AppliedAt *time.Time
+	// Modified is true if the file changed after the version was applied
+	Modified bool
+	HasDown  bool
+}
+
+type appliedMigration struct {
+	checksum  string
+	appliedAt time.Time
+}
+
+// read_migrations reads and checks all NNN-name.sql files, sorted by version
+func (hdb *HonuaDatabase) read_migrations() ([]*migration, error) {
+	entries, err := fs.ReadDir(hdb.files, ".")
 	if err != nil {
-		log.Printf("An error occured during checking if the metadata %s exists: %s\n", filepath, err.Error())
-		return false, err
+		return nil, fmt.Errorf("reading the migration files: %w", err)
 	}
 
-	var state bool = false
+	var byVersion map[int]*migration = map[int]*migration{}
+	var downs map[int]string = map[int]string{}
 
-	for rows.Next() {
-		err = rows.Scan(&state)
+	for _, entry := range entries {
+		match := migration_file_pattern.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+		version, err := strconv.Atoi(match[1])
 		if err != nil {
-			rows.Close()
-			log.Printf("An error occured during checking if the metadata %s exists: %s\n", filepath, err.Error())
-			return false, err
+			return nil, fmt.Errorf("parsing the version of %s: %w", entry.Name(), err)
+		}
+		content, err := fs.ReadFile(hdb.files, entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("reading the migration %s: %w", entry.Name(), err)
+		}
+
+		if match[3] != "" {
+			if _, ok := downs[version]; ok {
+				return nil, fmt.Errorf("there is more than one down migration with version %d", version)
+			}
+			downs[version] = string(content)
+			continue
+		}
+
+		if _, ok := byVersion[version]; ok {
+			return nil, fmt.Errorf("there is more than one migration with version %d", version)
+		}
+		sum := sha256.Sum256(content)
+		byVersion[version] = &migration{
+			version:  version,
+			name:     match[2],
+			up:       string(content),
+			checksum: hex.EncodeToString(sum[:]),
 		}
 	}
 
-	rows.Close()
+	var result []*migration = []*migration{}
+	for version, down := range downs {
+		m, ok := byVersion[version]
+		if !ok {
+			return nil, fmt.Errorf("the down migration with version %d has no up migration", version)
+		}
+		m.down = down
+	}
+	for _, m := range byVersion {
+		result = append(result, m)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].version < result[j].version })
+	return result, nil
+}
+
+func (hdb *HonuaDatabase) get_applied_migrations(ctx context.Context) (map[int]appliedMigration, error) {
+	rows, err := hdb.db.QueryContext(ctx, get_schema_migrations)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	return state, nil
+	var result map[int]appliedMigration = map[int]appliedMigration{}
+	for rows.Next() {
+		var version int
+		var applied appliedMigration
+		if err = rows.Scan(&version, &applied.checksum, &applied.appliedAt); err != nil {
+			return nil, err
+		}
+		result[version] = applied
+	}
+	return result, rows.Err()
 }
 
-func (hdb *HonuaDatabase) get_all_done_migrations() []string {
-	var migrations []string
+// prepare_migrations creates the schema_migrations table and takes over the
+// versions from the old metadata table, which holds the paths of the executed files.
+func (hdb *HonuaDatabase) prepare_migrations(ctx context.Context, migrations []*migration) error {
+	_, err := hdb.db.ExecContext(ctx, create_schema_migrations)
+	if err != nil {
+		return fmt.Errorf("creating the table schema_migrations: %w", err)
+	}
 
-	rows, err := hdb.db.Query(get_metadata)
+	applied, err := hdb.get_applied_migrations(ctx)
 	if err != nil {
-		rows.Close()
-		return migrations
+		return fmt.Errorf("reading the applied migrations: %w", err)
+	}
+	if len(applied) > 0 {
+		return nil
 	}
 
+	var legacy []string
+	rows, err := hdb.db.QueryContext(ctx, get_metadata)
+	if err != nil {
+		// there is no metadata table, nothing to take over
+		return nil
+	}
 	for rows.Next() {
-		var migration string
-		err := rows.Scan(&migration)
-		if err != nil {
+		var filepath string
+		if err = rows.Scan(&filepath); err != nil {
 			rows.Close()
-			return migrations
+			return fmt.Errorf("reading the table metadata: %w", err)
 		}
-		migrations = append(migrations, migration)
+		legacy = append(legacy, path.Base(filepath))
 	}
-
 	rows.Close()
 
-	return migrations
+	for _, file := range legacy {
+		match := migration_file_pattern.FindStringSubmatch(file)
+		if match == nil || match[3] != "" {
+			continue
+		}
+		version, _ := strconv.Atoi(match[1])
+		for _, m := range migrations {
+			if m.version != version {
+				continue
+			}
+			_, err = hdb.db.ExecContext(ctx, add_schema_migration, m.version, m.name, m.checksum)
+			if err != nil {
+				return fmt.Errorf("taking over migration %d from the table metadata: %w", m.version, err)
+			}
+			hdb.logger.InfoContext(ctx, "Migration taken over from the table metadata", slog.Int("version", m.version), slog.String("file", file))
+		}
+	}
+	return nil
 }
 
-// reads all the migrations sql files which are in the folder /app/database/files
-func (hdb *HonuaDatabase) read_migrations() []string {
-	var files []string
+// Migrate applies all migrations that were not applied yet
+func (hdb *HonuaDatabase) Migrate() error {
+	return hdb.MigrateContext(context.Background())
+}
 
-	files, err := filepath.Glob(fmt.Sprintf("%s/*.sql", hdb.pathToFiles))
+func (hdb *HonuaDatabase) MigrateContext(ctx context.Context) error {
+	migrations, err := hdb.read_migrations()
 	if err != nil {
-		log.Printf("Error running readMigrations %s\n", err.Error())
+		return err
+	}
+	if len(migrations) == 0 {
+		return nil
 	}
-	return files
+	return hdb.migrate_to(ctx, migrations, migrations[len(migrations)-1].version)
 }
 
-// adds a migration to the migration table
-func (hdb *HonuaDatabase) write_metadata(migration string) {
-	_, err := hdb.db.Exec(add_metadata, migration)
+// MigrateTo applies or rolls back migrations until version is the last applied one.
+// A version of 0 rolls back all migrations.
+func (hdb *HonuaDatabase) MigrateTo(version int) error {
+	return hdb.MigrateToContext(context.Background(), version)
+}
+
+func (hdb *HonuaDatabase) MigrateToContext(ctx context.Context, version int) error {
+	migrations, err := hdb.read_migrations()
 	if err != nil {
-		log.Printf("Error running writeMetadata %s\n", err.Error())
+		return err
+	}
+	if version != 0 && find_migration(migrations, version) == nil {
+		return fmt.Errorf("%w: %d", ErrUnknownMigration, version)
 	}
+	return hdb.migrate_to(ctx, migrations, version)
 }
 
-// public Method to start the Migration
-func (hdb *HonuaDatabase) Migrate() {
-	// get all migrations that where done in the past
-	var done []string = hdb.get_all_done_migrations()
-	// get all migrations which are in the folder /app/database/files
-	var migrations []string = hdb.read_migrations()
+func (hdb *HonuaDatabase) migrate_to(ctx context.Context, migrations []*migration, version int) error {
+	if err := hdb.prepare_migrations(ctx, migrations); err != nil {
+		return err
+	}
 
-	// array to store all the migrations that were not already done in the past
-	var todo []string = []string{}
+	applied, err := hdb.get_applied_migrations(ctx)
+	if err != nil {
+		return fmt.Errorf("reading the applied migrations: %w", err)
+	}
 
-	// Iterate through the migration list and add those migrations that have not already been done to the todo list
-	for _, migration := range migrations {
-		if !string_array_contains_string(migration, done) {
-			todo = append(todo, migration)
+	for _, m := range migrations {
+		if a, ok := applied[m.version]; ok && a.checksum != m.checksum {
+			return fmt.Errorf("%w: version %d (%s)", ErrChecksumMismatch, m.version, m.name)
 		}
 	}
 
-	// Iterate through the todo list and parse the migrations to string statements. And Execute each statement
-	// After that write the migration to the metadata table
-	for _, migration := range todo {
-		if strings.Contains(migration, "create.sql") {
-			log.Printf("Migrate Database skip file %s\n", migration)
-			continue
+	// up, in ascending order
+	for _, m := range migrations {
+		if m.version > version {
+			break
 		}
-		log.Printf("Migrate Database with file %s\n", migration)
-		stmts, err := read_and_parse_sql_file(migration)
-		if err != nil {
-			log.Printf("Error while Migrating with file %s: %s\n", migration, err.Error())
+		if _, ok := applied[m.version]; ok {
 			continue
 		}
-		for _, stmt := range stmts {
-			_, err := hdb.db.Exec(stmt)
-			if err != nil {
-				log.Printf("Error while Migrating with file %s: %s\n", migration, err.Error())
-				continue
-			}
+		if err = hdb.apply_migration(ctx, m, true); err != nil {
+			return err
 		}
-		hdb.write_metadata(migration)
 	}
-}
 
-// reads the file in with the given filepath and parse it to a string array
-func read_and_parse_sql_file(filepath string) ([]string, error) {
-	var statements []string
-
-	// Open File
-	file, err := os.Open(filepath)
-	if err != nil {
-		return nil, err
+	// down, in descending order
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.version <= version {
+			break
+		}
+		if _, ok := applied[m.version]; !ok {
+			continue
+		}
+		if m.down == "" {
+			return fmt.Errorf("%w: version %d (%s)", ErrMissingDownMigration, m.version, m.name)
+		}
+		if err = hdb.apply_migration(ctx, m, false); err != nil {
+			return err
+		}
 	}
-	defer file.Close()
-
-	// Scanner zum Zeilenweisen Lesen der Datei erstellen
-	scanner := bufio.NewScanner(file)
+	return nil
+}
 
-	// Variable zum Zwischenspeichern von mehrzeiligen Statements
-	var statementBuilder strings.Builder
+// apply_migration runs the up or down file of m and records it in one transaction.
+// The advisory lock keeps two processes from running the same migration.
+func (hdb *HonuaDatabase) apply_migration(ctx context.Context, m *migration, up bool) error {
+	start := time.Now()
+	err := hdb.with_tx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, lock_migrations, migration_lock_id)
+		if err != nil {
+			return err
+		}
 
-	// Zeilenweise Datei lesen
-	for scanner.Scan() {
-		line := scanner.Text()
+		var exists bool
+		err = tx.QueryRowContext(ctx, exists_schema_migration, m.version).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists == up {
+			// done by somebody else in the meantime
+			return nil
+		}
 
-		// Wenn die Zeile mit einem Kommentar beginnt, überspringen
-		if strings.HasPrefix(strings.TrimSpace(line), "--") {
-			continue
+		if up {
+			if _, err = tx.ExecContext(ctx, m.up); err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, add_schema_migration, m.version, m.name, m.checksum)
+			return err
 		}
 
-		// Wenn die Zeile ein Teil eines mehrzeiligen Statements ist,
-		// an den Builder anhängen
-		if strings.HasSuffix(strings.TrimSpace(line), ";") && statementBuilder.Len() > 0 {
-			statementBuilder.WriteString(" ")
-			statementBuilder.WriteString(strings.TrimSpace(line))
-			statement := statementBuilder.String()
-			statements = append(statements, statement)
-			statementBuilder.Reset()
-		} else {
-			// Ansonsten die Zeile an den Builder anhängen
-			statementBuilder.WriteString(" ")
-			statementBuilder.WriteString(strings.TrimSpace(line))
+		if _, err = tx.ExecContext(ctx, m.down); err != nil {
+			return err
 		}
-	}
+		_, err = tx.ExecContext(ctx, delete_schema_migration, m.version)
+		return err
+	})
 
-	// Letztes Statement hinzufügen, falls mehrzeiliges Statement am Ende
-	if statementBuilder.Len() > 0 {
-		statement := statementBuilder.String()
-		statements = append(statements, strings.TrimSpace(statement))
+	attrs := []slog.Attr{
+		slog.Int("version", m.version),
+		slog.String("name", m.name),
+		slog.Bool("up", up),
+		slog.Duration("duration", time.Since(start)),
 	}
+	if err != nil {
+		hdb.logger.LogAttrs(ctx, slog.LevelError, "Error while Migrating", append(attrs, slog.Any("error", err))...)
+		return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+	}
+	hdb.logger.LogAttrs(ctx, slog.LevelInfo, "Migrate Database", attrs...)
+	return nil
+}
 
-	// Fehler beim Scanner prüfen
-	if err := scanner.Err(); err != nil {
+// Status lists every migration version with its state in the database
+func (hdb *HonuaDatabase) Status() ([]*MigrationStatus, error) {
+	return hdb.StatusContext(context.Background())
+}
+
+func (hdb *HonuaDatabase) StatusContext(ctx context.Context) ([]*MigrationStatus, error) {
+	migrations, err := hdb.read_migrations()
+	if err != nil {
 		return nil, err
 	}
+	if err = hdb.prepare_migrations(ctx, migrations); err != nil {
+		return nil, err
+	}
+	applied, err := hdb.get_applied_migrations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("reading the applied migrations: %w", err)
+	}
 
-	return statements, nil
+	var result []*MigrationStatus = []*MigrationStatus{}
+	for _, m := range migrations {
+		status := &MigrationStatus{
+			Version: m.version,
+			Name:    m.name,
+			HasDown: m.down != "",
+		}
+		if a, ok := applied[m.version]; ok {
+			appliedAt := a.appliedAt
+			status.Applied = true
+			status.AppliedAt = &appliedAt
+			status.Modified = a.checksum != m.checksum
+		}
+		result = append(result, status)
+	}
+	return result, nil
 }
 
-// Determine if a string s is in the string array a
-func string_array_contains_string(s string, a []string) bool {
-	for _, k := range a {
-		if s == k {
-			return true
+func find_migration(migrations []*migration, version int) *migration {
+	for _, m := range migrations {
+		if m.version == version {
+			return m
 		}
 	}
-	return false
-}
\ No newline at end of file
+	return nil
+}
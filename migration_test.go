@@ -0,0 +1,215 @@
+package honuadatabase
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// test_schema creates an empty schema in the database of HONUA_TEST_DSN,
+// which is dropped at the end of the test. It returns a DSN whose
+// connections use the schema, so the migrations do not touch the tables of
+// the other tests.
+func test_schema(t *testing.T) (string, *sql.DB) {
+	t.Helper()
+	dsn := os.Getenv("HONUA_TEST_DSN")
+	if dsn == "" {
+		t.Skip("HONUA_TEST_DSN is not set")
+	}
+
+	ctx := context.Background()
+	schema := fmt.Sprintf("honua_migration_%d", time.Now().UnixNano())
+	if strings.Contains(dsn, "://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			t.Fatalf("parsing HONUA_TEST_DSN: %v", err)
+		}
+		query := u.Query()
+		query.Set("search_path", schema)
+		u.RawQuery = query.Encode()
+		dsn = u.String()
+	} else {
+		dsn += " search_path=" + schema
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("opening the database: %v", err)
+	}
+	if _, err := db.ExecContext(ctx, "CREATE SCHEMA "+schema+";"); err != nil {
+		db.Close()
+		t.Fatalf("creating the schema: %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := db.ExecContext(ctx, "DROP SCHEMA "+schema+" CASCADE;"); err != nil {
+			t.Errorf("dropping the schema: %v", err)
+		}
+		db.Close()
+	})
+	return dsn, db
+}
+
+func open_schema(t *testing.T, dsn string, files fs.FS) *HonuaDatabase {
+	t.Helper()
+	hdb, err := New(context.Background(), Config{DSN: dsn, FS: files})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(hdb.CloseDatabase)
+	return hdb
+}
+
+// check_status checks that exactly the versions up to last are applied and
+// that no applied file was modified
+func check_status(t *testing.T, hdb *HonuaDatabase, last int) {
+	t.Helper()
+	status, err := hdb.StatusContext(context.Background())
+	if err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	if len(status) == 0 {
+		t.Fatal("Status lists no migrations")
+	}
+	for _, s := range status {
+		if want := s.Version <= last; s.Applied != want {
+			t.Errorf("migration %d: applied is %t, want %t", s.Version, s.Applied, want)
+		}
+		if s.Applied != (s.AppliedAt != nil) {
+			t.Errorf("migration %d: applied is %t, but the time is %v", s.Version, s.Applied, s.AppliedAt)
+		}
+		if s.Modified {
+			t.Errorf("migration %d is modified", s.Version)
+		}
+	}
+}
+
+// TestMigrateDownAndUp rolls the embedded migrations back and applies them again
+func TestMigrateDownAndUp(t *testing.T) {
+	dsn, _ := test_schema(t)
+	hdb := open_schema(t, dsn, nil)
+	ctx := context.Background()
+
+	migrations, err := hdb.read_migrations()
+	if err != nil {
+		t.Fatalf("reading the migrations: %v", err)
+	}
+	latest := migrations[len(migrations)-1].version
+	check_status(t, hdb, latest)
+
+	for _, version := range []int{latest - 2, 0, latest} {
+		if err := hdb.MigrateToContext(ctx, version); err != nil {
+			t.Fatalf("MigrateTo(%d): %v", version, err)
+		}
+		check_status(t, hdb, version)
+	}
+
+	if err := hdb.MigrateToContext(ctx, latest+1); !errors.Is(err, ErrUnknownMigration) {
+		t.Errorf("MigrateTo(%d): got %v, want ErrUnknownMigration", latest+1, err)
+	}
+}
+
+// test_files returns three migrations, every down file records its version
+// in migration_log. The migrations depend on each other, so a down file
+// fails if it runs before the one of the next version.
+func test_files() fstest.MapFS {
+	file := func(content string) *fstest.MapFile {
+		return &fstest.MapFile{Data: []byte(content)}
+	}
+	return fstest.MapFS{
+		"create.sql": file(`CREATE TABLE IF NOT EXISTS metadata (id SERIAL PRIMARY KEY, filepath TEXT NOT NULL);
+CREATE TABLE IF NOT EXISTS migration_log (id SERIAL PRIMARY KEY, version INTEGER NOT NULL);`),
+		"001-first.sql":       file("CREATE TABLE first (id INTEGER PRIMARY KEY);"),
+		"001-first.down.sql":  file("DROP TABLE first; INSERT INTO migration_log(version) VALUES (1);"),
+		"002-second.sql":      file("CREATE TABLE second (id INTEGER PRIMARY KEY REFERENCES first(id));"),
+		"002-second.down.sql": file("DROP TABLE second; INSERT INTO migration_log(version) VALUES (2);"),
+		"003-third.sql":       file("ALTER TABLE second ADD COLUMN name TEXT;"),
+		"003-third.down.sql":  file("ALTER TABLE second DROP COLUMN name; INSERT INTO migration_log(version) VALUES (3);"),
+	}
+}
+
+func TestMigrateDownOrder(t *testing.T) {
+	dsn, db := test_schema(t)
+	hdb := open_schema(t, dsn, test_files())
+	ctx := context.Background()
+	check_status(t, hdb, 3)
+
+	if err := hdb.MigrateToContext(ctx, 0); err != nil {
+		t.Fatalf("MigrateTo(0): %v", err)
+	}
+	check_status(t, hdb, 0)
+
+	rows, err := db.QueryContext(ctx, "SELECT version FROM migration_log ORDER BY id ASC;")
+	if err != nil {
+		t.Fatalf("reading the log: %v", err)
+	}
+	defer rows.Close()
+	var order []int
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			t.Fatalf("reading the log: %v", err)
+		}
+		order = append(order, version)
+	}
+	if fmt.Sprint(order) != "[3 2 1]" {
+		t.Errorf("the down migrations ran in the order %v, want [3 2 1]", order)
+	}
+}
+
+func TestMigrateChecksumMismatch(t *testing.T) {
+	dsn, _ := test_schema(t)
+	files := test_files()
+	hdb := open_schema(t, dsn, files)
+	ctx := context.Background()
+
+	files["002-second.sql"] = &fstest.MapFile{Data: []byte("CREATE TABLE second (id INTEGER PRIMARY KEY);")}
+	status, err := hdb.StatusContext(ctx)
+	if err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	for _, s := range status {
+		if want := s.Version == 2; s.Modified != want {
+			t.Errorf("migration %d: modified is %t, want %t", s.Version, s.Modified, want)
+		}
+	}
+
+	// nothing is rolled back with a modified file
+	if err := hdb.MigrateToContext(ctx, 0); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("MigrateTo(0): got %v, want ErrChecksumMismatch", err)
+	}
+	if _, err := New(ctx, Config{DSN: dsn, FS: files}); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("New: got %v, want ErrChecksumMismatch", err)
+	}
+	files["002-second.sql"] = test_files()["002-second.sql"]
+	check_status(t, hdb, 3)
+}
+
+// TestMigrateLegacyMetadata takes over the versions that an old version of
+// the package recorded in the table metadata
+func TestMigrateLegacyMetadata(t *testing.T) {
+	dsn, db := test_schema(t)
+	ctx := context.Background()
+
+	// the state of an old database, the first migration ran already
+	for _, query := range []string{
+		"CREATE TABLE metadata (id SERIAL PRIMARY KEY, filepath TEXT NOT NULL);",
+		"CREATE TABLE first (id INTEGER PRIMARY KEY);",
+		"INSERT INTO metadata(filepath) VALUES ('files/001-first.sql');",
+	} {
+		if _, err := db.ExecContext(ctx, query); err != nil {
+			t.Fatalf("preparing the old database: %v", err)
+		}
+	}
+
+	// the first migration would fail if it ran again
+	hdb := open_schema(t, dsn, test_files())
+	check_status(t, hdb, 3)
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 )
 
@@ -47,12 +48,23 @@ type State struct {
 	RecordTime *time.Time
 }
 
+// StateTransition is the last change of the state of an entity
+type StateTransition struct {
+	EntityId int
+	// From is the state before the change, it is empty if the entity never had another state
+	From string
+	To   string
+	// Since is the record time of the first state after the change
+	Since time.Time
+}
+
 type Rule struct {
 	Id                   int
 	Enabled              bool
 	EventBasedEvaluation bool
 	PeriodicTrigger      PeriodicTriggerType
 	Name                 string
+	Description          string
 	Target               *Entity
 	Condition            *Condition
 	ThenActions          []*Action
@@ -75,6 +87,35 @@ const (
 	SixH
 )
 
+// Interval returns the time between two periodic evaluations, 0 for an unknown trigger
+func (t PeriodicTriggerType) Interval() time.Duration {
+	switch t {
+	case OneMin:
+		return time.Minute
+	case TwoMin:
+		return 2 * time.Minute
+	case FiveMin:
+		return 5 * time.Minute
+	case TenMin:
+		return 10 * time.Minute
+	case FifteenMin:
+		return 15 * time.Minute
+	case TwentyMin:
+		return 20 * time.Minute
+	case TwentyFiveMin:
+		return 25 * time.Minute
+	case FortyFiveMin:
+		return 45 * time.Minute
+	case OneH:
+		return time.Hour
+	case TwoH:
+		return 2 * time.Hour
+	case SixH:
+		return 6 * time.Hour
+	}
+	return 0
+}
+
 type Condition struct {
 	Id              int
 	Type            ConditionType
@@ -84,7 +125,69 @@ type Condition struct {
 	Before          string
 	Above           *ConditionValue
 	Below           *ConditionValue
-	SubConditions   []*Condition
+	// Attribute is the attribute of the sensor a STATE or NUMERICSTATE
+	// condition compares, the state of the sensor is compared if it is empty.
+	// The sensor has to record this attribute as its Attribute.
+	Attribute string
+	// Template is the expression of a TEMPLATE condition, see the package expression
+	Template string
+	// Time is the typed form of a TIME condition, After and Before hold its
+	// bounds as text. Time is used when a condition is saved if it is set.
+	// It is nil for a stored condition whose After or Before is not valid.
+	Time *TimeCondition
+	// For is how long the sensor of a STATE, NUMERICSTATE or FROM_TO
+	// condition has to meet the condition before the condition is true
+	For time.Duration
+	// FromState and ToState are the states of a FROM_TO condition, it is true
+	// after the state changed from FromState to ToState. An empty state
+	// matches every state.
+	FromState     string
+	ToState       string
+	SubConditions []*Condition
+}
+
+// TimeCondition is true between After and Before on the weekdays in the range
+// of dates, every part may be missing
+type TimeCondition struct {
+	After  *TimeBound
+	Before *TimeBound
+	// Weekdays are the days the condition is true on, every day if it is empty
+	Weekdays []time.Weekday
+	// DateFrom and DateTo are a range of days in the year, the range wraps
+	// around the new year if DateFrom is after DateTo
+	DateFrom *MonthDay
+	DateTo   *MonthDay
+}
+
+type TimeBoundType int
+
+const (
+	CLOCK TimeBoundType = iota
+	SUNRISE
+	SUNSET
+)
+
+// TimeBound is a time of the day, like 07:30:00 or 30 minutes after sunrise
+type TimeBound struct {
+	Type TimeBoundType
+	// Clock is the time since midnight of a CLOCK bound
+	Clock time.Duration
+	// Offset is added to the sunrise or sunset
+	Offset time.Duration
+}
+
+type MonthDay struct {
+	Month time.Month
+	Day   int
+}
+
+// Location is where an identity is, it is used for sunrise and sunset
+type Location struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	// TimeZone is an IANA time zone like Europe/Berlin, the clock times of
+	// time conditions are in this time zone
+	TimeZone string `json:"time_zone"`
 }
 
 type ConditionType int
@@ -97,11 +200,13 @@ const (
 	NUMERICSTATE
 	STATE
 	TIME
+	TEMPLATE
+	FROM_TO
 )
 
 type ConditionValue struct {
 	Valid bool
-	Value int
+	Value float64
 }
 
 type ActionType int
@@ -109,13 +214,34 @@ type ActionType int
 const (
 	SERVICE ActionType = iota
 	DELAY
+	NOTIFY
+	SET_STATE
+	SWITCH_RULE
+	SCENE
+	WAIT_UNTIL
+	REPEAT
 )
 
 type Action struct {
-	Id      int
-	Type    ActionType
-	Service string
-	Delay   *Delay
+	Id   int
+	Type ActionType
+	// Position of the action in the then or else actions of its rule, starting at 0
+	Position int
+	// Service is the domain of the home assistant service and ServiceName the
+	// service to call in it, e.g. light and turn_on
+	Service     string
+	ServiceName string
+	// Target is the entity the service is called for, nil means the target of the rule
+	Target *Entity
+	// ServiceData is a JSON object sent with the service call, e.g. {"brightness": 120}
+	ServiceData  json.RawMessage
+	Delay        *Delay
+	Notification *Notification
+	StateChange  *StateChange
+	RuleSwitch   *RuleSwitch
+	Scene        *Scene
+	Wait         *Wait
+	Repeat       *Repeat
 }
 
 type Service struct {
@@ -130,3 +256,158 @@ type Delay struct {
 	Minutes int32
 	Seconds int32
 }
+
+// Notification is sent by a NOTIFY action. The message may contain
+// expressions in double braces, like {{ sensor.soc }}, which are replaced
+// with the latest states when the notification is sent.
+type Notification struct {
+	Id        int
+	Title     string
+	Message   string
+	Recipient string
+}
+
+// StateChange writes State as the new state of Entity, e.g. of a virtual entity
+type StateChange struct {
+	Id     int
+	Entity *Entity
+	State  string
+}
+
+// RuleSwitch enables or disables the rule with the id RuleID
+type RuleSwitch struct {
+	Id      int
+	RuleID  int
+	Enabled bool
+}
+
+// Scene is a stored set of entity states that is activated by a SCENE action
+type Scene struct {
+	Id     int
+	Name   string
+	States []*SceneState
+}
+
+type SceneState struct {
+	Entity *Entity
+	State  string
+}
+
+// Wait pauses the actions until Condition holds. If Timeout is not 0 and the
+// condition does not hold in time, the TimeoutActions are run instead of the
+// following actions. The Timeout must be whole seconds.
+type Wait struct {
+	Id             int
+	Condition      *Condition
+	Timeout        time.Duration
+	TimeoutActions []*Action
+}
+
+// Repeat runs Actions Count times, or as long as While holds if While is set.
+// With both set the actions are run at most Count times. Without Count an
+// iteration takes at least the poll interval of the executor.
+type Repeat struct {
+	Id      int
+	Count   int
+	While   *Condition
+	Actions []*Action
+}
+
+// ActionRun is a then or else action list of a rule that is being executed.
+// It is stored, so the run can continue after a restart.
+type ActionRun struct {
+	Id           int
+	RuleID       int
+	IsThenAction bool
+	// Position leads from the action list of the rule to the running action,
+	// the first entry is the index in the then or else actions
+	Position []ActionPosition
+	// ResumeAt is the end of the running delay or the timeout of the running wait
+	ResumeAt  *time.Time
+	StartedAt time.Time
+	// RuleRunID is the recorded RuleRun the outcomes of the actions are added to, nil if there is none
+	RuleRunID *int
+}
+
+// ActionPosition is the index of an action in its list. Iteration counts the
+// finished repetitions of a REPEAT action, Timeout is set when a WAIT_UNTIL
+// action timed out and runs its timeout actions.
+type ActionPosition struct {
+	Index     int  `json:"index"`
+	Iteration int  `json:"iteration,omitempty"`
+	Timeout   bool `json:"timeout,omitempty"`
+}
+
+// TriggerType tells why a rule was evaluated
+type TriggerType int
+
+const (
+	PERIODIC TriggerType = iota
+	EVENT
+)
+
+func (t TriggerType) String() string {
+	if t == PERIODIC {
+		return "periodic"
+	}
+	return "event"
+}
+
+// ConditionTrace is the result of one condition of a tree, Children are the
+// traces of its subconditions in their order
+type ConditionTrace struct {
+	ConditionID int           `json:"condition_id"`
+	Type        ConditionType `json:"type"`
+	Result      bool          `json:"result"`
+	// Reason describes why the condition is true or false
+	Reason   string            `json:"reason"`
+	Children []*ConditionTrace `json:"children,omitempty"`
+}
+
+// RuleRun records one evaluation of a rule and the actions it ran
+type RuleRun struct {
+	Id     int
+	RuleID int
+	// EntityID is the target of the rule
+	EntityID int
+	Trigger  TriggerType
+	// TriggerEntityID is the entity whose new state triggered an event based rule, nil for periodic runs
+	TriggerEntityID *int
+	Matched         bool
+	Trace           *ConditionTrace
+	// Error is why the evaluation or the actions failed, it is empty if they did not
+	Error   string
+	Actions []*ActionOutcome
+	// EvaluatedAt is the time the rule was evaluated at and Duration how long the evaluation took
+	EvaluatedAt time.Time
+	Duration    time.Duration
+	// FinishedAt is set when the actions finished, it is nil while they run
+	FinishedAt *time.Time
+}
+
+// ActionOutcome is the result of one executed action of a RuleRun
+type ActionOutcome struct {
+	ActionID  int              `json:"action_id"`
+	Type      ActionType       `json:"type"`
+	Position  []ActionPosition `json:"position"`
+	StartedAt time.Time        `json:"started_at"`
+	Duration  time.Duration    `json:"duration"`
+	// TimedOut is set for a WAIT_UNTIL action whose condition did not hold in time
+	TimedOut bool   `json:"timed_out,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Page selects runs, the newest run comes first
+type Page struct {
+	Offset int
+	// Limit is the maximum number of runs, 0 means 50
+	Limit int
+}
+
+// RetentionPolicy says which rule runs are pruned. Runs older than MaxAge
+// and runs of a rule beyond the newest MaxRunsPerRule are deleted, a zero
+// value keeps the runs.
+type RetentionPolicy struct {
+	MaxAge         time.Duration
+	MaxRunsPerRule int
+}
@@ -0,0 +1,257 @@
+package honuadatabase
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/JonasBordewick/honua-database/models"
+)
+
+const rule_run_columns = "id, rule_id, entity_id, trigger, trigger_entity_id, matched, trace, error, actions, evaluated_at, duration_ns, finished_at"
+
+// default_page_limit is the number of runs of a page without a limit
+const default_page_limit = 50
+
+// AddRuleRun records the evaluation of a rule, it sets the id of the run
+func (hdb *HonuaDatabase) AddRuleRun(identity string, run *models.RuleRun) error {
+	return hdb.AddRuleRunContext(context.Background(), identity, run)
+}
+
+func (hdb *HonuaDatabase) AddRuleRunContext(ctx context.Context, identity string, run *models.RuleRun) (err error) {
+	defer hdb.observe(ctx, "add_rule_run", time.Now(), &err, slog.String("identity", identity), slog.Int("rule_id", run.RuleID))
+	const query = "INSERT INTO rule_runs(identity, " + rule_run_columns + ") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13);"
+
+	trace, err := json.Marshal(run.Trace)
+	if err != nil {
+		return err
+	}
+	actions, err := json.Marshal(outcomes(run.Actions))
+	if err != nil {
+		return err
+	}
+
+	var id int
+	err = hdb.with_tx(ctx, func(tx *sql.Tx) error {
+		var err error
+		id, err = hdb.next_id(ctx, tx, identity, "rule_runs")
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, query, identity, id, run.RuleID, run.EntityID, run.Trigger, run.TriggerEntityID, run.Matched,
+			trace, run.Error, actions, run.EvaluatedAt, int64(run.Duration), run.FinishedAt)
+		return map_error(err)
+	})
+	if err != nil {
+		return err
+	}
+	run.Id = id
+	return nil
+}
+
+// AddRuleRunAction appends the outcome of an executed action to the run
+func (hdb *HonuaDatabase) AddRuleRunAction(identity string, id int, outcome *models.ActionOutcome) error {
+	return hdb.AddRuleRunActionContext(context.Background(), identity, id, outcome)
+}
+
+func (hdb *HonuaDatabase) AddRuleRunActionContext(ctx context.Context, identity string, id int, outcome *models.ActionOutcome) (err error) {
+	defer hdb.observe(ctx, "add_rule_run_action", time.Now(), &err, slog.String("identity", identity), slog.Int("rule_run_id", id))
+	const query = "UPDATE rule_runs SET actions = actions || $1::jsonb WHERE identity = $2 AND id = $3;"
+
+	action, err := json.Marshal([]*models.ActionOutcome{outcome})
+	if err != nil {
+		return err
+	}
+	result, err := hdb.db.ExecContext(ctx, query, action, identity, id)
+	return affected_or_not_found(result, err, "the rule run %d of %s does not exist", id, identity)
+}
+
+// FinishRuleRun records the end of the actions of the run, failure is empty if they did not fail
+func (hdb *HonuaDatabase) FinishRuleRun(identity string, id int, finishedAt time.Time, failure string) error {
+	return hdb.FinishRuleRunContext(context.Background(), identity, id, finishedAt, failure)
+}
+
+func (hdb *HonuaDatabase) FinishRuleRunContext(ctx context.Context, identity string, id int, finishedAt time.Time, failure string) (err error) {
+	defer hdb.observe(ctx, "finish_rule_run", time.Now(), &err, slog.String("identity", identity), slog.Int("rule_run_id", id))
+	const query = "UPDATE rule_runs SET finished_at = $1, error = CASE WHEN $2 = '' THEN error ELSE $2 END WHERE identity = $3 AND id = $4;"
+
+	result, err := hdb.db.ExecContext(ctx, query, finishedAt, failure, identity, id)
+	return affected_or_not_found(result, err, "the rule run %d of %s does not exist", id, identity)
+}
+
+func (hdb *HonuaDatabase) GetRuleRun(identity string, id int) (*models.RuleRun, error) {
+	return hdb.GetRuleRunContext(context.Background(), identity, id)
+}
+
+func (hdb *HonuaDatabase) GetRuleRunContext(ctx context.Context, identity string, id int) (_ *models.RuleRun, err error) {
+	defer hdb.observe(ctx, "get_rule_run", time.Now(), &err, slog.String("identity", identity), slog.Int("rule_run_id", id))
+	const query = "SELECT " + rule_run_columns + " FROM rule_runs WHERE identity = $1 AND id = $2;"
+
+	run, err := scan_rule_run(hdb.db.QueryRowContext(ctx, query, identity, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: the rule run %d of %s does not exist", ErrNotFound, id, identity)
+	}
+	return run, err
+}
+
+// GetRuleRunsOfRule returns a page of the runs of the rule, the newest run first
+func (hdb *HonuaDatabase) GetRuleRunsOfRule(identity string, ruleID int, page models.Page) ([]*models.RuleRun, error) {
+	return hdb.GetRuleRunsOfRuleContext(context.Background(), identity, ruleID, page)
+}
+
+func (hdb *HonuaDatabase) GetRuleRunsOfRuleContext(ctx context.Context, identity string, ruleID int, page models.Page) (_ []*models.RuleRun, err error) {
+	defer hdb.observe(ctx, "get_rule_runs_of_rule", time.Now(), &err, slog.String("identity", identity), slog.Int("rule_id", ruleID))
+	const query = "SELECT " + rule_run_columns + ` FROM rule_runs WHERE identity = $1 AND rule_id = $2
+ORDER BY evaluated_at DESC, id DESC LIMIT $3 OFFSET $4;`
+
+	return hdb.get_rule_runs(ctx, query, identity, ruleID, page)
+}
+
+// GetRuleRunsOfEntity returns a page of the runs of the rules that target the
+// entity or were triggered by a state of it, the newest run first
+func (hdb *HonuaDatabase) GetRuleRunsOfEntity(identity string, entityID int, page models.Page) ([]*models.RuleRun, error) {
+	return hdb.GetRuleRunsOfEntityContext(context.Background(), identity, entityID, page)
+}
+
+func (hdb *HonuaDatabase) GetRuleRunsOfEntityContext(ctx context.Context, identity string, entityID int, page models.Page) (_ []*models.RuleRun, err error) {
+	defer hdb.observe(ctx, "get_rule_runs_of_entity", time.Now(), &err, slog.String("identity", identity), slog.Int("entity_id", entityID))
+	const query = "SELECT " + rule_run_columns + ` FROM rule_runs WHERE identity = $1 AND (entity_id = $2 OR trigger_entity_id = $2)
+ORDER BY evaluated_at DESC, id DESC LIMIT $3 OFFSET $4;`
+
+	return hdb.get_rule_runs(ctx, query, identity, entityID, page)
+}
+
+func (hdb *HonuaDatabase) get_rule_runs(ctx context.Context, query, identity string, id int, page models.Page) ([]*models.RuleRun, error) {
+	limit, offset, err := check_page(page)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := hdb.db.QueryContext(ctx, query, identity, id, limit, offset)
+	if err != nil {
+		return nil, map_error(err)
+	}
+	defer rows.Close()
+
+	var result []*models.RuleRun = []*models.RuleRun{}
+	for rows.Next() {
+		run, err := scan_rule_run(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, run)
+	}
+	return result, map_error(rows.Err())
+}
+
+// PruneRuleRuns deletes the runs of the identity the policy does not keep and
+// returns the number of deleted runs
+func (hdb *HonuaDatabase) PruneRuleRuns(identity string, policy models.RetentionPolicy) (int, error) {
+	return hdb.PruneRuleRunsContext(context.Background(), identity, policy)
+}
+
+func (hdb *HonuaDatabase) PruneRuleRunsContext(ctx context.Context, identity string, policy models.RetentionPolicy) (_ int, err error) {
+	defer hdb.observe(ctx, "prune_rule_runs", time.Now(), &err, slog.String("identity", identity))
+	const by_age = "DELETE FROM rule_runs WHERE identity = $1 AND evaluated_at < $2;"
+	const by_count = `DELETE FROM rule_runs r USING (
+    SELECT id, row_number() OVER (PARTITION BY rule_id ORDER BY evaluated_at DESC, id DESC) AS n FROM rule_runs WHERE identity = $1
+) o WHERE r.identity = $1 AND r.id = o.id AND o.n > $2;`
+
+	if err = check_retention(policy); err != nil {
+		return 0, err
+	}
+
+	var deleted int64
+	err = hdb.with_tx(ctx, func(tx *sql.Tx) error {
+		if policy.MaxAge > 0 {
+			result, err := tx.ExecContext(ctx, by_age, identity, time.Now().Add(-policy.MaxAge))
+			if err != nil {
+				return map_error(err)
+			}
+			n, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			deleted += n
+		}
+		if policy.MaxRunsPerRule > 0 {
+			result, err := tx.ExecContext(ctx, by_count, identity, policy.MaxRunsPerRule)
+			if err != nil {
+				return map_error(err)
+			}
+			n, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			deleted += n
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(deleted), nil
+}
+
+func scan_rule_run(row rowScanner) (*models.RuleRun, error) {
+	var run models.RuleRun
+	var triggerEntityID sql.NullInt32
+	var trace, actions []byte
+	var duration int64
+	var finishedAt sql.NullTime
+	err := row.Scan(&run.Id, &run.RuleID, &run.EntityID, &run.Trigger, &triggerEntityID, &run.Matched,
+		&trace, &run.Error, &actions, &run.EvaluatedAt, &duration, &finishedAt)
+	if err == sql.ErrNoRows {
+		return nil, err
+	}
+	if err != nil {
+		return nil, map_error(err)
+	}
+
+	if triggerEntityID.Valid {
+		id := int(triggerEntityID.Int32)
+		run.TriggerEntityID = &id
+	}
+	if len(trace) > 0 {
+		if err := json.Unmarshal(trace, &run.Trace); err != nil {
+			return nil, fmt.Errorf("the trace of the rule run %d: %w", run.Id, err)
+		}
+	}
+	if err := json.Unmarshal(actions, &run.Actions); err != nil {
+		return nil, fmt.Errorf("the actions of the rule run %d: %w", run.Id, err)
+	}
+	run.Duration = time.Duration(duration)
+	if finishedAt.Valid {
+		run.FinishedAt = &finishedAt.Time
+	}
+	return &run, nil
+}
+
+// check_page returns the limit and the offset of the page
+func check_page(page models.Page) (int, int, error) {
+	if page.Limit < 0 || page.Offset < 0 {
+		return 0, 0, fmt.Errorf("the limit %d and the offset %d of a page must not be negative", page.Limit, page.Offset)
+	}
+	if page.Limit == 0 {
+		return default_page_limit, page.Offset, nil
+	}
+	return page.Limit, page.Offset, nil
+}
+
+func check_retention(policy models.RetentionPolicy) error {
+	if policy.MaxAge < 0 || policy.MaxRunsPerRule < 0 {
+		return fmt.Errorf("the maximum age %v and the maximum number of runs %d must not be negative", policy.MaxAge, policy.MaxRunsPerRule)
+	}
+	return nil
+}
+
+// outcomes stores no outcomes as [] instead of null
+func outcomes(o []*models.ActionOutcome) []*models.ActionOutcome {
+	if o == nil {
+		return []*models.ActionOutcome{}
+	}
+	return o
+}
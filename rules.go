@@ -1,93 +1,271 @@
 package honuadatabase
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"strings"
+	"time"
 
 	"github.com/JonasBordewick/honua-database/models"
 )
 
+// RulePart names the part of a rule that could not be written or removed
+type RulePart string
+
+const (
+	RulePartCondition   RulePart = "condition"
+	RulePartRule        RulePart = "rule"
+	RulePartThenActions RulePart = "then actions"
+	RulePartElseActions RulePart = "else actions"
+	RulePartDelay       RulePart = "delay"
+	RulePartTransaction RulePart = "transaction"
+)
+
+// RuleError is returned by AddRule, EditRule and DeleteRule. The transaction
+// was rolled back, so nothing of the rule was changed.
+type RuleError struct {
+	Part   RulePart
+	RuleID int
+	Err    error
+}
+
+func (e *RuleError) Error() string {
+	return fmt.Sprintf("rule %d: %s failed: %s", e.RuleID, e.Part, e.Err.Error())
+}
+
+func (e *RuleError) Unwrap() error {
+	return e.Err
+}
+
+// as_rule_error wraps err in a *RuleError, unless it already is one
+func as_rule_error(part RulePart, ruleID int, err error) error {
+	var ruleErr *RuleError
+	if errors.As(err, &ruleErr) {
+		return err
+	}
+	return &RuleError{Part: part, RuleID: ruleID, Err: map_error(err)}
+}
+
 func (hdb *HonuaDatabase) GetAllRulesOfIdentity(identity string) ([]*models.Rule, error) {
-	const query = "SELECT * FROM rules WHERE identity=$1;"
+	return hdb.GetAllRulesOfIdentityContext(context.Background(), identity)
+}
+
+func (hdb *HonuaDatabase) GetAllRulesOfIdentityContext(ctx context.Context, identity string) (_ []*models.Rule, err error) {
+	defer hdb.observe(ctx, "get_all_rules_of_identity", time.Now(), &err, slog.String("identity", identity))
+	return hdb.get_rules(ctx, "identity=$1", identity)
+}
 
-	rows, err := hdb.db.Query(query, identity)
+// GetRule returns the rule with its target, condition tree and actions
+func (hdb *HonuaDatabase) GetRule(identity string, id int) (*models.Rule, error) {
+	return hdb.GetRuleContext(context.Background(), identity, id)
+}
+
+func (hdb *HonuaDatabase) GetRuleContext(ctx context.Context, identity string, id int) (_ *models.Rule, err error) {
+	defer hdb.observe(ctx, "get_rule", time.Now(), &err, slog.String("identity", identity), slog.Int("rule_id", id))
+	rules, err := hdb.get_rules(ctx, "identity=$1 AND id=$2", identity, id)
 	if err != nil {
-		log.Printf("An error occured during getting all rules of identity %s: %s\n", identity, err.Error())
 		return nil, err
 	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("%w: the rule %d of %s does not exist", ErrNotFound, id, identity)
+	}
+	return rules[0], nil
+}
+
+// GetActiveRules returns the enabled rules whose target has its rules enabled
+func (hdb *HonuaDatabase) GetActiveRules(identity string) ([]*models.Rule, error) {
+	return hdb.GetActiveRulesContext(context.Background(), identity)
+}
+
+func (hdb *HonuaDatabase) GetActiveRulesContext(ctx context.Context, identity string) (_ []*models.Rule, err error) {
+	defer hdb.observe(ctx, "get_active_rules", time.Now(), &err, slog.String("identity", identity))
+	return hdb.get_rules(ctx, "identity=$1 AND is_enabled AND entity_id IN (SELECT id FROM entities WHERE identity=$1 AND rules_enabled)", identity)
+}
+
+// SearchRules returns the rules of the identity whose name or description
+// contains text, ignoring the case
+func (hdb *HonuaDatabase) SearchRules(identity, text string) ([]*models.Rule, error) {
+	return hdb.SearchRulesContext(context.Background(), identity, text)
+}
+
+func (hdb *HonuaDatabase) SearchRulesContext(ctx context.Context, identity, text string) (_ []*models.Rule, err error) {
+	defer hdb.observe(ctx, "search_rules", time.Now(), &err, slog.String("identity", identity))
+	pattern := "%" + like_escaper.Replace(text) + "%"
+	return hdb.get_rules(ctx, "identity=$1 AND (name ILIKE $2 OR description ILIKE $2)", identity, pattern)
+}
+
+// like_escaper escapes the wildcards of a LIKE pattern
+var like_escaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// get_rules reads the rules matching where, ordered by id. The targets and
+// the condition trees of all rules are loaded together.
+func (hdb *HonuaDatabase) get_rules(ctx context.Context, where string, args ...any) ([]*models.Rule, error) {
+	query := `SELECT id, identity, entity_id, event_based_evaluation, periodic_trigger_type,
+		name, description, condition_id, is_enabled FROM rules WHERE ` + where + " ORDER BY id;"
+
+	rows, err := hdb.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, map_error(err)
+	}
 
 	var result []*models.Rule = []*models.Rule{}
+	var identity string
+	var entityIDs []int
+	var conditionIDs []int
+	var ruleIDs []int
 
 	for rows.Next() {
 		var id int
-		var identity string
 		var entity_id int
 		var ebe bool
 		var periodic sql.NullInt32
+		var name string
 		var description string
 		var cId int
 		var enabled bool
 
-		err = rows.Scan(&id, &identity, &entity_id, &ebe, &periodic, &description, &cId, &enabled)
+		err = rows.Scan(&id, &identity, &entity_id, &ebe, &periodic, &name, &description, &cId, &enabled)
 
 		if err != nil {
 			rows.Close()
-			log.Printf("An error occured during getting all rules of identity %s: %s\n", identity, err.Error())
-			return nil, err
+			return nil, map_error(err)
 		}
 
 		rule := &models.Rule{
-			Id: id,
-			Enabled: enabled,
+			Id:                   id,
+			Enabled:              enabled,
 			EventBasedEvaluation: ebe,
+			Name:                 name,
+			Description:          description,
+			Target:               &models.Entity{Id: entity_id},
+			Condition:            &models.Condition{Id: cId},
 		}
 
 		if !ebe {
 			rule.PeriodicTrigger = models.PeriodicTriggerType(periodic.Int32)
 		}
 
+		entityIDs = append(entityIDs, entity_id)
+		conditionIDs = append(conditionIDs, cId)
+		ruleIDs = append(ruleIDs, id)
+		result = append(result, rule)
+	}
 
-		entity, err := hdb.GetEntity(identity, entity_id)
-		if err != nil {
-			rows.Close()
-			log.Printf("An error occured during getting all rules of identity %s: %s\n", identity, err.Error())
-			return nil, err
-		}
-
-		rule.Name = fmt.Sprintf("%s -- Regel", entity.Name)
-		rule.Target = entity
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, map_error(err)
+	}
 
-		tAction, eActions, err := hdb.GetActionsOfRule(identity, id)
-		if err != nil {
-			rows.Close()
-			log.Printf("An error occured during getting all rules of identity %s: %s\n", identity, err.Error())
-			return nil, err
-		}
+	targets, err := hdb.get_entities_by_id(ctx, hdb.db, identity, entityIDs)
+	if err != nil {
+		return nil, err
+	}
 
-		rule.ThenActions = tAction
-		rule.ElseActions = eActions
+	conditions, err := hdb.get_condition_trees(ctx, hdb.db, identity, conditionIDs)
+	if err != nil {
+		return nil, err
+	}
 
-		result = append(result, rule)
+	actions, err := hdb.get_actions_of_rules(ctx, hdb.db, identity, ruleIDs)
+	if err != nil {
+		return nil, err
 	}
 
-	rows.Close()
+	for _, rule := range result {
+		target, ok := targets[rule.Target.Id]
+		if !ok {
+			return nil, fmt.Errorf("%w: the target %d of rule %d does not exist", ErrNotFound, rule.Target.Id, rule.Id)
+		}
+		rule.Target = target
+		rule.Condition = conditions[rule.Condition.Id]
+		rule.ThenActions = actions[rule.Id].then
+		rule.ElseActions = actions[rule.Id].otherwise
+	}
 
 	return result, nil
 }
 
 func (hdb *HonuaDatabase) AddRule(identity string, rule *models.Rule) error {
-	cID, err := hdb.AddCondition(identity, rule.Condition)
+	return hdb.AddRuleContext(context.Background(), identity, rule)
+}
+
+// AddRuleContext writes the condition tree, the rule and its actions in one transaction.
+// If any part fails, nothing is written and a *RuleError is returned.
+func (hdb *HonuaDatabase) AddRuleContext(ctx context.Context, identity string, rule *models.Rule) (err error) {
+	defer hdb.observe(ctx, "add_rule", time.Now(), &err, slog.String("identity", identity))
+	defer hdb.subscribers.rules_changed(identity, &err)
+	var id int
+	err = hdb.with_tx(ctx, func(tx *sql.Tx) error {
+		var err error
+		id, err = hdb.next_id(ctx, tx, identity, "rules")
+		if err != nil {
+			return &RuleError{Part: RulePartRule, RuleID: -1, Err: err}
+		}
+		return hdb.add_rule(ctx, tx, identity, id, rule)
+	})
 	if err != nil {
-		log.Printf("An error occured during add rule: %s\n", err.Error())
+		err = as_rule_error(RulePartTransaction, id, err)
 		return err
 	}
+	rule.Id = id
+	return nil
+}
+
+func (hdb *HonuaDatabase) EditRule(identity string, rule *models.Rule) error {
+	return hdb.EditRuleContext(context.Background(), identity, rule)
+}
+
+// EditRuleContext replaces the stored rule with the given one in one transaction.
+// The rule keeps its id.
+func (hdb *HonuaDatabase) EditRuleContext(ctx context.Context, identity string, rule *models.Rule) (err error) {
+	defer hdb.observe(ctx, "edit_rule", time.Now(), &err, slog.String("identity", identity), slog.Int("rule_id", rule.Id))
+	defer hdb.subscribers.rules_changed(identity, &err)
+	err = hdb.with_tx(ctx, func(tx *sql.Tx) error {
+		err := hdb.delete_rule(ctx, tx, identity, rule.Id)
+		if err != nil {
+			return err
+		}
+		return hdb.add_rule(ctx, tx, identity, rule.Id, rule)
+	})
+	if err != nil {
+		err = as_rule_error(RulePartTransaction, rule.Id, err)
+	}
+	return err
+}
 
-	id, err := hdb.get_rule_id(identity)
+func (hdb *HonuaDatabase) DeleteRule(identity string, id int) error {
+	return hdb.DeleteRuleContext(context.Background(), identity, id)
+}
+
+// DeleteRuleContext removes the rule with its condition tree, actions and delays in one transaction.
+func (hdb *HonuaDatabase) DeleteRuleContext(ctx context.Context, identity string, id int) (err error) {
+	defer hdb.observe(ctx, "delete_rule", time.Now(), &err, slog.String("identity", identity), slog.Int("rule_id", id))
+	defer hdb.subscribers.rules_changed(identity, &err)
+	err = hdb.with_tx(ctx, func(tx *sql.Tx) error {
+		err := hdb.delete_rule(ctx, tx, identity, id)
+		if err != nil {
+			return err
+		}
+		// the actions of other rules that switch this rule
+		err = hdb.delete_rule_switches_of_rule(ctx, tx, identity, id)
+		if err != nil {
+			return &RuleError{Part: RulePartThenActions, RuleID: id, Err: err}
+		}
+		return nil
+	})
 	if err != nil {
-		log.Printf("An error occured during add rule: %s\n", err.Error())
-		return err
+		err = as_rule_error(RulePartTransaction, id, err)
+	}
+	return err
+}
+
+func (hdb *HonuaDatabase) add_rule(ctx context.Context, q querier, identity string, id int, rule *models.Rule) error {
+	cID, err := hdb.add_condition(ctx, q, identity, rule.Condition)
+	if err != nil {
+		return &RuleError{Part: RulePartCondition, RuleID: id, Err: err}
 	}
 
 	var periodic sql.NullInt32 = sql.NullInt32{
@@ -97,71 +275,127 @@ func (hdb *HonuaDatabase) AddRule(identity string, rule *models.Rule) error {
 
 	const query = `INSERT INTO rules(
 		id, identity, entity_id, event_based_evaluation,
-		 periodic_trigger_type, description, condition_id
-		) VALUES ($1, $2, $3, $4, $5, $6, $7);`
-
+		 periodic_trigger_type, name, description, condition_id, is_enabled
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9);`
 
-	_, err = hdb.db.Exec(query, id, identity, rule.Target.Id, rule.EventBasedEvaluation, periodic, "", cID)
+	_, err = q.ExecContext(ctx, query, id, identity, rule.Target.Id, rule.EventBasedEvaluation, periodic, rule_name(rule), rule.Description, cID, rule.Enabled)
 	if err != nil {
-		log.Printf("An error occured during add rule: %s\n", err.Error())
-		return err
+		return &RuleError{Part: RulePartRule, RuleID: id, Err: map_error(err)}
 	}
 
 	for _, a := range rule.ThenActions {
-		err = hdb.AddAction(identity, id, true, a)
+		err = hdb.add_action(ctx, q, identity, id, true, a)
 		if err != nil {
-			log.Printf("An error occured during add rule: %s\n", err.Error())
-			return err
+			return as_rule_error(RulePartThenActions, id, err)
 		}
 	}
 
 	for _, a := range rule.ElseActions {
-		err = hdb.AddAction(identity, id, false, a)
+		err = hdb.add_action(ctx, q, identity, id, false, a)
 		if err != nil {
-			log.Printf("An error occured during add rule: %s\n", err.Error())
-			return err
+			return as_rule_error(RulePartElseActions, id, err)
 		}
 	}
 
+	return nil
+}
 
-	return err
+// rule_name returns the name of the rule, a rule without a name is named after its target
+func rule_name(rule *models.Rule) string {
+	if rule.Name != "" {
+		return rule.Name
+	}
+	return fmt.Sprintf("%s -- Regel", rule.Target.Name)
 }
 
-func (hdb *HonuaDatabase) EditRule(identity string, rule *models.Rule) error {
-	err := hdb.DeleteRule(identity, rule.Id)
+func (hdb *HonuaDatabase) delete_rule(ctx context.Context, q querier, identity string, id int) error {
+	// * GET ID of Condition
+	cID, err := hdb.get_condition_id_of_rule(ctx, q, identity, id)
 	if err != nil {
-		log.Printf("An error occured during deleting rule %d of %s: %s\n", rule.Id, identity, err.Error())
-		return err
+		return &RuleError{Part: RulePartRule, RuleID: id, Err: err}
 	}
-	err = hdb.AddRule(identity, rule)
+	// * DELETE the delays and other parameters of the actions, they are not removed by a constraint
+	err = hdb.delete_action_parameters(ctx, q, identity, "rule_id=$2", id)
 	if err != nil {
-		log.Printf("An error occured during deleting rule %d of %s: %s\n", rule.Id, identity, err.Error())
+		return &RuleError{Part: RulePartDelay, RuleID: id, Err: err}
 	}
-	return err
-}
-
-func (hdb *HonuaDatabase) DeleteRule(identity string, id int) error {
-	// * GET ID of Condition & DELETE Condition
-	cID, err := hdb.get_condition_id_of_rule(identity, id)
+	// * CONSTRAINT WILL DELETE SUB CONDITIONS + RULE + ACTIONS
+	_, err = q.ExecContext(ctx, "DELETE FROM conditions WHERE id=$1 AND identity=$2;", cID, identity)
 	if err != nil {
-		log.Printf("An error occured during deleting the rule %d in %s: %s\n", id, identity, err.Error())
-		return err
+		return &RuleError{Part: RulePartCondition, RuleID: id, Err: map_error(err)}
 	}
-	// * CONSTRAINT WILL DELETE SUB CONDITIONS + RULE + ACTIONS
-	err = hdb.DeleteCondition(cID, identity)
+	return nil
+}
+
+func (hdb *HonuaDatabase) SetRuleEnabled(identity string, id int, enabled bool) error {
+	return hdb.SetRuleEnabledContext(context.Background(), identity, id, enabled)
+}
+
+func (hdb *HonuaDatabase) SetRuleEnabledContext(ctx context.Context, identity string, id int, enabled bool) (err error) {
+	defer hdb.observe(ctx, "set_rule_enabled", time.Now(), &err, slog.String("identity", identity), slog.Int("rule_id", id), slog.Bool("enabled", enabled))
+	defer hdb.subscribers.rules_changed(identity, &err)
+	const query = "UPDATE rules SET is_enabled = $1 WHERE identity = $2 AND id = $3;"
+
+	return hdb.with_tx(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, query, enabled, identity, id)
+		if err := affected_or_not_found(result, err, "the rule %d of %s does not exist", id, identity); err != nil {
+			return err
+		}
+		// a disabled rule does not finish its running actions
+		if !enabled {
+			return hdb.delete_action_runs(ctx, tx, identity, &id)
+		}
+		return nil
+	})
+}
+
+// SetAllRulesEnabled enables or disables all rules of the identity and
+// returns the number of changed rules
+func (hdb *HonuaDatabase) SetAllRulesEnabled(identity string, enabled bool) (int, error) {
+	return hdb.SetAllRulesEnabledContext(context.Background(), identity, enabled)
+}
+
+func (hdb *HonuaDatabase) SetAllRulesEnabledContext(ctx context.Context, identity string, enabled bool) (_ int, err error) {
+	defer hdb.observe(ctx, "set_all_rules_enabled", time.Now(), &err, slog.String("identity", identity), slog.Bool("enabled", enabled))
+	defer hdb.subscribers.rules_changed(identity, &err)
+	const query = "UPDATE rules SET is_enabled = $1 WHERE identity = $2 AND is_enabled <> $1;"
+
+	var n int64
+	err = hdb.with_tx(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, query, enabled, identity)
+		if err != nil {
+			return map_error(err)
+		}
+		if n, err = result.RowsAffected(); err != nil {
+			return err
+		}
+		if !enabled {
+			return hdb.delete_action_runs(ctx, tx, identity, nil)
+		}
+		return nil
+	})
 	if err != nil {
-		log.Printf("An error occured during deleting the rule %d in %s: %s\n", id, identity, err.Error())
+		return 0, err
 	}
-	return err
+	return int(n), nil
+}
+
+// SubscribeRules calls handler after every change of the rules of an identity until cancel is called
+func (hdb *HonuaDatabase) SubscribeRules(handler RuleHandler) (cancel func()) {
+	return hdb.subscribers.rules.subscribe(handler)
 }
 
 func (hdb *HonuaDatabase) ExistRule(identity string, id int) (bool, error) {
+	return hdb.ExistRuleContext(context.Background(), identity, id)
+}
+
+func (hdb *HonuaDatabase) ExistRuleContext(ctx context.Context, identity string, id int) (_ bool, err error) {
+	defer hdb.observe(ctx, "exist_rule", time.Now(), &err, slog.String("identity", identity), slog.Int("rule_id", id))
 	const query = "SELECT CASE WHEN EXISTS ( SELECT * FROM rules WHERE identity=$1 AND id = $2) THEN true ELSE false END"
 
-	rows, err := hdb.db.Query(query, identity, id)
+	rows, err := hdb.db.QueryContext(ctx, query, identity, id)
 	if err != nil {
-		log.Printf("An error occured during checking if the rule with id %d exists: %s\n", id, err.Error())
-		return false, err
+		return false, map_error(err)
 	}
 
 	var state bool = false
@@ -170,8 +404,7 @@ func (hdb *HonuaDatabase) ExistRule(identity string, id int) (bool, error) {
 		err = rows.Scan(&state)
 		if err != nil {
 			rows.Close()
-			log.Printf("An error occured during checking if the rule with id %d exists: %s\n", id, err.Error())
-			return false, err
+			return false, map_error(err)
 		}
 	}
 
@@ -181,12 +414,16 @@ func (hdb *HonuaDatabase) ExistRule(identity string, id int) (bool, error) {
 }
 
 func (hdb *HonuaDatabase) ExistRules(identity string) (bool, error) {
+	return hdb.ExistRulesContext(context.Background(), identity)
+}
+
+func (hdb *HonuaDatabase) ExistRulesContext(ctx context.Context, identity string) (_ bool, err error) {
+	defer hdb.observe(ctx, "exist_rules", time.Now(), &err, slog.String("identity", identity))
 	query := "SELECT CASE WHEN EXISTS ( SELECT * FROM rules WHERE identity = $1) THEN true ELSE false END"
 
-	rows, err := hdb.db.Query(query, identity)
+	rows, err := hdb.db.QueryContext(ctx, query, identity)
 	if err != nil {
-		log.Printf("An error occured during getting id of rule in %s: %s\n", identity, err.Error())
-		return false, err
+		return false, map_error(err)
 	}
 
 	var exist_identity bool = false
@@ -195,8 +432,7 @@ func (hdb *HonuaDatabase) ExistRules(identity string) (bool, error) {
 		err = rows.Scan(&exist_identity)
 		if err != nil {
 			rows.Close()
-			log.Printf("An error occured during getting id of rule in %s: %s\n", identity, err.Error())
-			return false, err
+			return false, map_error(err)
 		}
 	}
 
@@ -205,84 +441,48 @@ func (hdb *HonuaDatabase) ExistRules(identity string) (bool, error) {
 	return exist_identity, nil
 }
 
-func (hdb *HonuaDatabase) get_condition_id_of_rule(identifier string, id int) (int, error) {
+func (hdb *HonuaDatabase) get_condition_id_of_rule(ctx context.Context, q querier, identifier string, id int) (int, error) {
 	const query = "SELECT condition_id FROM rules WHERE id=$1 AND identity=$2;"
-	rows, err := hdb.db.Query(query, id, identifier)
-	if err != nil {
-		log.Printf("An error occured during getting the condition_id of rule %d in %s: %s\n", id, identifier, err.Error())
-		return -1, nil
-	}
 
-	var result sql.NullInt32
-	for rows.Next() {
-		err = rows.Scan(&result)
-		if err != nil {
-			rows.Close()
-			log.Printf("An error occured during getting the condition_id of rule %d in %s: %s\n", id, identifier, err.Error())
-			return -1, nil
-		}
-	}
-	rows.Close()
-
-	if !result.Valid {
-		log.Printf("An error occured during getting the delay_id of action %d in %s.\n", id, identifier)
-		return -1, fmt.Errorf("an error occured during getting the condition_id of rule %d in %s", id, identifier)
+	var result int
+	err := q.QueryRowContext(ctx, query, id, identifier).Scan(&result)
+	if err != nil {
+		return -1, map_error(err)
 	}
 
-	return int(result.Int32), nil
+	return result, nil
 }
 
-func (hdb *HonuaDatabase) get_rule_id(identity string) (int, error) {
-	query := "SELECT CASE WHEN EXISTS ( SELECT * FROM rules WHERE identity = $1) THEN true ELSE false END"
-
-	rows, err := hdb.db.Query(query, identity)
+// get_rule_ids returns the ids of the rules matching where
+func (hdb *HonuaDatabase) get_rule_ids(ctx context.Context, q querier, where string, args ...any) ([]int, error) {
+	rows, err := q.QueryContext(ctx, "SELECT id FROM rules WHERE "+where+" ORDER BY id;", args...)
 	if err != nil {
-		log.Printf("An error occured during getting id of rule in %s: %s\n", identity, err.Error())
-		return -1, err
+		return nil, map_error(err)
 	}
+	defer rows.Close()
 
-	var exist_identity bool = false
-
+	var result []int
 	for rows.Next() {
-		err = rows.Scan(&exist_identity)
-		if err != nil {
-			rows.Close()
-			log.Printf("An error occured during getting id of rule in %s: %s\n", identity, err.Error())
-			return -1, err
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			return nil, map_error(err)
 		}
+		result = append(result, id)
 	}
+	return result, map_error(rows.Err())
+}
 
-	rows.Close()
-
-	if !exist_identity {
-		return 0, nil
-	}
-
-	query = "SELECT MAX(id) FROM rules WHERE identity = $1;"
-
-	rows, err = hdb.db.Query(query, identity)
-	if err != nil {
-		log.Printf("An error occured during getting id of rule in %s: %s\n", identity, err.Error())
-		return -1, err
-	}
-
-	var id int = -1
-
-	for rows.Next() {
-		err = rows.Scan(&id)
-		if err != nil {
-			rows.Close()
-			log.Printf("An error occured during getting id of rule in %s: %s\n", identity, err.Error())
-			return -1, err
+// delete_rules deletes the rules like DeleteRule, for the rules the
+// constraints would delete with their target or condition. The constraints
+// leave the parameters of their actions and the switches of other rules.
+func (hdb *HonuaDatabase) delete_rules(ctx context.Context, q querier, identity string, ids []int) error {
+	for _, id := range ids {
+		if err := hdb.delete_rule(ctx, q, identity, id); err != nil {
+			return err
+		}
+		if err := hdb.delete_rule_switches_of_rule(ctx, q, identity, id); err != nil {
+			return err
 		}
 	}
-	rows.Close()
-
-	if id == -1 {
-		return -1, errors.New("something went wrong during getting id of rule")
-	}
-
-	id = id + 1
-
-	return id, nil
+	return nil
 }
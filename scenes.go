@@ -0,0 +1,207 @@
+package honuadatabase
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/JonasBordewick/honua-database/models"
+	"github.com/lib/pq"
+)
+
+func (hdb *HonuaDatabase) GetScenesOfIdentity(identity string) ([]*models.Scene, error) {
+	return hdb.GetScenesOfIdentityContext(context.Background(), identity)
+}
+
+func (hdb *HonuaDatabase) GetScenesOfIdentityContext(ctx context.Context, identity string) (_ []*models.Scene, err error) {
+	defer hdb.observe(ctx, "get_scenes_of_identity", time.Now(), &err, slog.String("identity", identity))
+	return hdb.get_scenes(ctx, hdb.db, identity, nil)
+}
+
+func (hdb *HonuaDatabase) GetScene(identity string, id int) (*models.Scene, error) {
+	return hdb.GetSceneContext(context.Background(), identity, id)
+}
+
+func (hdb *HonuaDatabase) GetSceneContext(ctx context.Context, identity string, id int) (_ *models.Scene, err error) {
+	defer hdb.observe(ctx, "get_scene", time.Now(), &err, slog.String("identity", identity), slog.Int("scene_id", id))
+	return hdb.get_scene(ctx, hdb.db, identity, id)
+}
+
+// AddScene stores the scene with its states and sets the id of the scene
+func (hdb *HonuaDatabase) AddScene(identity string, scene *models.Scene) error {
+	return hdb.AddSceneContext(context.Background(), identity, scene)
+}
+
+func (hdb *HonuaDatabase) AddSceneContext(ctx context.Context, identity string, scene *models.Scene) (err error) {
+	defer hdb.observe(ctx, "add_scene", time.Now(), &err, slog.String("identity", identity), slog.String("name", scene.Name))
+	var id int
+	err = hdb.with_tx(ctx, func(tx *sql.Tx) error {
+		var err error
+		id, err = hdb.next_id(ctx, tx, identity, "scenes")
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO scenes(id, identity, name) VALUES ($1, $2, $3);", id, identity, scene.Name)
+		if err != nil {
+			return map_error(err)
+		}
+		return hdb.add_scene_states(ctx, tx, identity, id, scene.States)
+	})
+	if err != nil {
+		return err
+	}
+	scene.Id = id
+	return nil
+}
+
+// EditScene replaces the name and the states of the scene
+func (hdb *HonuaDatabase) EditScene(identity string, scene *models.Scene) error {
+	return hdb.EditSceneContext(context.Background(), identity, scene)
+}
+
+func (hdb *HonuaDatabase) EditSceneContext(ctx context.Context, identity string, scene *models.Scene) (err error) {
+	defer hdb.observe(ctx, "edit_scene", time.Now(), &err, slog.String("identity", identity), slog.Int("scene_id", scene.Id))
+	return hdb.with_tx(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, "UPDATE scenes SET name=$1 WHERE identity=$2 AND id=$3;", scene.Name, identity, scene.Id)
+		err = affected_or_not_found(result, err, "the scene %d of %s does not exist", scene.Id, identity)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM scene_states WHERE identity=$1 AND scene_id=$2;", identity, scene.Id)
+		if err != nil {
+			return map_error(err)
+		}
+		return hdb.add_scene_states(ctx, tx, identity, scene.Id, scene.States)
+	})
+}
+
+// DeleteScene removes the scene, the actions activating it are removed too
+// and the runs of their rules are cancelled
+func (hdb *HonuaDatabase) DeleteScene(identity string, id int) error {
+	return hdb.DeleteSceneContext(context.Background(), identity, id)
+}
+
+func (hdb *HonuaDatabase) DeleteSceneContext(ctx context.Context, identity string, id int) (err error) {
+	defer hdb.observe(ctx, "delete_scene", time.Now(), &err, slog.String("identity", identity), slog.Int("scene_id", id))
+	defer hdb.subscribers.rules_changed(identity, &err)
+	const query = "DELETE FROM scenes WHERE identity=$1 AND id=$2;"
+
+	return hdb.with_tx(ctx, func(tx *sql.Tx) error {
+		// the constraint would delete the scene actions too, but leave gaps in the positions
+		if err := hdb.delete_actions(ctx, tx, identity, "scene_id=$2", id); err != nil {
+			return err
+		}
+		result, err := tx.ExecContext(ctx, query, identity, id)
+		return affected_or_not_found(result, err, "the scene %d of %s does not exist", id, identity)
+	})
+}
+
+func (hdb *HonuaDatabase) ExistScene(identity string, id int) (bool, error) {
+	return hdb.ExistSceneContext(context.Background(), identity, id)
+}
+
+func (hdb *HonuaDatabase) ExistSceneContext(ctx context.Context, identity string, id int) (_ bool, err error) {
+	defer hdb.observe(ctx, "exist_scene", time.Now(), &err, slog.String("identity", identity), slog.Int("scene_id", id))
+	const query = "SELECT EXISTS (SELECT * FROM scenes WHERE identity=$1 AND id=$2);"
+
+	var exists bool
+	err = hdb.db.QueryRowContext(ctx, query, identity, id).Scan(&exists)
+	if err != nil {
+		return false, map_error(err)
+	}
+	return exists, nil
+}
+
+func (hdb *HonuaDatabase) add_scene_states(ctx context.Context, q querier, identity string, sceneID int, states []*models.SceneState) error {
+	const query = "INSERT INTO scene_states(identity, scene_id, entity_id, state) VALUES ($1, $2, $3, $4);"
+	for _, s := range states {
+		if s.Entity == nil {
+			return fmt.Errorf("%w: a state of the scene %d has no entity", ErrInvalidAction, sceneID)
+		}
+		_, err := q.ExecContext(ctx, query, identity, sceneID, s.Entity.Id, s.State)
+		if err != nil {
+			return map_error(err)
+		}
+	}
+	return nil
+}
+
+func (hdb *HonuaDatabase) get_scene(ctx context.Context, q querier, identity string, id int) (*models.Scene, error) {
+	scenes, err := hdb.get_scenes(ctx, q, identity, []int{id})
+	if err != nil {
+		return nil, err
+	}
+	if len(scenes) == 0 {
+		return nil, fmt.Errorf("%w: the scene %d of %s does not exist", ErrNotFound, id, identity)
+	}
+	return scenes[0], nil
+}
+
+// get_scenes loads the scenes with the given ids, or all scenes of the
+// identity if ids is nil, together with their states
+func (hdb *HonuaDatabase) get_scenes(ctx context.Context, q querier, identity string, ids []int) ([]*models.Scene, error) {
+	const query = "SELECT id, name FROM scenes WHERE identity=$1 AND ($2::INTEGER[] IS NULL OR id = ANY($2)) ORDER BY id;"
+	const statesQuery = "SELECT scene_id, entity_id, state FROM scene_states WHERE identity=$1 AND ($2::INTEGER[] IS NULL OR scene_id = ANY($2)) ORDER BY scene_id, entity_id;"
+
+	var filter interface{} = nil
+	if ids != nil {
+		filter = pq.Array(ids)
+	}
+
+	rows, err := q.QueryContext(ctx, query, identity, filter)
+	if err != nil {
+		return nil, map_error(err)
+	}
+
+	var result []*models.Scene = []*models.Scene{}
+	var byID map[int]*models.Scene = map[int]*models.Scene{}
+	for rows.Next() {
+		scene := &models.Scene{States: []*models.SceneState{}}
+		if err = rows.Scan(&scene.Id, &scene.Name); err != nil {
+			rows.Close()
+			return nil, map_error(err)
+		}
+		result = append(result, scene)
+		byID[scene.Id] = scene
+	}
+	rows.Close()
+
+	rows, err = q.QueryContext(ctx, statesQuery, identity, filter)
+	if err != nil {
+		return nil, map_error(err)
+	}
+
+	type stateRow struct {
+		sceneID  int
+		entityID int
+		state    string
+	}
+	var stateRows []stateRow
+	var entityIDs []int
+	for rows.Next() {
+		var row stateRow
+		if err = rows.Scan(&row.sceneID, &row.entityID, &row.state); err != nil {
+			rows.Close()
+			return nil, map_error(err)
+		}
+		stateRows = append(stateRows, row)
+		entityIDs = append(entityIDs, row.entityID)
+	}
+	rows.Close()
+
+	entities, err := hdb.get_entities_by_id(ctx, q, identity, entityIDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range stateRows {
+		scene, ok := byID[row.sceneID]
+		if !ok {
+			continue
+		}
+		scene.States = append(scene.States, &models.SceneState{Entity: entities[row.entityID], State: row.state})
+	}
+
+	return result, nil
+}
@@ -0,0 +1,533 @@
+// Package scheduler evaluates the active rules of every identity, periodic
+// rules on their interval and event based rules when a state of an entity
+// of their condition tree is added, and hands the results to an Executor.
+//
+// The rules of an identity are loaded again when the store reports a change
+// with SubscribeRules, this covers identities added after Start too. Changes
+// made through another handle of the database, like one of another process,
+// are not reported. Every rule is read again before it is evaluated, so such
+// a rule stops after it was disabled or deleted and runs with its new
+// conditions and actions, but new rules and new entities of event based
+// rules are only seen after Reload.
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+
+	honuadatabase "github.com/JonasBordewick/honua-database"
+	"github.com/JonasBordewick/honua-database/clock"
+	"github.com/JonasBordewick/honua-database/engine"
+	"github.com/JonasBordewick/honua-database/expression"
+	"github.com/JonasBordewick/honua-database/models"
+)
+
+var (
+	ErrRunning    = errors.New("the scheduler is already running")
+	ErrNotRunning = errors.New("the scheduler is not running")
+)
+
+// Trigger tells why a rule was evaluated, it is recorded with the RuleRun
+type Trigger = models.TriggerType
+
+const (
+	Periodic = models.PERIODIC
+	Event    = models.EVENT
+)
+
+// Run is one evaluation of a rule
+type Run struct {
+	Identity string
+	Rule     *models.Rule
+	Trigger  Trigger
+	// State is the state that triggered an event based rule, nil for periodic runs
+	State  *models.State
+	Result *engine.Result
+	// RuleRun is the recorded evaluation, nil if it could not be recorded. It
+	// is finished by the Executor, unless the result has no actions.
+	RuleRun *models.RuleRun
+}
+
+// Executor runs the actions of an evaluated rule. Periodic rules and events
+// are handled on different goroutines, so Execute is called concurrently.
+type Executor interface {
+	Execute(ctx context.Context, run *Run) error
+}
+
+// ExecutorFunc lets a function be used as an Executor
+type ExecutorFunc func(ctx context.Context, run *Run) error
+
+func (f ExecutorFunc) Execute(ctx context.Context, run *Run) error {
+	return f(ctx, run)
+}
+
+type Scheduler struct {
+	store    honuadatabase.Store
+	executor Executor
+	engine   *engine.Engine
+	clock    clock.Clock
+	jitter   time.Duration
+	buffer   int
+	logger   *slog.Logger
+	// retention prunes the recorded runs every retentionInterval
+	retention         *models.RetentionPolicy
+	retentionInterval time.Duration
+
+	randMutex sync.Mutex
+	rand      *rand.Rand
+
+	mutex       sync.Mutex
+	ctx         context.Context
+	cancel      context.CancelFunc
+	unsubscribe []func()
+	identities  map[string]*schedule
+	wg          sync.WaitGroup
+
+	// loadMutex serializes Reload, so an older load never replaces a newer one
+	loadMutex sync.Mutex
+
+	// pending are the identities whose rules were changed, they are loaded
+	// again after a signal on reload
+	pendingMutex sync.Mutex
+	pending      map[string]bool
+}
+
+// schedule holds the loaded rules of one identity
+type schedule struct {
+	// cancel stops the periodic rules
+	cancel context.CancelFunc
+	// byEntity maps the id of an entity to the event based rules that reference it
+	byEntity map[int][]*models.Rule
+}
+
+type event struct {
+	identity string
+	state    *models.State
+}
+
+type Option func(*Scheduler)
+
+// WithClock replaces the system clock, for the timers and the evaluation
+func WithClock(c clock.Clock) Option {
+	return func(s *Scheduler) {
+		s.clock = c
+	}
+}
+
+// WithJitter adds a random delay up to jitter to every periodic interval,
+// so rules with the same interval do not all run at once
+func WithJitter(jitter time.Duration) Option {
+	return func(s *Scheduler) {
+		s.jitter = jitter
+	}
+}
+
+// WithEventBuffer sets how many new states wait for the evaluation, default
+// is 256. New states are dropped while the buffer is full.
+func WithEventBuffer(n int) Option {
+	return func(s *Scheduler) {
+		s.buffer = n
+	}
+}
+
+// WithLogger sets the logger, default is a logger that discards everything
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Scheduler) {
+		s.logger = logger
+	}
+}
+
+// WithRetention prunes the recorded rule runs of every identity with the
+// policy, first after Start and then every interval
+func WithRetention(policy models.RetentionPolicy, interval time.Duration) Option {
+	return func(s *Scheduler) {
+		s.retention = &policy
+		s.retentionInterval = interval
+	}
+}
+
+func New(store honuadatabase.Store, executor Executor, options ...Option) *Scheduler {
+	s := &Scheduler{
+		store:    store,
+		executor: executor,
+		clock:    clock.System(),
+		buffer:   256,
+		logger:   honuadatabase.DiscardLogger(),
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for _, option := range options {
+		option(s)
+	}
+	s.engine = engine.New(engine.WithClock(s.clock))
+	return s
+}
+
+// Start loads the active rules of every identity and starts to evaluate
+// them until ctx is done or Stop is called. Stop has to be called before the
+// scheduler can be started again.
+func (s *Scheduler) Start(ctx context.Context) error {
+	s.mutex.Lock()
+	if s.cancel != nil {
+		s.mutex.Unlock()
+		return ErrRunning
+	}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	events := make(chan event, s.buffer)
+	reload := make(chan struct{}, 1)
+	s.identities = map[string]*schedule{}
+	s.unsubscribe = []func(){
+		s.store.SubscribeStates(func(identity string, state *models.State) {
+			s.on_state(events, identity, state)
+		}),
+		s.store.SubscribeRules(func(identity string) {
+			s.on_rules(reload, identity)
+		}),
+	}
+	s.wg.Add(2)
+	go s.handle_events(s.ctx, events)
+	go s.handle_reloads(s.ctx, reload)
+	s.mutex.Unlock()
+
+	identities, err := s.store.GetIdentitiesContext(ctx)
+	if err != nil {
+		s.Stop()
+		return err
+	}
+	for _, identity := range identities {
+		if err := s.Reload(ctx, identity.Id); err != nil {
+			s.Stop()
+			return err
+		}
+	}
+
+	if s.retention != nil && s.retentionInterval > 0 {
+		s.mutex.Lock()
+		if s.cancel != nil {
+			s.wg.Add(1)
+			go s.prune(s.ctx)
+		}
+		s.mutex.Unlock()
+	}
+	return nil
+}
+
+// Stop stops every rule and waits for the running evaluations
+func (s *Scheduler) Stop() {
+	s.mutex.Lock()
+	if s.cancel == nil {
+		s.mutex.Unlock()
+		return
+	}
+	s.cancel()
+	for _, unsubscribe := range s.unsubscribe {
+		unsubscribe()
+	}
+	s.cancel = nil
+	s.identities = nil
+	s.mutex.Unlock()
+
+	s.wg.Wait()
+}
+
+// Reload loads the active rules of the identity again. It is called when the
+// store reports a change, changes it does not report need a call.
+func (s *Scheduler) Reload(ctx context.Context, identity string) error {
+	s.loadMutex.Lock()
+	defer s.loadMutex.Unlock()
+
+	rules, err := s.store.GetActiveRulesContext(ctx, identity)
+	if err != nil {
+		return err
+	}
+
+	byEntity := map[int][]*models.Rule{}
+	var periodic []*models.Rule
+	for _, rule := range rules {
+		if !rule.EventBasedEvaluation {
+			periodic = append(periodic, rule)
+			continue
+		}
+		ids, err := s.entities_of(ctx, identity, rule.Condition)
+		if err != nil {
+			return fmt.Errorf("rule %d: %w", rule.Id, err)
+		}
+		for _, id := range ids {
+			byEntity[id] = append(byEntity[id], rule)
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.cancel == nil {
+		return ErrNotRunning
+	}
+	if old, ok := s.identities[identity]; ok {
+		old.cancel()
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	s.identities[identity] = &schedule{cancel: cancel, byEntity: byEntity}
+	for _, rule := range periodic {
+		interval := rule.PeriodicTrigger.Interval()
+		if interval <= 0 {
+			s.logger.Warn("The rule has an unknown periodic trigger", slog.String("identity", identity), slog.Int("rule_id", rule.Id), slog.Int("trigger", int(rule.PeriodicTrigger)))
+			continue
+		}
+		s.wg.Add(1)
+		go s.periodic(ctx, identity, rule, interval)
+	}
+	return nil
+}
+
+func (s *Scheduler) periodic(ctx context.Context, identity string, rule *models.Rule, interval time.Duration) {
+	defer s.wg.Done()
+	for {
+		timer := s.clock.NewTimer(interval + s.random_jitter())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+		s.run(ctx, identity, rule, Periodic, nil)
+	}
+}
+
+// on_state is called by AddState, it must not block
+func (s *Scheduler) on_state(events chan<- event, identity string, state *models.State) {
+	select {
+	case events <- event{identity: identity, state: state}:
+	default:
+		s.logger.Warn("The state is dropped, the event buffer is full", slog.String("identity", identity), slog.Int("entity_id", state.EntityId))
+	}
+}
+
+// on_rules is called when the rules of the identity were changed, it must not block
+func (s *Scheduler) on_rules(reload chan<- struct{}, identity string) {
+	s.pendingMutex.Lock()
+	if s.pending == nil {
+		s.pending = map[string]bool{}
+	}
+	s.pending[identity] = true
+	s.pendingMutex.Unlock()
+
+	select {
+	case reload <- struct{}{}:
+	default:
+		// a signal is waiting already, it reloads this identity too
+	}
+}
+
+// handle_reloads loads the rules of the pending identities after every signal
+func (s *Scheduler) handle_reloads(ctx context.Context, reload <-chan struct{}) {
+	defer s.wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reload:
+		}
+
+		s.pendingMutex.Lock()
+		pending := s.pending
+		s.pending = nil
+		s.pendingMutex.Unlock()
+
+		for identity := range pending {
+			if err := s.Reload(ctx, identity); err != nil && ctx.Err() == nil {
+				s.logger.ErrorContext(ctx, "Error while loading the changed rules", slog.String("identity", identity), slog.Any("error", err))
+			}
+		}
+	}
+}
+
+func (s *Scheduler) handle_events(ctx context.Context, events <-chan event) {
+	defer s.wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-events:
+			for _, rule := range s.rules_of(e.identity, e.state.EntityId) {
+				s.run(ctx, e.identity, rule, Event, e.state)
+			}
+		}
+	}
+}
+
+func (s *Scheduler) rules_of(identity string, entityID int) []*models.Rule {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if sc, ok := s.identities[identity]; ok {
+		return sc.byEntity[entityID]
+	}
+	return nil
+}
+
+func (s *Scheduler) run(ctx context.Context, identity string, rule *models.Rule, trigger Trigger, state *models.State) {
+	rule, err := s.current(ctx, identity, rule)
+	if err != nil {
+		if ctx.Err() == nil {
+			s.logger.ErrorContext(ctx, "Error while reading the rule", slog.String("identity", identity), slog.Int("rule_id", rule.Id), slog.Any("error", err))
+		}
+		return
+	}
+	if rule == nil {
+		return
+	}
+
+	evaluatedAt, start := s.clock.Now(), time.Now()
+	result, err := s.engine.Evaluate(ctx, rule, engine.NewStoreProvider(s.store, identity))
+	if ctx.Err() != nil {
+		return
+	}
+	record := s.record(ctx, identity, rule, trigger, state, evaluatedAt, time.Since(start), result, err)
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Error while evaluating the rule", slog.String("identity", identity), slog.Int("rule_id", rule.Id), slog.String("trigger", trigger.String()), slog.Any("error", err))
+		return
+	}
+
+	run := &Run{Identity: identity, Rule: rule, Trigger: trigger, State: state, Result: result, RuleRun: record}
+	if err := s.executor.Execute(ctx, run); err != nil && ctx.Err() == nil {
+		s.logger.ErrorContext(ctx, "Error while executing the rule", slog.String("identity", identity), slog.Int("rule_id", rule.Id), slog.String("trigger", trigger.String()), slog.Any("error", err))
+		if record != nil {
+			if err := s.store.FinishRuleRunContext(ctx, identity, record.Id, s.clock.Now(), err.Error()); err != nil {
+				s.logger.ErrorContext(ctx, "Error while recording the rule run", slog.String("identity", identity), slog.Int("rule_id", rule.Id), slog.Any("error", err))
+			}
+		}
+	}
+}
+
+// current reads the rule again, it is nil if the rule was deleted or is not active anymore
+func (s *Scheduler) current(ctx context.Context, identity string, rule *models.Rule) (*models.Rule, error) {
+	current, err := s.store.GetRuleContext(ctx, identity, rule.Id)
+	if errors.Is(err, honuadatabase.ErrNotFound) {
+		s.logger.DebugContext(ctx, "The rule was deleted", slog.String("identity", identity), slog.Int("rule_id", rule.Id))
+		return nil, nil
+	}
+	if err != nil {
+		return rule, err
+	}
+	if !current.Enabled || (current.Target != nil && !current.Target.RulesEnabled) {
+		s.logger.DebugContext(ctx, "The rule is not active", slog.String("identity", identity), slog.Int("rule_id", rule.Id))
+		return nil, nil
+	}
+	return current, nil
+}
+
+// record stores the evaluation as a RuleRun, a run without actions is finished at once
+func (s *Scheduler) record(ctx context.Context, identity string, rule *models.Rule, trigger Trigger, state *models.State, evaluatedAt time.Time, duration time.Duration, result *engine.Result, err error) *models.RuleRun {
+	run := &models.RuleRun{RuleID: rule.Id, Trigger: trigger, EvaluatedAt: evaluatedAt, Duration: duration}
+	if rule.Target != nil {
+		run.EntityID = rule.Target.Id
+	}
+	if state != nil {
+		id := state.EntityId
+		run.TriggerEntityID = &id
+	}
+	if err != nil {
+		run.Error = err.Error()
+	} else {
+		run.Matched = result.Matched
+		run.Trace = result.Trace
+	}
+	if err != nil || len(result.Actions) == 0 {
+		run.FinishedAt = &evaluatedAt
+	}
+
+	if err := s.store.AddRuleRunContext(ctx, identity, run); err != nil {
+		s.logger.ErrorContext(ctx, "Error while recording the rule run", slog.String("identity", identity), slog.Int("rule_id", rule.Id), slog.Any("error", err))
+		return nil
+	}
+	return run
+}
+
+// prune applies the retention policy to every identity
+func (s *Scheduler) prune(ctx context.Context) {
+	defer s.wg.Done()
+	for {
+		identities, err := s.store.GetIdentitiesContext(ctx)
+		for _, identity := range identities {
+			var n int
+			if n, err = s.store.PruneRuleRunsContext(ctx, identity.Id, *s.retention); err != nil {
+				break
+			}
+			s.logger.DebugContext(ctx, "The rule runs are pruned", slog.String("identity", identity.Id), slog.Int("deleted", n))
+		}
+		if err != nil && ctx.Err() == nil {
+			s.logger.ErrorContext(ctx, "Error while pruning the rule runs", slog.Any("error", err))
+		}
+
+		timer := s.clock.NewTimer(s.retentionInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+	}
+}
+
+// entities_of returns the ids of the entities the condition tree depends on,
+// the sensors of its conditions and the entities of its templates
+func (s *Scheduler) entities_of(ctx context.Context, identity string, c *models.Condition) ([]int, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	var ids []int
+	if c.Sensor != nil {
+		ids = append(ids, c.Sensor.Id)
+	}
+	if c.Type == models.TEMPLATE {
+		expr, err := expression.Parse(c.Template)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range expr.Entities() {
+			id, err := s.store.GetIdOfEntityContext(ctx, identity, name)
+			if errors.Is(err, honuadatabase.ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, id)
+		}
+	}
+	for _, sub := range c.SubConditions {
+		subIDs, err := s.entities_of(ctx, identity, sub)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, subIDs...)
+	}
+	return unique(ids), nil
+}
+
+func (s *Scheduler) random_jitter() time.Duration {
+	if s.jitter <= 0 {
+		return 0
+	}
+	s.randMutex.Lock()
+	defer s.randMutex.Unlock()
+	return time.Duration(s.rand.Int63n(int64(s.jitter)))
+}
+
+func unique(ids []int) []int {
+	seen := map[int]bool{}
+	var result []int
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			result = append(result, id)
+		}
+	}
+	return result
+}
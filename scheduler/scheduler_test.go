@@ -0,0 +1,368 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	honuadatabase "github.com/JonasBordewick/honua-database"
+	"github.com/JonasBordewick/honua-database/clock"
+	"github.com/JonasBordewick/honua-database/models"
+)
+
+const identity = "home"
+
+var start = time.Date(2024, 6, 21, 12, 0, 0, 0, time.UTC)
+
+// recorder is an Executor that sends every run to its channel
+type recorder chan *Run
+
+func (r recorder) Execute(ctx context.Context, run *Run) error {
+	r <- run
+	return nil
+}
+
+// next waits for the next run
+func (r recorder) next(t *testing.T) *Run {
+	t.Helper()
+	select {
+	case run := <-r:
+		return run
+	case <-time.After(5 * time.Second):
+		t.Fatal("no rule was run")
+		return nil
+	}
+}
+
+// none checks that no run is waiting
+func (r recorder) none(t *testing.T) {
+	t.Helper()
+	select {
+	case run := <-r:
+		t.Fatalf("the rule %d was run by %s", run.Rule.Id, run.Trigger)
+	default:
+	}
+}
+
+// test_store returns a store with the identity and its entities, every
+// entity has the state "on"
+func test_store(t *testing.T, entityIDs ...string) (*honuadatabase.MemoryStore, map[string]*models.Entity) {
+	t.Helper()
+	store := honuadatabase.NewMemoryStore()
+	add_identity(t, store, identity)
+	entities := map[string]*models.Entity{}
+	for _, entityID := range entityIDs {
+		entities[entityID] = add_entity(t, store, identity, entityID)
+	}
+	return store, entities
+}
+
+func add_identity(t *testing.T, store *honuadatabase.MemoryStore, id string) {
+	t.Helper()
+	if err := store.AddIdentity(&models.Identity{Id: id, Name: id}); err != nil {
+		t.Fatalf("AddIdentity: %v", err)
+	}
+}
+
+func add_entity(t *testing.T, store *honuadatabase.MemoryStore, identity, entityID string) *models.Entity {
+	t.Helper()
+	entity := &models.Entity{IdentityId: identity, EntityId: entityID, Name: entityID, AllowRules: true, RulesEnabled: true}
+	if err := store.AddEntity(entity); err != nil {
+		t.Fatalf("AddEntity: %v", err)
+	}
+	if err := store.AddState(identity, &models.State{EntityId: entity.Id, State: "on"}); err != nil {
+		t.Fatalf("AddState: %v", err)
+	}
+	return entity
+}
+
+// add_rule adds a rule on target that is true while sensor is "on", it is
+// event based if trigger is nil
+func add_rule(t *testing.T, store *honuadatabase.MemoryStore, identity string, target, sensor *models.Entity, trigger *models.PeriodicTriggerType) *models.Rule {
+	t.Helper()
+	rule := &models.Rule{
+		Enabled:              true,
+		EventBasedEvaluation: trigger == nil,
+		Name:                 fmt.Sprintf("%s is on", sensor.EntityId),
+		Target:               target,
+		Condition: &models.Condition{Type: models.AND, SubConditions: []*models.Condition{
+			{Type: models.STATE, Sensor: sensor, ComparisonState: "on"},
+		}},
+	}
+	if trigger != nil {
+		rule.PeriodicTrigger = *trigger
+	}
+	if err := store.AddRule(identity, rule); err != nil {
+		t.Fatalf("AddRule: %v", err)
+	}
+	return rule
+}
+
+func start_scheduler(t *testing.T, store honuadatabase.Store, executor Executor, options ...Option) *Scheduler {
+	t.Helper()
+	s := New(store, executor, options...)
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(s.Stop)
+	return s
+}
+
+// wait_for waits until check is true, for the work of the scheduler that
+// does not wait on the clock
+func wait_for(t *testing.T, what string, check func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !check() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPeriodic(t *testing.T) {
+	store, entities := test_store(t, "switch.pump", "sensor.pv")
+	trigger := models.FiveMin
+	rule := add_rule(t, store, identity, entities["switch.pump"], entities["sensor.pv"], &trigger)
+
+	fake := clock.NewFake(start)
+	runs := make(recorder, 16)
+	start_scheduler(t, store, runs, WithClock(fake))
+
+	for i := 1; i <= 3; i++ {
+		fake.BlockUntil(1)
+		fake.Advance(5*time.Minute - time.Second)
+		runs.none(t)
+		fake.Advance(time.Second)
+
+		run := runs.next(t)
+		if run.Rule.Id != rule.Id || run.Trigger != Periodic || run.State != nil {
+			t.Fatalf("run %d: got the rule %d by %s, want the rule %d by %s", i, run.Rule.Id, run.Trigger, rule.Id, Periodic)
+		}
+		if !run.Result.Matched {
+			t.Errorf("run %d: the rule did not match", i)
+		}
+		if want := start.Add(time.Duration(i) * 5 * time.Minute); !run.RuleRun.EvaluatedAt.Equal(want) {
+			t.Errorf("run %d: evaluated at %s, want %s", i, run.RuleRun.EvaluatedAt, want)
+		}
+	}
+	// the timer is armed again only after the run
+	fake.BlockUntil(1)
+	runs.none(t)
+}
+
+func TestEventOnlyReferencingRules(t *testing.T) {
+	store, entities := test_store(t, "switch.pump", "sensor.a", "sensor.b", "sensor.c")
+	ruleA := add_rule(t, store, identity, entities["switch.pump"], entities["sensor.a"], nil)
+	ruleB := add_rule(t, store, identity, entities["switch.pump"], entities["sensor.b"], nil)
+	trigger := models.OneMin
+	add_rule(t, store, identity, entities["switch.pump"], entities["sensor.c"], &trigger)
+
+	runs := make(recorder, 16)
+	start_scheduler(t, store, runs, WithClock(clock.NewFake(start)))
+
+	// the events are handled in order on one goroutine, so a run of
+	// another rule would arrive before the expected one
+	for _, step := range []struct {
+		entity string
+		rule   *models.Rule
+	}{
+		{"sensor.a", ruleA},
+		{"sensor.c", nil},
+		{"switch.pump", nil},
+		{"sensor.b", ruleB},
+		{"sensor.a", ruleA},
+	} {
+		state := &models.State{EntityId: entities[step.entity].Id, State: "on"}
+		if err := store.AddState(identity, state); err != nil {
+			t.Fatalf("AddState: %v", err)
+		}
+		if step.rule == nil {
+			continue
+		}
+		run := runs.next(t)
+		if run.Rule.Id != step.rule.Id || run.Trigger != Event {
+			t.Fatalf("%s: got the rule %d by %s, want the rule %d by %s", step.entity, run.Rule.Id, run.Trigger, step.rule.Id, Event)
+		}
+		if run.State == nil || run.State.EntityId != state.EntityId || run.State.Id != state.Id {
+			t.Errorf("%s: got the state %+v, want %+v", step.entity, run.State, state)
+		}
+		if run.RuleRun == nil || run.RuleRun.TriggerEntityID == nil || *run.RuleRun.TriggerEntityID != state.EntityId {
+			t.Errorf("%s: the rule run does not record the entity %d", step.entity, state.EntityId)
+		}
+	}
+	runs.none(t)
+}
+
+// timerClock records the durations of the timers of the fake clock
+type timerClock struct {
+	*clock.Fake
+	durations chan time.Duration
+}
+
+func (c timerClock) NewTimer(d time.Duration) clock.Timer {
+	c.durations <- d
+	return c.Fake.NewTimer(d)
+}
+
+func TestJitter(t *testing.T) {
+	const jitter = 30 * time.Second
+	store, entities := test_store(t, "switch.pump", "sensor.pv")
+	trigger := models.OneMin
+	add_rule(t, store, identity, entities["switch.pump"], entities["sensor.pv"], &trigger)
+
+	fake := clock.NewFake(start)
+	timers := timerClock{Fake: fake, durations: make(chan time.Duration, 16)}
+	runs := make(recorder, 16)
+	s := start_scheduler(t, store, runs, WithClock(timers), WithJitter(jitter))
+
+	for i := 0; i < 1000; i++ {
+		if d := s.random_jitter(); d < 0 || d >= jitter {
+			t.Fatalf("got the jitter %s, want it in [0, %s)", d, jitter)
+		}
+	}
+
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 20; i++ {
+		d := <-timers.durations
+		if d < time.Minute || d >= time.Minute+jitter {
+			t.Errorf("timer %d: got %s, want it in [%s, %s)", i, d, time.Minute, time.Minute+jitter)
+		}
+		seen[d] = true
+		fake.BlockUntil(1)
+		fake.Advance(time.Minute + jitter)
+		runs.next(t)
+	}
+	if len(seen) < 2 {
+		t.Errorf("every timer waited %d, the jitter is not random", len(seen))
+	}
+}
+
+func TestReloadOnRuleChange(t *testing.T) {
+	store, entities := test_store(t, "switch.pump", "sensor.a")
+	rule := add_rule(t, store, identity, entities["switch.pump"], entities["sensor.a"], nil)
+
+	runs := make(recorder, 16)
+	s := start_scheduler(t, store, runs, WithClock(clock.NewFake(start)))
+	loaded := func(identity string, entityID int, n int) func() bool {
+		return func() bool { return len(s.rules_of(identity, entityID)) == n }
+	}
+	wait_for(t, "the rule", loaded(identity, entities["sensor.a"].Id, 1))
+
+	if err := store.SetRuleEnabled(identity, rule.Id, false); err != nil {
+		t.Fatalf("SetRuleEnabled: %v", err)
+	}
+	wait_for(t, "the disabled rule to be removed", loaded(identity, entities["sensor.a"].Id, 0))
+
+	if err := store.SetEntityRulesEnabled(identity, entities["switch.pump"].Id, false); err != nil {
+		t.Fatalf("SetEntityRulesEnabled: %v", err)
+	}
+	if err := store.SetRuleEnabled(identity, rule.Id, true); err != nil {
+		t.Fatalf("SetRuleEnabled: %v", err)
+	}
+	if err := store.SetEntityRulesEnabled(identity, entities["switch.pump"].Id, true); err != nil {
+		t.Fatalf("SetEntityRulesEnabled: %v", err)
+	}
+	wait_for(t, "the enabled rule", loaded(identity, entities["sensor.a"].Id, 1))
+
+	// an identity added after Start
+	add_identity(t, store, "office")
+	target := add_entity(t, store, "office", "switch.light")
+	sensor := add_entity(t, store, "office", "sensor.a")
+	other := add_rule(t, store, "office", target, sensor, nil)
+	wait_for(t, "the rule of the new identity", loaded("office", sensor.Id, 1))
+
+	if err := store.AddState("office", &models.State{EntityId: sensor.Id, State: "on"}); err != nil {
+		t.Fatalf("AddState: %v", err)
+	}
+	if run := runs.next(t); run.Identity != "office" || run.Rule.Id != other.Id {
+		t.Errorf("got the rule %d of %s, want the rule %d of office", run.Rule.Id, run.Identity, other.Id)
+	}
+	runs.none(t)
+}
+
+// TestSkipInactiveRule checks the rule again before it is evaluated, for the
+// changes the store does not report
+func TestSkipInactiveRule(t *testing.T) {
+	store, entities := test_store(t, "switch.pump", "sensor.a")
+	rule := add_rule(t, store, identity, entities["switch.pump"], entities["sensor.a"], nil)
+
+	runs := make(recorder, 16)
+	s := New(store, runs, WithClock(clock.NewFake(start)))
+	ctx := context.Background()
+	state := &models.State{EntityId: entities["sensor.a"].Id, State: "on"}
+
+	s.run(ctx, identity, rule, Event, state)
+	runs.next(t)
+
+	if err := store.SetRuleEnabled(identity, rule.Id, false); err != nil {
+		t.Fatalf("SetRuleEnabled: %v", err)
+	}
+	s.run(ctx, identity, rule, Event, state)
+	runs.none(t)
+
+	if err := store.DeleteRule(identity, rule.Id); err != nil {
+		t.Fatalf("DeleteRule: %v", err)
+	}
+	s.run(ctx, identity, rule, Event, state)
+	runs.none(t)
+}
+
+func TestStop(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	store, entities := test_store(t, "switch.pump", "sensor.a", "sensor.pv")
+	trigger := models.OneMin
+	add_rule(t, store, identity, entities["switch.pump"], entities["sensor.pv"], &trigger)
+	add_rule(t, store, identity, entities["switch.pump"], entities["sensor.a"], nil)
+
+	// the event based rule blocks in the executor until it is stopped
+	started := make(chan struct{})
+	executor := ExecutorFunc(func(ctx context.Context, run *Run) error {
+		if run.Trigger == Event {
+			close(started)
+			<-ctx.Done()
+		}
+		return nil
+	})
+
+	fake := clock.NewFake(start)
+	s := New(store, executor, WithClock(fake), WithRetention(models.RetentionPolicy{MaxAge: time.Hour}, time.Hour))
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	fake.BlockUntil(2)
+	if err := store.AddState(identity, &models.State{EntityId: entities["sensor.a"].Id, State: "on"}); err != nil {
+		t.Fatalf("AddState: %v", err)
+	}
+	<-started
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop did not return")
+	}
+
+	// the goroutines have called Done, but may not have exited yet
+	wait_for(t, "the goroutines to exit", func() bool { return runtime.NumGoroutine() <= before })
+
+	// a stopped scheduler does not follow the store anymore
+	if err := store.AddState(identity, &models.State{EntityId: entities["sensor.a"].Id, State: "on"}); err != nil {
+		t.Fatalf("AddState: %v", err)
+	}
+	if err := s.Reload(context.Background(), identity); err != ErrNotRunning {
+		t.Errorf("Reload after Stop: got %v, want %v", err, ErrNotRunning)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("Start after Stop: %v", err)
+	}
+	s.Stop()
+}
@@ -0,0 +1,125 @@
+package simulation
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/JonasBordewick/honua-database/engine"
+	"github.com/JonasBordewick/honua-database/models"
+)
+
+// history is the recorded states of one entity, ordered like they were recorded
+type history struct {
+	entity *models.Entity
+	states []*models.State
+}
+
+// at returns the index of the last state recorded at or before t, -1 if there is none
+func (h *history) at(t time.Time) int {
+	i := -1
+	for j, s := range h.states {
+		if s.RecordTime == nil || s.RecordTime.After(t) {
+			break
+		}
+		i = j
+	}
+	return i
+}
+
+// provider answers the engine with the history as it was at now, it
+// implements engine.StateProvider
+type provider struct {
+	store    Store
+	identity string
+	now      time.Time
+	// byEntityID and byID hold the same histories
+	byEntityID map[string]*history
+	byID       map[int]*history
+	location   *models.Location
+	noLocation error
+}
+
+func (p *provider) history(entity *models.Entity, attribute string) (*history, error) {
+	h, ok := p.byEntityID[entity.EntityId]
+	if !ok {
+		h, ok = p.byID[entity.Id]
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: %s is not replayed", engine.ErrNoState, entity.EntityId)
+	}
+	if attribute != "" && !(h.entity.HasAttribute && h.entity.Attribute == attribute) {
+		return nil, fmt.Errorf("%w: the attribute %s of %s is not recorded", engine.ErrNoState, attribute, h.entity.EntityId)
+	}
+	return h, nil
+}
+
+func (p *provider) State(ctx context.Context, entity *models.Entity, attribute string) (*models.State, error) {
+	h, err := p.history(entity, attribute)
+	if err != nil {
+		return nil, err
+	}
+	i := h.at(p.now)
+	if i < 0 {
+		return nil, fmt.Errorf("%w: there is no state of %s at %s", engine.ErrNoState, h.entity.EntityId, p.now.Format(time.RFC3339))
+	}
+	return h.states[i], nil
+}
+
+func (p *provider) States(ctx context.Context, entity *models.Entity, attribute string, from, to time.Time) ([]*models.State, error) {
+	h, err := p.history(entity, attribute)
+	if err != nil {
+		return nil, err
+	}
+	if to.After(p.now) {
+		to = p.now
+	}
+
+	var result []*models.State = []*models.State{}
+	if i := h.at(from); i >= 0 {
+		result = append(result, h.states[i])
+	}
+	for _, s := range h.states {
+		if s.RecordTime != nil && s.RecordTime.After(from) && !s.RecordTime.After(to) {
+			result = append(result, s)
+		}
+	}
+	return result, nil
+}
+
+// LastChange works like Store.GetLastStateChange on the states recorded until now
+func (p *provider) LastChange(ctx context.Context, entity *models.Entity, attribute string) (*models.StateTransition, error) {
+	h, err := p.history(entity, attribute)
+	if err != nil {
+		return nil, err
+	}
+	i := h.at(p.now)
+	if i < 0 {
+		return nil, fmt.Errorf("%w: there is no state of %s at %s", engine.ErrNoState, h.entity.EntityId, p.now.Format(time.RFC3339))
+	}
+
+	last := h.states[i]
+	result := &models.StateTransition{EntityId: last.EntityId, To: last.State, Since: *last.RecordTime}
+	for j := i - 1; j >= 0; j-- {
+		if h.states[j].State != result.To {
+			result.From = h.states[j].State
+			break
+		}
+		result.Since = *h.states[j].RecordTime
+	}
+	return result, nil
+}
+
+func (p *provider) Entity(ctx context.Context, entityID string) (*models.Entity, error) {
+	if h, ok := p.byEntityID[entityID]; ok {
+		return h.entity, nil
+	}
+	return nil, fmt.Errorf("%w: %s is not replayed", engine.ErrNoState, entityID)
+}
+
+func (p *provider) Location(ctx context.Context) (*models.Location, error) {
+	if p.location == nil {
+		return nil, p.noLocation
+	}
+	return p.location, nil
+}
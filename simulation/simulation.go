@@ -0,0 +1,254 @@
+// Package simulation replays the recorded states of an identity to show how
+// a rule, saved or not, would have been evaluated in a past time range. It
+// only reads the store, no action is run.
+package simulation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	honuadatabase "github.com/JonasBordewick/honua-database"
+	"github.com/JonasBordewick/honua-database/clock"
+	"github.com/JonasBordewick/honua-database/engine"
+	"github.com/JonasBordewick/honua-database/expression"
+	"github.com/JonasBordewick/honua-database/models"
+)
+
+var (
+	ErrInvalidRange = errors.New("the time range is not valid")
+	ErrTooManySteps = errors.New("the simulation has too many steps")
+)
+
+// Store is the part of honuadatabase.Store a simulation reads, it has no method that writes
+type Store interface {
+	GetIdOfEntityContext(ctx context.Context, identifier, entityId string) (int, error)
+	GetEntityContext(ctx context.Context, identity string, id int) (*models.Entity, error)
+	GetStatesBetweenContext(ctx context.Context, identity string, entityID int, from, to time.Time) ([]*models.State, error)
+	GetLocationContext(ctx context.Context, identifier string) (*models.Location, error)
+}
+
+// Step is one evaluation of the simulated rule
+type Step struct {
+	Time    time.Time
+	Trigger models.TriggerType
+	// TriggerEntityID is the entity whose new state triggered the step, nil for periodic steps
+	TriggerEntityID *int
+	Matched         bool
+	Branch          engine.Branch
+	// Actions are the then or else actions that would have run
+	Actions []*models.Action
+	Trace   *models.ConditionTrace
+}
+
+// Timeline is the result of a simulation
+type Timeline struct {
+	RuleID int
+	From   time.Time
+	To     time.Time
+	Steps  []*Step
+	// Matched counts the steps the condition matched at, Activations the
+	// steps it matched at after it did not match before
+	Matched     int
+	Activations int
+}
+
+type simulation struct {
+	lookback time.Duration
+	maxSteps int
+}
+
+type Option func(*simulation)
+
+// WithLookback sets how long before the start of the range the states are
+// replayed, for durations and state changes, default is 24 hours. It is
+// extended to the longest For of the conditions.
+func WithLookback(d time.Duration) Option {
+	return func(s *simulation) {
+		s.lookback = d
+	}
+}
+
+// WithMaxSteps limits the number of evaluations, default is 100000
+func WithMaxSteps(n int) Option {
+	return func(s *simulation) {
+		s.maxSteps = n
+	}
+}
+
+// Run evaluates the rule at every periodic tick after from until to, or at
+// every new state of an entity of the condition tree if the rule is event
+// based, with the states that were recorded at that time.
+func Run(ctx context.Context, store Store, identity string, rule *models.Rule, from, to time.Time, options ...Option) (*Timeline, error) {
+	s := &simulation{lookback: 24 * time.Hour, maxSteps: 100000}
+	for _, option := range options {
+		option(s)
+	}
+
+	if !to.After(from) {
+		return nil, fmt.Errorf("%w: %s is not after %s", ErrInvalidRange, to.Format(time.RFC3339), from.Format(time.RFC3339))
+	}
+	if rule.Condition == nil {
+		return nil, fmt.Errorf("%w: rule %d", engine.ErrNoCondition, rule.Id)
+	}
+
+	p := &provider{store: store, identity: identity, byEntityID: map[string]*history{}, byID: map[int]*history{}}
+	if err := s.load_entities(ctx, p, rule.Condition); err != nil {
+		return nil, err
+	}
+	lookback := s.lookback
+	if longest := longest_for(rule.Condition); longest > lookback {
+		lookback = longest
+	}
+	for _, h := range p.byID {
+		states, err := store.GetStatesBetweenContext(ctx, identity, h.entity.Id, from.Add(-lookback), to)
+		if err != nil {
+			return nil, err
+		}
+		h.states = states
+	}
+
+	location, err := store.GetLocationContext(ctx, identity)
+	switch {
+	case errors.Is(err, honuadatabase.ErrNotFound):
+		p.noLocation = fmt.Errorf("%w: %s has no location", engine.ErrNoLocation, identity)
+	case err != nil:
+		return nil, err
+	default:
+		p.location = location
+	}
+
+	steps, err := s.steps(rule, p, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	timeline := &Timeline{RuleID: rule.Id, From: from, To: to, Steps: steps}
+	for i, step := range steps {
+		p.now = step.Time
+		result, err := engine.New(engine.WithClock(clock.Fixed(step.Time))).Evaluate(ctx, rule, p)
+		if err != nil {
+			return nil, fmt.Errorf("the step at %s: %w", step.Time.Format(time.RFC3339), err)
+		}
+		step.Matched, step.Branch, step.Actions, step.Trace = result.Matched, result.Branch, result.Actions, result.Trace
+		if step.Matched {
+			timeline.Matched++
+			if i == 0 || !steps[i-1].Matched {
+				timeline.Activations++
+			}
+		}
+	}
+	return timeline, nil
+}
+
+// steps returns the steps without their results, ordered by time
+func (s *simulation) steps(rule *models.Rule, p *provider, from, to time.Time) ([]*Step, error) {
+	var steps []*Step
+	if !rule.EventBasedEvaluation {
+		interval := rule.PeriodicTrigger.Interval()
+		if interval <= 0 {
+			return nil, fmt.Errorf("the periodic trigger %d of rule %d is not known", rule.PeriodicTrigger, rule.Id)
+		}
+		if n := int(to.Sub(from) / interval); n > s.maxSteps {
+			return nil, fmt.Errorf("%w: %d ticks of %v", ErrTooManySteps, n, interval)
+		}
+		for t := from.Add(interval); !t.After(to); t = t.Add(interval) {
+			steps = append(steps, &Step{Time: t, Trigger: models.PERIODIC})
+		}
+		return steps, nil
+	}
+
+	for _, id := range sorted_ids(p.byID) {
+		for _, state := range p.byID[id].states {
+			if state.RecordTime == nil || !state.RecordTime.After(from) || state.RecordTime.After(to) {
+				continue
+			}
+			entityID := id
+			steps = append(steps, &Step{Time: *state.RecordTime, Trigger: models.EVENT, TriggerEntityID: &entityID})
+		}
+	}
+	if len(steps) > s.maxSteps {
+		return nil, fmt.Errorf("%w: %d states", ErrTooManySteps, len(steps))
+	}
+	sort.SliceStable(steps, func(i, j int) bool { return steps[i].Time.Before(steps[j].Time) })
+	return steps, nil
+}
+
+// load_entities finds the sensors and the template entities of the condition
+// tree. A sensor of an unsaved rule is looked up by its Home Assistant entity id.
+func (s *simulation) load_entities(ctx context.Context, p *provider, c *models.Condition) error {
+	if c.Sensor != nil {
+		id := c.Sensor.Id
+		if c.Sensor.EntityId != "" {
+			var err error
+			if id, err = p.store.GetIdOfEntityContext(ctx, p.identity, c.Sensor.EntityId); err != nil {
+				return fmt.Errorf("condition %d: %w", c.Id, err)
+			}
+		}
+		if err := p.add_entity(ctx, id); err != nil {
+			return fmt.Errorf("condition %d: %w", c.Id, err)
+		}
+	}
+
+	if c.Type == models.TEMPLATE {
+		expr, err := expression.Parse(c.Template)
+		if err != nil {
+			return fmt.Errorf("condition %d: %w", c.Id, err)
+		}
+		for _, name := range expr.Entities() {
+			id, err := p.store.GetIdOfEntityContext(ctx, p.identity, name)
+			if errors.Is(err, honuadatabase.ErrNotFound) {
+				// the template has no state for the entity, like at run time
+				continue
+			}
+			if err == nil {
+				err = p.add_entity(ctx, id)
+			}
+			if err != nil {
+				return fmt.Errorf("condition %d: %w", c.Id, err)
+			}
+		}
+	}
+
+	for _, sub := range c.SubConditions {
+		if err := s.load_entities(ctx, p, sub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *provider) add_entity(ctx context.Context, id int) error {
+	if _, ok := p.byID[id]; ok {
+		return nil
+	}
+	entity, err := p.store.GetEntityContext(ctx, p.identity, id)
+	if err != nil {
+		return err
+	}
+	h := &history{entity: entity}
+	p.byID[id] = h
+	p.byEntityID[entity.EntityId] = h
+	return nil
+}
+
+func longest_for(c *models.Condition) time.Duration {
+	longest := c.For
+	for _, sub := range c.SubConditions {
+		if d := longest_for(sub); d > longest {
+			longest = d
+		}
+	}
+	return longest
+}
+
+func sorted_ids(histories map[int]*history) []int {
+	var ids []int
+	for id := range histories {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
@@ -1,30 +1,47 @@
 package honuadatabase
 
 import (
+	"context"
 	"database/sql"
-	"log"
+	"fmt"
+	"log/slog"
 	"time"
 
 	"github.com/JonasBordewick/honua-database/models"
 )
 
 func (hdb *HonuaDatabase) AddState(identity string, state *models.State) error {
-	const query = "INSERT INTO states (entity_id, identity, state) VALUES ($1, $2, $3);"
-	_, err := hdb.db.Exec(query, state.EntityId, identity, state.State)
-	if err != nil {
-		log.Printf("An error occured during adding a new state to table states: %s\n", err.Error())
+	return hdb.AddStateContext(context.Background(), identity, state)
+}
+
+func (hdb *HonuaDatabase) AddStateContext(ctx context.Context, identity string, state *models.State) (err error) {
+	defer hdb.observe(ctx, "add_state", time.Now(), &err, slog.String("identity", identity), slog.Int("entity_id", state.EntityId))
+	const query = "INSERT INTO states (entity_id, identity, state) VALUES ($1, $2, $3) RETURNING id, record_time;"
+	var recordTime time.Time
+	if err = hdb.db.QueryRowContext(ctx, query, state.EntityId, identity, state.State).Scan(&state.Id, &recordTime); err != nil {
+		return map_error(err)
 	}
-	return err
+	state.RecordTime = &recordTime
+	hdb.subscribers.notify(identity, state)
+	return nil
+}
+
+// SubscribeStates calls handler for every state added with AddState until cancel is called
+func (hdb *HonuaDatabase) SubscribeStates(handler StateHandler) (cancel func()) {
+	return hdb.subscribers.states.subscribe(handler)
 }
 
 func (hdb *HonuaDatabase) GetState(identity string, entityID int) (*models.State, error) {
-	const query = "SELECT * FROM states WHERE id = (SELECT MAX(id) FROM states WHERE identity = $1 AND entity_id = $2);"
+	return hdb.GetStateContext(context.Background(), identity, entityID)
+}
 
+func (hdb *HonuaDatabase) GetStateContext(ctx context.Context, identity string, entityID int) (_ *models.State, err error) {
+	defer hdb.observe(ctx, "get_state", time.Now(), &err, slog.String("identity", identity), slog.Int("entity_id", entityID))
+	const query = "SELECT * FROM states WHERE id = (SELECT MAX(id) FROM states WHERE identity = $1 AND entity_id = $2);"
 
-	rows, err := hdb.db.Query(query, identity, entityID)
+	rows, err := hdb.db.QueryContext(ctx, query, identity, entityID)
 	if err != nil {
-		log.Printf("An error occured during getting the latest state of entity with id = %d: %s\n", entityID, err.Error())
-		return nil, err
+		return nil, map_error(err)
 	}
 
 	var state *models.State
@@ -33,32 +50,41 @@ func (hdb *HonuaDatabase) GetState(identity string, entityID int) (*models.State
 		state, err = hdb.make_state(rows)
 		if err != nil {
 			rows.Close()
-			log.Printf("An error occured during getting the latest state of entity with id = %d: %s\n", entityID, err.Error())
 			return nil, err
 		}
 	}
 
 	rows.Close()
 
+	if state == nil {
+		return nil, fmt.Errorf("%w: there is no state of entity %d in %s", ErrNotFound, entityID, identity)
+	}
+
 	return state, nil
 }
 
 func (hdb *HonuaDatabase) DeleteOldestState(identity string, entityID int) error {
+	return hdb.DeleteOldestStateContext(context.Background(), identity, entityID)
+}
+
+func (hdb *HonuaDatabase) DeleteOldestStateContext(ctx context.Context, identity string, entityID int) (err error) {
+	defer hdb.observe(ctx, "delete_oldest_state", time.Now(), &err, slog.String("identity", identity), slog.Int("entity_id", entityID))
 	const query = "DELETE FROM states WHERE id = (SELECT MIN(id) FROM states WHERE identity=$1 AND entity_id = $2);"
-	_, err := hdb.db.Exec(query, identity, entityID)
-	if err != nil {
-		log.Printf("An error occured during deleting the oldest state of enitity with id = %d: %s\n", entityID, err.Error())
-	}
-	return err
+	_, err = hdb.db.ExecContext(ctx, query, identity, entityID)
+	return map_error(err)
 }
 
 func (hdb *HonuaDatabase) GetNumberOfStatesOfEntity(identity string, entityID int) (int, error) {
+	return hdb.GetNumberOfStatesOfEntityContext(context.Background(), identity, entityID)
+}
+
+func (hdb *HonuaDatabase) GetNumberOfStatesOfEntityContext(ctx context.Context, identity string, entityID int) (_ int, err error) {
+	defer hdb.observe(ctx, "get_number_of_states_of_entity", time.Now(), &err, slog.String("identity", identity), slog.Int("entity_id", entityID))
 	const query = "SELECT COUNT(*) AS count FROM states WHERE identity=$1 AND entity_id = $2;"
 
-	rows, err := hdb.db.Query(query, identity, entityID)
+	rows, err := hdb.db.QueryContext(ctx, query, identity, entityID)
 	if err != nil {
-		log.Printf("An error occured during getting the number of states of entity with id = %d: %s\n", entityID, err.Error())
-		return -1, err
+		return -1, map_error(err)
 	}
 
 	var counter int = -1
@@ -67,8 +93,7 @@ func (hdb *HonuaDatabase) GetNumberOfStatesOfEntity(identity string, entityID in
 		err = rows.Scan(&counter)
 		if err != nil {
 			rows.Close()
-			log.Printf("An error occured during getting the number of states of entity with id = %d: %s\n", entityID, err.Error())
-			return -1, err
+			return -1, map_error(err)
 		}
 	}
 
@@ -77,6 +102,73 @@ func (hdb *HonuaDatabase) GetNumberOfStatesOfEntity(identity string, entityID in
 	return counter, nil
 }
 
+// GetStatesBetween returns the states of the entity recorded after from until
+// to, ordered by id. The first state is the one the entity had at from if
+// it was recorded before.
+func (hdb *HonuaDatabase) GetStatesBetween(identity string, entityID int, from, to time.Time) ([]*models.State, error) {
+	return hdb.GetStatesBetweenContext(context.Background(), identity, entityID, from, to)
+}
+
+func (hdb *HonuaDatabase) GetStatesBetweenContext(ctx context.Context, identity string, entityID int, from, to time.Time) (_ []*models.State, err error) {
+	defer hdb.observe(ctx, "get_states_between", time.Now(), &err, slog.String("identity", identity), slog.Int("entity_id", entityID))
+	const query = `
+(SELECT id, entity_id, identity, state, record_time FROM states
+	WHERE identity = $1 AND entity_id = $2 AND record_time <= $3 ORDER BY id DESC LIMIT 1)
+UNION ALL
+(SELECT id, entity_id, identity, state, record_time FROM states
+	WHERE identity = $1 AND entity_id = $2 AND record_time > $3 AND record_time <= $4)
+ORDER BY id;`
+
+	rows, err := hdb.db.QueryContext(ctx, query, identity, entityID, from, to)
+	if err != nil {
+		return nil, map_error(err)
+	}
+	defer rows.Close()
+
+	var result []*models.State = []*models.State{}
+	for rows.Next() {
+		state, err := hdb.make_state(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, state)
+	}
+	return result, map_error(rows.Err())
+}
+
+// GetLastStateChange returns the last change of the state of the entity,
+// ErrNotFound if there is no state of the entity
+func (hdb *HonuaDatabase) GetLastStateChange(identity string, entityID int) (*models.StateTransition, error) {
+	return hdb.GetLastStateChangeContext(context.Background(), identity, entityID)
+}
+
+func (hdb *HonuaDatabase) GetLastStateChangeContext(ctx context.Context, identity string, entityID int) (_ *models.StateTransition, err error) {
+	defer hdb.observe(ctx, "get_last_state_change", time.Now(), &err, slog.String("identity", identity), slog.Int("entity_id", entityID))
+	const query = `
+WITH current AS (
+	SELECT id, state FROM states WHERE identity = $1 AND entity_id = $2 ORDER BY id DESC LIMIT 1
+), previous AS (
+	SELECT s.id, s.state FROM states s, current c
+	WHERE s.identity = $1 AND s.entity_id = $2 AND s.state <> c.state ORDER BY s.id DESC LIMIT 1
+)
+SELECT c.state, p.state, (
+	SELECT record_time FROM states s
+	WHERE s.identity = $1 AND s.entity_id = $2 AND s.id > COALESCE(p.id, 0) ORDER BY s.id LIMIT 1
+) FROM current c LEFT JOIN previous p ON true;`
+
+	var from sql.NullString
+	result := &models.StateTransition{EntityId: entityID}
+	err = hdb.db.QueryRowContext(ctx, query, identity, entityID).Scan(&result.To, &from, &result.Since)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: there is no state of entity %d in %s", ErrNotFound, entityID, identity)
+	}
+	if err != nil {
+		return nil, map_error(err)
+	}
+	result.From = from.String
+	return result, nil
+}
+
 func (hdb *HonuaDatabase) make_state(rows *sql.Rows) (*models.State, error) {
 	var id int
 	var entityID int
@@ -85,7 +177,7 @@ func (hdb *HonuaDatabase) make_state(rows *sql.Rows) (*models.State, error) {
 	var recordTime *time.Time
 	err := rows.Scan(&id, &entityID, &identity, &state, &recordTime)
 	if err != nil {
-		return nil, err
+		return nil, map_error(err)
 	}
 
 	return &models.State{
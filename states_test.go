@@ -0,0 +1,79 @@
+package honuadatabase
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/JonasBordewick/honua-database/models"
+)
+
+// test_memory_store returns a MemoryStore with a new identity
+func test_memory_store(t *testing.T) (*MemoryStore, string) {
+	t.Helper()
+	ms := NewMemoryStore()
+	const identity = "test"
+	if err := ms.AddIdentity(&models.Identity{Id: identity, Name: identity}); err != nil {
+		t.Fatalf("AddIdentity: %v", err)
+	}
+	return ms, identity
+}
+
+// scenario_record_time checks that the store records states at the current
+// time, the durations of sensor and from_to conditions are measured from it
+func scenario_record_time(t *testing.T, store Store, identity string) {
+	ctx := context.Background()
+
+	entity := test_entity(identity, 0)
+	if err := store.AddEntityContext(ctx, entity); err != nil {
+		t.Fatalf("AddEntity: %v", err)
+	}
+
+	before := time.Now()
+	for _, s := range []string{"off", "on"} {
+		if err := store.AddStateContext(ctx, identity, &models.State{EntityId: entity.Id, State: s}); err != nil {
+			t.Fatalf("AddState: %v", err)
+		}
+	}
+	after := time.Now()
+
+	// the clock of the database may differ a bit, but not by hours
+	const tolerance = time.Minute
+	near := func(what string, got time.Time) {
+		t.Helper()
+		if got.Before(before.Add(-tolerance)) || got.After(after.Add(tolerance)) {
+			t.Errorf("%s is %s, want it between %s and %s", what, got, before, after)
+		}
+	}
+
+	state, err := store.GetStateContext(ctx, identity, entity.Id)
+	if err != nil {
+		t.Fatalf("GetState: %v", err)
+	}
+	near("the record time", *state.RecordTime)
+
+	change, err := store.GetLastStateChangeContext(ctx, identity, entity.Id)
+	if err != nil {
+		t.Fatalf("GetLastStateChange: %v", err)
+	}
+	if change.From != "off" || change.To != "on" {
+		t.Errorf("got the change from %q to %q, want from off to on", change.From, change.To)
+	}
+	near("the last change", change.Since)
+
+	states, err := store.GetStatesBetweenContext(ctx, identity, entity.Id, before.Add(-tolerance), after.Add(tolerance))
+	if err != nil {
+		t.Fatalf("GetStatesBetween: %v", err)
+	}
+	if len(states) != 2 {
+		t.Errorf("got %d states around now, want 2", len(states))
+	}
+	states, err = store.GetStatesBetweenContext(ctx, identity, entity.Id, after.Add(tolerance), after.Add(3*time.Hour))
+	if err != nil {
+		t.Fatalf("GetStatesBetween: %v", err)
+	}
+	// only the state the entity had at the start
+	if len(states) != 1 || states[0].State != "on" {
+		t.Errorf("got %d states in the future, want the current one", len(states))
+	}
+}
@@ -0,0 +1,246 @@
+package honuadatabase
+
+import (
+	"context"
+	"time"
+
+	"github.com/JonasBordewick/honua-database/models"
+)
+
+// Store is the storage backend used by honua. It is implemented by the
+// PostgreSQL backed HonuaDatabase and by the in-memory MemoryStore.
+type Store interface {
+	IdentityStore
+	EntityStore
+	StateStore
+	RuleStore
+	ConditionStore
+	ActionStore
+	ActionRunStore
+	RuleRunStore
+	DelayStore
+	SceneStore
+	HassServiceStore
+	AllowedServiceStore
+	AllowedSensorStore
+}
+
+type IdentityStore interface {
+	AddIdentity(identity *models.Identity) error
+	AddIdentityContext(ctx context.Context, identity *models.Identity) error
+	DeleteIdentity(identifier string) error
+	DeleteIdentityContext(ctx context.Context, identifier string) error
+	ExistIdentity(identifier string) (bool, error)
+	ExistIdentityContext(ctx context.Context, identifier string) (bool, error)
+	GetIdentity(identifier string) (*models.Identity, error)
+	GetIdentityContext(ctx context.Context, identifier string) (*models.Identity, error)
+	GetIdentities() ([]*models.Identity, error)
+	GetIdentitiesContext(ctx context.Context) ([]*models.Identity, error)
+	SetLocation(identifier string, location *models.Location) error
+	SetLocationContext(ctx context.Context, identifier string, location *models.Location) error
+	GetLocation(identifier string) (*models.Location, error)
+	GetLocationContext(ctx context.Context, identifier string) (*models.Location, error)
+}
+
+type EntityStore interface {
+	GetEntity(identity string, id int) (*models.Entity, error)
+	GetEntityContext(ctx context.Context, identity string, id int) (*models.Entity, error)
+	AddEntity(entity *models.Entity) error
+	AddEntityContext(ctx context.Context, entity *models.Entity) error
+	DeleteEntity(id int, identity string) error
+	DeleteEntityContext(ctx context.Context, id int, identity string) error
+	EditEntity(identifier string, entity *models.Entity) error
+	EditEntityContext(ctx context.Context, identifier string, entity *models.Entity) error
+	SetEntityRulesEnabled(identity string, id int, enabled bool) error
+	SetEntityRulesEnabledContext(ctx context.Context, identity string, id int, enabled bool) error
+	ExistEntity(identifier string, id int, hasAttribute bool, attribute string) (bool, error)
+	ExistEntityContext(ctx context.Context, identifier string, id int, hasAttribute bool, attribute string) (bool, error)
+	GetIdOfEntity(identifier, entityId string) (int, error)
+	GetIdOfEntityContext(ctx context.Context, identifier, entityId string) (int, error)
+	GetEntities(identifier string) ([]*models.Entity, error)
+	GetEntitiesContext(ctx context.Context, identifier string) ([]*models.Entity, error)
+	GetEntitiesWhereRulesAreAllowed(identifier string) ([]*models.Entity, error)
+	GetEntitiesWhereRulesAreAllowedContext(ctx context.Context, identifier string) ([]*models.Entity, error)
+	GetEntitiesWithoutRule(identifier string) ([]*models.Entity, error)
+	GetEntitiesWithoutRuleContext(ctx context.Context, identifier string) ([]*models.Entity, error)
+	GetVictronEntities(identifier string) ([]*models.Entity, error)
+	GetVictronEntitiesContext(ctx context.Context, identifier string) ([]*models.Entity, error)
+}
+
+type StateStore interface {
+	AddState(identity string, state *models.State) error
+	AddStateContext(ctx context.Context, identity string, state *models.State) error
+	GetState(identity string, entityID int) (*models.State, error)
+	GetStateContext(ctx context.Context, identity string, entityID int) (*models.State, error)
+	DeleteOldestState(identity string, entityID int) error
+	DeleteOldestStateContext(ctx context.Context, identity string, entityID int) error
+	GetNumberOfStatesOfEntity(identity string, entityID int) (int, error)
+	GetNumberOfStatesOfEntityContext(ctx context.Context, identity string, entityID int) (int, error)
+	GetStatesBetween(identity string, entityID int, from, to time.Time) ([]*models.State, error)
+	GetStatesBetweenContext(ctx context.Context, identity string, entityID int, from, to time.Time) ([]*models.State, error)
+	GetLastStateChange(identity string, entityID int) (*models.StateTransition, error)
+	GetLastStateChangeContext(ctx context.Context, identity string, entityID int) (*models.StateTransition, error)
+	// SubscribeStates calls handler for every state added with AddState until cancel is called
+	SubscribeStates(handler StateHandler) (cancel func())
+}
+
+type RuleStore interface {
+	GetAllRulesOfIdentity(identity string) ([]*models.Rule, error)
+	GetAllRulesOfIdentityContext(ctx context.Context, identity string) ([]*models.Rule, error)
+	GetRule(identity string, id int) (*models.Rule, error)
+	GetRuleContext(ctx context.Context, identity string, id int) (*models.Rule, error)
+	GetActiveRules(identity string) ([]*models.Rule, error)
+	GetActiveRulesContext(ctx context.Context, identity string) ([]*models.Rule, error)
+	SearchRules(identity, text string) ([]*models.Rule, error)
+	SearchRulesContext(ctx context.Context, identity, text string) ([]*models.Rule, error)
+	AddRule(identity string, rule *models.Rule) error
+	AddRuleContext(ctx context.Context, identity string, rule *models.Rule) error
+	EditRule(identity string, rule *models.Rule) error
+	EditRuleContext(ctx context.Context, identity string, rule *models.Rule) error
+	DeleteRule(identity string, id int) error
+	DeleteRuleContext(ctx context.Context, identity string, id int) error
+	SetRuleEnabled(identity string, id int, enabled bool) error
+	SetRuleEnabledContext(ctx context.Context, identity string, id int, enabled bool) error
+	SetAllRulesEnabled(identity string, enabled bool) (int, error)
+	SetAllRulesEnabledContext(ctx context.Context, identity string, enabled bool) (int, error)
+	ExistRule(identity string, id int) (bool, error)
+	ExistRuleContext(ctx context.Context, identity string, id int) (bool, error)
+	ExistRules(identity string) (bool, error)
+	ExistRulesContext(ctx context.Context, identity string) (bool, error)
+	// SubscribeRules calls handler after every change of the rules of an
+	// identity until cancel is called, changes made through another handle of
+	// the database are not reported
+	SubscribeRules(handler RuleHandler) (cancel func())
+}
+
+type ConditionStore interface {
+	AddCondition(identity string, condition *models.Condition) (int, error)
+	AddConditionContext(ctx context.Context, identity string, condition *models.Condition) (int, error)
+	DeleteCondition(conditionID int, identity string) error
+	DeleteConditionContext(ctx context.Context, conditionID int, identity string) error
+	EditCondition(identity string, condition *models.Condition) error
+	EditConditionContext(ctx context.Context, identity string, condition *models.Condition) error
+	ExistCondition(conditionID int, identity string) (bool, error)
+	ExistConditionContext(ctx context.Context, conditionID int, identity string) (bool, error)
+	GetCondition(conditionID int, identity string) (*models.Condition, error)
+	GetConditionContext(ctx context.Context, conditionID int, identity string) (*models.Condition, error)
+}
+
+type ActionStore interface {
+	GetActionsOfRule(identifier string, ruleID int) ([]*models.Action, []*models.Action, error)
+	GetActionsOfRuleContext(ctx context.Context, identifier string, ruleID int) ([]*models.Action, []*models.Action, error)
+	AddAction(identifier string, ruleID int, isThenAction bool, action *models.Action) error
+	AddActionContext(ctx context.Context, identifier string, ruleID int, isThenAction bool, action *models.Action) error
+	InsertAction(identifier string, ruleID int, isThenAction bool, position int, action *models.Action) error
+	InsertActionContext(ctx context.Context, identifier string, ruleID int, isThenAction bool, position int, action *models.Action) error
+	MoveActionUp(identifier string, id int) error
+	MoveActionUpContext(ctx context.Context, identifier string, id int) error
+	MoveActionDown(identifier string, id int) error
+	MoveActionDownContext(ctx context.Context, identifier string, id int) error
+	ReorderActions(identifier string, ruleID int, isThenAction bool, ids []int) error
+	ReorderActionsContext(ctx context.Context, identifier string, ruleID int, isThenAction bool, ids []int) error
+	DeleteAction(identifier string, id int) error
+	DeleteActionContext(ctx context.Context, identifier string, id int) error
+	ExistAction(identifier string, id int) (bool, error)
+	ExistActionContext(ctx context.Context, identifier string, id int) (bool, error)
+}
+
+type ActionRunStore interface {
+	AddActionRun(identity string, run *models.ActionRun) error
+	AddActionRunContext(ctx context.Context, identity string, run *models.ActionRun) error
+	UpdateActionRun(identity string, run *models.ActionRun) error
+	UpdateActionRunContext(ctx context.Context, identity string, run *models.ActionRun) error
+	GetActionRun(identity string, id int) (*models.ActionRun, error)
+	GetActionRunContext(ctx context.Context, identity string, id int) (*models.ActionRun, error)
+	GetActionRuns(identity string) ([]*models.ActionRun, error)
+	GetActionRunsContext(ctx context.Context, identity string) ([]*models.ActionRun, error)
+	DeleteActionRun(identity string, id int) error
+	DeleteActionRunContext(ctx context.Context, identity string, id int) error
+	DeleteActionRunsOfRule(identity string, ruleID int) error
+	DeleteActionRunsOfRuleContext(ctx context.Context, identity string, ruleID int) error
+}
+
+type RuleRunStore interface {
+	AddRuleRun(identity string, run *models.RuleRun) error
+	AddRuleRunContext(ctx context.Context, identity string, run *models.RuleRun) error
+	AddRuleRunAction(identity string, id int, outcome *models.ActionOutcome) error
+	AddRuleRunActionContext(ctx context.Context, identity string, id int, outcome *models.ActionOutcome) error
+	FinishRuleRun(identity string, id int, finishedAt time.Time, failure string) error
+	FinishRuleRunContext(ctx context.Context, identity string, id int, finishedAt time.Time, failure string) error
+	GetRuleRun(identity string, id int) (*models.RuleRun, error)
+	GetRuleRunContext(ctx context.Context, identity string, id int) (*models.RuleRun, error)
+	GetRuleRunsOfRule(identity string, ruleID int, page models.Page) ([]*models.RuleRun, error)
+	GetRuleRunsOfRuleContext(ctx context.Context, identity string, ruleID int, page models.Page) ([]*models.RuleRun, error)
+	GetRuleRunsOfEntity(identity string, entityID int, page models.Page) ([]*models.RuleRun, error)
+	GetRuleRunsOfEntityContext(ctx context.Context, identity string, entityID int, page models.Page) ([]*models.RuleRun, error)
+	PruneRuleRuns(identity string, policy models.RetentionPolicy) (int, error)
+	PruneRuleRunsContext(ctx context.Context, identity string, policy models.RetentionPolicy) (int, error)
+}
+
+type DelayStore interface {
+	GetDelay(identifier string, delayID int) (*models.Delay, error)
+	GetDelayContext(ctx context.Context, identifier string, delayID int) (*models.Delay, error)
+	AddDelay(identity string, delay *models.Delay) (int, error)
+	AddDelayContext(ctx context.Context, identity string, delay *models.Delay) (int, error)
+	EditDelay(identity string, delay *models.Delay) error
+	EditDelayContext(ctx context.Context, identity string, delay *models.Delay) error
+	DeleteDelay(identity string, delayID int) error
+	DeleteDelayContext(ctx context.Context, identity string, delayID int) error
+	ExistDelay(identifier string, delayID int) (bool, error)
+	ExistDelayContext(ctx context.Context, identifier string, delayID int) (bool, error)
+}
+
+type SceneStore interface {
+	GetScenesOfIdentity(identity string) ([]*models.Scene, error)
+	GetScenesOfIdentityContext(ctx context.Context, identity string) ([]*models.Scene, error)
+	GetScene(identity string, id int) (*models.Scene, error)
+	GetSceneContext(ctx context.Context, identity string, id int) (*models.Scene, error)
+	AddScene(identity string, scene *models.Scene) error
+	AddSceneContext(ctx context.Context, identity string, scene *models.Scene) error
+	EditScene(identity string, scene *models.Scene) error
+	EditSceneContext(ctx context.Context, identity string, scene *models.Scene) error
+	DeleteScene(identity string, id int) error
+	DeleteSceneContext(ctx context.Context, identity string, id int) error
+	ExistScene(identity string, id int) (bool, error)
+	ExistSceneContext(ctx context.Context, identity string, id int) (bool, error)
+}
+
+type HassServiceStore interface {
+	AddHassService(service *models.HassService, identity string) error
+	AddHassServiceContext(ctx context.Context, service *models.HassService, identity string) error
+	GetIDofHassService(identity, domain string) (int, error)
+	GetIDofHassServiceContext(ctx context.Context, identity, domain string) (int, error)
+	GetHassService(identity string, id int) (*models.HassService, error)
+	GetHassServiceContext(ctx context.Context, identity string, id int) (*models.HassService, error)
+	ToggleHassService(identity, domain string) error
+	ToggleHassServiceContext(ctx context.Context, identity, domain string) error
+	DeleteHassService(identity, domain string) error
+	DeleteHassServiceContext(ctx context.Context, identity, domain string) error
+	ExistsHassService(identity, domain string) (bool, error)
+	ExistsHassServiceContext(ctx context.Context, identity, domain string) (bool, error)
+	GetAllowedHassServicesOfEntity(identity, entityId string) ([]*models.HassService, error)
+	GetAllowedHassServicesOfEntityContext(ctx context.Context, identity, entityId string) ([]*models.HassService, error)
+}
+
+type AllowedServiceStore interface {
+	AllowService(identity, domain, entityId string) error
+	AllowServiceContext(ctx context.Context, identity, domain, entityId string) error
+	DisallowService(identity, domain, entityId string) error
+	DisallowServiceContext(ctx context.Context, identity, domain, entityId string) error
+	IsServiceAllowed(identity, domain, entityId string) (bool, error)
+	IsServiceAllowedContext(ctx context.Context, identity, domain, entityId string) (bool, error)
+}
+
+type AllowedSensorStore interface {
+	AllowSensor(identity, deviceId, sensorId string) error
+	AllowSensorContext(ctx context.Context, identity, deviceId, sensorId string) error
+	DisallowSensor(identity, deviceId, sensorId string) error
+	DisallowSensorContext(ctx context.Context, identity, deviceId, sensorId string) error
+	IsSensorAllowed(identity, deviceId, sensorId string) (bool, error)
+	IsSensorAllowedContext(ctx context.Context, identity, deviceId, sensorId string) (bool, error)
+}
+
+var (
+	_ Store = (*HonuaDatabase)(nil)
+	_ Store = (*MemoryStore)(nil)
+)
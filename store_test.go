@@ -0,0 +1,306 @@
+package honuadatabase
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/JonasBordewick/honua-database/models"
+)
+
+// test_stores opens every Store implementation with a new identity, the
+// database is skipped without HONUA_TEST_DSN
+var test_stores = map[string]func(t *testing.T) (Store, string){
+	"memory": func(t *testing.T) (Store, string) { return test_memory_store(t) },
+	"postgres": func(t *testing.T) (Store, string) {
+		hdb, identity := test_database(t)
+		return hdb, identity
+	},
+}
+
+// storeScenarios run against every Store, so the MemoryStore can not drift
+// away from the database
+var storeScenarios = []struct {
+	name string
+	run  func(t *testing.T, store Store, identity string)
+}{
+	{"record time", scenario_record_time},
+	{"rules", scenario_rules},
+	{"delete entity", scenario_delete_entity},
+	{"delete rule", scenario_delete_rule},
+	{"delete scene", scenario_delete_scene},
+	{"delete action", scenario_delete_action},
+	{"wait timeout", scenario_wait_timeout},
+}
+
+func TestStore(t *testing.T) {
+	for name, open := range test_stores {
+		t.Run(name, func(t *testing.T) {
+			for _, scenario := range storeScenarios {
+				t.Run(scenario.name, func(t *testing.T) {
+					store, identity := open(t)
+					scenario.run(t, store, identity)
+				})
+			}
+		})
+	}
+}
+
+// add_test_entities adds n entities with the state "on"
+func add_test_entities(t *testing.T, store Store, identity string, n int) []*models.Entity {
+	t.Helper()
+	ctx := context.Background()
+	var entities []*models.Entity
+	for i := 0; i < n; i++ {
+		entity := test_entity(identity, i)
+		if err := store.AddEntityContext(ctx, entity); err != nil {
+			t.Fatalf("AddEntity: %v", err)
+		}
+		if err := store.AddStateContext(ctx, identity, &models.State{EntityId: entity.Id, State: "on"}); err != nil {
+			t.Fatalf("AddState: %v", err)
+		}
+		entities = append(entities, entity)
+	}
+	return entities
+}
+
+func test_condition(sensor *models.Entity) *models.Condition {
+	return &models.Condition{Type: models.AND, SubConditions: []*models.Condition{
+		{Type: models.STATE, Sensor: sensor, ComparisonState: "on"},
+	}}
+}
+
+func test_notify(message string) *models.Action {
+	return &models.Action{Type: models.NOTIFY, Notification: &models.Notification{Title: "test", Message: message}}
+}
+
+// add_test_rule adds a rule on target with the then actions and returns it as it is stored
+func add_test_rule(t *testing.T, store Store, identity string, target, sensor *models.Entity, actions ...*models.Action) *models.Rule {
+	t.Helper()
+	ctx := context.Background()
+	rule := &models.Rule{
+		Enabled:              true,
+		EventBasedEvaluation: true,
+		Name:                 target.EntityId,
+		Target:               target,
+		Condition:            test_condition(sensor),
+		ThenActions:          actions,
+	}
+	if err := store.AddRuleContext(ctx, identity, rule); err != nil {
+		t.Fatalf("AddRule: %v", err)
+	}
+	stored, err := store.GetRuleContext(ctx, identity, rule.Id)
+	if err != nil {
+		t.Fatalf("GetRule: %v", err)
+	}
+	return stored
+}
+
+// check_actions checks the types of the then actions of the rule and that
+// their positions have no gaps
+func check_actions(t *testing.T, store Store, identity string, ruleID int, types ...models.ActionType) {
+	t.Helper()
+	then, _, err := store.GetActionsOfRuleContext(context.Background(), identity, ruleID)
+	if err != nil {
+		t.Fatalf("GetActionsOfRule: %v", err)
+	}
+	if len(then) != len(types) {
+		t.Fatalf("got %d then actions, want %d", len(then), len(types))
+	}
+	for i, a := range then {
+		if a.Type != types[i] || a.Position != i {
+			t.Errorf("action %d: got the type %d at %d, want %d at %d", a.Id, a.Type, a.Position, types[i], i)
+		}
+	}
+}
+
+func check_not_found(t *testing.T, what string, err error) {
+	t.Helper()
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("%s: got %v, want ErrNotFound", what, err)
+	}
+}
+
+// check_runs checks the number of stored action runs
+func check_runs(t *testing.T, store Store, identity string, n int) {
+	t.Helper()
+	runs, err := store.GetActionRunsContext(context.Background(), identity)
+	if err != nil {
+		t.Fatalf("GetActionRuns: %v", err)
+	}
+	if len(runs) != n {
+		t.Errorf("got %d action runs, want %d", len(runs), n)
+	}
+}
+
+func add_test_run(t *testing.T, store Store, identity string, ruleID int) {
+	t.Helper()
+	run := &models.ActionRun{RuleID: ruleID, IsThenAction: true, Position: []models.ActionPosition{{Index: 1}}}
+	if err := store.AddActionRunContext(context.Background(), identity, run); err != nil {
+		t.Fatalf("AddActionRun: %v", err)
+	}
+}
+
+func scenario_rules(t *testing.T, store Store, identity string) {
+	ctx := context.Background()
+	entities := add_test_entities(t, store, identity, 2)
+	delay := &models.Action{Type: models.DELAY, Delay: &models.Delay{Minutes: 5}}
+	rule := add_test_rule(t, store, identity, entities[0], entities[1], test_notify("a"), delay, test_notify("b"))
+	check_actions(t, store, identity, rule.Id, models.NOTIFY, models.DELAY, models.NOTIFY)
+	d := rule.ThenActions[1].Delay
+	if d == nil || d.Minutes != 5 {
+		t.Fatalf("got the delay %+v, want 5 minutes", d)
+	}
+	delayID := d.Id
+
+	active, err := store.GetActiveRulesContext(ctx, identity)
+	if err != nil {
+		t.Fatalf("GetActiveRules: %v", err)
+	}
+	if len(active) != 1 || active[0].Id != rule.Id {
+		t.Errorf("got %d active rules, want the rule %d", len(active), rule.Id)
+	}
+
+	// a disabled rule does not finish its running actions
+	add_test_run(t, store, identity, rule.Id)
+	if err := store.SetRuleEnabledContext(ctx, identity, rule.Id, false); err != nil {
+		t.Fatalf("SetRuleEnabled: %v", err)
+	}
+	check_runs(t, store, identity, 0)
+	active, err = store.GetActiveRulesContext(ctx, identity)
+	if err != nil {
+		t.Fatalf("GetActiveRules: %v", err)
+	}
+	if len(active) != 0 {
+		t.Errorf("got %d active rules, want none", len(active))
+	}
+
+	// an edited rule keeps its id
+	rule.Name = "edited"
+	rule.ThenActions = []*models.Action{test_notify("c")}
+	if err := store.EditRuleContext(ctx, identity, rule); err != nil {
+		t.Fatalf("EditRule: %v", err)
+	}
+	edited, err := store.GetRuleContext(ctx, identity, rule.Id)
+	if err != nil {
+		t.Fatalf("GetRule: %v", err)
+	}
+	if edited.Name != "edited" {
+		t.Errorf("got the name %q, want edited", edited.Name)
+	}
+	check_actions(t, store, identity, rule.Id, models.NOTIFY)
+	_, err = store.GetDelayContext(ctx, identity, delayID)
+	check_not_found(t, "the delay of the replaced action", err)
+
+	if err := store.DeleteRuleContext(ctx, identity, rule.Id); err != nil {
+		t.Fatalf("DeleteRule: %v", err)
+	}
+	_, err = store.GetRuleContext(ctx, identity, rule.Id)
+	check_not_found(t, "the deleted rule", err)
+	_, err = store.GetConditionContext(ctx, edited.Condition.Id, identity)
+	check_not_found(t, "the condition of the deleted rule", err)
+}
+
+// scenario_delete_entity deletes an entity with its rule, the actions of
+// other rules on the entity or its rule go too
+func scenario_delete_entity(t *testing.T, store Store, identity string) {
+	ctx := context.Background()
+	entities := add_test_entities(t, store, identity, 3)
+	delay := &models.Action{Type: models.DELAY, Delay: &models.Delay{Seconds: 30}}
+	deleted := add_test_rule(t, store, identity, entities[0], entities[2], delay)
+	delayID := deleted.ThenActions[0].Delay.Id
+
+	change := &models.Action{Type: models.SET_STATE, StateChange: &models.StateChange{Entity: entities[0], State: "off"}}
+	switchRule := &models.Action{Type: models.SWITCH_RULE, RuleSwitch: &models.RuleSwitch{RuleID: deleted.Id}}
+	kept := add_test_rule(t, store, identity, entities[1], entities[2], change, test_notify("a"), switchRule, test_notify("b"))
+	add_test_run(t, store, identity, kept.Id)
+
+	if err := store.DeleteEntityContext(ctx, entities[0].Id, identity); err != nil {
+		t.Fatalf("DeleteEntity: %v", err)
+	}
+	_, err := store.GetRuleContext(ctx, identity, deleted.Id)
+	check_not_found(t, "the rule of the deleted entity", err)
+	_, err = store.GetConditionContext(ctx, deleted.Condition.Id, identity)
+	check_not_found(t, "the condition of the deleted rule", err)
+	_, err = store.GetDelayContext(ctx, identity, delayID)
+	check_not_found(t, "the delay of the deleted rule", err)
+
+	check_actions(t, store, identity, kept.Id, models.NOTIFY, models.NOTIFY)
+	// the stored position of the run is not valid anymore
+	check_runs(t, store, identity, 0)
+}
+
+// scenario_delete_rule deletes a rule that another rule switches
+func scenario_delete_rule(t *testing.T, store Store, identity string) {
+	ctx := context.Background()
+	entities := add_test_entities(t, store, identity, 2)
+	deleted := add_test_rule(t, store, identity, entities[0], entities[1], test_notify("a"))
+	switchRule := &models.Action{Type: models.SWITCH_RULE, RuleSwitch: &models.RuleSwitch{RuleID: deleted.Id, Enabled: true}}
+	kept := add_test_rule(t, store, identity, entities[1], entities[0], switchRule, test_notify("b"))
+
+	if err := store.DeleteRuleContext(ctx, identity, deleted.Id); err != nil {
+		t.Fatalf("DeleteRule: %v", err)
+	}
+	check_actions(t, store, identity, kept.Id, models.NOTIFY)
+}
+
+func scenario_delete_scene(t *testing.T, store Store, identity string) {
+	ctx := context.Background()
+	entities := add_test_entities(t, store, identity, 2)
+	scene := &models.Scene{Name: "evening", States: []*models.SceneState{{Entity: entities[0], State: "off"}}}
+	if err := store.AddSceneContext(ctx, identity, scene); err != nil {
+		t.Fatalf("AddScene: %v", err)
+	}
+	apply := &models.Action{Type: models.SCENE, Scene: &models.Scene{Id: scene.Id}}
+	rule := add_test_rule(t, store, identity, entities[0], entities[1], test_notify("a"), apply, test_notify("b"))
+	add_test_run(t, store, identity, rule.Id)
+
+	if err := store.DeleteSceneContext(ctx, identity, scene.Id); err != nil {
+		t.Fatalf("DeleteScene: %v", err)
+	}
+	_, err := store.GetSceneContext(ctx, identity, scene.Id)
+	check_not_found(t, "the deleted scene", err)
+	check_actions(t, store, identity, rule.Id, models.NOTIFY, models.NOTIFY)
+	check_runs(t, store, identity, 0)
+}
+
+func scenario_delete_action(t *testing.T, store Store, identity string) {
+	ctx := context.Background()
+	entities := add_test_entities(t, store, identity, 2)
+	delay := &models.Action{Type: models.DELAY, Delay: &models.Delay{Hours: 1}}
+	rule := add_test_rule(t, store, identity, entities[0], entities[1], test_notify("a"), delay, test_notify("b"))
+	delayID := rule.ThenActions[1].Delay.Id
+	add_test_run(t, store, identity, rule.Id)
+
+	if err := store.DeleteActionContext(ctx, identity, rule.ThenActions[1].Id); err != nil {
+		t.Fatalf("DeleteAction: %v", err)
+	}
+	check_actions(t, store, identity, rule.Id, models.NOTIFY, models.NOTIFY)
+	_, err := store.GetDelayContext(ctx, identity, delayID)
+	check_not_found(t, "the delay of the deleted action", err)
+	check_runs(t, store, identity, 0)
+
+	err = store.DeleteActionContext(ctx, identity, rule.ThenActions[1].Id)
+	check_not_found(t, "the deleted action", err)
+}
+
+// scenario_wait_timeout adds waits whose timeout can not be stored in whole seconds
+func scenario_wait_timeout(t *testing.T, store Store, identity string) {
+	ctx := context.Background()
+	entities := add_test_entities(t, store, identity, 2)
+	for _, timeout := range []time.Duration{-time.Second, 1500 * time.Millisecond} {
+		wait := &models.Action{Type: models.WAIT_UNTIL, Wait: &models.Wait{Condition: test_condition(entities[1]), Timeout: timeout}}
+		rule := &models.Rule{Enabled: true, Name: "wait", Target: entities[0], Condition: test_condition(entities[1]), ThenActions: []*models.Action{wait}}
+		if err := store.AddRuleContext(ctx, identity, rule); !errors.Is(err, ErrInvalidAction) {
+			t.Errorf("the timeout %v: got %v, want ErrInvalidAction", timeout, err)
+		}
+	}
+	rules, err := store.GetAllRulesOfIdentityContext(ctx, identity)
+	if err != nil {
+		t.Fatalf("GetAllRulesOfIdentity: %v", err)
+	}
+	if len(rules) != 0 {
+		t.Errorf("got %d rules, want none", len(rules))
+	}
+}
@@ -0,0 +1,89 @@
+package honuadatabase
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/JonasBordewick/honua-database/models"
+)
+
+// StateHandler is called after a state was recorded with AddState. It is
+// called on the goroutine of AddState, so it must not block.
+type StateHandler func(identity string, state *models.State)
+
+// RuleHandler is called after the rules of the identity were changed, like a
+// rule that was added, edited, enabled, disabled or deleted, or an entity
+// whose rules were switched. It is called on the goroutine of the change, so
+// it must not block.
+type RuleHandler func(identity string)
+
+// subscribers holds the handlers of SubscribeStates and SubscribeRules, the
+// zero value is ready to use
+type subscribers struct {
+	states handlers[StateHandler]
+	rules  handlers[RuleHandler]
+}
+
+// notify calls every state handler with its own copy of the state
+func (s *subscribers) notify(identity string, state *models.State) {
+	for _, handler := range s.states.list() {
+		c := *state
+		handler(identity, &c)
+	}
+}
+
+// rules_changed calls every rule handler if err is nil. It is deferred by
+// the methods that change rules, the MemoryStore defers it before it locks,
+// so the handlers are called without the lock.
+func (s *subscribers) rules_changed(identity string, err *error) {
+	if *err != nil {
+		return
+	}
+	for _, handler := range s.rules.list() {
+		handler(identity)
+	}
+}
+
+// handlers holds subscribed handlers, the zero value is ready to use
+type handlers[H any] struct {
+	mutex    sync.Mutex
+	next     int
+	handlers map[int]H
+}
+
+// subscribe adds the handler and returns the function that removes it again
+func (h *handlers[H]) subscribe(handler H) func() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.handlers == nil {
+		h.handlers = map[int]H{}
+	}
+	h.next++
+	id := h.next
+	h.handlers[id] = handler
+
+	return func() {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		delete(h.handlers, id)
+	}
+}
+
+// list returns the handlers in the order they were subscribed, so they can
+// be called without the lock
+func (h *handlers[H]) list() []H {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var ids []int
+	for id := range h.handlers {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	var result []H
+	for _, id := range ids {
+		result = append(result, h.handlers[id])
+	}
+	return result
+}
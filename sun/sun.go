@@ -0,0 +1,90 @@
+// Package sun calculates sunrise, sunset and the position of the sun with
+// the approximations of the NOAA Global Monitoring Division. The results are
+// accurate to about a minute between the polar circles.
+package sun
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// Errors returned by Times for days without sunrise or sunset
+var (
+	ErrAlwaysUp   = errors.New("the sun does not set on this day")
+	ErrAlwaysDown = errors.New("the sun does not rise on this day")
+)
+
+// zenith of the sun at sunrise and sunset, corrected for refraction and the size of the sun
+const zenith = 90.833
+
+// Times returns the sunrise and sunset on the day of date at latitude and
+// longitude in degrees, east and north are positive. The day and the results
+// are in the location of date.
+func Times(date time.Time, latitude, longitude float64) (sunrise, sunset time.Time, err error) {
+	year, month, day := date.Date()
+	midnight := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+
+	eqtime, decl := equation(date.YearDay(), 12)
+	lat := radians(latitude)
+
+	cosHA := math.Cos(radians(zenith))/(math.Cos(lat)*math.Cos(decl)) - math.Tan(lat)*math.Tan(decl)
+	if cosHA < -1 {
+		return time.Time{}, time.Time{}, ErrAlwaysUp
+	}
+	if cosHA > 1 {
+		return time.Time{}, time.Time{}, ErrAlwaysDown
+	}
+	ha := degrees(math.Acos(cosHA))
+
+	rise := 720 - 4*(longitude+ha) - eqtime
+	set := 720 - 4*(longitude-ha) - eqtime
+
+	sunrise = midnight.Add(minutes(rise)).In(date.Location())
+	sunset = midnight.Add(minutes(set)).In(date.Location())
+	return sunrise, sunset, nil
+}
+
+// Position returns the elevation above the horizon and the azimuth,
+// clockwise from north, of the sun at t in degrees
+func Position(t time.Time, latitude, longitude float64) (elevation, azimuth float64) {
+	t = t.UTC()
+	hour := float64(t.Hour()) + float64(t.Minute())/60 + float64(t.Second())/3600
+
+	eqtime, decl := equation(t.YearDay(), hour)
+	lat := radians(latitude)
+
+	// true solar time in minutes and the hour angle
+	tst := hour*60 + eqtime + 4*longitude
+	ha := radians(tst/4 - 180)
+
+	cosZenith := math.Sin(lat)*math.Sin(decl) + math.Cos(lat)*math.Cos(decl)*math.Cos(ha)
+	cosZenith = math.Max(-1, math.Min(1, cosZenith))
+	elevation = 90 - degrees(math.Acos(cosZenith))
+
+	azimuth = degrees(math.Atan2(math.Sin(ha), math.Cos(ha)*math.Sin(lat)-math.Tan(decl)*math.Cos(lat))) + 180
+	azimuth = math.Mod(azimuth, 360)
+	return elevation, azimuth
+}
+
+// equation returns the equation of time in minutes and the declination of
+// the sun in radians at hour (UTC) of the day of the year
+func equation(yearDay int, hour float64) (eqtime, decl float64) {
+	g := 2 * math.Pi / 365 * (float64(yearDay-1) + (hour-12)/24)
+
+	eqtime = 229.18 * (0.000075 + 0.001868*math.Cos(g) - 0.032077*math.Sin(g) - 0.014615*math.Cos(2*g) - 0.040849*math.Sin(2*g))
+	decl = 0.006918 - 0.399912*math.Cos(g) + 0.070257*math.Sin(g) - 0.006758*math.Cos(2*g) + 0.000907*math.Sin(2*g) - 0.002697*math.Cos(3*g) + 0.00148*math.Sin(3*g)
+	return eqtime, decl
+}
+
+func radians(d float64) float64 {
+	return d * math.Pi / 180
+}
+
+func degrees(r float64) float64 {
+	return r * 180 / math.Pi
+}
+
+func minutes(m float64) time.Duration {
+	return time.Duration(m * float64(time.Minute)).Round(time.Second)
+}
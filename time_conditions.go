@@ -0,0 +1,282 @@
+package honuadatabase
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JonasBordewick/honua-database/models"
+)
+
+// max_sun_offset limits the offset of a bound relative to sunrise or sunset
+const max_sun_offset = 12 * time.Hour
+
+// HH:MM or HH:MM:SS
+var clock_pattern = regexp.MustCompile(`^(\d{1,2}):(\d{2})(?::(\d{2}))?$`)
+
+// sunrise, sunset, sunrise+30m or sunset-1h30m
+var sun_pattern = regexp.MustCompile(`^(sunrise|sunset)(?:([+-])(.+))?$`)
+
+// timeColumns are the column values of a time condition
+type timeColumns struct {
+	after    sql.NullString
+	before   sql.NullString
+	weekdays sql.NullInt32
+	dateFrom sql.NullString
+	dateTo   sql.NullString
+}
+
+// normalize_time_condition validates the time condition, writes its
+// normalized form back into condition and returns the column values.
+// Time is used if it is set, otherwise After and Before are parsed.
+func normalize_time_condition(condition *models.Condition) (timeColumns, error) {
+	var columns timeColumns
+
+	tc := condition.Time
+	if tc == nil {
+		tc = &models.TimeCondition{}
+		var err error
+		if len(condition.After) > 0 {
+			if tc.After, err = parse_time_bound(condition.After); err != nil {
+				return columns, err
+			}
+		}
+		if len(condition.Before) > 0 {
+			if tc.Before, err = parse_time_bound(condition.Before); err != nil {
+				return columns, err
+			}
+		}
+	}
+
+	for _, b := range []*models.TimeBound{tc.After, tc.Before} {
+		if err := check_time_bound(b); err != nil {
+			return columns, err
+		}
+	}
+	if tc.After != nil && tc.Before != nil && *tc.After == *tc.Before {
+		return columns, fmt.Errorf("%w: after and before of a time condition are the same", ErrInvalidCondition)
+	}
+
+	for _, d := range tc.Weekdays {
+		if d < time.Sunday || d > time.Saturday {
+			return columns, fmt.Errorf("%w: %d is not a weekday", ErrInvalidCondition, d)
+		}
+	}
+
+	if (tc.DateFrom == nil) != (tc.DateTo == nil) {
+		return columns, fmt.Errorf("%w: a date range needs a first and a last day", ErrInvalidCondition)
+	}
+	for _, md := range []*models.MonthDay{tc.DateFrom, tc.DateTo} {
+		if md == nil {
+			continue
+		}
+		// 2024 is a leap year, so the 29th of February is valid
+		if md.Month < time.January || md.Month > time.December || md.Day < 1 || md.Day > days_in_month(2024, md.Month) {
+			return columns, fmt.Errorf("%w: %d-%d is not a valid day of the year", ErrInvalidCondition, md.Month, md.Day)
+		}
+	}
+
+	if tc.After == nil && tc.Before == nil && len(tc.Weekdays) == 0 && tc.DateFrom == nil {
+		return columns, fmt.Errorf("%w: a time condition needs after, before, weekdays or a date range", ErrInvalidCondition)
+	}
+
+	if tc.After != nil {
+		columns.after = sql.NullString{Valid: true, String: format_time_bound(tc.After)}
+	}
+	if tc.Before != nil {
+		columns.before = sql.NullString{Valid: true, String: format_time_bound(tc.Before)}
+	}
+	if len(tc.Weekdays) > 0 {
+		columns.weekdays = null_int(weekday_mask(tc.Weekdays))
+	}
+	if tc.DateFrom != nil {
+		columns.dateFrom = sql.NullString{Valid: true, String: format_month_day(tc.DateFrom)}
+		columns.dateTo = sql.NullString{Valid: true, String: format_month_day(tc.DateTo)}
+	}
+
+	condition.Time = tc
+	condition.After = columns.after.String
+	condition.Before = columns.before.String
+	return columns, nil
+}
+
+// TimeConditionOf returns the validated typed form of a TIME condition, it
+// parses After and Before if Time is not set like a condition that is saved
+func TimeConditionOf(condition *models.Condition) (*models.TimeCondition, error) {
+	c := *condition
+	if _, err := normalize_time_condition(&c); err != nil {
+		return nil, err
+	}
+	return c.Time, nil
+}
+
+// set_time stores the normalized time condition in the row
+func (row *conditionRow) set_time(condition *models.Condition) error {
+	columns, err := normalize_time_condition(condition)
+	if err != nil {
+		return err
+	}
+	row.after = columns.after
+	row.before = columns.before
+	row.weekdays = columns.weekdays
+	row.dateFrom = columns.dateFrom
+	row.dateTo = columns.dateTo
+	return nil
+}
+
+// make_time_condition builds the typed time condition out of its columns.
+// It is nil if after or before is not valid, they were saved as free text
+// before the bounds were validated. The condition keeps the text in After and
+// Before and is reported as invalid when it is evaluated, so the other
+// conditions and rules of the identity can still be read.
+func make_time_condition(row *conditionRow) (*models.TimeCondition, error) {
+	tc := &models.TimeCondition{Weekdays: mask_weekdays(int(row.weekdays.Int32))}
+	var err error
+	if row.after.Valid {
+		if tc.After, err = parse_time_bound(row.after.String); err != nil {
+			return nil, nil
+		}
+	}
+	if row.before.Valid {
+		if tc.Before, err = parse_time_bound(row.before.String); err != nil {
+			return nil, nil
+		}
+	}
+	if row.dateFrom.Valid && row.dateTo.Valid {
+		if tc.DateFrom, err = parse_month_day(row.dateFrom.String); err != nil {
+			return nil, fmt.Errorf("time condition %d: %w", row.id, err)
+		}
+		if tc.DateTo, err = parse_month_day(row.dateTo.String); err != nil {
+			return nil, fmt.Errorf("time condition %d: %w", row.id, err)
+		}
+	}
+	return tc, nil
+}
+
+func check_time_bound(b *models.TimeBound) error {
+	if b == nil {
+		return nil
+	}
+	switch b.Type {
+	case models.CLOCK:
+		if b.Clock < 0 || b.Clock >= 24*time.Hour || b.Clock%time.Second != 0 {
+			return fmt.Errorf("%w: %v is not a time of the day", ErrInvalidCondition, b.Clock)
+		}
+	case models.SUNRISE, models.SUNSET:
+		if b.Offset <= -max_sun_offset || b.Offset >= max_sun_offset || b.Offset%time.Second != 0 {
+			return fmt.Errorf("%w: the offset %v to the sun is not valid", ErrInvalidCondition, b.Offset)
+		}
+	default:
+		return fmt.Errorf("%w: the time bound type %d is not supported", ErrUnsupportedType, b.Type)
+	}
+	return nil
+}
+
+// parse_time_bound parses HH:MM[:SS], sunrise or sunset with an optional offset like +30m
+func parse_time_bound(s string) (*models.TimeBound, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+
+	if match := clock_pattern.FindStringSubmatch(s); match != nil {
+		hours, _ := strconv.Atoi(match[1])
+		mins, _ := strconv.Atoi(match[2])
+		secs := 0
+		if match[3] != "" {
+			secs, _ = strconv.Atoi(match[3])
+		}
+		if hours > 23 || mins > 59 || secs > 59 {
+			return nil, fmt.Errorf("%w: %q is not a time of the day", ErrInvalidCondition, s)
+		}
+		clock := time.Duration(hours)*time.Hour + time.Duration(mins)*time.Minute + time.Duration(secs)*time.Second
+		return &models.TimeBound{Type: models.CLOCK, Clock: clock}, nil
+	}
+
+	if match := sun_pattern.FindStringSubmatch(s); match != nil {
+		b := &models.TimeBound{Type: models.SUNRISE}
+		if match[1] == "sunset" {
+			b.Type = models.SUNSET
+		}
+		if match[3] != "" {
+			offset, err := time.ParseDuration(match[3])
+			if err != nil || offset < 0 {
+				return nil, fmt.Errorf("%w: %q has no valid offset", ErrInvalidCondition, s)
+			}
+			if match[2] == "-" {
+				offset = -offset
+			}
+			b.Offset = offset
+		}
+		return b, check_time_bound(b)
+	}
+
+	return nil, fmt.Errorf("%w: %q is neither HH:MM:SS nor sunrise or sunset", ErrInvalidCondition, s)
+}
+
+// format_time_bound is the inverse of parse_time_bound, like 07:30:00 or sunset-1h30m
+func format_time_bound(b *models.TimeBound) string {
+	if b.Type == models.CLOCK {
+		secs := int(b.Clock / time.Second)
+		return fmt.Sprintf("%02d:%02d:%02d", secs/3600, secs/60%60, secs%60)
+	}
+
+	name := "sunrise"
+	if b.Type == models.SUNSET {
+		name = "sunset"
+	}
+	if b.Offset == 0 {
+		return name
+	}
+	sign := "+"
+	offset := b.Offset
+	if offset < 0 {
+		sign = "-"
+		offset = -offset
+	}
+	// 1h30m instead of 1h30m0s
+	text := offset.String()
+	if strings.HasSuffix(text, "m0s") {
+		text = strings.TrimSuffix(text, "0s")
+	}
+	if strings.HasSuffix(text, "h0m") {
+		text = strings.TrimSuffix(text, "0m")
+	}
+	return name + sign + text
+}
+
+// parse_month_day parses MM-DD
+func parse_month_day(s string) (*models.MonthDay, error) {
+	var month, day int
+	if _, err := fmt.Sscanf(s, "%d-%d", &month, &day); err != nil {
+		return nil, fmt.Errorf("%w: %q is not a day of the year", ErrInvalidCondition, s)
+	}
+	return &models.MonthDay{Month: time.Month(month), Day: day}, nil
+}
+
+func format_month_day(md *models.MonthDay) string {
+	return fmt.Sprintf("%02d-%02d", int(md.Month), md.Day)
+}
+
+// weekday_mask stores the weekdays as bits, Sunday is bit 0
+func weekday_mask(days []time.Weekday) int {
+	var mask int
+	for _, d := range days {
+		mask |= 1 << uint(d)
+	}
+	return mask
+}
+
+func mask_weekdays(mask int) []time.Weekday {
+	var result []time.Weekday = []time.Weekday{}
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if mask&(1<<uint(d)) != 0 {
+			result = append(result, d)
+		}
+	}
+	return result
+}
+
+func days_in_month(year int, month time.Month) int {
+	return time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}